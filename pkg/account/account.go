@@ -43,7 +43,8 @@ type (
 		LoginCount int    `json:"-"`
 		LoginFrom  string `json:"-"`
 		// internal
-		Token     string `json:"-"` // a temporary token to confirm the account or to exchanged for the "real" token
+		Token     string `json:"-"` // a temporary token to confirm the account or to exchanged for the "real" token, never stored
+		TokenHash string `json:"-"` // keyed hash of the temporary token
 		Expires   int64  `json:"-"` // 0 == never
 		Confirmed int64  `json:"-"`
 		Created   int64  `json:"-"`
@@ -103,16 +104,20 @@ func CreateAccount(ctx context.Context, realm, userID string, expires int) (*Acc
 		UserID:    userID,
 		ClientID:  uid,
 		Status:    AccountUnconfirmed,
-		Token:     token,
 		Expires:   timestamp.IncT(timestamp.Now(), expires),
 		Confirmed: 0,
 		Created:   now,
 		Updated:   now,
 	}
+	if err := account.SetToken(token); err != nil {
+		return nil, err
+	}
 
 	if err := UpdateAccount(ctx, &account); err != nil {
 		return nil, err
 	}
+	PublishAccountEvent(ctx, TopicAccountCreated, &account)
+
 	return &account, nil
 }
 
@@ -142,7 +147,18 @@ func UpdateAccount(ctx context.Context, account *Account) error {
 	// there is a SMALL time window where the cache and the datastore are inconsistent ...
 
 	account.Updated = timestamp.Now()
-	if _, err := ds.DataStore().Put(ctx, k, account); err != nil {
+	if account.Token != "" {
+		hash, err := HashToken(account.Token)
+		if err != nil {
+			return err
+		}
+		account.TokenHash = hash
+	}
+
+	// only the hash of the token is stored
+	stored := *account
+	stored.Token = ""
+	if _, err := ds.DataStore().Put(ctx, k, &stored); err != nil {
 		return err
 	}
 
@@ -210,10 +226,19 @@ func FindAccountByUserID(ctx context.Context, realm, userID string) (*Account, e
 	return account, nil
 }
 
-// FindAccountByToken retrieves an account bases on either the temporary token or the auth token
+// FindAccountByToken retrieves an account bases on the temporary token
 func FindAccountByToken(ctx context.Context, token string) (*Account, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	hash, err := HashToken(token)
+	if err != nil {
+		return nil, err
+	}
+
 	var accounts []*Account
-	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAccounts).Filter("Token =", token), &accounts); err != nil {
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAccounts).Filter("TokenHash =", hash), &accounts); err != nil {
 		return nil, err
 	}
 	if accounts == nil {
@@ -226,7 +251,9 @@ func FindAccountByToken(ctx context.Context, token string) (*Account, error) {
 func ResetAccountChallenge(ctx context.Context, acc *Account, expires int) (*Account, error) {
 	token, _ := id.ShortUUID()
 	acc.Expires = timestamp.IncT(timestamp.Now(), expires)
-	acc.Token = token
+	if err := acc.SetToken(token); err != nil {
+		return nil, err
+	}
 	acc.Status = AccountUnconfirmed
 
 	if err := UpdateAccount(ctx, acc); err != nil {
@@ -235,12 +262,17 @@ func ResetAccountChallenge(ctx context.Context, acc *Account, expires int) (*Acc
 	return acc, nil
 }
 
-// ResetTemporaryToken creates a new temporary token and resets the timer
+// ResetTemporaryToken creates a new temporary token and resets the timer. An active account stays active,
+// the existing sessions are not affected by a new login.
 func ResetTemporaryToken(ctx context.Context, acc *Account, expires int) (*Account, error) {
 	token, _ := id.ShortUUID()
 	acc.Expires = timestamp.IncT(timestamp.Now(), expires)
-	acc.Token = token
-	acc.Status = AccountLoggedOut
+	if err := acc.SetToken(token); err != nil {
+		return nil, err
+	}
+	if acc.Status != AccountActive {
+		acc.Status = AccountLoggedOut
+	}
 
 	if err := UpdateAccount(ctx, acc); err != nil {
 		return nil, err
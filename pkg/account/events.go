@@ -0,0 +1,37 @@
+package account
+
+import (
+	"context"
+
+	"github.com/txsvc/platform/v2"
+)
+
+const (
+	// topics of the account lifecycle events
+	TopicAccountCreated   = "account.created"
+	TopicAccountConfirmed = "account.confirmed"
+	TopicAccountBlocked   = "account.blocked"
+)
+
+type (
+	// AccountEvent is the payload of all account lifecycle events
+	AccountEvent struct {
+		Realm    string `json:"realm"`
+		ClientID string `json:"client_id"`
+		UserID   string `json:"user_id"`
+		Status   int    `json:"status"`
+	}
+)
+
+// PublishAccountEvent publishes an event about acc on topic. Events are fire-and-forget, errors are only reported.
+func PublishAccountEvent(ctx context.Context, topic string, acc *Account) {
+	e := AccountEvent{
+		Realm:    acc.Realm,
+		ClientID: acc.ClientID,
+		UserID:   acc.UserID,
+		Status:   acc.Status,
+	}
+	if err := platform.Publish(ctx, topic, &e, "realm", acc.Realm); err != nil {
+		platform.ReportError(err)
+	}
+}
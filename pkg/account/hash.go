@@ -0,0 +1,157 @@
+package account
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/env"
+)
+
+var (
+	// ErrNoTokenPepper indicates that the server secret used to hash tokens is missing
+	ErrNoTokenPepper = errors.New("TOKEN_PEPPER is not set, tokens can't be hashed without a server secret")
+
+	pepper       []byte
+	pepperLoaded bool
+	allowEmpty   bool
+	pepperMutex  sync.RWMutex
+)
+
+// SetTokenPepper sets the server secret used by HashToken. Changing the pepper invalidates all stored tokens.
+// By default, the pepper is read from the environment: TOKEN_PEPPER. Without a pepper, tokens can't be hashed,
+// unless an empty pepper is allowed for local development, see AllowEmptyTokenPepper.
+func SetTokenPepper(p string) {
+	pepperMutex.Lock()
+	defer pepperMutex.Unlock()
+
+	pepper = []byte(p)
+	pepperLoaded = true
+}
+
+// AllowEmptyTokenPepper allows tokens to be hashed without a server secret. This must only be used for local
+// development and tests. It can also be enabled in the environment: TOKEN_PEPPER_INSECURE=true.
+func AllowEmptyTokenPepper(allow bool) {
+	pepperMutex.Lock()
+	defer pepperMutex.Unlock()
+
+	allowEmpty = allow
+}
+
+// CheckTokenPepper returns ErrNoTokenPepper if the pepper is missing. Services call it on startup
+// so that they refuse to start instead of failing on every login.
+func CheckTokenPepper() error {
+	_, err := tokenPepper()
+	return err
+}
+
+// HashToken returns the keyed hash (HMAC-SHA256 with the server pepper) of a token.
+// Tokens are only stored and looked up by their hash. Returns ErrNoTokenPepper if the pepper is missing.
+func HashToken(token string) (string, error) {
+	p, err := tokenPepper()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, p)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// tokenPepper returns the pepper, reading it from the environment on first use
+func tokenPepper() ([]byte, error) {
+	pepperMutex.RLock()
+	if pepperLoaded {
+		defer pepperMutex.RUnlock()
+		return checkPepper(pepper, allowEmpty)
+	}
+	pepperMutex.RUnlock()
+
+	pepperMutex.Lock()
+	defer pepperMutex.Unlock()
+
+	if !pepperLoaded {
+		pepper = []byte(env.GetString("TOKEN_PEPPER", ""))
+		pepperLoaded = true
+		if env.GetString("TOKEN_PEPPER_INSECURE", "") == "true" {
+			allowEmpty = true
+		}
+		if len(pepper) == 0 {
+			platform.ReportError(ErrNoTokenPepper)
+		}
+	}
+	return checkPepper(pepper, allowEmpty)
+}
+
+func checkPepper(p []byte, allowEmpty bool) ([]byte, error) {
+	if len(p) == 0 && !allowEmpty {
+		return nil, ErrNoTokenPepper
+	}
+	return p, nil
+}
+
+// SetToken sets the temporary token. Only its hash is stored, the token itself is only kept in memory
+// so that it can be sent to the user. Use an empty token to clear it.
+func (acc *Account) SetToken(token string) error {
+	acc.Token = token
+	acc.TokenHash = ""
+	if token == "" {
+		return nil
+	}
+
+	hash, err := HashToken(token)
+	if err != nil {
+		acc.Token = ""
+		return err
+	}
+	acc.TokenHash = hash
+	return nil
+}
+
+// HasToken reports whether token matches the stored token. It never matches if the token can't be hashed.
+func (acc *Account) HasToken(token string) bool {
+	if token == "" || acc.TokenHash == "" {
+		return false
+	}
+	hash, err := HashToken(token)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(acc.TokenHash), []byte(hash)) == 1
+}
+
+// MigrateTokenHashes replaces the plaintext tokens of existing accounts with their hashes and returns
+// the number of migrated accounts
+func MigrateTokenHashes(ctx context.Context) (int, error) {
+	var accounts []*Account
+
+	keys, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAccounts).Filter("Token >", ""), &accounts)
+	if err != nil {
+		return 0, err
+	}
+	if len(accounts) == 0 {
+		return 0, nil
+	}
+
+	for _, acc := range accounts {
+		if acc.TokenHash, err = HashToken(acc.Token); err != nil {
+			return 0, err
+		}
+		acc.Token = ""
+	}
+	if _, err := ds.DataStore().PutMulti(ctx, keys, accounts); err != nil {
+		return 0, err
+	}
+
+	for _, k := range keys {
+		accountLoader.Remove(ctx, k.Encode())
+	}
+	return len(accounts), nil
+}
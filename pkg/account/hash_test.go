@@ -0,0 +1,99 @@
+package account
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPepper = "test-pepper"
+
+func TestMain(m *testing.M) {
+	SetTokenPepper(testPepper)
+	os.Exit(m.Run())
+}
+
+func TestHashToken(t *testing.T) {
+	h, err := HashToken("token")
+	require.NoError(t, err)
+	assert.Len(t, h, 64)
+
+	h2, _ := HashToken("token")
+	assert.Equal(t, h, h2)
+	h2, _ = HashToken("other")
+	assert.NotEqual(t, h, h2)
+
+	// the pepper is part of the hash
+	SetTokenPepper("pepper")
+	t.Cleanup(func() { SetTokenPepper(testPepper) })
+	h2, _ = HashToken("token")
+	assert.NotEqual(t, h, h2)
+}
+
+func TestEmptyTokenPepper(t *testing.T) {
+	SetTokenPepper("")
+	t.Cleanup(func() {
+		SetTokenPepper(testPepper)
+		AllowEmptyTokenPepper(false)
+	})
+
+	// tokens can't be hashed without a pepper
+	assert.Equal(t, ErrNoTokenPepper, CheckTokenPepper())
+	_, err := HashToken("token")
+	assert.Equal(t, ErrNoTokenPepper, err)
+
+	var acc Account
+	assert.Equal(t, ErrNoTokenPepper, acc.SetToken("token"))
+	assert.Empty(t, acc.TokenHash)
+	assert.False(t, acc.HasToken("token"))
+
+	// unless explicitly allowed for local development
+	AllowEmptyTokenPepper(true)
+	assert.NoError(t, CheckTokenPepper())
+	h, err := HashToken("token")
+	assert.NoError(t, err)
+	assert.Len(t, h, 64)
+}
+
+func TestSetTokenPepperConcurrently(t *testing.T) {
+	t.Cleanup(func() { SetTokenPepper(testPepper) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			SetTokenPepper(fmt.Sprintf("pepper%d", i))
+		}(i)
+		go func() {
+			defer wg.Done()
+			h, err := HashToken("token")
+			assert.NoError(t, err)
+			assert.Len(t, h, 64)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSetToken(t *testing.T) {
+	var acc Account
+
+	assert.NoError(t, acc.SetToken("token"))
+	assert.Equal(t, "token", acc.Token)
+	h, _ := HashToken("token")
+	assert.Equal(t, h, acc.TokenHash)
+
+	// only the hash is needed to verify the token
+	acc.Token = ""
+	assert.True(t, acc.HasToken("token"))
+	assert.False(t, acc.HasToken("other"))
+	assert.False(t, acc.HasToken(""))
+
+	assert.NoError(t, acc.SetToken(""))
+	assert.Empty(t, acc.TokenHash)
+	assert.False(t, acc.HasToken("token"))
+}
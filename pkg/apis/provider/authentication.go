@@ -19,5 +19,7 @@ type (
 		Endpoint                 string
 		AuthenticationExpiration int
 		AuthorizationExpiration  int
+		AccessTokenExpiration    int
+		MaxSessions              int // concurrent sessions per account
 	}
 )
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const (
+	// DefaultBatchConcurrency is the max number of tasks that are created in parallel
+	DefaultBatchConcurrency = 10
+)
+
+type (
+	// BatchError reports the tasks of a batch that could not be created
+	BatchError struct {
+		// Errors has one entry per task of the batch, nil if the task was created
+		Errors []error
+	}
+)
+
+var (
+	// ErrNotASlice indicates that the items to fan out are not a slice
+	ErrNotASlice = errors.New("items must be a slice")
+)
+
+// CreateHttpTasksConcurrently calls create for every task, with at most concurrency calls in flight.
+// It returns a *BatchError if any task could not be created. Tasks that were not started before ctx
+// was cancelled fail with the context's error.
+func CreateHttpTasksConcurrently(ctx context.Context, tasks []HttpTask, concurrency int, create func(context.Context, HttpTask) error) error {
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	errs := make([]error, len(tasks))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i := range tasks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = create(ctx, tasks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// FanOut splits items, which must be a slice, into chunks of at most size items and returns one task per chunk.
+// The tasks are copies of template with the chunk as payload. If template has a name, the index of the chunk is appended to it.
+func FanOut(template HttpTask, items interface{}, size int) ([]HttpTask, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return nil, ErrNotASlice
+	}
+	if v.Len() == 0 {
+		return []HttpTask{}, nil
+	}
+	if size <= 0 {
+		size = v.Len()
+	}
+
+	tasks := make([]HttpTask, 0, (v.Len()+size-1)/size)
+	for i := 0; i < v.Len(); i += size {
+		j := i + size
+		if j > v.Len() {
+			j = v.Len()
+		}
+
+		task := template
+		task.Payload = v.Slice(i, j).Interface()
+		if template.Name != "" {
+			task.Name = fmt.Sprintf("%s-%d", template.Name, len(tasks))
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// Failed returns the indices of the tasks that could not be created
+func (e *BatchError) Failed() []int {
+	failed := make([]int, 0)
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return "no task failed"
+	}
+	return fmt.Sprintf("%d of %d tasks failed: %v", len(failed), len(e.Errors), e.Errors[failed[0]])
+}
@@ -9,6 +9,10 @@ type (
 	// defaultProviderImpl provides a default implementation in the absence of any other configuration.
 	defaultProviderImpl struct {
 	}
+
+	// nullSubscription never receives any events
+	nullSubscription struct {
+	}
 )
 
 var (
@@ -23,6 +27,7 @@ var (
 	_ LoggingProvider        = (*defaultProviderImpl)(nil)
 	_ MetricsProvider        = (*defaultProviderImpl)(nil)
 	_ AuthenticationProvider = (*defaultProviderImpl)(nil)
+	_ EventBusProvider       = (*defaultProviderImpl)(nil)
 )
 
 // a NULL provider that does nothing but prevents NPEs in case someone forgets to actually initializa a 'real' platform provider
@@ -38,8 +43,12 @@ func (np *defaultProviderImpl) Close() error {
 
 // IF HttpRequestContextProvider
 
+// NewHttpContext returns the context of req, request IDs, client IPs and deadlines are added by the platform providers
 func (np *defaultProviderImpl) NewHttpContext(req *h.Request) context.Context {
-	return context.TODO()
+	if req == nil {
+		return context.Background()
+	}
+	return req.Context()
 }
 
 // IF ErrorReportingProvider
@@ -78,5 +87,21 @@ func (a *defaultProviderImpl) Options() *AuthenticationProviderConfig {
 		Endpoint:                 "http://localhost:8080",
 		AuthenticationExpiration: 10, // min
 		AuthorizationExpiration:  90, // days
+		AccessTokenExpiration:    60, // min
+		MaxSessions:              10,
 	}
 }
+
+// IF EventBusProvider
+
+func (np *defaultProviderImpl) Publish(ctx context.Context, e *Event) error {
+	return nil
+}
+
+func (np *defaultProviderImpl) Subscribe(topic, name string, h EventHandler) (Subscription, error) {
+	return &nullSubscription{}, nil
+}
+
+func (s *nullSubscription) Unsubscribe() error {
+	return nil
+}
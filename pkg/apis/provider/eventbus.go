@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+)
+
+type (
+	// Event is a message that is published to a topic. Topics are named <domain>.<event>, e.g. account.created.
+	Event struct {
+		ID         string            `json:"id"`
+		Topic      string            `json:"topic"`
+		Data       []byte            `json:"data,omitempty"` // JSON encoded payload
+		Attributes map[string]string `json:"attributes,omitempty"`
+		Published  time.Time         `json:"published"`
+		// Attempt is the number of the delivery to a subscription, starting with 1
+		Attempt int `json:"-"`
+	}
+
+	// EventHandler processes an event. Returning an error nacks the event, it is delivered again later.
+	EventHandler func(context.Context, *Event) error
+
+	// Subscription receives the events of a topic
+	Subscription interface {
+		Unsubscribe() error
+	}
+
+	// EventBusProvider delivers events at least once to every subscription of their topic
+	EventBusProvider interface {
+		// Publish sends e to all subscriptions of its topic. ID and Published are set by the provider.
+		Publish(ctx context.Context, e *Event) error
+		// Subscribe creates subscription name on topic. Every subscription receives all events published after it was created.
+		Subscribe(topic, name string, h EventHandler) (Subscription, error)
+	}
+)
+
+var (
+	// ErrInvalidTopic indicates a topic that does not follow the naming convention
+	ErrInvalidTopic = errors.New("invalid topic")
+	// ErrSubscriptionExists indicates that a subscription with the same name already exists on a topic
+	ErrSubscriptionExists = errors.New("subscription already exists")
+
+	// lower case, dot separated segments e.g. account.created
+	topicRegexp = regexp.MustCompile(`^[a-z][a-z0-9_-]*(\.[a-z0-9_-]+)*$`)
+)
+
+// NewEvent creates an event for topic with a JSON encoded payload. The attributes are key/value pairs.
+func NewEvent(topic string, payload interface{}, attributes ...string) (*Event, error) {
+	if !ValidTopic(topic) {
+		return nil, ErrInvalidTopic
+	}
+
+	e := Event{
+		Topic:      topic,
+		Attributes: make(map[string]string),
+	}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = b
+	}
+
+	for i := 0; i < len(attributes); i += 2 {
+		if i+1 < len(attributes) {
+			e.Attributes[attributes[i]] = attributes[i+1]
+		} else {
+			e.Attributes[attributes[i]] = ""
+		}
+	}
+	return &e, nil
+}
+
+// ValidTopic checks the topic naming convention: lower case segments separated by dots
+func ValidTopic(topic string) bool {
+	return topicRegexp.MatchString(topic)
+}
+
+// Decode unmarshals the payload of the event into v
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
@@ -2,6 +2,17 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// headers added to task requests, compatible with Cloud Tasks
+	HeaderQueueName          = "X-CloudTasks-QueueName"
+	HeaderTaskName           = "X-CloudTasks-TaskName"
+	HeaderTaskRetryCount     = "X-CloudTasks-TaskRetryCount"
+	HeaderTaskExecutionCount = "X-CloudTasks-TaskExecutionCount"
+	HeaderTaskETA            = "X-CloudTasks-TaskETA"
 )
 
 const (
@@ -19,9 +30,67 @@ type (
 		Request string
 		Token   string
 		Payload interface{}
+		// Headers are added to the request, they can't override the Authorization, User-Agent and X-CloudTasks-* headers
+		Headers map[string]string
+		// Name is unique, a task with the same name is rejected. Use it to de-duplicate tasks.
+		Name string
+		// ScheduleAt is the earliest time the task is dispatched. Delay is used if ScheduleAt is not set.
+		ScheduleAt time.Time
+		Delay      time.Duration
+		// DispatchDeadline is the max time to wait for the response, 0 = provider default
+		DispatchDeadline time.Duration
+		// RetryPolicy overrides the retry policy of the queue, if the provider supports it
+		RetryPolicy *RetryPolicy
+		// Queue selects the queue the task is added to, the provider's default queue is used if empty
+		Queue string
+		// AppEngine routes the task to an App Engine service instead of an URL. Request is the relative URI then.
+		AppEngine *AppEngineTarget
+	}
+
+	// AppEngineTarget selects the App Engine service, version and instance that receives a task.
+	// Empty values use the defaults of the App Engine application.
+	AppEngineTarget struct {
+		Service  string
+		Version  string
+		Instance string
 	}
 
 	HttpTaskProvider interface {
 		CreateHttpTask(context.Context, HttpTask) error
+		// CreateHttpTasks creates a batch of tasks. It returns a *BatchError if some of the tasks could not be created.
+		CreateHttpTasks(context.Context, []HttpTask) error
 	}
 )
+
+var (
+	// ErrTaskAlreadyExists indicates that a task with the same name was already created
+	ErrTaskAlreadyExists = errors.New("task already exists")
+)
+
+// ScheduleTime returns the earliest time the task should be dispatched, relative to now.
+// The zero time means the task is dispatched immediately.
+func (t *HttpTask) ScheduleTime(now time.Time) time.Time {
+	if !t.ScheduleAt.IsZero() {
+		return t.ScheduleAt
+	}
+	if t.Delay > 0 {
+		return now.Add(t.Delay)
+	}
+	return time.Time{}
+}
+
+// String returns the name of the HTTP method
+func (m HttpMethod) String() string {
+	switch m {
+	case HttpMethodGet:
+		return "GET"
+	case HttpMethodPost:
+		return "POST"
+	case HttpMethodPut:
+		return "PUT"
+	case HttpMethodDelete:
+		return "DELETE"
+	default:
+		return "GET"
+	}
+}
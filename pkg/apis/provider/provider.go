@@ -7,6 +7,7 @@ const (
 	TypeTask
 	TypeMetrics
 	TypeAuthentication
+	TypeEventBus
 )
 
 type (
@@ -40,6 +41,8 @@ func (l ProviderType) String() string {
 		return "METRICS"
 	case TypeAuthentication:
 		return "AUTHENTICATION"
+	case TypeEventBus:
+		return "EVENT_BUS"
 	default:
 		panic("unsupported")
 	}
@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultMaxDoublings is the number of times the backoff is doubled before it increases linearly, same as Cloud Tasks
+	DefaultMaxDoublings = 16
+)
+
+type (
+	// RetryPolicy controls how often and how fast a failed task is retried.
+	// Zero values are replaced with the defaults of the queue, see WithDefaults.
+	RetryPolicy struct {
+		// MaxAttempts is the max number of attempts, including the first one. A negative value means unlimited attempts.
+		MaxAttempts int
+		// MinBackoff is the time to wait before the first retry
+		MinBackoff time.Duration
+		// MaxBackoff is the upper limit of the time to wait between two attempts
+		MaxBackoff time.Duration
+		// MaxDoublings is the number of times the backoff is doubled. After that, it increases linearly.
+		MaxDoublings int
+		// MaxRetryDuration limits the time since the first attempt during which the task is retried, 0 = no limit
+		MaxRetryDuration time.Duration
+	}
+
+	// DeadLetter is a task that failed permanently
+	DeadLetter struct {
+		ID       string    `json:"id"`
+		Task     HttpTask  `json:"task"`
+		Error    string    `json:"error"`
+		Attempts int       `json:"attempts"`
+		Failed   time.Time `json:"failed"`
+	}
+
+	// DeadLetterFunc is called after the final attempt of a task failed
+	DeadLetterFunc func(context.Context, *DeadLetter)
+
+	// DeadLetterQueue is implemented by task providers that keep tasks that failed permanently
+	DeadLetterQueue interface {
+		// DeadLetters returns all tasks that failed permanently, oldest first
+		DeadLetters(context.Context) ([]*DeadLetter, error)
+		// Requeue removes a dead-lettered task and creates it again, with a fresh retry budget
+		Requeue(context.Context, string) error
+	}
+)
+
+var (
+	// ErrNoSuchTask indicates that a task does not exist
+	ErrNoSuchTask = errors.New("no such task")
+)
+
+// WithDefaults returns a copy of the policy with all unset values taken from def
+func (p RetryPolicy) WithDefaults(def RetryPolicy) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = def.MaxAttempts
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = def.MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = def.MaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	if p.MaxDoublings <= 0 {
+		p.MaxDoublings = def.MaxDoublings
+	}
+	if p.MaxDoublings <= 0 {
+		p.MaxDoublings = DefaultMaxDoublings
+	}
+	if p.MaxRetryDuration <= 0 {
+		p.MaxRetryDuration = def.MaxRetryDuration
+	}
+	return p
+}
+
+// Backoff returns the time to wait after the n-th failed attempt. The wait time starts with MinBackoff
+// and is doubled MaxDoublings times, after that it increases linearly, up to MaxBackoff.
+//
+// E.g. MinBackoff=10s, MaxBackoff=300s and MaxDoublings=3 results in 10s, 20s, 40s, 80s, 160s, 240s, 300s, 300s ...
+func (p *RetryPolicy) Backoff(attempts int) time.Duration {
+	d := p.MinBackoff
+	step := p.MinBackoff
+	for i := 1; i < attempts; i++ {
+		if i <= p.MaxDoublings {
+			d = d * 2
+			step = d
+		} else {
+			d = d + step
+		}
+		if d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return d
+}
+
+// Exhausted reports whether a task that failed attempts times, the first time at first, must not be retried again.
+// If both MaxAttempts and MaxRetryDuration are set, the task is retried until both limits are reached.
+func (p *RetryPolicy) Exhausted(attempts int, first, now time.Time) bool {
+	attemptsDone := p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+	durationDone := p.MaxRetryDuration > 0 && now.Sub(first) >= p.MaxRetryDuration
+
+	switch {
+	case p.MaxAttempts > 0 && p.MaxRetryDuration > 0:
+		return attemptsDone && durationDone
+	case p.MaxAttempts > 0:
+		return attemptsDone
+	case p.MaxRetryDuration > 0:
+		return durationDone
+	}
+	return false
+}
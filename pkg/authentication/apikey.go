@@ -0,0 +1,352 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	mcache "github.com/OrlovEvgeny/go-mcache"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreAPIKeys collection API_KEYS
+	datastoreAPIKeys string = "API_KEYS"
+
+	// APIKeyPath is the prefix of the API key management routes
+	APIKeyPath = "/apikeys"
+
+	// APIKeyPrefix is the prefix of all API keys, followed by the token type, e.g. 'sk_api-...'
+	APIKeyPrefix = "sk_"
+
+	// apiKeyDisplayLength is the number of characters of a key that are kept to identify it
+	apiKeyDisplayLength = 16
+	// apiKeyTouchInterval limits the updates of LastUsed, in seconds
+	apiKeyTouchInterval = 60
+	// apiKeyCacheTTL is how long a key is cached. Revocations and rotations on other instances take effect after at most this time.
+	apiKeyCacheTTL = apiKeyTouchInterval * time.Second
+)
+
+type (
+	// APIKey is a long-lived credential of a machine client, e.g. a backend service or a bot.
+	// The key itself is only known when it is created or rotated, only its hash is stored.
+	APIKey struct {
+		ID        string `json:"id"`
+		Realm     string `json:"realm"`
+		Name      string `json:"name"`
+		TokenType string `json:"token_type"` // api, app or bot
+		Scope     string `json:"scope"`
+		Prefix    string `json:"prefix"`                      // the start of the key, to identify it
+		Key       string `json:"key,omitempty" datastore:"-"` // only set when the key was created or rotated
+		Expires   int64  `json:"expires,omitempty"`           // 0 = never
+		LastUsed  int64  `json:"last_used,omitempty"`
+		Revoked   bool   `json:"revoked"`
+		CreatedBy string `json:"created_by,omitempty"` // the client that created the key
+		Created   int64  `json:"created"`
+		Updated   int64  `json:"updated"`
+		// internal
+		KeyHash string `json:"-"`
+	}
+
+	// APIKeyRequest creates a new API key
+	APIKeyRequest struct {
+		Name      string `json:"name" binding:"required"`
+		Scope     string `json:"scope"`                // default api:read
+		TokenType string `json:"token_type,omitempty"` // default api
+		Expires   int    `json:"expires,omitempty"`    // in days, 0 = never
+	}
+)
+
+var (
+	// ErrInvalidTokenType indicates a token type that can't be used for API keys
+	ErrInvalidTokenType = errors.New("invalid token type")
+	// ErrScopeNotGranted indicates a scope that the creator of a key does not have itself
+	ErrScopeNotGranted = errors.New("scope not granted")
+
+	// cache of the keys in use, maps the key hash to the API key
+	apiKeyCache = mcache.New()
+)
+
+// IsAPIKey reports whether token looks like an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// NewAPIKey creates an API key in realm with a new secret. The key expires after expires days, 0 = never.
+func NewAPIKey(realm, name, tokenType, scope string, expires int) (*APIKey, error) {
+	if tokenType == "" {
+		tokenType = APITokenType
+	}
+	if tokenType != APITokenType && tokenType != AppTokenType && tokenType != BotTokenType {
+		return nil, ErrInvalidTokenType
+	}
+	if scope == "" {
+		scope = ScopeAPIRead
+	}
+
+	kid, err := id.ShortUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp.Now()
+
+	k := APIKey{
+		ID:        kid,
+		Realm:     realm,
+		Name:      name,
+		TokenType: tokenType,
+		Scope:     ParseScopes(scope).String(),
+		Created:   now,
+		Updated:   now,
+	}
+	if expires > 0 {
+		k.Expires = now + int64(expires)*86400
+	}
+	if err := k.newSecret(); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// newSecret replaces the secret of the key
+func (k *APIKey) newSecret() error {
+	key, err := id.RandomToken(APIKeyPrefix + k.TokenType)
+	if err != nil {
+		return err
+	}
+	hash, err := account.HashToken(key)
+	if err != nil {
+		return err
+	}
+	k.Key = key
+	k.KeyHash = hash
+	k.Prefix = key[:apiKeyDisplayLength]
+	return nil
+}
+
+// IsValid verifies that the key is not revoked and not expired
+func (k *APIKey) IsValid() bool {
+	if k.Revoked {
+		return false
+	}
+	return k.Expires == 0 || k.Expires >= timestamp.Now()
+}
+
+// authorization returns the authorization of a request made with the key
+func (k *APIKey) authorization() *Authorization {
+	return &Authorization{
+		ClientID:  k.ID,
+		Realm:     k.Realm,
+		TokenHash: k.KeyHash,
+		TokenType: k.TokenType,
+		UserID:    k.Name,
+		Scope:     k.Scope,
+		Expires:   k.Expires,
+		Revoked:   k.Revoked,
+		Created:   k.Created,
+		Updated:   k.Updated,
+	}
+}
+
+// CheckAPIKeyScope verifies that scopes, granted in realm, include all scopes of an API key.
+// A key can't have more permissions than the client that created it.
+func CheckAPIKeyScope(realm, scopes, scope string) error {
+	if !grantsScopes(realm, scopes, scope) {
+		return ErrScopeNotGranted
+	}
+	return nil
+}
+
+// grantsScopes checks if scopes, granted in realm, include all of the requested scopes
+func grantsScopes(realm, scopes, requested string) bool {
+	granted := GrantedScopes(realm, scopes)
+	for _, s := range ParseScopes(requested).Slice() {
+		if !granted.Has(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateAPIKey creates and stores a new API key. The returned key contains the secret, it can't be retrieved later.
+func CreateAPIKey(ctx context.Context, realm, createdBy string, req *APIKeyRequest) (*APIKey, error) {
+	k, err := NewAPIKey(realm, req.Name, req.TokenType, req.Scope, req.Expires)
+	if err != nil {
+		return nil, err
+	}
+	k.CreatedBy = createdBy
+
+	if err := UpdateAPIKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LookupAPIKey retrieves an API key by its ID
+func LookupAPIKey(ctx context.Context, realm, keyID string) (*APIKey, error) {
+	var k APIKey
+
+	if err := ds.DataStore().Get(ctx, apiKeyKey(realm, keyID), &k); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &k, nil
+}
+
+// UpdateAPIKey writes the key back
+func UpdateAPIKey(ctx context.Context, k *APIKey) error {
+	k.Updated = timestamp.Now()
+	if _, err := ds.DataStore().Put(ctx, apiKeyKey(k.Realm, k.ID), k); err != nil {
+		return err
+	}
+	apiKeyCache.Remove(k.KeyHash)
+	return nil
+}
+
+// ListAPIKeys returns the keys of a realm, newest first
+func ListAPIKeys(ctx context.Context, realm string) ([]*APIKey, error) {
+	var keys []*APIKey
+
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAPIKeys).Filter("Realm =", realm), &keys); err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created > keys[j].Created })
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes a key, requests made with the key fail immediately
+func RevokeAPIKey(ctx context.Context, realm, keyID string) (*APIKey, error) {
+	k, err := LookupAPIKey(ctx, realm, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, ErrNoSuchEntity
+	}
+
+	k.Revoked = true
+	if err := UpdateAPIKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// RotateAPIKey replaces the secret of a key, the old secret is invalid immediately. The returned key contains the new secret.
+func RotateAPIKey(ctx context.Context, realm, keyID string) (*APIKey, error) {
+	k, err := LookupAPIKey(ctx, realm, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || k.Revoked {
+		return nil, ErrNoSuchEntity
+	}
+
+	apiKeyCache.Remove(k.KeyHash)
+	if err := k.newSecret(); err != nil {
+		return nil, err
+	}
+	if err := UpdateAPIKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// FindAPIKey looks for an API key by its secret and records its use
+func FindAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	if key == "" {
+		return nil, ErrNoToken
+	}
+
+	hash, err := account.HashToken(key)
+	if err != nil {
+		return nil, err
+	}
+	k, err := findAPIKeyByHash(ctx, hash)
+	if err != nil || k == nil {
+		return nil, err
+	}
+
+	// record the use, but not on every request
+	if timestamp.Now()-k.LastUsed > apiKeyTouchInterval {
+		used, err := touchAPIKey(ctx, k.Realm, k.ID, hash)
+		if err != nil {
+			platform.ReportError(err)
+			return k, nil
+		}
+		if used == nil {
+			return nil, nil // the key was rotated or deleted
+		}
+		return used, nil
+	}
+	return k, nil
+}
+
+// touchAPIKey updates LastUsed of the stored key and returns it. The key is read in the transaction, so that
+// a concurrent revoke or rotate is never undone, and nil is returned if its secret does not match hash anymore.
+func touchAPIKey(ctx context.Context, realm, keyID, hash string) (*APIKey, error) {
+	var k APIKey
+	found := false
+	dk := apiKeyKey(realm, keyID)
+
+	_, err := ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		found = false
+		if err := tx.Get(dk, &k); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if k.KeyHash != hash {
+			return nil
+		}
+		found = true
+		if k.Revoked {
+			return nil // nothing to record
+		}
+		k.LastUsed = timestamp.Now()
+		_, err := tx.Put(dk, &k)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		apiKeyCache.Remove(hash)
+		return nil, nil
+	}
+	apiKeyCache.Set(hash, &k, apiKeyCacheTTL)
+	return &k, nil
+}
+
+func findAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	if k, ok := apiKeyCache.Get(hash); ok {
+		return k.(*APIKey), nil
+	}
+
+	var keys []*APIKey
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAPIKeys).Filter("KeyHash =", hash), &keys); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	apiKeyCache.Set(hash, keys[0], apiKeyCacheTTL)
+	return keys[0], nil
+}
+
+func apiKeyKey(realm, keyID string) *datastore.Key {
+	return datastore.NameKey(datastoreAPIKeys, namedKey(realm, keyID), nil)
+}
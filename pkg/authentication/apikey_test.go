@@ -0,0 +1,103 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	k, err := NewAPIKey(realm, "backend", "", "", 30)
+	require.NoError(t, err)
+
+	assert.True(t, IsAPIKey(k.Key))
+	assert.True(t, strings.HasPrefix(k.Key, APIKeyPrefix+APITokenType+"-"))
+	assert.True(t, strings.HasPrefix(k.Key, k.Prefix))
+	hash, _ := account.HashToken(k.Key)
+	assert.Equal(t, hash, k.KeyHash)
+	assert.Equal(t, ScopeAPIRead, k.Scope)
+	assert.Greater(t, k.Expires, timestamp.Now())
+	assert.True(t, k.IsValid())
+
+	secret := k.Key
+	require.NoError(t, k.newSecret())
+	assert.NotEqual(t, secret, k.Key)
+
+	_, err = NewAPIKey(realm, "user", UserTokenType, "", 0)
+	assert.Equal(t, ErrInvalidTokenType, err)
+	assert.False(t, IsAPIKey(CreateSimpleToken()))
+}
+
+func TestAPIKeyAuthorization(t *testing.T) {
+	k, err := NewAPIKey(realm, "bot", BotTokenType, "api:write", 0)
+	require.NoError(t, err)
+
+	auth := k.authorization()
+	assert.Equal(t, BotTokenType, auth.TokenType)
+	assert.True(t, auth.IsValid()) // never expires
+	assert.True(t, hasScope(realm, auth.Scope, ScopeAPIRead))
+	assert.False(t, hasScope(realm, auth.Scope, ScopeAPIAdmin))
+
+	k.Revoked = true
+	assert.False(t, k.IsValid())
+	assert.False(t, k.authorization().IsValid())
+}
+
+func TestFindAPIKeyKeepsRevocation(t *testing.T) {
+	ctx := context.TODO()
+
+	k, err := CreateAPIKey(ctx, realm, "test", &APIKeyRequest{Name: "backend"})
+	require.NoError(t, err)
+	defer ds.DataStore().Delete(ctx, apiKeyKey(k.Realm, k.ID))
+
+	found, err := FindAPIKey(ctx, k.Key)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.False(t, found.Revoked)
+
+	// another instance revokes the key while it is cached here
+	revoked := *found
+	revoked.Revoked = true
+	_, err = ds.DataStore().Put(ctx, apiKeyKey(k.Realm, k.ID), &revoked)
+	require.NoError(t, err)
+	cached, _ := apiKeyCache.Get(k.KeyHash)
+	cached.(*APIKey).LastUsed = 0 // the next lookup records the use
+
+	found, err = FindAPIKey(ctx, k.Key)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.True(t, found.Revoked)
+
+	stored, err := LookupAPIKey(ctx, k.Realm, k.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Revoked)
+}
+
+func TestCheckAPIKeyScope(t *testing.T) {
+	assert.NoError(t, CheckAPIKeyScope(realm, ScopeAPIAdmin, "api:read,api:write"))
+	assert.NoError(t, CheckAPIKeyScope(realm, "api:write", "api:read"))
+	assert.Equal(t, ErrScopeNotGranted, CheckAPIKeyScope(realm, "api:read", "api:write"))
+	assert.Equal(t, ErrScopeNotGranted, CheckAPIKeyScope(realm, ScopeAPIAdmin, "billing:read"))
+}
+
+func TestCreateAPIKeyEndpointScope(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, APIKeyPath, strings.NewReader(`{"name":"backend","scope":"api:admin"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	c.Set(PrincipalContextKey, &Principal{Realm: realm, ClientID: "client", Scopes: []string{"api:write"}})
+
+	require.NoError(t, CreateAPIKeyEndpoint(c))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/txsvc/platform/v2/pkg/account"
 	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/jwt"
 	"github.com/txsvc/platform/v2/pkg/timestamp"
 )
 
@@ -34,6 +35,8 @@ const (
 	DefaultAuthenticationExpiration = 10
 	// DefaultAuthorizationExpiration in days
 	DefaultAuthorizationExpiration = 90
+	// DefaultAccessTokenExpiration in minutes. Used when access tokens are refreshed with a refresh token.
+	DefaultAccessTokenExpiration = 60
 
 	// DefaultEndpoint is used to build the urls in the notifications
 	DefaultEndpoint = "http://localhost:8080"
@@ -52,10 +55,17 @@ type (
 		UserID    string `json:"user_id"`                       // depends on TokenType. UserID could equal ClientID or BotUserID in Slack
 		Scope     string `json:"scope"`                         // a comma separated list of scopes, see below
 		Expires   int64  `json:"expires"`                       // 0 = never
+		// only set when a new refresh token was issued
+		RefreshToken string `json:"refresh_token,omitempty" datastore:"-"`
+		// the session the token belongs to, see Session, and the OAuth client that started it
+		SessionID   string `json:"session_id,omitempty" datastore:"-"`
+		OAuthClient string `json:"oauth_client,omitempty" datastore:"-"`
 		// internal
-		Revoked bool  `json:"-"`
-		Created int64 `json:"-"`
-		Updated int64 `json:"-"`
+		TokenHash string `json:"-"` // keyed hash of Token, the token itself is never stored
+		TokenID   string `json:"-"` // the 'jti' claim if Token is a JWT
+		Revoked   bool   `json:"-"`
+		Created   int64  `json:"-"`
+		Updated   int64  `json:"-"`
 	}
 
 	// AuthorizationRequest represents a login/authorization request from a user, app, or bot
@@ -65,6 +75,14 @@ type (
 		ClientID string `json:"client_id"`
 		Token    string `json:"token"`
 		Scope    string `json:"scope"`
+		Device   string `json:"device,omitempty"` // a name for the session, e.g. 'cli' or 'laptop'
+		OTP      string `json:"otp,omitempty"`    // a TOTP or recovery code, if the account has MFA enabled
+		// set by the server
+		UserAgent string `json:"-"`
+		// response only
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Expires      int64  `json:"expires,omitempty"`
+		SessionID    string `json:"session_id,omitempty"`
 	}
 )
 
@@ -117,6 +135,14 @@ func GetClientID(ctx context.Context, r *http.Request) (string, error) {
 		return "", err
 	}
 
+	if conf := jwtConfig(); conf != nil && jwt.IsJWT(token) {
+		auth, err := verifyJWT(ctx, conf, token)
+		if err != nil {
+			return "", err
+		}
+		return auth.ClientID, nil
+	}
+
 	// FIXME optimize this, e.g. implement caching
 
 	auth, err := FindAuthorizationByToken(ctx, token)
@@ -149,17 +175,21 @@ func ConfirmLoginChallenge(ctx context.Context, token string) (*account.Account,
 
 	acc.Confirmed = now
 	acc.Expires = 0
-	acc.Status = account.AccountLoggedOut
-	acc.Token = ""
+	if acc.Status != account.AccountActive {
+		acc.Status = account.AccountLoggedOut
+	}
+	acc.SetToken("")
 
 	err = account.UpdateAccount(ctx, acc)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
+	account.PublishAccountEvent(ctx, account.TopicAccountConfirmed, acc)
 
 	return acc, http.StatusNoContent, nil
 }
 
+// LogoutAccount logs the account out of all sessions, see RevokeSession to end a single session
 func LogoutAccount(ctx context.Context, realm, clientID string) (int, error) {
 	// find the account
 	acc, err := account.LookupAccount(ctx, realm, clientID)
@@ -179,7 +209,7 @@ func LogoutAccount(ctx context.Context, realm, clientID string) (int, error) {
 		return http.StatusInternalServerError, err
 	}
 
-	// find the matching authorization and revoke it
+	// find the matching authorization and revoke it, this ends all sessions
 	auth, err := LookupAuthorization(ctx, acc.Realm, acc.ClientID)
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -187,15 +217,27 @@ func LogoutAccount(ctx context.Context, realm, clientID string) (int, error) {
 
 	if auth != nil {
 		auth.Revoked = true
+		if err := revokeToken(ctx, auth); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if err := RevokeRefreshTokens(ctx, auth.Realm, auth.ClientID); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if _, err := RevokeSessions(ctx, auth.Realm, auth.ClientID, ""); err != nil {
+			return http.StatusInternalServerError, err
+		}
 		err = UpdateAuthorization(ctx, auth)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
+		PublishAuthorizationEvent(ctx, TopicLogout, auth, "")
 	}
 
 	return http.StatusNoContent, nil
 }
 
+// BlockAccount revokes the authorization, sessions and refresh tokens of an account. Opaque tokens fail at once,
+// JWT access tokens may be accepted by other instances for up to RevocationDelay.
 func BlockAccount(ctx context.Context, realm, clientID string) error {
 	acc, err := account.LookupAccount(ctx, realm, clientID)
 	if err != nil {
@@ -211,12 +253,27 @@ func BlockAccount(ctx context.Context, realm, clientID string) error {
 	}
 	if auth != nil {
 		auth.Revoked = true
+		if err := revokeToken(ctx, auth); err != nil {
+			return err
+		}
+		if err := RevokeRefreshTokens(ctx, auth.Realm, auth.ClientID); err != nil {
+			return err
+		}
+		if _, err := RevokeSessions(ctx, auth.Realm, auth.ClientID, ""); err != nil {
+			return err
+		}
 		err = UpdateAuthorization(ctx, auth)
 		if err != nil {
 			return err
 		}
+		PublishAuthorizationEvent(ctx, TopicRevoked, auth, "")
 	}
 
 	acc.Status = account.AccountBlocked
-	return account.UpdateAccount(ctx, acc)
+	if err := account.UpdateAccount(ctx, acc); err != nil {
+		return err
+	}
+	account.PublishAccountEvent(ctx, account.TopicAccountBlocked, acc)
+
+	return nil
 }
@@ -21,12 +21,12 @@ func TestScope(t *testing.T) {
 
 	scope1 := "production:read,production:write,production:build"
 
-	assert.False(t, hasScope("", ""))
-	assert.False(t, hasScope(scope1, ""))
-	assert.False(t, hasScope("", scopeResourceRead))
+	assert.False(t, hasScope(realm, "", ""))
+	assert.False(t, hasScope(realm, scope1, ""))
+	assert.False(t, hasScope(realm, "", scopeResourceRead))
 
-	assert.True(t, hasScope(scope1, scopeProductionRead))
-	assert.False(t, hasScope(scope1, scopeResourceRead))
+	assert.True(t, hasScope(realm, scope1, scopeProductionRead))
+	assert.False(t, hasScope(realm, scope1, scopeResourceRead))
 }
 
 func TestConfirmLoginChallenge(t *testing.T) {
@@ -3,7 +3,6 @@ package authentication
 import (
 	"context"
 	"net/http"
-	"strings"
 
 	"cloud.google.com/go/datastore"
 	mcache "github.com/OrlovEvgeny/go-mcache"
@@ -11,6 +10,7 @@ import (
 
 	"github.com/txsvc/platform/v2/pkg/account"
 	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/jwt"
 	"github.com/txsvc/platform/v2/pkg/loader"
 	"github.com/txsvc/platform/v2/pkg/timestamp"
 )
@@ -21,7 +21,7 @@ const (
 )
 
 var (
-	// secondary cache, maps token to authorization
+	// secondary cache, maps the token hash to authorization
 	authCache = mcache.New()
 )
 
@@ -29,15 +29,31 @@ func (ath *Authorization) Equal(a *Authorization) bool {
 	if a == nil {
 		return false
 	}
-	return ath.Token == a.Token && ath.Realm == a.Realm && ath.ClientID == a.ClientID && ath.UserID == a.UserID
+	h1, err := ath.hash()
+	if err != nil {
+		return false
+	}
+	h2, err := a.hash()
+	if err != nil {
+		return false
+	}
+	return h1 == h2 && ath.Realm == a.Realm && ath.ClientID == a.ClientID && ath.UserID == a.UserID
 }
 
-// IsValid verifies that the Authorization is still valid, i.e. is not expired and not revoked.
+// hash returns the hash of the token, the stored one if the token is not known
+func (ath *Authorization) hash() (string, error) {
+	if ath.Token != "" {
+		return account.HashToken(ath.Token)
+	}
+	return ath.TokenHash, nil
+}
+
+// IsValid verifies that the Authorization is still valid, i.e. is not expired and not revoked. Expires == 0 never expires.
 func (ath *Authorization) IsValid() bool {
 	if ath.Revoked {
 		return false
 	}
-	if ath.Expires < timestamp.Now() {
+	if ath.Expires != 0 && ath.Expires < timestamp.Now() {
 		return false
 	}
 	return true
@@ -45,21 +61,24 @@ func (ath *Authorization) IsValid() bool {
 
 // HasAdminScope checks if the authorization includes scope 'api:admin'
 func (ath *Authorization) HasAdminScope() bool {
-	return strings.Contains(ath.Scope, ScopeAPIAdmin)
+	return ath.Scopes().Has(ScopeAPIAdmin)
 }
 
-func hasScope(scopes, scope string) bool {
-	// FIXME this is a VERY simple implementation
-	if scopes == "" || scope == "" {
+// Scopes returns the granted scopes, expanded with the scope hierarchy of the realm
+func (ath *Authorization) Scopes() ScopeSet {
+	return GrantedScopes(ath.Realm, ath.Scope)
+}
+
+// hasScope checks if scopes, granted in realm, satisfy the scope expression, see ParseRequirement
+func hasScope(realm, scopes, expr string) bool {
+	if scopes == "" || expr == "" {
 		return false // empty inputs should never evalute to true
 	}
-
-	// FIXME this is a VERY naiv implementation
-	return strings.Contains(scopes, scope)
+	return GrantedScopes(realm, scopes).Satisfies(ParseRequirement(expr))
 }
 
 // CheckAuthorization relies on the presence of a bearer token and validates the
-// matching authorization against a list of requested scopes. If everything checks
+// matching authorization against a scope expression, see ParseRequirement. If everything checks
 // out, the function returns the authorization or an error otherwise.
 func CheckAuthorization(ctx context.Context, c echo.Context, scope string) (*Authorization, error) {
 	token, err := GetBearerToken(c.Request())
@@ -67,24 +86,51 @@ func CheckAuthorization(ctx context.Context, c echo.Context, scope string) (*Aut
 		return nil, err
 	}
 
+	auth, err := ValidateToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !hasScope(auth.Realm, auth.Scope, scope) {
+		return nil, ErrNotAuthorized
+	}
+
+	return auth, nil
+}
+
+// ValidateToken returns the authorization of a token if the token is valid, i.e. it is known, not expired, not revoked
+// and, for users, the account is logged-in. Returns ErrNotAuthorized otherwise.
+func ValidateToken(ctx context.Context, token string) (*Authorization, error) {
+	// JWTs are verified without a lookup, blocked accounts have their tokens revoked
+	if conf := jwtConfig(); conf != nil && jwt.IsJWT(token) {
+		auth, err := verifyJWT(ctx, conf, token)
+		if err != nil {
+			return nil, err
+		}
+		if !auth.IsValid() {
+			return nil, ErrNotAuthorized
+		}
+		return auth, nil
+	}
+
 	auth, err := FindAuthorizationByToken(ctx, token)
 	if err != nil || auth == nil || !auth.IsValid() {
 		return nil, ErrNotAuthorized
 	}
 
+	// only users have an account, API keys and service accounts don't
+	if IsAPIKey(token) || auth.TokenType != UserTokenType {
+		return auth, nil
+	}
+
 	acc, err := account.FindAccountByUserID(ctx, auth.Realm, auth.UserID)
 	if err != nil {
 		return nil, err
 	}
 
-	if acc.Status != account.AccountActive {
+	if acc == nil || acc.Status != account.AccountActive {
 		return nil, ErrNotAuthorized // not logged-in
 	}
 
-	if !hasScope(auth.Scope, scope) {
-		return nil, ErrNotAuthorized
-	}
-
 	return auth, nil
 }
 
@@ -110,12 +156,22 @@ func NewAuthorization(req *AuthorizationRequest, expires int) *Authorization {
 func UpdateAuthorization(ctx context.Context, auth *Authorization) error {
 	k := nativeKey(auth.Key())
 
-	// remove from the cache
-	authCache.Remove(auth.Token)
+	hash, err := auth.hash()
+	if err != nil {
+		return err
+	}
+
+	// remove from the cache, the token might have changed
+	authCache.Remove(auth.TokenHash)
+	auth.TokenHash = hash
+	authCache.Remove(auth.TokenHash)
 
 	// we simply overwrite the existing authorization. If this is no desired, use GetAuthorization first,
-	// update the Authorization and then write it back.
-	if _, err := ds.DataStore().Put(ctx, k, auth); err != nil {
+	// update the Authorization and then write it back. Only the hash of the token is stored.
+	stored := *auth
+	stored.Token = ""
+	stored.RefreshToken = ""
+	if _, err := ds.DataStore().Put(ctx, k, &stored); err != nil {
 		return err
 	}
 
@@ -153,41 +209,109 @@ func DeleteAuthorization(ctx context.Context, realm, clientID string) (*Authoriz
 	}
 
 	// remove from the cache
-	authCache.Remove(auth.Token)
+	authCache.Remove(auth.TokenHash)
 
 	return auth, nil
 }
 
-// FindAuthorizationByToken looks for an authorization by the token
+// FindAuthorizationByToken looks for an authorization by the token. The authorization of a session
+// carries the session's token, expiration and revocation status.
 func FindAuthorizationByToken(ctx context.Context, token string) (*Authorization, error) {
 	if token == "" {
 		return nil, ErrNoSuchEntity
 	}
-	if a, ok := authCache.Get(token); ok {
+	if IsAPIKey(token) {
+		k, err := FindAPIKey(ctx, token)
+		if err != nil || k == nil {
+			return nil, err
+		}
+		return k.authorization(), nil
+	}
+
+	hash, err := account.HashToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := authCache.Get(hash); ok {
 		return a.(*Authorization), nil
 	}
 
-	var auth []*Authorization
+	var a *Authorization
 
-	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAuthorizations).Filter("Token =", token), &auth); err != nil {
+	s, err := findSessionByToken(ctx, hash)
+	if err != nil {
 		return nil, err
 	}
-	if auth == nil {
-		return nil, nil
-	}
+	if s != nil {
+		auth, err := LookupAuthorization(ctx, s.Realm, s.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if auth == nil {
+			return nil, nil
+		}
 
-	a := auth[0]
+		// the cache limits this to one update per cache period
+		s.LastUsed = timestamp.Now()
+		if err := UpdateSession(ctx, s); err != nil {
+			return nil, err
+		}
+		a = s.authorization(auth)
+	} else {
+		// tokens issued before sessions were introduced
+		var auth []*Authorization
+
+		if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAuthorizations).Filter("TokenHash =", hash), &auth); err != nil {
+			return nil, err
+		}
+		if auth == nil {
+			return nil, nil
+		}
+		a = auth[0]
+	}
+	a.Token = token
 
 	// add the authorization to the cache
-	authCache.Set(a.Token, a, loader.DefaultTTL)
+	authCache.Set(hash, a, loader.DefaultTTL)
 
 	return a, nil
 }
 
-// ExchangeToken confirms the temporary auth token and creates the permanent one
-func ExchangeToken(ctx context.Context, req *AuthorizationRequest, expires int, loginFrom string) (*Authorization, int, error) {
-	var auth *Authorization
+// MigrateTokenHashes replaces the plaintext tokens of existing accounts and authorizations with their hashes.
+// It returns the number of migrated records and only has to be run once after upgrading.
+func MigrateTokenHashes(ctx context.Context) (int, error) {
+	n, err := account.MigrateTokenHashes(ctx)
+	if err != nil {
+		return n, err
+	}
+
+	var auths []*Authorization
+	keys, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreAuthorizations).Filter("Token >", ""), &auths)
+	if err != nil {
+		return n, err
+	}
+	if len(auths) == 0 {
+		return n, nil
+	}
 
+	for _, a := range auths {
+		if a.TokenHash, err = account.HashToken(a.Token); err != nil {
+			return n, err
+		}
+		a.Token = ""
+	}
+	if _, err := ds.DataStore().PutMulti(ctx, keys, auths); err != nil {
+		return n, err
+	}
+	return n + len(auths), nil
+}
+
+// ExchangeToken confirms the temporary auth token and starts a new session with its own token. The login is valid for
+// expires days. With accessExpires > 0, the access token expires after accessExpires minutes and a refresh token is issued,
+// see RefreshAuthorization. Otherwise the access token is valid for the whole login. Other sessions of the account
+// stay valid, the least recently used ones are ended if there are more than the configured maximum.
+// Accounts with MFA enabled also need a valid code in req.OTP, see VerifyMFA.
+func ExchangeToken(ctx context.Context, req *AuthorizationRequest, expires, accessExpires int, loginFrom string) (*Authorization, int, error) {
 	acc, err := account.FindAccountByUserID(ctx, req.Realm, req.UserID)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
@@ -195,13 +319,28 @@ func ExchangeToken(ctx context.Context, req *AuthorizationRequest, expires int,
 	if acc == nil {
 		return nil, http.StatusNotFound, nil
 	}
-	now := timestamp.Now()
-	if acc.Expires < now || acc.Token != req.Token {
+	if acc.Expires < timestamp.Now() || !acc.HasToken(req.Token) {
 		return nil, http.StatusUnauthorized, nil
 	}
 
+	return loginAccount(ctx, acc, req, expires, accessExpires, loginFrom)
+}
+
+// loginAccount starts a new session of an account whose identity was verified, e.g. with the temporary token
+// or by an external identity provider. The authorization of the account is created with req.Scope if it does not exist.
+// Accounts with MFA enabled also need a valid code in req.OTP, on every path that logs in.
+func loginAccount(ctx context.Context, acc *account.Account, req *AuthorizationRequest, expires, accessExpires int, loginFrom string) (*Authorization, int, error) {
+	if err := checkMFA(ctx, acc, req.OTP); err != nil {
+		if err == ErrMFARequired || err == ErrInvalidMFACode {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	now := timestamp.Now()
+
 	// all OK, create or update the authorization
-	auth, err = LookupAuthorization(ctx, acc.Realm, acc.ClientID)
+	auth, err := LookupAuthorization(ctx, acc.Realm, acc.ClientID)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err // FIXME maybe use a different code here
 	}
@@ -212,32 +351,80 @@ func ExchangeToken(ctx context.Context, req *AuthorizationRequest, expires int,
 		req.ClientID = acc.ClientID
 		auth = NewAuthorization(req, expires)
 	}
-	auth.Token = CreateSimpleToken()
 	auth.Revoked = false
 	auth.Expires = now + (int64(expires) * 86400)
 	auth.Updated = now
 
+	// the token belongs to the session, the authorization only keeps the grant of the account.
+	// A token that was issued before sessions were introduced is replaced.
+	if err := revokeToken(ctx, auth); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	authCache.Remove(auth.TokenHash)
+	auth.Token = ""
+	auth.TokenHash = ""
+	auth.TokenID = ""
+
 	err = UpdateAuthorization(ctx, auth)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
+	auth, err = issueSession(ctx, auth, NewSession(auth, req, loginFrom), accessExpires)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
 	// update the account
 	acc.Status = account.AccountActive
 	acc.LastLogin = now
 	acc.LoginCount = acc.LoginCount + 1
 	acc.LoginFrom = loginFrom
-	acc.Token = ""
+	acc.SetToken("")
 	acc.Expires = 0 // never
 
 	err = account.UpdateAccount(ctx, acc)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
+	PublishAuthorizationEvent(ctx, TopicLogin, auth, loginFrom)
 
 	return auth, http.StatusOK, nil
 }
 
+// issueSession starts session s of the authorization grant and issues its tokens. The session ends at grant.Expires.
+// With accessExpires > 0, the access token expires after accessExpires minutes and a refresh token is issued.
+// Returns the authorization of the session, including its tokens.
+func issueSession(ctx context.Context, grant *Authorization, s *Session, accessExpires int) (*Authorization, error) {
+	auth := *grant
+	auth.SessionID = s.ID
+	auth.OAuthClient = s.Client
+	if s.Scope != "" {
+		auth.Scope = s.Scope
+	}
+
+	if accessExpires > 0 {
+		rt, err := issueRefreshToken(ctx, &auth, grant.Expires)
+		if err != nil {
+			return nil, err
+		}
+		auth.RefreshToken = rt.Token
+		auth.Expires = accessTokenExpires(timestamp.Now(), accessExpires, grant.Expires)
+	}
+	if err := issueToken(ctx, &auth); err != nil {
+		return nil, err
+	}
+
+	if err := s.attach(&auth); err != nil {
+		return nil, err
+	}
+	auth.TokenHash = s.TokenHash
+	if err := startSession(ctx, s, maxSessions()); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
 //
 // keys, cache and dataloader
 //
@@ -155,6 +155,11 @@ func TestLookupAuthorizationByToken(t *testing.T) {
 	ath, err := LookupAuthorization(ctx, accountTestRealm, account.ClientID)
 	if assert.NoError(t, err) {
 		ath1 := *ath // dereference to avoid cache issues
+
+		// only the hash of the token is stored, issue a new one
+		ath1.Token = CreateSimpleToken()
+		assert.NoError(t, UpdateAuthorization(ctx, &ath1))
+
 		ath2, err := FindAuthorizationByToken(ctx, ath1.Token)
 
 		assert.NoError(t, err)
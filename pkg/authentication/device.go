@@ -0,0 +1,279 @@
+package authentication
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreDeviceCodes collection DEVICE_CODES
+	datastoreDeviceCodes string = "DEVICE_CODES"
+
+	// DefaultDeviceCodeExpiration in minutes
+	DefaultDeviceCodeExpiration = 10
+	// DefaultDevicePollInterval is the minimum time between two token requests of a device, in seconds
+	DefaultDevicePollInterval = 5
+	// DeviceVerificationPath is the page of the frontend where users enter the user code, see Options().Endpoint
+	DeviceVerificationPath = "/device"
+
+	// device authorization states
+	DevicePending  = 0
+	DeviceApproved = 1
+	DeviceDenied   = -1
+
+	// user codes use consonants only, to avoid words and ambiguous characters, see RFC 8628, section 6.1
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	deviceCodePrefix = "dc"
+)
+
+type (
+	// DeviceAuthorization is a pending login of a device with limited input capabilities, e.g. the CLI,
+	// see RFC 8628. The user approves the login in the browser by entering the user code.
+	DeviceAuthorization struct {
+		Realm    string `json:"realm"`
+		Client   string `json:"oauth_client"` // the OAuth client
+		Scope    string `json:"scope"`
+		UserCode string `json:"user_code"`
+		Expires  int64  `json:"expires"`
+		// internal
+		Status   int    `json:"-"`
+		ClientID string `json:"-"` // the account of the user that approved the login
+		UserID   string `json:"-"`
+		Interval int64  `json:"-"` // seconds between two polls, increased if the device polls too often
+		LastPoll int64  `json:"-"`
+		Created  int64  `json:"-"`
+	}
+
+	// DeviceAuthorizationResponse is the response of the device authorization endpoint, see RFC 8628, section 3.2
+	DeviceAuthorizationResponse struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+		ExpiresIn               int64  `json:"expires_in"`
+		Interval                int64  `json:"interval"`
+	}
+)
+
+var (
+	// RFC 8628, section 3.5
+	ErrAuthorizationPending = &OAuthError{Code: "authorization_pending", Status: http.StatusBadRequest}
+	ErrSlowDown             = &OAuthError{Code: "slow_down", Status: http.StatusBadRequest}
+	ErrExpiredToken         = &OAuthError{Code: "expired_token", Status: http.StatusBadRequest}
+)
+
+// NewDeviceAuthorization starts the login of a device with client c. The device polls the token endpoint with the
+// returned device code while the user approves the login with the user code.
+func NewDeviceAuthorization(ctx context.Context, c *OAuthClient, scope string) (*DeviceAuthorizationResponse, error) {
+	if !c.AllowsGrant(GrantDeviceCode) {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, err := c.RestrictScope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := id.RandomToken(deviceCodePrefix)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp.Now()
+
+	da := DeviceAuthorization{
+		Realm:    c.Realm,
+		Client:   c.ID,
+		Scope:    scope,
+		UserCode: userCode,
+		Status:   DevicePending,
+		Interval: DefaultDevicePollInterval,
+		Expires:  timestamp.IncT(now, DefaultDeviceCodeExpiration),
+		Created:  now,
+	}
+	k, err := deviceCodeKey(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ds.DataStore().Put(ctx, k, &da); err != nil {
+		return nil, err
+	}
+
+	uri := authenticationProvider().Options().Endpoint + DeviceVerificationPath
+	return &DeviceAuthorizationResponse{
+		DeviceCode:              code,
+		UserCode:                FormatUserCode(userCode),
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + "?user_code=" + userCode,
+		ExpiresIn:               da.Expires - now,
+		Interval:                da.Interval,
+	}, nil
+}
+
+// LookupDeviceAuthorization returns the pending device login of a user code, or nil if there is none
+func LookupDeviceAuthorization(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	_, da, err := findDeviceAuthorization(ctx, userCode)
+	return da, err
+}
+
+// ApproveDevice approves or denies the device login of a user code on behalf of the user of auth. The user must
+// have all scopes requested by the device.
+func ApproveDevice(ctx context.Context, auth *Authorization, userCode string, approve bool) error {
+	if auth.TokenType != UserTokenType {
+		return ErrNotAuthorized
+	}
+	k, da, err := findDeviceAuthorization(ctx, userCode)
+	if err != nil {
+		return err
+	}
+	if da == nil || da.Realm != auth.Realm {
+		return ErrNoSuchEntity
+	}
+
+	if !approve {
+		da.Status = DeviceDenied
+	} else {
+		if !grantsScopes(auth.Realm, auth.Scope, da.Scope) {
+			return ErrScopeNotGranted
+		}
+		da.Status = DeviceApproved
+		da.ClientID = auth.ClientID
+		da.UserID = auth.UserID
+	}
+
+	_, err = ds.DataStore().Put(ctx, k, da)
+	return err
+}
+
+// ExchangeDeviceCode returns the tokens of an approved device login, see RFC 8628, section 3.4. Until the user
+// approved the login, ErrAuthorizationPending is returned, ErrSlowDown if the device polls too often.
+func ExchangeDeviceCode(ctx context.Context, c *OAuthClient, code, loginFrom, userAgent string) (*Authorization, error) {
+	var da DeviceAuthorization
+	var result error // the response to the device, the transaction must not be rolled back
+	now := timestamp.Now()
+	k, err := deviceCodeKey(code)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		result = nil
+		if err := tx.Get(k, &da); err != nil {
+			return err
+		}
+		if da.Client != c.ID {
+			result = ErrInvalidGrant
+			return nil
+		}
+		if da.Expires < now {
+			result = ErrExpiredToken
+			return tx.Delete(k)
+		}
+
+		// a login can be approved or denied once, the device code is used up
+		switch da.Status {
+		case DeviceApproved:
+			return tx.Delete(k)
+		case DeviceDenied:
+			result = ErrAccessDenied
+			return tx.Delete(k)
+		}
+
+		result = ErrAuthorizationPending
+		if now-da.LastPoll < da.Interval {
+			da.Interval += DefaultDevicePollInterval
+			result = ErrSlowDown
+		}
+		da.LastPoll = now
+		_, err := tx.Put(k, &da)
+		return err
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrInvalidGrant
+		}
+		return nil, err
+	}
+	if result != nil {
+		return nil, result
+	}
+
+	auth, _, err := startClientSession(ctx, c, da.Realm, da.ClientID, da.Scope, loginFrom, userAgent)
+	return auth, err
+}
+
+// FormatUserCode formats a user code for display, e.g. 'WDJB-MJHT'
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// NormalizeUserCode removes the formatting of a user code as entered by a user
+func NormalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// newUserCode returns a random user code, see RFC 8628, section 6.1
+func newUserCode() (string, error) {
+	// bytes above the largest multiple of the alphabet size are skipped, every character is equally likely
+	max := 256 - 256%len(userCodeAlphabet)
+	code := make([]byte, 0, userCodeLength)
+	b := make([]byte, userCodeLength)
+
+	for len(code) < userCodeLength {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) < max && len(code) < userCodeLength {
+				code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// findDeviceAuthorization looks for a pending device login by its user code
+func findDeviceAuthorization(ctx context.Context, userCode string) (*datastore.Key, *DeviceAuthorization, error) {
+	var logins []*DeviceAuthorization
+
+	q := datastore.NewQuery(datastoreDeviceCodes).Filter("UserCode =", NormalizeUserCode(userCode)).Filter("Status =", DevicePending)
+	keys, err := ds.DataStore().GetAll(ctx, q, &logins)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := timestamp.Now()
+	for i, da := range logins {
+		if da.Expires >= now {
+			return keys[i], da, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func deviceCodeKey(code string) (*datastore.Key, error) {
+	hash, err := account.HashToken(code)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NameKey(datastoreDeviceCodes, hash, nil), nil
+}
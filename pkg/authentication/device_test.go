@@ -0,0 +1,94 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+)
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	require.NoError(t, err)
+	assert.Len(t, code, userCodeLength)
+	for _, c := range code {
+		assert.Contains(t, userCodeAlphabet, string(c))
+	}
+
+	assert.Equal(t, "WDJB-MJHT", FormatUserCode("WDJBMJHT"))
+	assert.Equal(t, "WDJBMJHT", NormalizeUserCode("wdjb-mjht"))
+	assert.Equal(t, "WDJBMJHT", NormalizeUserCode(" WDJB MJHT "))
+}
+
+func TestDeviceAuthorizationEndpointClient(t *testing.T) {
+	form := url.Values{"scope": {"api:read"}}
+	req := httptest.NewRequest(http.MethodPost, OAuthPath+"/device_authorization", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, DeviceAuthorizationEndpoint(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid_client")
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ctx := context.TODO()
+
+	// a logged-in user
+	acc := createUnconfirmedUser(t, 10)
+	_, _, err := ConfirmLoginChallenge(ctx, acc.Token)
+	require.NoError(t, err)
+	acc, err = account.LookupAccount(ctx, accountTestRealm, acc.ClientID)
+	require.NoError(t, err)
+	acc, err = account.ResetTemporaryToken(ctx, acc, 10)
+	require.NoError(t, err)
+	user, status, err := ExchangeToken(ctx, &AuthorizationRequest{Realm: accountTestRealm, UserID: accountTestUser, Token: acc.Token, Scope: DefaultScope}, 1, 0, "127.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	cli, err := RegisterOAuthClient(ctx, accountTestRealm, &OAuthClientRequest{Name: "cli", Public: true, GrantTypes: []string{GrantDeviceCode, GrantRefreshToken}})
+	require.NoError(t, err)
+	t.Cleanup(func() { DeleteOAuthClient(ctx, accountTestRealm, cli.ID) })
+
+	resp, err := NewDeviceAuthorization(ctx, cli, "api:read")
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.DeviceCode)
+	assert.Equal(t, int64(DefaultDevicePollInterval), resp.Interval)
+
+	_, err = ExchangeDeviceCode(ctx, cli, resp.DeviceCode, "127.0.0.1", "cli")
+	assert.Equal(t, ErrAuthorizationPending, err)
+	_, err = ExchangeDeviceCode(ctx, cli, resp.DeviceCode, "127.0.0.1", "cli")
+	assert.Equal(t, ErrSlowDown, err)
+
+	require.NoError(t, ApproveDevice(ctx, user, strings.ToLower(resp.UserCode), true))
+	assert.Equal(t, ErrNoSuchEntity, ApproveDevice(ctx, user, resp.UserCode, true))
+
+	auth, err := ExchangeDeviceCode(ctx, cli, resp.DeviceCode, "127.0.0.1", "cli")
+	require.NoError(t, err)
+	assert.Equal(t, user.ClientID, auth.ClientID)
+	assert.Equal(t, "api:read", auth.Scope)
+	assert.Equal(t, cli.ID, auth.OAuthClient)
+	assert.NotEmpty(t, auth.RefreshToken)
+
+	// the device code is used up
+	_, err = ExchangeDeviceCode(ctx, cli, resp.DeviceCode, "127.0.0.1", "cli")
+	assert.Equal(t, ErrInvalidGrant, err)
+
+	// denied logins
+	resp, err = NewDeviceAuthorization(ctx, cli, "")
+	require.NoError(t, err)
+	require.NoError(t, ApproveDevice(ctx, user, resp.UserCode, false))
+	_, err = ExchangeDeviceCode(ctx, cli, resp.DeviceCode, "127.0.0.1", "cli")
+	assert.Equal(t, ErrAccessDenied, err)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -25,6 +26,11 @@ const (
 	getAuthorizationRoute  = "/auth"
 )
 
+func TestMain(m *testing.M) {
+	account.SetTokenPepper("test-pepper")
+	os.Exit(m.Run())
+}
+
 // Scenario 1: new account, login, account confirmation, token swap
 func TestLoginScenario1(t *testing.T) {
 	t.Cleanup(cleaner)
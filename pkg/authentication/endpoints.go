@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/txsvc/platform/v2"
@@ -29,6 +30,11 @@ func authenticationProvider() provider.AuthenticationProvider {
 		platform.ReportError(err)
 		log.Fatal(err) // this halts the process but there is no point because it would just crash later anyways
 	}
+	// without the pepper, no token can be issued or verified
+	if err := account.CheckTokenPepper(); err != nil {
+		platform.ReportError(err)
+		log.Fatal(err)
+	}
 	ap = p.(provider.AuthenticationProvider)
 
 	return ap
@@ -44,7 +50,7 @@ func authenticationProvider() provider.AuthenticationProvider {
 // status 201: new account, account confirmation sent
 // status 204: existing account, email with auth token sent
 // status 400: invalid request data
-// status 403: only logged-out and confirmed users can proceed
+// status 403: blocked or deactivated accounts can't proceed, logged-in users start an additional session
 func LoginRequestEndpoint(c echo.Context) error {
 	var req *AuthorizationRequest = new(AuthorizationRequest) // FIXME change this
 	ctx := platform.NewHttpContext(c.Request())
@@ -93,9 +99,9 @@ func LoginRequestEndpoint(c echo.Context) error {
 		// status 201: new account
 		return c.NoContent(http.StatusCreated)
 	}
-	if acc.Status != 0 {
-		// status 403: only logged-out and confirmed users can proceed, do nothing otherwise
-		return api.ErrorResponse(c, http.StatusForbidden, ErrAlreadyAuthorized)
+	if acc.Status < 0 {
+		// status 403: only confirmed users that are logged-in or logged-out can proceed, do nothing otherwise
+		return api.ErrorResponse(c, http.StatusForbidden, ErrNotAuthorized)
 	}
 
 	// create and send the auth token
@@ -140,7 +146,20 @@ func LogoutRequestEndpoint(c echo.Context) error {
 		return api.ErrorResponse(c, http.StatusBadRequest, err)
 	}
 
-	// logout starts here
+	// logout starts here, other sessions of the account stay logged-in
+	if ath.SessionID != "" {
+		if err := RevokeSession(ctx, ath.Realm, ath.ClientID, ath.SessionID); err != nil {
+			return api.ErrorResponse(c, http.StatusInternalServerError, err)
+		}
+		sessions, err := ListSessions(ctx, ath.Realm, ath.ClientID)
+		if err != nil {
+			return api.ErrorResponse(c, http.StatusInternalServerError, err)
+		}
+		if len(sessions) > 0 {
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+
 	status, err := LogoutAccount(ctx, ath.Realm, ath.ClientID)
 	if err != nil {
 		return api.ErrorResponse(c, status, err)
@@ -244,13 +263,346 @@ func GetAuthorizationEndpoint(c echo.Context) error {
 	// make sure we have a known default scope and no one sneaks something in
 	req.Scope = authenticationProvider().Options().Scope
 
-	ath, status, err := ExchangeToken(ctx, req, authenticationProvider().Options().AuthorizationExpiration, c.Request().RemoteAddr)
+	req.UserAgent = c.Request().UserAgent()
+
+	opts := authenticationProvider().Options()
+	ath, status, err := ExchangeToken(ctx, req, opts.AuthorizationExpiration, opts.AccessTokenExpiration, c.Request().RemoteAddr)
 	if status != http.StatusOK {
 		return api.ErrorResponse(c, status, err)
 	}
 
 	req.Token = ath.Token
+	req.OTP = ""
 	req.ClientID = ath.ClientID
+	req.RefreshToken = ath.RefreshToken
+	req.Expires = ath.Expires
+	req.SessionID = ath.SessionID
 
 	return api.StandardResponse(c, status, req)
 }
+
+// RefreshTokenEndpoint exchanges a refresh token for a new access token and a new refresh token.
+// Refresh tokens can only be used once, reusing one revokes all tokens issued since the login.
+//
+// POST /auth/refresh
+// status 200: success, the new tokens are in the response
+// status 400: missing refresh token
+// status 401: the refresh token is unknown, expired, revoked or was used before
+func RefreshTokenEndpoint(c echo.Context) error {
+	var req RefreshRequest
+	ctx := platform.NewHttpContext(c.Request())
+
+	if err := c.Bind(&req); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+
+	accessExpires := authenticationProvider().Options().AccessTokenExpiration
+	if accessExpires <= 0 {
+		accessExpires = DefaultAccessTokenExpiration
+	}
+
+	ath, status, err := RefreshAuthorization(ctx, req.RefreshToken, accessExpires)
+	if status != http.StatusOK {
+		return api.ErrorResponse(c, status, err)
+	}
+
+	resp := AuthorizationRequest{
+		Realm:        ath.Realm,
+		UserID:       ath.UserID,
+		ClientID:     ath.ClientID,
+		Token:        ath.Token,
+		Scope:        ath.Scope,
+		RefreshToken: ath.RefreshToken,
+		Expires:      ath.Expires,
+		SessionID:    ath.SessionID,
+	}
+	return api.StandardResponse(c, status, &resp)
+}
+
+// ListSessionsEndpoint returns the sessions of the caller, most recently used first.
+// The session of the request is marked as current.
+//
+// GET /auth/sessions
+// status 200: success, the sessions are in the response
+// status 401: missing or invalid token
+func ListSessionsEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	sessions, err := ListSessions(ctx, ath.Realm, ath.ClientID)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	for _, s := range sessions {
+		s.Current = s.ID == ath.SessionID
+	}
+
+	return api.StandardResponse(c, http.StatusOK, sessions)
+}
+
+// RevokeSessionEndpoint ends one session of the caller
+//
+// DELETE /auth/sessions/:id
+// status 204: the session was ended
+// status 401: missing or invalid token
+// status 404: the caller has no such session
+func RevokeSessionEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	if err := RevokeSession(ctx, ath.Realm, ath.ClientID, c.Param("id")); err != nil {
+		if err == ErrNoSuchEntity {
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RevokeSessionsEndpoint ends all sessions of the caller. With ?others=true, the session of the request stays valid.
+//
+// DELETE /auth/sessions
+// status 204: the sessions were ended
+// status 401: missing or invalid token
+func RevokeSessionsEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	if c.QueryParam("others") != "true" {
+		status, err := LogoutAccount(ctx, ath.Realm, ath.ClientID)
+		if err != nil {
+			return api.ErrorResponse(c, status, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if _, err := RevokeSessions(ctx, ath.Realm, ath.ClientID, ath.SessionID); err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// EnrollMFAEndpoint creates a new TOTP secret for the caller's account. MFA is enabled with the first code
+// of the authenticator app, see ConfirmMFAEndpoint.
+//
+// POST /auth/mfa
+// status 201: success, the secret and the otpauth URI are in the response
+// status 401: missing or invalid token
+// status 403: only users can enroll
+// status 409: MFA is already enabled
+func EnrollMFAEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	if ath.TokenType != UserTokenType {
+		return api.ErrorResponse(c, http.StatusForbidden, ErrNotAuthorized)
+	}
+
+	enrollment, err := EnrollMFA(ctx, ath.Realm, ath.ClientID, ath.UserID)
+	if err != nil {
+		if err == ErrMFAEnabled {
+			return api.ErrorResponse(c, http.StatusConflict, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusCreated, enrollment)
+}
+
+// ConfirmMFAEndpoint enables MFA of the caller's account with a code of the authenticator app.
+// The recovery codes are only returned once.
+//
+// POST /auth/mfa/confirm
+// status 200: success, the recovery codes are in the response
+// status 400: invalid request data
+// status 401: missing or invalid token, or a wrong code
+// status 409: MFA is already enabled
+func ConfirmMFAEndpoint(c echo.Context) error {
+	var req MFARequest
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+
+	codes, err := ConfirmMFA(ctx, ath.Realm, ath.ClientID, req.Code)
+	if err != nil {
+		switch err {
+		case ErrInvalidMFACode, ErrMFANotEnabled:
+			return api.ErrorResponse(c, http.StatusUnauthorized, err)
+		case ErrMFAEnabled:
+			return api.ErrorResponse(c, http.StatusConflict, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusOK, &MFARecoveryCodes{Codes: codes})
+}
+
+// DisableMFAEndpoint removes the second factor of the caller's account, a valid code or recovery code is required
+//
+// DELETE /auth/mfa
+// status 204: MFA is disabled
+// status 400: invalid request data
+// status 401: missing or invalid token, or a wrong code
+// status 404: MFA is not enabled
+func DisableMFAEndpoint(c echo.Context) error {
+	var req MFARequest
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+
+	if err := DisableMFA(ctx, ath.Realm, ath.ClientID, req.Code); err != nil {
+		switch err {
+		case ErrInvalidMFACode:
+			return api.ErrorResponse(c, http.StatusUnauthorized, err)
+		case ErrMFANotEnabled:
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// MountAPIKeys adds the API key management routes to e. All routes require the admin scope.
+func MountAPIKeys(e *echo.Echo) {
+	g := e.Group(APIKeyPath, RequireScope(ScopeAPIAdmin))
+
+	g.POST("", CreateAPIKeyEndpoint)
+	g.GET("", ListAPIKeysEndpoint)
+	g.DELETE("/:id", RevokeAPIKeyEndpoint)
+	g.POST("/:id/rotate", RotateAPIKeyEndpoint)
+}
+
+// CreateAPIKeyEndpoint creates an API key in the realm of the caller. The key can't have scopes the caller
+// was not granted itself. The secret is only returned once.
+//
+// POST /apikeys
+// status 201: the key was created, the secret is in the response
+// status 400: invalid name, scope or token type
+// status 401: not authorized
+// status 403: the caller was not granted the requested scope
+func CreateAPIKeyEndpoint(c echo.Context) error {
+	var req APIKeyRequest
+
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+	if err := c.Bind(&req); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Name == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+	if req.Scope == "" {
+		req.Scope = ScopeAPIRead
+	}
+	if err := CheckAPIKeyScope(p.Realm, strings.Join(p.Scopes, ","), req.Scope); err != nil {
+		return api.ErrorResponse(c, http.StatusForbidden, err)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	k, err := CreateAPIKey(ctx, p.Realm, p.ClientID, &req)
+	if err != nil {
+		if err == ErrInvalidTokenType {
+			return api.ErrorResponse(c, http.StatusBadRequest, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusCreated, k)
+}
+
+// ListAPIKeysEndpoint returns the API keys of the caller's realm, without their secrets
+//
+// GET /apikeys
+// status 200: success
+// status 401: not authorized
+func ListAPIKeysEndpoint(c echo.Context) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	keys, err := ListAPIKeys(ctx, p.Realm)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusOK, keys)
+}
+
+// RevokeAPIKeyEndpoint revokes an API key
+//
+// DELETE /apikeys/:id
+// status 204: the key was revoked
+// status 401: not authorized
+// status 404: unknown key
+func RevokeAPIKeyEndpoint(c echo.Context) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	if _, err := RevokeAPIKey(ctx, p.Realm, c.Param("id")); err != nil {
+		if err == ErrNoSuchEntity {
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RotateAPIKeyEndpoint replaces the secret of an API key. The new secret is only returned once.
+//
+// POST /apikeys/:id/rotate
+// status 200: success, the new secret is in the response
+// status 401: not authorized
+// status 404: unknown or revoked key
+func RotateAPIKeyEndpoint(c echo.Context) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	k, err := RotateAPIKey(ctx, p.Realm, c.Param("id"))
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusOK, k)
+}
@@ -0,0 +1,43 @@
+package authentication
+
+import (
+	"context"
+
+	"github.com/txsvc/platform/v2"
+)
+
+const (
+	// topics of the authorization lifecycle events
+	TopicLogin   = "authorization.login"
+	TopicLogout  = "authorization.logout"
+	TopicRevoked = "authorization.revoked"
+)
+
+type (
+	// AuthorizationEvent is the payload of all authorization lifecycle events. It never contains the token.
+	AuthorizationEvent struct {
+		Realm     string `json:"realm"`
+		ClientID  string `json:"client_id"`
+		UserID    string `json:"user_id"`
+		TokenType string `json:"token_type"`
+		Scope     string `json:"scope"`
+		SessionID string `json:"session_id,omitempty"`
+		LoginFrom string `json:"login_from,omitempty"`
+	}
+)
+
+// PublishAuthorizationEvent publishes an event about auth on topic. Events are fire-and-forget, errors are only reported.
+func PublishAuthorizationEvent(ctx context.Context, topic string, auth *Authorization, loginFrom string) {
+	e := AuthorizationEvent{
+		Realm:     auth.Realm,
+		ClientID:  auth.ClientID,
+		UserID:    auth.UserID,
+		TokenType: auth.TokenType,
+		Scope:     auth.Scope,
+		SessionID: auth.SessionID,
+		LoginFrom: loginFrom,
+	}
+	if err := platform.Publish(ctx, topic, &e, "realm", auth.Realm); err != nil {
+		platform.ReportError(err)
+	}
+}
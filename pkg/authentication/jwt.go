@@ -0,0 +1,406 @@
+package authentication
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	mcache "github.com/OrlovEvgeny/go-mcache"
+
+	"github.com/txsvc/platform/v2"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/env"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/scheduler"
+	"github.com/txsvc/platform/v2/pkg/tasks"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreRevokedTokens collection REVOKED_TOKENS
+	datastoreRevokedTokens string = "REVOKED_TOKENS"
+
+	// DefaultKeyID is the 'kid' of the signing key configured from the environment
+	DefaultKeyID = "default"
+	// revocationCacheTTL is how long the DatastoreRevocationList caches a revoked token
+	revocationCacheTTL = time.Minute
+	// RevocationDelay is how long the DatastoreRevocationList caches a token that is not revoked. A token revoked on
+	// another instance is accepted for at most this time.
+	RevocationDelay = 30 * time.Second
+
+	// RevocationCleanupTask is the name of the task and job that delete expired tokens from the revocation list
+	RevocationCleanupTask = "revoked-tokens-cleanup"
+	// DefaultRevocationCleanup is the schedule of the RevocationCleanupTask, every day at 3am
+	DefaultRevocationCleanup = "0 3 * * *"
+
+	// maxDeleteBatch is the number of entities the datastore deletes in one call
+	maxDeleteBatch = 500
+)
+
+type (
+	// JWTConfig enables JWT access tokens. Without a config, opaque tokens are issued.
+	JWTConfig struct {
+		// Issuer is the 'iss' claim
+		Issuer string
+		// Key signs new tokens. Leave it empty to use the signing keys of the KeyManager.
+		Key *jwt.Key
+		// KeyManager provides rotating signing keys if Key is empty
+		KeyManager *KeyManager
+		// Keys returns the keys that verify tokens, Key or the keys of the KeyManager if nil
+		Keys jwt.Keyfunc
+		// Revocations lists revoked tokens that are not expired yet, a DatastoreRevocationList if nil
+		Revocations RevocationList
+	}
+
+	// RevocationList keeps the IDs ('jti') of revoked tokens until they expire
+	RevocationList interface {
+		Revoke(ctx context.Context, tokenID string, expires int64) error
+		IsRevoked(ctx context.Context, tokenID string) (bool, error)
+		// DeleteExpired removes the tokens that expired anyways and returns their number
+		DeleteExpired(ctx context.Context) (int, error)
+	}
+
+	// MemoryRevocationList is a RevocationList for a single instance, e.g. for tests
+	MemoryRevocationList struct {
+		mu      sync.Mutex
+		revoked map[string]int64
+	}
+
+	// DatastoreRevocationList keeps revoked tokens in the datastore and caches lookups. A revocation takes effect
+	// at once on the instance that revoked the token, and after at most RevocationDelay on all other instances.
+	DatastoreRevocationList struct {
+		cache *mcache.CacheDriver
+	}
+
+	revokedToken struct {
+		Expires int64
+	}
+)
+
+var (
+	jwtConf     *JWTConfig
+	jwtConfOnce sync.Once
+	jwtMutex    sync.RWMutex
+
+	// Interface guards
+	_ RevocationList = (*MemoryRevocationList)(nil)
+	_ RevocationList = (*DatastoreRevocationList)(nil)
+)
+
+// ConfigureJWT enables JWT access tokens, use nil to issue opaque tokens
+func ConfigureJWT(conf *JWTConfig) {
+	jwtConfOnce.Do(func() {}) // don't read the environment later on
+
+	if conf != nil {
+		conf.setDefaults()
+	}
+
+	jwtMutex.Lock()
+	defer jwtMutex.Unlock()
+	jwtConf = conf
+}
+
+// jwtConfig returns the current config. On first use, the config is read from the environment:
+// JWT_PRIVATE_KEY_FILE (a PEM encoded RSA or Ed25519 key), JWT_SIGNING_KEY (a HS256 secret) or
+// JWT_SIGNING_ALG (managed keys, rotated every JWT_KEY_ROTATION_DAYS), JWT_KEY_ID and JWT_ISSUER.
+// Returns nil if JWTs are not enabled.
+func jwtConfig() *JWTConfig {
+	jwtConfOnce.Do(func() {
+		conf, err := jwtConfigFromEnv()
+		if err != nil {
+			platform.ReportError(err)
+			return
+		}
+		if conf != nil {
+			conf.setDefaults()
+		}
+		jwtMutex.Lock()
+		jwtConf = conf
+		jwtMutex.Unlock()
+	})
+
+	jwtMutex.RLock()
+	defer jwtMutex.RUnlock()
+	return jwtConf
+}
+
+func jwtConfigFromEnv() (*JWTConfig, error) {
+	var key *jwt.Key
+	var err error
+
+	kid := env.GetString("JWT_KEY_ID", DefaultKeyID)
+	if path := env.GetString("JWT_PRIVATE_KEY_FILE", ""); path != "" {
+		data, rerr := ioutil.ReadFile(path)
+		if rerr != nil {
+			return nil, rerr
+		}
+		key, err = jwt.ParsePrivateKey(kid, data)
+	} else if secret := env.GetString("JWT_SIGNING_KEY", ""); secret != "" {
+		key, err = jwt.NewHS256Key(kid, []byte(secret))
+	} else if alg := env.GetString("JWT_SIGNING_ALG", ""); alg != "" {
+		km := NewKeyManager(KeyManagerConfig{
+			Alg:              alg,
+			RotationInterval: time.Duration(env.GetInt("JWT_KEY_ROTATION_DAYS", 0)) * 24 * time.Hour,
+		})
+		return &JWTConfig{
+			Issuer:     env.GetString("JWT_ISSUER", ""),
+			KeyManager: km,
+		}, nil
+	} else {
+		return nil, nil // JWTs are not enabled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTConfig{
+		Issuer: env.GetString("JWT_ISSUER", ""),
+		Key:    key,
+	}, nil
+}
+
+func (conf *JWTConfig) setDefaults() {
+	if conf.Keys == nil {
+		if conf.Key != nil {
+			conf.Keys = jwt.NewKeySet(conf.Key).Lookup
+		} else if conf.KeyManager != nil {
+			conf.Keys = conf.KeyManager.Lookup
+		}
+	}
+	if conf.Revocations == nil {
+		conf.Revocations = NewDatastoreRevocationList()
+	}
+}
+
+// signingKey returns the key that signs new tokens
+func (conf *JWTConfig) signingKey(ctx context.Context) (*jwt.Key, error) {
+	if conf.Key != nil {
+		return conf.Key, nil
+	}
+	if conf.KeyManager != nil {
+		return conf.KeyManager.SigningKey(ctx)
+	}
+	return nil, jwt.ErrInvalidKey
+}
+
+// issueToken creates a new token for auth, a JWT if enabled or an opaque token otherwise.
+// A JWT that was issued before is revoked.
+func issueToken(ctx context.Context, auth *Authorization) error {
+	conf := jwtConfig()
+	if conf == nil {
+		auth.Token = CreateSimpleToken()
+		auth.TokenID = ""
+		return nil
+	}
+
+	if err := revokeToken(ctx, auth); err != nil {
+		return err
+	}
+
+	jti, err := id.SimpleUUID()
+	if err != nil {
+		return err
+	}
+	claims := jwt.Claims{
+		Issuer:          conf.Issuer,
+		Subject:         auth.UserID,
+		IssuedAt:        timestamp.Now(),
+		ExpiresAt:       auth.Expires,
+		ID:              jti,
+		Realm:           auth.Realm,
+		ClientID:        auth.ClientID,
+		Scope:           auth.Scope,
+		TokenType:       auth.TokenType,
+		SessionID:       auth.SessionID,
+		AuthorizedParty: auth.OAuthClient,
+	}
+	key, err := conf.signingKey(ctx)
+	if err != nil {
+		return err
+	}
+	token, err := jwt.Sign(&claims, key)
+	if err != nil {
+		return err
+	}
+
+	auth.Token = token
+	auth.TokenID = jti
+	return nil
+}
+
+// revokeToken adds the JWT of auth, if any, to the revocation list. Other instances may accept the token
+// for up to RevocationDelay, see DatastoreRevocationList.
+func revokeToken(ctx context.Context, auth *Authorization) error {
+	conf := jwtConfig()
+	if conf == nil || auth.TokenID == "" {
+		return nil
+	}
+	return conf.Revocations.Revoke(ctx, auth.TokenID, auth.Expires)
+}
+
+// verifyJWT checks the signature, expiry and revocation of token and returns the authorization
+// described by its claims. Returns ErrNotAuthorized if the token is not valid.
+func verifyJWT(ctx context.Context, conf *JWTConfig, token string) (*Authorization, error) {
+	claims, err := jwt.Parse(token, conf.Keys)
+	if err != nil {
+		return nil, ErrNotAuthorized
+	}
+	if conf.Issuer != "" && claims.Issuer != conf.Issuer {
+		return nil, ErrNotAuthorized
+	}
+
+	if claims.ID != "" {
+		revoked, err := conf.Revocations.IsRevoked(ctx, claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrNotAuthorized
+		}
+	}
+
+	return &Authorization{
+		ClientID:    claims.ClientID,
+		Realm:       claims.Realm,
+		Token:       token,
+		TokenID:     claims.ID,
+		TokenType:   claims.TokenType,
+		SessionID:   claims.SessionID,
+		OAuthClient: claims.AuthorizedParty,
+		UserID:      claims.Subject,
+		Scope:       claims.Scope,
+		Expires:     claims.ExpiresAt,
+		Created:     claims.IssuedAt,
+	}, nil
+}
+
+// NewMemoryRevocationList creates an empty revocation list
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{
+		revoked: make(map[string]int64),
+	}
+}
+
+func (l *MemoryRevocationList) Revoke(ctx context.Context, tokenID string, expires int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// forget tokens that expired anyways
+	now := timestamp.Now()
+	for t, exp := range l.revoked {
+		if exp < now {
+			delete(l.revoked, t)
+		}
+	}
+	l.revoked[tokenID] = expires
+	return nil
+}
+
+func (l *MemoryRevocationList) IsRevoked(ctx context.Context, tokenID string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.revoked[tokenID]
+	return ok, nil
+}
+
+func (l *MemoryRevocationList) DeleteExpired(ctx context.Context) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	now := timestamp.Now()
+	for t, exp := range l.revoked {
+		if exp < now {
+			delete(l.revoked, t)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// NewDatastoreRevocationList creates a revocation list backed by the datastore
+func NewDatastoreRevocationList() *DatastoreRevocationList {
+	return &DatastoreRevocationList{
+		cache: mcache.New(),
+	}
+}
+
+func (l *DatastoreRevocationList) Revoke(ctx context.Context, tokenID string, expires int64) error {
+	k := datastore.NameKey(datastoreRevokedTokens, tokenID, nil)
+	if _, err := ds.DataStore().Put(ctx, k, &revokedToken{Expires: expires}); err != nil {
+		return err
+	}
+	l.cache.Set(tokenID, true, revocationCacheTTL)
+	return nil
+}
+
+func (l *DatastoreRevocationList) IsRevoked(ctx context.Context, tokenID string) (bool, error) {
+	if revoked, ok := l.cache.Get(tokenID); ok {
+		return revoked.(bool), nil
+	}
+
+	var rt revokedToken
+	if err := ds.DataStore().Get(ctx, datastore.NameKey(datastoreRevokedTokens, tokenID, nil), &rt); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			return false, err
+		}
+		l.cache.Set(tokenID, false, RevocationDelay)
+		return false, nil
+	}
+
+	l.cache.Set(tokenID, true, revocationCacheTTL)
+	return true, nil
+}
+
+func (l *DatastoreRevocationList) DeleteExpired(ctx context.Context) (int, error) {
+	q := datastore.NewQuery(datastoreRevokedTokens).Filter("Expires <", timestamp.Now()).KeysOnly()
+	keys, err := ds.DataStore().GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(keys); i += maxDeleteBatch {
+		j := i + maxDeleteBatch
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if err := ds.DataStore().DeleteMulti(ctx, keys[i:j]); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// DeleteExpiredRevocations removes the expired tokens from the revocation list of the current JWT config
+func DeleteExpiredRevocations(ctx context.Context) (int, error) {
+	conf := jwtConfig()
+	if conf == nil {
+		return 0, nil
+	}
+	return conf.Revocations.DeleteExpired(ctx)
+}
+
+// ScheduleRevocationCleanup registers the RevocationCleanupTask with r and adds a job to s that runs it
+// every time the cron expression spec fires, DefaultRevocationCleanup if empty.
+func ScheduleRevocationCleanup(s *scheduler.Scheduler, r *tasks.Registry, spec string) error {
+	if spec == "" {
+		spec = DefaultRevocationCleanup
+	}
+
+	err := r.Register(RevocationCleanupTask, func(ctx context.Context, _ *struct{}) error {
+		_, err := DeleteExpiredRevocations(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	task, err := r.Task(RevocationCleanupTask, nil)
+	if err != nil {
+		return err
+	}
+	return s.Add(RevocationCleanupTask, spec, task)
+}
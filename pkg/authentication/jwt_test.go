@@ -0,0 +1,142 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/scheduler"
+	"github.com/txsvc/platform/v2/pkg/tasks"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+	"github.com/txsvc/platform/v2/provider/local"
+)
+
+func configureTestJWT(t *testing.T) *JWTConfig {
+	key, err := jwt.NewHS256Key("test", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+
+	conf := JWTConfig{
+		Issuer:      "platform-test",
+		Key:         key,
+		Revocations: NewMemoryRevocationList(),
+	}
+	ConfigureJWT(&conf)
+	t.Cleanup(func() { ConfigureJWT(nil) })
+
+	return &conf
+}
+
+func checkToken(token, scope string) (*Authorization, error) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	return CheckAuthorization(context.Background(), c, scope)
+}
+
+func TestIssueAndCheckJWT(t *testing.T) {
+	configureTestJWT(t)
+	ctx := context.Background()
+
+	auth := Authorization{
+		ClientID:  "client",
+		Realm:     realm,
+		TokenType: DefaultTokenType,
+		UserID:    userID,
+		Scope:     DefaultScope,
+		Expires:   timestamp.Now() + 3600,
+	}
+	require.NoError(t, issueToken(ctx, &auth))
+	assert.True(t, jwt.IsJWT(auth.Token))
+	assert.NotEmpty(t, auth.TokenID)
+
+	checked, err := checkToken(auth.Token, ScopeAPIWrite)
+	require.NoError(t, err)
+	assert.Equal(t, auth.ClientID, checked.ClientID)
+	assert.Equal(t, auth.Realm, checked.Realm)
+	assert.Equal(t, auth.UserID, checked.UserID)
+	assert.Equal(t, auth.Scope, checked.Scope)
+	assert.Equal(t, auth.Expires, checked.Expires)
+
+	_, err = checkToken(auth.Token, ScopeAPIAdmin)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	// issuing a new token revokes the old one
+	old := auth.Token
+	require.NoError(t, issueToken(ctx, &auth))
+	_, err = checkToken(old, ScopeAPIRead)
+	assert.Equal(t, ErrNotAuthorized, err)
+	_, err = checkToken(auth.Token, ScopeAPIRead)
+	assert.NoError(t, err)
+
+	require.NoError(t, revokeToken(ctx, &auth))
+	_, err = checkToken(auth.Token, ScopeAPIRead)
+	assert.Equal(t, ErrNotAuthorized, err)
+}
+
+func TestCheckInvalidJWT(t *testing.T) {
+	conf := configureTestJWT(t)
+
+	expired, _ := jwt.Sign(&jwt.Claims{Issuer: conf.Issuer, Realm: realm, Scope: DefaultScope, ExpiresAt: timestamp.Now() - 3600}, conf.Key)
+	_, err := checkToken(expired, ScopeAPIRead)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	issuer, _ := jwt.Sign(&jwt.Claims{Issuer: "someone-else", Realm: realm, Scope: DefaultScope, ExpiresAt: timestamp.Now() + 3600}, conf.Key)
+	_, err = checkToken(issuer, ScopeAPIRead)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	other, _ := jwt.NewHS256Key("test", []byte("abcdef0123456789abcdef0123456789"))
+	forged, _ := jwt.Sign(&jwt.Claims{Issuer: conf.Issuer, Realm: realm, Scope: ScopeAPIAdmin, ExpiresAt: timestamp.Now() + 3600}, other)
+	_, err = checkToken(forged, ScopeAPIRead)
+	assert.Equal(t, ErrNotAuthorized, err)
+}
+
+func TestIssueOpaqueToken(t *testing.T) {
+	ConfigureJWT(nil)
+
+	auth := Authorization{Realm: realm, ClientID: "client"}
+	require.NoError(t, issueToken(context.Background(), &auth))
+	assert.False(t, jwt.IsJWT(auth.Token))
+	assert.Empty(t, auth.TokenID)
+}
+
+func TestRevocationCleanup(t *testing.T) {
+	ctx := context.Background()
+	conf := configureTestJWT(t)
+
+	now := timestamp.Now()
+	require.NoError(t, conf.Revocations.Revoke(ctx, "expired", now-10))
+	require.NoError(t, conf.Revocations.Revoke(ctx, "active", now+3600))
+
+	q := local.NewLocalTaskProvider(local.TaskQueueConfig{Workers: 1})
+	defer q.Close()
+	r := tasks.New(tasks.Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+	s := scheduler.New(scheduler.Config{Provider: q})
+
+	require.NoError(t, ScheduleRevocationCleanup(s, r, ""))
+	next, ok := s.Next(RevocationCleanupTask)
+	require.True(t, ok)
+	assert.Equal(t, 3, next.Hour())
+
+	require.NoError(t, s.Run(ctx, next.Add(time.Second)))
+	q.Wait()
+
+	revoked, _ := conf.Revocations.IsRevoked(ctx, "expired")
+	assert.False(t, revoked)
+	revoked, _ = conf.Revocations.IsRevoked(ctx, "active")
+	assert.True(t, revoked)
+
+	n, err := DeleteExpiredRevocations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
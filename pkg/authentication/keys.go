@@ -0,0 +1,542 @@
+package authentication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreSigningKeys collection SIGNING_KEYS
+	datastoreSigningKeys string = "SIGNING_KEYS"
+
+	// DefaultSigningAlg is the algorithm of generated signing keys
+	DefaultSigningAlg = jwt.RS256
+	// DefaultKeyRotation is the lifetime of a signing key
+	DefaultKeyRotation = 30 * 24 * time.Hour
+	// DefaultKeyRefresh is the interval used by Start to reload and rotate the keys
+	DefaultKeyRefresh = time.Hour
+	// DefaultKeyPublication is the time a new key is published before it signs tokens, the time clients may cache the JWKS
+	DefaultKeyPublication = jwksMaxAge
+
+	// minKeyReload limits the reloads triggered by tokens with an unknown key ID
+	minKeyReload = time.Minute
+	// jwksMaxAge is the time clients may cache the JWKS document
+	jwksMaxAge = 5 * time.Minute
+)
+
+type (
+	// SigningKey is a stored signing key. A key is published when it is created, signs tokens from Activates
+	// until it is retired, and verifies tokens until it expires.
+	SigningKey struct {
+		ID        string
+		Alg       string
+		Private   []byte `datastore:",noindex"` // see jwt.MarshalPrivateKey
+		Created   int64
+		Activates int64 // 0 = the key signs tokens once it is created
+		Retired   int64 // 0 = the key is used to sign tokens
+		Expires   int64 // 0 = never
+	}
+
+	// KeyStore persists signing keys
+	KeyStore interface {
+		ListKeys(ctx context.Context) ([]*SigningKey, error)
+		PutKey(ctx context.Context, k *SigningKey) error
+		DeleteKey(ctx context.Context, id string) error
+	}
+
+	// DatastoreKeyStore keeps signing keys in the datastore
+	DatastoreKeyStore struct {
+	}
+
+	// MemoryKeyStore keeps signing keys in memory, e.g. for tests
+	MemoryKeyStore struct {
+		mu   sync.Mutex
+		keys map[string]*SigningKey
+	}
+
+	// KeyManagerConfig configures a KeyManager
+	KeyManagerConfig struct {
+		// Store persists the keys, a DatastoreKeyStore if nil
+		Store KeyStore
+		// Alg of new keys, DefaultSigningAlg if empty
+		Alg string
+		// RotationInterval is the time a key signs tokens, DefaultKeyRotation if 0
+		RotationInterval time.Duration
+		// PublicationPeriod is the time the next key is published before it signs tokens, DefaultKeyPublication if 0.
+		// It should not be shorter than the time clients cache the JWKS.
+		PublicationPeriod time.Duration
+		// VerificationPeriod is the time a retired key still verifies tokens. It should not be shorter
+		// than the lifetime of a token, DefaultAuthorizationExpiration if 0.
+		VerificationPeriod time.Duration
+	}
+
+	// KeyManager generates, rotates and loads signing keys. The current key signs new tokens,
+	// all keys that are not expired verify tokens. The next key is published PublicationPeriod
+	// before the current key is due, and replaces it once it is activated.
+	KeyManager struct {
+		conf KeyManagerConfig
+
+		mu        sync.RWMutex
+		current   *jwt.Key
+		activated int64 // of the current key
+		next      int64 // activation of the next key, 0 = none
+		keys      jwt.KeySet
+		loaded    time.Time
+
+		refresh sync.Mutex // serializes Refresh and Rotate
+		stop    chan struct{}
+		done    chan struct{}
+	}
+)
+
+var (
+	// Interface guards
+	_ KeyStore = (*DatastoreKeyStore)(nil)
+	_ KeyStore = (*MemoryKeyStore)(nil)
+)
+
+// NewKeyManager creates a key manager. Keys are loaded or generated on first use.
+func NewKeyManager(conf KeyManagerConfig) *KeyManager {
+	if conf.Store == nil {
+		conf.Store = &DatastoreKeyStore{}
+	}
+	if conf.Alg == "" {
+		conf.Alg = DefaultSigningAlg
+	}
+	if conf.RotationInterval <= 0 {
+		conf.RotationInterval = DefaultKeyRotation
+	}
+	if conf.PublicationPeriod <= 0 {
+		conf.PublicationPeriod = DefaultKeyPublication
+	}
+	if conf.VerificationPeriod <= 0 {
+		conf.VerificationPeriod = DefaultAuthorizationExpiration * 24 * time.Hour
+	}
+
+	return &KeyManager{
+		conf: conf,
+		keys: make(jwt.KeySet),
+	}
+}
+
+// SigningKey returns the current signing key, rotating it if it is due
+func (m *KeyManager) SigningKey(ctx context.Context) (*jwt.Key, error) {
+	m.mu.RLock()
+	current, activated, next := m.current, m.activated, m.next
+	m.mu.RUnlock()
+
+	if current != nil && !m.due(activated, next) {
+		return current, nil
+	}
+	if err := m.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current, nil
+}
+
+// Lookup returns the key that verifies tokens with key ID kid. Unknown key IDs trigger a reload,
+// at most once a minute, to pick up keys rotated by other instances.
+func (m *KeyManager) Lookup(kid string) (*jwt.Key, bool) {
+	m.mu.RLock()
+	k, ok := m.keys[kid]
+	stale := time.Since(m.loaded) > minKeyReload
+	m.mu.RUnlock()
+
+	if ok || !stale {
+		return k, ok
+	}
+	if _, err := m.load(context.Background()); err != nil {
+		platform.ReportError(err)
+		return nil, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok = m.keys[kid]
+	return k, ok
+}
+
+// Refresh reloads the keys and removes expired keys. It publishes the next key when the current key is due
+// within PublicationPeriod, and retires the current key once the next key is activated.
+func (m *KeyManager) Refresh(ctx context.Context) error {
+	m.refresh.Lock()
+	defer m.refresh.Unlock()
+
+	stored, err := m.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	current, activated, next := m.current, m.activated, m.next
+	m.mu.RUnlock()
+
+	if current == nil {
+		return m.rotate(ctx) // nothing was published that could sign tokens
+	}
+
+	// retire the keys replaced by the current key
+	now := timestamp.Now()
+	for _, sk := range stored {
+		if sk.Retired == 0 && sk.ID != current.ID && !after(sk, activated, current.ID) {
+			m.retire(sk, now)
+			if err := m.conf.Store.PutKey(ctx, sk); err != nil {
+				return err
+			}
+		}
+	}
+
+	if next == 0 && m.due(activated, next) {
+		// the next key is published at least PublicationPeriod before it signs tokens
+		activates := activated + int64(m.conf.RotationInterval/time.Second)
+		if min := now + int64(m.conf.PublicationPeriod/time.Second); activates < min {
+			activates = min
+		}
+		if _, err := m.newKey(ctx, activates); err != nil {
+			return err
+		}
+		_, err = m.load(ctx)
+		return err
+	}
+	return nil
+}
+
+// Rotate creates a new signing key and retires all other keys at once, e.g. if a key was compromised.
+// Retired keys verify tokens for the VerificationPeriod. Clients that cached the JWKS don't know the new key
+// for up to 5 minutes, scheduled rotations by Refresh publish the next key ahead of time instead.
+func (m *KeyManager) Rotate(ctx context.Context) error {
+	m.refresh.Lock()
+	defer m.refresh.Unlock()
+
+	return m.rotate(ctx)
+}
+
+// JWKS returns the public keys that verify tokens. HS256 keys are never published.
+func (m *KeyManager) JWKS() *jwt.JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.keys.JWKS()
+}
+
+// Mount adds the JWKS endpoint to e
+func (m *KeyManager) Mount(e *echo.Echo) {
+	e.GET(jwt.JWKSPath, m.JWKSEndpoint)
+}
+
+// JWKSEndpoint serves the public keys as JWKS document.
+//
+// GET /.well-known/jwks.json
+// status 200: success
+// status 500: the keys could not be loaded
+func (m *KeyManager) JWKSEndpoint(c echo.Context) error {
+	m.mu.RLock()
+	loaded := !m.loaded.IsZero()
+	m.mu.RUnlock()
+
+	if !loaded {
+		if err := m.Refresh(platform.NewHttpContext(c.Request())); err != nil {
+			return api.ErrorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", jwksCacheControl())
+	return api.StandardResponse(c, http.StatusOK, m.JWKS())
+}
+
+// JWKSEndpoint serves the public keys of the current JWT config, see ConfigureJWT.
+// Mount it on jwt.JWKSPath.
+//
+// GET /.well-known/jwks.json
+// status 200: success, the key set is empty if JWTs are not enabled
+// status 500: the keys could not be loaded
+func JWKSEndpoint(c echo.Context) error {
+	conf := jwtConfig()
+	if conf == nil {
+		return api.StandardResponse(c, http.StatusOK, &jwt.JWKS{Keys: []jwt.JWK{}})
+	}
+	if conf.Key == nil && conf.KeyManager != nil {
+		return conf.KeyManager.JWKSEndpoint(c)
+	}
+
+	ks := make(jwt.KeySet)
+	if conf.Key != nil {
+		ks[conf.Key.ID] = conf.Key
+	}
+	c.Response().Header().Set("Cache-Control", jwksCacheControl())
+	return api.StandardResponse(c, http.StatusOK, ks.JWKS())
+}
+
+// Start refreshes the keys every interval in the background, DefaultKeyRefresh if interval is 0
+func (m *KeyManager) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultKeyRefresh
+	}
+
+	m.mu.Lock()
+	if m.stop != nil {
+		m.mu.Unlock()
+		return // already running
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	stop, done := m.stop, m.done
+	m.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := m.Refresh(context.Background()); err != nil {
+				platform.ReportError(err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the background refresh
+func (m *KeyManager) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Close stops the background refresh
+func (m *KeyManager) Close() error {
+	m.Stop()
+	return nil
+}
+
+// due reports whether the keys must be refreshed: the next key is activated,
+// or there is no next key and the current key is due within PublicationPeriod
+func (m *KeyManager) due(activated, next int64) bool {
+	now := time.Now()
+	if next != 0 {
+		return !time.Unix(next, 0).After(now)
+	}
+	return time.Unix(activated, 0).Add(m.conf.RotationInterval - m.conf.PublicationPeriod).Before(now)
+}
+
+// load reads all keys from the store and deletes expired keys. The current key is the latest activated key
+// that is not retired. It returns the keys that were not deleted.
+func (m *KeyManager) load(ctx context.Context) ([]*SigningKey, error) {
+	stored, err := m.conf.Store.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := timestamp.Now()
+	keys := make(jwt.KeySet)
+	valid := make([]*SigningKey, 0, len(stored))
+	var current *jwt.Key
+	var activated, next int64
+
+	for _, sk := range stored {
+		if sk.Expires != 0 && sk.Expires < now {
+			if err := m.conf.Store.DeleteKey(ctx, sk.ID); err != nil {
+				platform.ReportError(err)
+			}
+			continue
+		}
+
+		k, err := jwt.UnmarshalPrivateKey(sk.ID, sk.Alg, sk.Private)
+		if err != nil {
+			platform.ReportError(err)
+			continue
+		}
+		keys[k.ID] = k
+		valid = append(valid, sk)
+
+		if sk.Retired != 0 {
+			continue
+		}
+		if activates := sk.activates(); activates > now {
+			if next == 0 || activates < next {
+				next = activates
+			}
+		} else if current == nil || after(sk, activated, current.ID) {
+			current, activated = k, activates
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys = keys
+	m.current = current
+	m.activated = activated
+	m.next = next
+	m.loaded = time.Now()
+	return valid, nil
+}
+
+// rotate creates a signing key that is activated at once, and retires all other keys
+func (m *KeyManager) rotate(ctx context.Context) error {
+	stored, err := m.conf.Store.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := timestamp.Now()
+	sk, err := m.newKey(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	// retire all other signing keys, including keys created concurrently by other instances
+	for _, other := range stored {
+		if other.Retired == 0 && other.ID != sk.ID {
+			m.retire(other, now)
+			if err := m.conf.Store.PutKey(ctx, other); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = m.load(ctx)
+	return err
+}
+
+// newKey generates and stores a key that signs tokens from activates on
+func (m *KeyManager) newKey(ctx context.Context, activates int64) (*SigningKey, error) {
+	kid, err := id.ShortUUID()
+	if err != nil {
+		return nil, err
+	}
+	k, err := jwt.GenerateKey(kid, m.conf.Alg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := jwt.MarshalPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+
+	sk := SigningKey{ID: kid, Alg: k.Alg, Private: data, Created: timestamp.Now(), Activates: activates}
+	if err := m.conf.Store.PutKey(ctx, &sk); err != nil {
+		return nil, err
+	}
+	return &sk, nil
+}
+
+// retire stops sk from signing tokens, it verifies tokens for the VerificationPeriod
+func (m *KeyManager) retire(sk *SigningKey, now int64) {
+	sk.Retired = now
+	sk.Expires = now + int64(m.conf.VerificationPeriod/time.Second)
+}
+
+// activates returns the time the key signs tokens from
+func (sk *SigningKey) activates() int64 {
+	if sk.Activates == 0 {
+		return sk.Created
+	}
+	return sk.Activates
+}
+
+// after reports whether sk was activated after the key with activation time activated and key ID kid.
+// Keys activated at the same time are ordered by ID, so that all instances pick the same current key.
+func after(sk *SigningKey, activated int64, kid string) bool {
+	if a := sk.activates(); a != activated {
+		return a > activated
+	}
+	return sk.ID > kid
+}
+
+func jwksCacheControl() string {
+	return fmt.Sprintf("public, max-age=%d", int(jwksMaxAge/time.Second))
+}
+
+func (s *DatastoreKeyStore) ListKeys(ctx context.Context) ([]*SigningKey, error) {
+	var keys []*SigningKey
+
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreSigningKeys), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *DatastoreKeyStore) PutKey(ctx context.Context, k *SigningKey) error {
+	_, err := ds.DataStore().Put(ctx, datastore.NameKey(datastoreSigningKeys, k.ID, nil), k)
+	return err
+}
+
+func (s *DatastoreKeyStore) DeleteKey(ctx context.Context, id string) error {
+	return ds.DataStore().Delete(ctx, datastore.NameKey(datastoreSigningKeys, id, nil))
+}
+
+// NewMemoryKeyStore creates an empty key store
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: make(map[string]*SigningKey),
+	}
+}
+
+// ListKeys returns the keys ordered by activation, creation and ID
+func (s *MemoryKeyStore) ListKeys(ctx context.Context) ([]*SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*SigningKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		cp := *k
+		keys = append(keys, &cp)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := keys[i].activates(), keys[j].activates(); a != b {
+			return a < b
+		}
+		if keys[i].Created != keys[j].Created {
+			return keys[i].Created < keys[j].Created
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (s *MemoryKeyStore) PutKey(ctx context.Context, k *SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := *k
+	s.keys[k.ID] = &cp
+	return nil
+}
+
+func (s *MemoryKeyStore) DeleteKey(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, id)
+	return nil
+}
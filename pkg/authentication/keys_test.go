@@ -0,0 +1,188 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+// storedKey returns the stored key with key ID kid
+func storedKey(t *testing.T, store KeyStore, kid string) *SigningKey {
+	keys, err := store.ListKeys(context.Background())
+	require.NoError(t, err)
+	for _, k := range keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	require.Failf(t, "missing key", "key %s is not stored", kid)
+	return nil
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryKeyStore()
+	m := NewKeyManager(KeyManagerConfig{Store: store, Alg: jwt.EdDSA})
+
+	k1, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.EdDSA, k1.Alg)
+
+	k, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Same(t, k1, k)
+
+	token, err := jwt.Sign(&jwt.Claims{Subject: "user"}, k1)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Rotate(ctx))
+	k2, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, k1.ID, k2.ID)
+
+	// the retired key still verifies tokens
+	_, err = jwt.Parse(token, m.Lookup)
+	assert.NoError(t, err)
+	assert.Len(t, m.JWKS().Keys, 2)
+
+	keys, _ := store.ListKeys(ctx)
+	require.Len(t, keys, 2)
+	retired := storedKey(t, store, k1.ID)
+	assert.NotZero(t, retired.Retired)
+	assert.NotZero(t, retired.Expires)
+	assert.Zero(t, storedKey(t, store, k2.ID).Retired)
+
+	// expired keys are removed
+	retired.Expires = timestamp.Now() - 1
+	require.NoError(t, store.PutKey(ctx, retired))
+	require.NoError(t, m.Refresh(ctx))
+	_, ok := m.Lookup(k1.ID)
+	assert.False(t, ok)
+	keys, _ = store.ListKeys(ctx)
+	assert.Len(t, keys, 1)
+}
+
+func TestKeyRotationIsDue(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryKeyStore()
+	m := NewKeyManager(KeyManagerConfig{Store: store, Alg: jwt.EdDSA, RotationInterval: time.Hour})
+
+	k1, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+
+	// age the key, the next key is published but does not sign tokens yet
+	current := storedKey(t, store, k1.ID)
+	current.Activates -= 3600
+	require.NoError(t, store.PutKey(ctx, current))
+	require.NoError(t, m.Refresh(ctx))
+
+	k, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, k1.ID, k.ID)
+	assert.Len(t, m.JWKS().Keys, 2)
+
+	keys, _ := store.ListKeys(ctx)
+	require.Len(t, keys, 2)
+	var next *SigningKey
+	for _, sk := range keys {
+		if sk.ID != k1.ID {
+			next = sk
+		}
+	}
+	require.NotNil(t, next)
+	assert.Zero(t, next.Retired)
+	assert.GreaterOrEqual(t, next.Activates, timestamp.Now()+int64(DefaultKeyPublication/time.Second))
+	_, ok := m.Lookup(next.ID)
+	assert.True(t, ok)
+
+	// the next key signs tokens once it is activated, the current key is retired
+	next.Activates = timestamp.Now() - 1
+	require.NoError(t, store.PutKey(ctx, next))
+	require.NoError(t, m.Refresh(ctx))
+
+	k2, err := m.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, next.ID, k2.ID)
+
+	keys, _ = store.ListKeys(ctx)
+	require.Len(t, keys, 2)
+	assert.NotZero(t, storedKey(t, store, k1.ID).Retired)
+	assert.Zero(t, storedKey(t, store, next.ID).Retired)
+
+	// nothing to do until the next key is due
+	require.NoError(t, m.Refresh(ctx))
+	keys, _ = store.ListKeys(ctx)
+	assert.Len(t, keys, 2)
+
+	// HS256 keys are never published
+	hs := NewKeyManager(KeyManagerConfig{Store: NewMemoryKeyStore(), Alg: jwt.HS256})
+	_, err = hs.SigningKey(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, hs.JWKS().Keys)
+}
+
+func TestKeysSharedByInstances(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryKeyStore()
+	m1 := NewKeyManager(KeyManagerConfig{Store: store, Alg: jwt.EdDSA})
+	m2 := NewKeyManager(KeyManagerConfig{Store: store, Alg: jwt.EdDSA})
+
+	k, err := m1.SigningKey(ctx)
+	require.NoError(t, err)
+	token, _ := jwt.Sign(&jwt.Claims{Subject: "user"}, k)
+
+	// m2 has never loaded its keys, the unknown key ID triggers a reload
+	_, err = jwt.Parse(token, m2.Lookup)
+	assert.NoError(t, err)
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	m := NewKeyManager(KeyManagerConfig{Store: NewMemoryKeyStore(), Alg: jwt.RS256})
+	e := echo.New()
+	m.Mount(e)
+
+	req := httptest.NewRequest(http.MethodGet, jwt.JWKSPath, nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var jwks jwt.JWKS
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "RSA", jwks.Keys[0].Kty)
+
+	// tokens verify with the published keys
+	k, err := m.SigningKey(context.Background())
+	require.NoError(t, err)
+	token, _ := jwt.Sign(&jwt.Claims{Subject: "user"}, k)
+	_, err = jwt.Parse(token, jwks.KeySet().Lookup)
+	assert.NoError(t, err)
+}
+
+func TestIssueJWTWithKeyManager(t *testing.T) {
+	m := NewKeyManager(KeyManagerConfig{Store: NewMemoryKeyStore(), Alg: jwt.EdDSA})
+	ConfigureJWT(&JWTConfig{KeyManager: m, Revocations: NewMemoryRevocationList()})
+	t.Cleanup(func() { ConfigureJWT(nil) })
+
+	auth := Authorization{Realm: realm, ClientID: "client", Scope: DefaultScope, Expires: timestamp.Now() + 3600}
+	require.NoError(t, issueToken(context.Background(), &auth))
+
+	require.NoError(t, m.Rotate(context.Background()))
+	_, err := checkToken(auth.Token, ScopeAPIRead)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, jwt.JWKSPath, nil), rec)
+	require.NoError(t, JWKSEndpoint(c))
+	assert.Contains(t, rec.Body.String(), `"crv":"Ed25519"`)
+}
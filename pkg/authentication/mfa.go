@@ -0,0 +1,284 @@
+package authentication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+	"github.com/txsvc/platform/v2/pkg/totp"
+)
+
+const (
+	// datastoreMFA collection MFA
+	datastoreMFA string = "MFA"
+
+	// RecoveryCodes is the number of recovery codes issued when MFA is enabled
+	RecoveryCodes = 10
+	// recoveryCodeSize is the size of a recovery code in bytes
+	recoveryCodeSize = 5
+)
+
+type (
+	// MFA is the second factor of an account, a TOTP secret shared with an authenticator app.
+	// Recovery codes can be used once each if the authenticator is lost, only their hashes are stored.
+	MFA struct {
+		Realm    string
+		ClientID string
+		Secret   string `datastore:",noindex"` // base32, needed to verify codes
+		Enabled  bool
+		// LastCounter is the time step of the last accepted code, codes can't be used twice
+		LastCounter   int64
+		RecoveryCodes []string `datastore:",noindex"`
+		Created       int64
+		Updated       int64
+	}
+
+	// MFARequest carries a TOTP or recovery code
+	MFARequest struct {
+		Code string `json:"code"`
+	}
+
+	// MFARecoveryCodes are returned once, when MFA is enabled
+	MFARecoveryCodes struct {
+		Codes []string `json:"recovery_codes"`
+	}
+
+	// MFAEnrollment is the secret of a new second factor, to be added to an authenticator app
+	MFAEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"` // the otpauth URI, usually shown as a QR code
+	}
+)
+
+var (
+	// ErrMFARequired indicates a login of an account with MFA, without a code
+	ErrMFARequired = errors.New("mfa code required")
+	// ErrInvalidMFACode indicates a wrong, expired or reused code
+	ErrInvalidMFACode = errors.New("invalid mfa code")
+	// ErrMFAEnabled indicates an enrollment while MFA is already enabled
+	ErrMFAEnabled = errors.New("mfa already enabled")
+	// ErrMFANotEnabled indicates that the account has no second factor
+	ErrMFANotEnabled = errors.New("mfa not enabled")
+
+	recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// EnrollMFA creates a new TOTP secret for an account. MFA is enabled once a first code was verified, see ConfirmMFA.
+func EnrollMFA(ctx context.Context, realm, clientID, userID string) (*MFAEnrollment, error) {
+	m, err := LookupMFA(ctx, realm, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && m.Enabled {
+		return nil, ErrMFAEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp.Now()
+
+	m = &MFA{
+		Realm:    realm,
+		ClientID: clientID,
+		Secret:   secret,
+		Created:  now,
+	}
+	if err := UpdateMFA(ctx, m); err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{
+		Secret: secret,
+		URI:    totp.URI(realm, userID, secret),
+	}, nil
+}
+
+// ConfirmMFA enables the second factor of an account with the first code of the authenticator app.
+// Returns the recovery codes, they can't be retrieved later.
+func ConfirmMFA(ctx context.Context, realm, clientID, code string) ([]string, error) {
+	m, err := LookupMFA(ctx, realm, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, ErrMFANotEnabled
+	}
+	if m.Enabled {
+		return nil, ErrMFAEnabled
+	}
+
+	counter, ok := totp.Validate(m.Secret, code, time.Now(), totp.DefaultSkew)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Enabled = true
+	m.LastCounter = counter
+	m.RecoveryCodes = hashes
+	if err := UpdateMFA(ctx, m); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableMFA removes the second factor of an account, a valid code or recovery code is required
+func DisableMFA(ctx context.Context, realm, clientID, code string) error {
+	if err := VerifyMFA(ctx, realm, clientID, code); err != nil {
+		return err
+	}
+	return ds.DataStore().Delete(ctx, mfaKey(realm, clientID))
+}
+
+// MFAEnabled reports whether an account has an enabled second factor
+func MFAEnabled(ctx context.Context, realm, clientID string) (bool, error) {
+	m, err := LookupMFA(ctx, realm, clientID)
+	if err != nil {
+		return false, err
+	}
+	return m != nil && m.Enabled, nil
+}
+
+// VerifyMFA checks a TOTP code or a recovery code of an account. Codes are accepted once, a recovery code is used up.
+func VerifyMFA(ctx context.Context, realm, clientID, code string) error {
+	var result error // the transaction must not be rolled back if only the code is wrong
+	k := mfaKey(realm, clientID)
+
+	_, err := ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var m MFA
+
+		result = nil
+		if err := tx.Get(k, &m); err != nil {
+			return err
+		}
+		if !m.Enabled {
+			result = ErrMFANotEnabled
+			return nil
+		}
+
+		if counter, ok := totp.Validate(m.Secret, code, time.Now(), totp.DefaultSkew); ok {
+			if counter <= m.LastCounter {
+				result = ErrInvalidMFACode // replay
+				return nil
+			}
+			m.LastCounter = counter
+		} else if !m.useRecoveryCode(code) {
+			result = ErrInvalidMFACode
+			return nil
+		}
+
+		m.Updated = timestamp.Now()
+		_, err := tx.Put(k, &m)
+		return err
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return ErrMFANotEnabled
+		}
+		return err
+	}
+	return result
+}
+
+// LookupMFA returns the second factor of an account, or nil if there is none
+func LookupMFA(ctx context.Context, realm, clientID string) (*MFA, error) {
+	var m MFA
+
+	if err := ds.DataStore().Get(ctx, mfaKey(realm, clientID), &m); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpdateMFA writes the second factor back
+func UpdateMFA(ctx context.Context, m *MFA) error {
+	m.Updated = timestamp.Now()
+	_, err := ds.DataStore().Put(ctx, mfaKey(m.Realm, m.ClientID), m)
+	return err
+}
+
+// checkMFA enforces the second factor of acc on login. Without a code, the login can be retried. A wrong code
+// invalidates the temporary token of the account, every guess requires a new token.
+func checkMFA(ctx context.Context, acc *account.Account, code string) error {
+	enabled, err := MFAEnabled(ctx, acc.Realm, acc.ClientID)
+	if err != nil || !enabled {
+		return err
+	}
+	if code == "" {
+		return ErrMFARequired
+	}
+
+	if err := VerifyMFA(ctx, acc.Realm, acc.ClientID, code); err != nil {
+		if err != ErrInvalidMFACode {
+			return err
+		}
+		acc.SetToken("")
+		if uerr := account.UpdateAccount(ctx, acc); uerr != nil {
+			return uerr
+		}
+		return err
+	}
+	return nil
+}
+
+// useRecoveryCode removes code from the recovery codes, if it is one of them. A code that can't be hashed never matches.
+func (m *MFA) useRecoveryCode(code string) bool {
+	hash, err := account.HashToken(normalizeRecoveryCode(code))
+	if err != nil {
+		return false
+	}
+	for i, h := range m.RecoveryCodes {
+		if h == hash {
+			m.RecoveryCodes = append(m.RecoveryCodes[:i], m.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes returns new recovery codes, e.g. 'abcd-efgh', and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodes)
+	hashes := make([]string, RecoveryCodes)
+
+	b := make([]byte, recoveryCodeSize)
+	for i := range codes {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		hash, err := account.HashToken(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hash
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode removes the formatting of a recovery code as entered by a user
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func mfaKey(realm, clientID string) *datastore.Key {
+	return datastore.NameKey(datastoreMFA, namedKey(realm, clientID), nil)
+}
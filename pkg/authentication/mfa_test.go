@@ -0,0 +1,91 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/totp"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	require.NoError(t, err)
+	assert.Len(t, codes, RecoveryCodes)
+	assert.Len(t, hashes, RecoveryCodes)
+	assert.Len(t, codes[0], 9)
+	assert.NotEqual(t, codes[0], codes[1])
+
+	m := MFA{RecoveryCodes: hashes}
+	assert.True(t, m.useRecoveryCode(strings.ToUpper(codes[3])))
+	assert.False(t, m.useRecoveryCode(codes[3]))
+	assert.True(t, m.useRecoveryCode(strings.Replace(codes[0], "-", " ", 1)))
+	assert.False(t, m.useRecoveryCode(""))
+	assert.Len(t, m.RecoveryCodes, RecoveryCodes-2)
+}
+
+func TestMFALogin(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ctx := context.TODO()
+
+	acc := createUnconfirmedUser(t, 10)
+	_, _, err := ConfirmLoginChallenge(ctx, acc.Token)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.DataStore().Delete(ctx, mfaKey(accountTestRealm, acc.ClientID)) })
+
+	enrollment, err := EnrollMFA(ctx, accountTestRealm, acc.ClientID, accountTestUser)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+
+	now := totp.Counter(time.Now())
+	code, _ := totp.Code(enrollment.Secret, now)
+	recovery, err := ConfirmMFA(ctx, accountTestRealm, acc.ClientID, code)
+	require.NoError(t, err)
+	assert.Len(t, recovery, RecoveryCodes)
+
+	_, err = EnrollMFA(ctx, accountTestRealm, acc.ClientID, accountTestUser)
+	assert.Equal(t, ErrMFAEnabled, err)
+
+	login := func(otp string) (*Authorization, int, error) {
+		acc, err := account.LookupAccount(ctx, accountTestRealm, acc.ClientID)
+		require.NoError(t, err)
+		acc, err = account.ResetTemporaryToken(ctx, acc, 10)
+		require.NoError(t, err)
+		req := AuthorizationRequest{Realm: accountTestRealm, UserID: accountTestUser, Token: acc.Token, Scope: DefaultScope, OTP: otp}
+		return ExchangeToken(ctx, &req, 1, 0, "127.0.0.1")
+	}
+
+	_, status, err := login("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, ErrMFARequired, err)
+
+	// the code of the confirmation can't be used again
+	_, status, err = login(code)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, ErrInvalidMFACode, err)
+
+	auth, status, err := login(recovery[0])
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, auth.Token)
+
+	_, status, _ = login(recovery[0])
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	next, _ := totp.Code(enrollment.Secret, now+1)
+	assert.Equal(t, ErrInvalidMFACode, DisableMFA(ctx, accountTestRealm, acc.ClientID, "000000"))
+	require.NoError(t, DisableMFA(ctx, accountTestRealm, acc.ClientID, next))
+
+	enabled, err := MFAEnabled(ctx, accountTestRealm, acc.ClientID)
+	require.NoError(t, err)
+	assert.False(t, enabled)
+}
@@ -0,0 +1,605 @@
+package authentication
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreOAuthClients collection OAUTH_CLIENTS
+	datastoreOAuthClients string = "OAUTH_CLIENTS"
+	// datastoreOAuthCodes collection OAUTH_CODES
+	datastoreOAuthCodes string = "OAUTH_CODES"
+
+	// grant types
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// CodeChallengeS256 is the only supported PKCE method, see RFC 7636
+	CodeChallengeS256 = "S256"
+
+	// DefaultCodeExpiration in minutes
+	DefaultCodeExpiration = 10
+
+	// prefixes of the generated secrets
+	oauthSecretPrefix = "ocs"
+	oauthCodePrefix   = "ac"
+)
+
+type (
+	// OAuthClient is a client application registered in a realm. Public clients, e.g. single page apps or
+	// the CLI, have no secret and must use PKCE. Confidential clients authenticate with their secret.
+	OAuthClient struct {
+		ID           string   `json:"client_id"`
+		Realm        string   `json:"realm"`
+		Name         string   `json:"name"`
+		Secret       string   `json:"client_secret,omitempty" datastore:"-"` // only set when the client was registered
+		RedirectURIs []string `json:"redirect_uris,omitempty"`
+		GrantTypes   []string `json:"grant_types"`
+		Scope        string   `json:"scope"` // the scopes the client may request
+		Public       bool     `json:"public"`
+		Created      int64    `json:"created"`
+		Updated      int64    `json:"updated"`
+		// internal
+		SecretHash string `json:"-"`
+	}
+
+	// OAuthClientRequest registers a new client
+	OAuthClientRequest struct {
+		Name         string   `json:"name" binding:"required"`
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"` // default authorization_code, refresh_token
+		Scope        string   `json:"scope"`       // default api:read
+		Public       bool     `json:"public"`
+	}
+
+	// OAuthCode is an authorization code, issued to a client on behalf of a user. The code can be exchanged once.
+	OAuthCode struct {
+		Realm       string
+		Client      string // the OAuth client
+		ClientID    string // the account of the user
+		UserID      string
+		RedirectURI string
+		Scope       string
+		Challenge   string `datastore:",noindex"`
+		SessionID   string // the session started with the code
+		Used        bool
+		Expires     int64
+		Created     int64
+	}
+
+	// OAuthError is an error response as defined in RFC 6749, section 5.2
+	OAuthError struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+		Status      int    `json:"-"`
+	}
+)
+
+var (
+	// the errors of RFC 6749
+	ErrInvalidRequest          = &OAuthError{Code: "invalid_request", Status: http.StatusBadRequest}
+	ErrInvalidClient           = &OAuthError{Code: "invalid_client", Status: http.StatusUnauthorized}
+	ErrInvalidGrant            = &OAuthError{Code: "invalid_grant", Status: http.StatusBadRequest}
+	ErrInvalidScope            = &OAuthError{Code: "invalid_scope", Status: http.StatusBadRequest}
+	ErrUnauthorizedClient      = &OAuthError{Code: "unauthorized_client", Status: http.StatusBadRequest}
+	ErrUnsupportedGrantType    = &OAuthError{Code: "unsupported_grant_type", Status: http.StatusBadRequest}
+	ErrUnsupportedResponseType = &OAuthError{Code: "unsupported_response_type", Status: http.StatusBadRequest}
+	ErrAccessDenied            = &OAuthError{Code: "access_denied", Status: http.StatusForbidden}
+)
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// WithDescription returns a copy of the error with a human readable description
+func (e *OAuthError) WithDescription(desc string) *OAuthError {
+	err := *e
+	err.Description = desc
+	return &err
+}
+
+// NewOAuthClient creates a client in realm. Confidential clients get a new secret.
+func NewOAuthClient(realm string, req *OAuthClientRequest) (*OAuthClient, error) {
+	if req.Name == "" {
+		return nil, ErrInvalidRequest.WithDescription("missing name")
+	}
+	grants := req.GrantTypes
+	if len(grants) == 0 {
+		grants = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	for _, g := range grants {
+		switch g {
+		case GrantAuthorizationCode, GrantRefreshToken, GrantDeviceCode:
+		case GrantClientCredentials:
+			if req.Public {
+				return nil, ErrInvalidRequest.WithDescription("public clients can't use client credentials")
+			}
+		default:
+			return nil, ErrUnsupportedGrantType
+		}
+	}
+	for _, uri := range req.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, ErrInvalidRequest.WithDescription("invalid redirect uri")
+		}
+	}
+	scope := req.Scope
+	if scope == "" {
+		scope = ScopeAPIRead
+	}
+
+	cid, err := id.SimpleUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp.Now()
+
+	c := OAuthClient{
+		ID:           cid,
+		Realm:        realm,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   grants,
+		Scope:        ParseScopes(scope).String(),
+		Public:       req.Public,
+		Created:      now,
+		Updated:      now,
+	}
+	if c.AllowsGrant(GrantAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return nil, ErrInvalidRequest.WithDescription("missing redirect uri")
+	}
+	if !c.Public {
+		secret, err := id.RandomToken(oauthSecretPrefix)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := account.HashToken(secret)
+		if err != nil {
+			return nil, err
+		}
+		c.Secret = secret
+		c.SecretHash = hash
+	}
+	return &c, nil
+}
+
+// Authenticate verifies the secret of a confidential client. Public clients have no secret.
+func (c *OAuthClient) Authenticate(secret string) bool {
+	if c.Public {
+		return secret == ""
+	}
+	if secret == "" {
+		return false
+	}
+	hash, err := account.HashToken(secret)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.SecretHash), []byte(hash)) == 1
+}
+
+// AllowsGrant reports whether the client may use a grant type
+func (c *OAuthClient) AllowsGrant(grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// RedirectURI returns the registered redirect uri that matches uri exactly. With only one registered
+// uri, uri may be empty.
+func (c *OAuthClient) RedirectURI(uri string) (string, bool) {
+	if uri == "" {
+		if len(c.RedirectURIs) == 1 {
+			return c.RedirectURIs[0], true
+		}
+		return "", false
+	}
+	for _, r := range c.RedirectURIs {
+		if r == uri {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// RestrictScope returns the requested scopes if the client may request all of them, or the scopes of the
+// client if nothing was requested
+func (c *OAuthClient) RestrictScope(requested string) (string, error) {
+	if requested == "" {
+		return c.Scope, nil
+	}
+	if !grantsScopes(c.Realm, c.Scope, requested) {
+		return "", ErrInvalidScope
+	}
+	return ParseScopes(requested).String(), nil
+}
+
+// VerifyCodeChallenge checks a PKCE code verifier against the S256 code challenge, see RFC 7636
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 || challenge == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(codeChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// codeChallenge returns the S256 code challenge of a PKCE code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RegisterOAuthClient creates and stores a new client. The returned client contains the secret, it can't be retrieved later.
+func RegisterOAuthClient(ctx context.Context, realm string, req *OAuthClientRequest) (*OAuthClient, error) {
+	c, err := NewOAuthClient(realm, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := UpdateOAuthClient(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LookupOAuthClient retrieves a client. Client IDs are unique across realms.
+func LookupOAuthClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	var c OAuthClient
+
+	if clientID == "" {
+		return nil, nil
+	}
+	if err := ds.DataStore().Get(ctx, oauthClientKey(clientID), &c); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// UpdateOAuthClient writes the client back
+func UpdateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	c.Updated = timestamp.Now()
+	_, err := ds.DataStore().Put(ctx, oauthClientKey(c.ID), c)
+	return err
+}
+
+// ListOAuthClients returns the clients of a realm
+func ListOAuthClients(ctx context.Context, realm string) ([]*OAuthClient, error) {
+	var clients []*OAuthClient
+
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreOAuthClients).Filter("Realm =", realm), &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client of a realm, revokes the grant of its service account and ends all its sessions
+func DeleteOAuthClient(ctx context.Context, realm, clientID string) error {
+	c, err := LookupOAuthClient(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	if c == nil || c.Realm != realm {
+		return ErrNoSuchEntity
+	}
+
+	grant, err := LookupAuthorization(ctx, realm, c.ID)
+	if err != nil {
+		return err
+	}
+	if grant != nil && !grant.Revoked {
+		grant.Revoked = true
+		if err := revokeToken(ctx, grant); err != nil {
+			return err
+		}
+		if err := UpdateAuthorization(ctx, grant); err != nil {
+			return err
+		}
+		PublishAuthorizationEvent(ctx, TopicRevoked, grant, "")
+	}
+	if _, err := RevokeSessions(ctx, realm, c.ID, ""); err != nil {
+		return err
+	}
+	return ds.DataStore().Delete(ctx, oauthClientKey(c.ID))
+}
+
+// NewAuthorizationCode issues an authorization code to client c on behalf of the user of auth. The code is valid for
+// DefaultCodeExpiration minutes. With a challenge, the code can only be exchanged with the matching PKCE code verifier.
+func NewAuthorizationCode(ctx context.Context, c *OAuthClient, auth *Authorization, redirectURI, scope, challenge string) (string, error) {
+	code, err := id.RandomToken(oauthCodePrefix)
+	if err != nil {
+		return "", err
+	}
+	now := timestamp.Now()
+
+	ac := OAuthCode{
+		Realm:       c.Realm,
+		Client:      c.ID,
+		ClientID:    auth.ClientID,
+		UserID:      auth.UserID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Challenge:   challenge,
+		Expires:     timestamp.IncT(now, DefaultCodeExpiration),
+		Created:     now,
+	}
+	k, err := oauthCodeKey(code)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ds.DataStore().Put(ctx, k, &ac); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ExchangeAuthorizationCode exchanges an authorization code for a new session of the user, restricted to the
+// scopes of the code. A code that is presented twice by its client ends the session that was started with it.
+func ExchangeAuthorizationCode(ctx context.Context, c *OAuthClient, code, redirectURI, verifier, loginFrom, userAgent string) (*Authorization, error) {
+	var ac OAuthCode
+	now := timestamp.Now()
+	k, err := oauthCodeKey(code)
+	if err != nil {
+		return nil, err
+	}
+
+	// the code is only marked as used if it was presented by its client, with all its parameters
+	_, err = ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(k, &ac); err != nil {
+			return err
+		}
+		if ac.Client != c.ID {
+			return ErrInvalidGrant
+		}
+		if ac.Used {
+			return ErrTokenReused
+		}
+		if ac.Expires < now || ac.RedirectURI != redirectURI {
+			return ErrInvalidGrant
+		}
+		if ac.Challenge != "" && !VerifyCodeChallenge(verifier, ac.Challenge) {
+			return ErrInvalidGrant.WithDescription("invalid code verifier")
+		}
+		ac.Used = true
+		_, err := tx.Put(k, &ac)
+		return err
+	})
+	if err != nil {
+		switch err {
+		case datastore.ErrNoSuchEntity:
+			return nil, ErrInvalidGrant
+		case ErrTokenReused:
+			if ac.SessionID != "" {
+				if rerr := RevokeSession(ctx, ac.Realm, ac.ClientID, ac.SessionID); rerr != nil {
+					platform.ReportError(rerr)
+				}
+			}
+			return nil, ErrInvalidGrant.WithDescription("code reused")
+		}
+		return nil, err
+	}
+
+	auth, s, err := startClientSession(ctx, c, ac.Realm, ac.ClientID, ac.Scope, loginFrom, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.SessionID = s.ID
+	if _, err := ds.DataStore().Put(ctx, k, &ac); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// startClientSession starts a session of client c for the user account realm.clientID, restricted to scope.
+// The session lasts as long as a login, refresh tokens are only issued if the client may use them.
+func startClientSession(ctx context.Context, c *OAuthClient, realm, clientID, scope, loginFrom, userAgent string) (*Authorization, *Session, error) {
+	acc, err := account.LookupAccount(ctx, realm, clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if acc == nil || acc.Status != account.AccountActive {
+		return nil, nil, ErrInvalidGrant
+	}
+	grant, err := LookupAuthorization(ctx, realm, clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if grant == nil || grant.Revoked {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	now := timestamp.Now()
+	expires := authenticationProvider().Options().AuthorizationExpiration
+	if expires <= 0 {
+		expires = DefaultAuthorizationExpiration
+	}
+	accessExpires := oauthAccessExpiration()
+	grant.Expires = now + int64(expires)*86400
+	if !c.AllowsGrant(GrantRefreshToken) {
+		grant.Expires = timestamp.IncT(now, accessExpires)
+		accessExpires = 0
+	}
+
+	s := NewSession(grant, &AuthorizationRequest{Device: c.Name, UserAgent: userAgent}, loginFrom)
+	s.Client = c.ID
+	s.Scope = scope
+
+	auth, err := issueSession(ctx, grant, s, accessExpires)
+	if err != nil {
+		return nil, nil, err
+	}
+	PublishAuthorizationEvent(ctx, TopicLogin, auth, loginFrom)
+
+	return auth, s, nil
+}
+
+// ClientCredentials issues an access token to the service account of a confidential client, see RFC 6749, section 4.4.
+// No refresh token is issued, the client simply requests a new token. A revoked service account is not reinstated.
+func ClientCredentials(ctx context.Context, c *OAuthClient, scope, loginFrom string) (*Authorization, error) {
+	if c.Public || !c.AllowsGrant(GrantClientCredentials) {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, err := c.RestrictScope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := LookupAuthorization(ctx, c.Realm, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if grant != nil && grant.Revoked {
+		return nil, ErrInvalidGrant.WithDescription("service account revoked")
+	}
+	now := timestamp.Now()
+	if grant == nil {
+		grant = &Authorization{
+			ClientID:  c.ID,
+			Realm:     c.Realm,
+			TokenType: AppTokenType,
+			UserID:    c.Name,
+			Created:   now,
+		}
+	}
+	// the service account always has the scopes of the client, the grant lasts as long as the token
+	grant.Scope = c.Scope
+	grant.Expires = timestamp.IncT(now, oauthAccessExpiration())
+	grant.Updated = now
+	if err := UpdateAuthorization(ctx, grant); err != nil {
+		return nil, err
+	}
+
+	s := NewSession(grant, &AuthorizationRequest{Device: c.Name}, loginFrom)
+	s.Client = c.ID
+	s.Scope = scope
+
+	return issueSession(ctx, grant, s, 0)
+}
+
+// RefreshOAuthToken exchanges a refresh token that was issued to client c, see RefreshAuthorization
+func RefreshOAuthToken(ctx context.Context, c *OAuthClient, token string) (*Authorization, error) {
+	if !c.AllowsGrant(GrantRefreshToken) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	s, err := refreshTokenSession(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.Client != c.ID {
+		return nil, ErrInvalidGrant
+	}
+
+	auth, status, err := RefreshAuthorization(ctx, token, oauthAccessExpiration())
+	if status == http.StatusOK {
+		return auth, nil
+	}
+	if status == http.StatusInternalServerError {
+		return nil, err
+	}
+	return nil, ErrInvalidGrant
+}
+
+// IntrospectToken returns the authorization of a valid token of realm, or nil if the token is not active
+func IntrospectToken(ctx context.Context, realm, token string) (*Authorization, error) {
+	auth, err := ValidateToken(ctx, token)
+	if err != nil {
+		if err == ErrNotAuthorized {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if auth.Realm != realm {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// RevokeOAuthToken ends the session of an access or refresh token that was issued to client c, see RFC 7009.
+// Unknown tokens are ignored.
+func RevokeOAuthToken(ctx context.Context, c *OAuthClient, token string) error {
+	s, err := refreshTokenSession(ctx, token)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		auth, err := ValidateToken(ctx, token)
+		if err == ErrNotAuthorized {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if auth.SessionID == "" {
+			return nil // e.g. API keys
+		}
+		if s, err = LookupSession(ctx, auth.Realm, auth.SessionID); err != nil || s == nil {
+			return err
+		}
+	}
+
+	if s.Client != c.ID || s.Realm != c.Realm || s.Revoked {
+		return nil
+	}
+	return revokeSession(ctx, s)
+}
+
+// refreshTokenSession returns the session of a refresh token, if any
+func refreshTokenSession(ctx context.Context, token string) (*Session, error) {
+	var rt RefreshToken
+
+	k, err := refreshTokenKey(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.DataStore().Get(ctx, k, &rt); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return LookupSession(ctx, rt.Realm, rt.Family)
+}
+
+// oauthAccessExpiration returns the configured lifetime of access tokens, in minutes
+func oauthAccessExpiration() int {
+	if n := authenticationProvider().Options().AccessTokenExpiration; n > 0 {
+		return n
+	}
+	return DefaultAccessTokenExpiration
+}
+
+func oauthClientKey(clientID string) *datastore.Key {
+	return datastore.NameKey(datastoreOAuthClients, clientID, nil)
+}
+
+func oauthCodeKey(code string) (*datastore.Key, error) {
+	hash, err := account.HashToken(code)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NameKey(datastoreOAuthCodes, hash, nil), nil
+}
@@ -0,0 +1,499 @@
+package authentication
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// OAuthPath is the prefix of the OAuth 2.0 routes
+	OAuthPath = "/oauth"
+)
+
+type (
+	// TokenResponse is the response of the token endpoint, see RFC 6749, section 5.1
+	TokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Scope        string `json:"scope,omitempty"`
+	}
+
+	// DeviceApprovalRequest approves or denies the login of a device
+	DeviceApprovalRequest struct {
+		UserCode string `json:"user_code" form:"user_code"`
+		Approve  bool   `json:"approve" form:"approve"`
+	}
+
+	// IntrospectionResponse is the response of the introspection endpoint, see RFC 7662, section 2.2
+	IntrospectionResponse struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Username  string `json:"username,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		Expires   int64  `json:"exp,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		Realm     string `json:"realm,omitempty"`
+	}
+)
+
+// MountOAuth adds the OAuth 2.0 routes to e. The client management routes require the admin scope.
+func MountOAuth(e *echo.Echo) {
+	g := e.Group(OAuthPath)
+
+	g.GET("/authorize", AuthorizeEndpoint)
+	g.POST("/token", TokenEndpoint)
+	g.POST("/introspect", IntrospectEndpoint)
+	g.POST("/revoke", RevokeEndpoint)
+	g.POST("/device_authorization", DeviceAuthorizationEndpoint)
+	g.GET("/device", DeviceEndpoint)
+	g.POST("/device", ApproveDeviceEndpoint)
+
+	clients := g.Group("/clients", RequireScope(ScopeAPIAdmin))
+	clients.POST("", RegisterClientEndpoint)
+	clients.GET("", ListClientsEndpoint)
+	clients.DELETE("/:id", DeleteClientEndpoint)
+}
+
+// AuthorizeEndpoint issues an authorization code to a client on behalf of the user of the bearer token and
+// redirects back to the client, see RFC 6749, section 4.1. Public clients must use PKCE with method S256.
+//
+// GET /oauth/authorize?response_type=code&client_id=...&redirect_uri=...&scope=...&state=...&code_challenge=...&code_challenge_method=S256
+// status 302: redirect to the client with either the code or the error
+// status 400: unknown client or redirect uri
+// status 401: the user is not logged-in
+func AuthorizeEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	if c.QueryParam("client_id") == "" {
+		return oauthError(c, ErrInvalidRequest.WithDescription("missing client_id"))
+	}
+	client, err := LookupOAuthClient(ctx, c.QueryParam("client_id"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if client == nil {
+		return oauthError(c, ErrInvalidRequest.WithDescription("unknown client"))
+	}
+	redirectURI, ok := client.RedirectURI(c.QueryParam("redirect_uri"))
+	if !ok {
+		return oauthError(c, ErrInvalidRequest.WithDescription("invalid redirect_uri"))
+	}
+
+	// from here on, errors are sent to the client
+	state := c.QueryParam("state")
+	if c.QueryParam("response_type") != "code" {
+		return oauthRedirect(c, redirectURI, state, ErrUnsupportedResponseType)
+	}
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return oauthRedirect(c, redirectURI, state, ErrUnauthorizedClient)
+	}
+	challenge := c.QueryParam("code_challenge")
+	if challenge != "" && c.QueryParam("code_challenge_method") != CodeChallengeS256 {
+		return oauthRedirect(c, redirectURI, state, ErrInvalidRequest.WithDescription("code_challenge_method must be S256"))
+	}
+	if challenge == "" && client.Public {
+		return oauthRedirect(c, redirectURI, state, ErrInvalidRequest.WithDescription("code_challenge required"))
+	}
+
+	token, err := GetBearerToken(c.Request())
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	auth, err := ValidateToken(ctx, token)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	if auth.TokenType != UserTokenType || auth.Realm != client.Realm {
+		return oauthRedirect(c, redirectURI, state, ErrAccessDenied)
+	}
+
+	// the client gets at most the scopes of the user
+	scope, err := client.RestrictScope(c.QueryParam("scope"))
+	if err != nil {
+		return oauthRedirect(c, redirectURI, state, err)
+	}
+	if !grantsScopes(auth.Realm, auth.Scope, scope) {
+		return oauthRedirect(c, redirectURI, state, ErrInvalidScope)
+	}
+
+	code, err := NewAuthorizationCode(ctx, client, auth, c.QueryParam("redirect_uri"), scope, challenge)
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	q.Set("code", code)
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+
+	return c.Redirect(http.StatusFound, u.String())
+}
+
+// TokenEndpoint issues tokens for the authorization code, refresh token, client credentials and device code grants,
+// see RFC 6749, sections 4.1.3, 4.4 and 6, and RFC 8628. Clients authenticate with HTTP basic auth or the request body.
+//
+// POST /oauth/token
+// status 200: success, the tokens are in the response
+// status 400: invalid request or grant
+// status 401: unknown client or invalid client secret
+func TokenEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	grantType := c.FormValue("grant_type")
+	switch grantType {
+	case GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials, GrantDeviceCode:
+	case "":
+		return oauthError(c, ErrInvalidRequest.WithDescription("missing grant_type"))
+	default:
+		return oauthError(c, ErrUnsupportedGrantType)
+	}
+
+	client, err := authenticateClient(c)
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	var auth *Authorization
+	loginFrom := c.Request().RemoteAddr
+
+	switch grantType {
+	case GrantAuthorizationCode:
+		if !client.AllowsGrant(GrantAuthorizationCode) {
+			return oauthError(c, ErrUnauthorizedClient)
+		}
+		if c.FormValue("code") == "" {
+			return oauthError(c, ErrInvalidRequest.WithDescription("missing code"))
+		}
+		auth, err = ExchangeAuthorizationCode(ctx, client, c.FormValue("code"), c.FormValue("redirect_uri"), c.FormValue("code_verifier"), loginFrom, c.Request().UserAgent())
+	case GrantRefreshToken:
+		if c.FormValue("refresh_token") == "" {
+			return oauthError(c, ErrInvalidRequest.WithDescription("missing refresh_token"))
+		}
+		auth, err = RefreshOAuthToken(ctx, client, c.FormValue("refresh_token"))
+	case GrantClientCredentials:
+		auth, err = ClientCredentials(ctx, client, c.FormValue("scope"), loginFrom)
+	case GrantDeviceCode:
+		if c.FormValue("device_code") == "" {
+			return oauthError(c, ErrInvalidRequest.WithDescription("missing device_code"))
+		}
+		auth, err = ExchangeDeviceCode(ctx, client, c.FormValue("device_code"), loginFrom, c.Request().UserAgent())
+	}
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	resp := TokenResponse{
+		AccessToken:  auth.Token,
+		TokenType:    "Bearer",
+		RefreshToken: auth.RefreshToken,
+		Scope:        auth.Scope,
+	}
+	if auth.Expires > 0 {
+		resp.ExpiresIn = auth.Expires - timestamp.Now()
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+	return c.JSON(http.StatusOK, &resp)
+}
+
+// IntrospectEndpoint returns the state of a token of the client's realm, see RFC 7662.
+// Only confidential clients can introspect tokens.
+//
+// POST /oauth/introspect
+// status 200: success, inactive or unknown tokens are reported as not active
+// status 401: unknown client or invalid client secret
+func IntrospectEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	client, err := authenticateClient(c)
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if client.Public {
+		return oauthError(c, ErrInvalidClient)
+	}
+	if c.FormValue("token") == "" {
+		return oauthError(c, ErrInvalidRequest.WithDescription("missing token"))
+	}
+
+	auth, err := IntrospectToken(ctx, client.Realm, c.FormValue("token"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if auth == nil {
+		return c.JSON(http.StatusOK, &IntrospectionResponse{Active: false})
+	}
+
+	resp := IntrospectionResponse{
+		Active:    true,
+		Scope:     auth.Scope,
+		ClientID:  auth.OAuthClient,
+		Username:  auth.UserID,
+		TokenType: "Bearer",
+		Expires:   auth.Expires,
+		Subject:   auth.ClientID,
+		Realm:     auth.Realm,
+	}
+	if resp.ClientID == "" {
+		resp.ClientID = auth.ClientID
+	}
+	return c.JSON(http.StatusOK, &resp)
+}
+
+// RevokeEndpoint ends the session of an access or refresh token that was issued to the client, see RFC 7009
+//
+// POST /oauth/revoke
+// status 200: the token was revoked or is unknown
+// status 401: unknown client or invalid client secret
+func RevokeEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	client, err := authenticateClient(c)
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if c.FormValue("token") == "" {
+		return oauthError(c, ErrInvalidRequest.WithDescription("missing token"))
+	}
+
+	if err := RevokeOAuthToken(ctx, client, c.FormValue("token")); err != nil {
+		return oauthError(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// DeviceAuthorizationEndpoint starts the login of a device, e.g. the CLI, see RFC 8628, section 3.1.
+// The device shows the user code and polls the token endpoint until the user approved the login.
+//
+// POST /oauth/device_authorization
+// status 200: success, the device and user code are in the response
+// status 400: invalid request or scope
+// status 401: unknown client or invalid client secret
+func DeviceAuthorizationEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	client, err := authenticateClient(c)
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	resp, err := NewDeviceAuthorization(ctx, client, c.FormValue("scope"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, resp)
+}
+
+// DeviceEndpoint returns the pending device login of a user code, e.g. to show the requested scopes before
+// the user approves the login
+//
+// GET /oauth/device?user_code=...
+// status 200: success
+// status 401: not authorized
+// status 404: unknown or expired user code
+func DeviceEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	da, err := LookupDeviceAuthorization(ctx, c.QueryParam("user_code"))
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	if da == nil || da.Realm != ath.Realm {
+		return api.ErrorResponse(c, http.StatusNotFound, ErrNoSuchEntity)
+	}
+
+	da.UserCode = FormatUserCode(da.UserCode)
+	return api.StandardResponse(c, http.StatusOK, da)
+}
+
+// ApproveDeviceEndpoint approves or denies the login of a device on behalf of the caller
+//
+// POST /oauth/device
+// status 204: the device login was approved or denied
+// status 400: invalid request
+// status 401: not authorized
+// status 403: the caller was not granted the scopes requested by the device
+// status 404: unknown or expired user code
+func ApproveDeviceEndpoint(c echo.Context) error {
+	var req DeviceApprovalRequest
+	ctx := platform.NewHttpContext(c.Request())
+
+	ath, err := CheckAuthorization(ctx, c, ScopeAPIRead)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+	if err := c.Bind(&req); err != nil || req.UserCode == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+
+	if err := ApproveDevice(ctx, ath, req.UserCode, req.Approve); err != nil {
+		switch err {
+		case ErrNotAuthorized:
+			return api.ErrorResponse(c, http.StatusUnauthorized, err)
+		case ErrScopeNotGranted:
+			return api.ErrorResponse(c, http.StatusForbidden, err)
+		case ErrNoSuchEntity:
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RegisterClientEndpoint registers an OAuth client in the realm of the caller. The secret is only returned once.
+//
+// POST /oauth/clients
+// status 201: the client was registered
+// status 400: invalid request
+// status 401: not authorized
+// status 403: the caller was not granted the requested scope
+func RegisterClientEndpoint(c echo.Context) error {
+	var req OAuthClientRequest
+
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+	if err := c.Bind(&req); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Scope != "" && !grantsScopes(p.Realm, strings.Join(p.Scopes, ","), req.Scope) {
+		return api.ErrorResponse(c, http.StatusForbidden, ErrScopeNotGranted)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	client, err := RegisterOAuthClient(ctx, p.Realm, &req)
+	if err != nil {
+		if _, ok := err.(*OAuthError); ok {
+			return api.ErrorResponse(c, http.StatusBadRequest, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusCreated, client)
+}
+
+// ListClientsEndpoint returns the OAuth clients of the caller's realm, without their secrets
+//
+// GET /oauth/clients
+// status 200: success
+// status 401: not authorized
+func ListClientsEndpoint(c echo.Context) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	clients, err := ListOAuthClients(ctx, p.Realm)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusOK, clients)
+}
+
+// DeleteClientEndpoint removes an OAuth client, the tokens of its service account are revoked
+//
+// DELETE /oauth/clients/:id
+// status 204: the client was removed
+// status 401: not authorized
+// status 404: unknown client
+func DeleteClientEndpoint(c echo.Context) error {
+	p, ok := GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNotAuthorized)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	if err := DeleteOAuthClient(ctx, p.Realm, c.Param("id")); err != nil {
+		if err == ErrNoSuchEntity {
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// authenticateClient identifies the client of a request, with HTTP basic auth or client_id and client_secret in the body
+func authenticateClient(c echo.Context) (*OAuthClient, error) {
+	clientID, secret, basic := c.Request().BasicAuth()
+	if basic {
+		// RFC 6749, section 2.3.1: both are form encoded
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.FormValue("client_id")
+		secret = c.FormValue("client_secret")
+	}
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, err := LookupOAuthClient(platform.NewHttpContext(c.Request()), clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil || !client.Authenticate(secret) {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// oauthError sends an error response as defined in RFC 6749, section 5.2
+func oauthError(c echo.Context, err error) error {
+	e, ok := err.(*OAuthError)
+	if !ok {
+		platform.ReportError(err)
+		e = &OAuthError{Code: "server_error", Status: http.StatusInternalServerError}
+	}
+	if e.Status == http.StatusUnauthorized {
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(e.Status, e)
+}
+
+// oauthRedirect sends an error back to the client, see RFC 6749, section 4.1.2.1
+func oauthRedirect(c echo.Context, redirectURI, state string, err error) error {
+	e, ok := err.(*OAuthError)
+	if !ok {
+		return oauthError(c, err)
+	}
+
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	q.Set("error", e.Code)
+	if e.Description != "" {
+		q.Set("error_description", e.Description)
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+
+	return c.Redirect(http.StatusFound, u.String())
+}
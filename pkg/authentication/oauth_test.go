@@ -0,0 +1,206 @@
+package authentication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// the example of RFC 7636, appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", challenge)
+	assert.True(t, VerifyCodeChallenge(verifier, challenge))
+	assert.False(t, VerifyCodeChallenge(verifier+"x", challenge))
+	assert.False(t, VerifyCodeChallenge("short", challenge))
+	assert.False(t, VerifyCodeChallenge(verifier, ""))
+}
+
+func TestNewOAuthClient(t *testing.T) {
+	_, err := NewOAuthClient(realm, &OAuthClientRequest{RedirectURIs: []string{"https://example.com/cb"}})
+	assert.Error(t, err)
+	_, err = NewOAuthClient(realm, &OAuthClientRequest{Name: "web"})
+	assert.Error(t, err)
+	_, err = NewOAuthClient(realm, &OAuthClientRequest{Name: "web", RedirectURIs: []string{"/cb"}})
+	assert.Error(t, err)
+	_, err = NewOAuthClient(realm, &OAuthClientRequest{Name: "spa", Public: true, GrantTypes: []string{GrantClientCredentials}})
+	assert.Error(t, err)
+	_, err = NewOAuthClient(realm, &OAuthClientRequest{Name: "web", GrantTypes: []string{"password"}})
+	assert.Equal(t, ErrUnsupportedGrantType, err)
+
+	c, err := NewOAuthClient(realm, &OAuthClientRequest{Name: "web", RedirectURIs: []string{"https://example.com/cb"}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, c.ID)
+	assert.NotEmpty(t, c.Secret)
+	assert.Equal(t, ScopeAPIRead, c.Scope)
+	assert.True(t, c.AllowsGrant(GrantAuthorizationCode))
+	assert.True(t, c.AllowsGrant(GrantRefreshToken))
+	assert.False(t, c.AllowsGrant(GrantClientCredentials))
+
+	assert.True(t, c.Authenticate(c.Secret))
+	assert.False(t, c.Authenticate(""))
+	assert.False(t, c.Authenticate("ocs-wrong"))
+
+	spa, err := NewOAuthClient(realm, &OAuthClientRequest{Name: "spa", Public: true, RedirectURIs: []string{"https://example.com/a", "https://example.com/b"}})
+	require.NoError(t, err)
+	assert.Empty(t, spa.Secret)
+	assert.True(t, spa.Authenticate(""))
+	assert.False(t, spa.Authenticate("secret"))
+}
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+	createActiveUser()
+
+	ctx := context.TODO()
+	acc, err := account.FindAccountByUserID(ctx, accountTestRealm, accountTestUser)
+	require.NoError(t, err)
+	auth, err := LookupAuthorization(ctx, accountTestRealm, acc.ClientID)
+	require.NoError(t, err)
+	t.Cleanup(func() { RevokeSessions(ctx, accountTestRealm, acc.ClientID, "") })
+
+	cb := "https://example.com/cb"
+	c, err := NewOAuthClient(accountTestRealm, &OAuthClientRequest{Name: "web", RedirectURIs: []string{cb}})
+	require.NoError(t, err)
+	other, err := NewOAuthClient(accountTestRealm, &OAuthClientRequest{Name: "other", RedirectURIs: []string{cb}})
+	require.NoError(t, err)
+
+	code, err := NewAuthorizationCode(ctx, c, auth, cb, DefaultScope, "")
+	require.NoError(t, err)
+
+	// failed exchanges don't use up the code
+	_, err = ExchangeAuthorizationCode(ctx, other, code, cb, "", "127.0.0.1", "test")
+	assert.Equal(t, ErrInvalidGrant, err)
+	_, err = ExchangeAuthorizationCode(ctx, c, code, "https://example.com/other", "", "127.0.0.1", "test")
+	assert.Equal(t, ErrInvalidGrant, err)
+
+	session, err := ExchangeAuthorizationCode(ctx, c, code, cb, "", "127.0.0.1", "test")
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.SessionID)
+
+	// another client can't end the session by presenting the code again
+	_, err = ExchangeAuthorizationCode(ctx, other, code, cb, "", "127.0.0.1", "test")
+	assert.Equal(t, ErrInvalidGrant, err)
+	_, err = ValidateToken(ctx, session.Token)
+	assert.NoError(t, err)
+
+	// the client itself presenting the code twice ends the session
+	_, err = ExchangeAuthorizationCode(ctx, c, code, cb, "", "127.0.0.1", "test")
+	assert.Error(t, err)
+	_, err = ValidateToken(ctx, session.Token)
+	assert.Error(t, err)
+}
+
+func TestClientCredentialsRevoked(t *testing.T) {
+	ctx := context.TODO()
+
+	c, err := NewOAuthClient(realm, &OAuthClientRequest{Name: "backend", GrantTypes: []string{GrantClientCredentials}})
+	require.NoError(t, err)
+	defer DeleteAuthorization(ctx, c.Realm, c.ID)
+
+	_, err = ClientCredentials(ctx, c, "", "")
+	require.NoError(t, err)
+
+	grant, err := LookupAuthorization(ctx, c.Realm, c.ID)
+	require.NoError(t, err)
+	require.NotNil(t, grant)
+	assert.NotZero(t, grant.Expires) // the grant expires with its token
+	grant.Revoked = true
+	require.NoError(t, UpdateAuthorization(ctx, grant))
+
+	// a revoked service account is not reinstated
+	_, err = ClientCredentials(ctx, c, "", "")
+	if assert.IsType(t, &OAuthError{}, err) {
+		assert.Equal(t, ErrInvalidGrant.Code, err.(*OAuthError).Code)
+	}
+	grant, err = LookupAuthorization(ctx, c.Realm, c.ID)
+	require.NoError(t, err)
+	assert.True(t, grant.Revoked)
+}
+
+func TestDeleteOAuthClientRevokesGrant(t *testing.T) {
+	ctx := context.TODO()
+
+	c, err := NewOAuthClient(realm, &OAuthClientRequest{Name: "backend", GrantTypes: []string{GrantClientCredentials}})
+	require.NoError(t, err)
+	require.NoError(t, UpdateOAuthClient(ctx, c))
+	defer DeleteAuthorization(ctx, c.Realm, c.ID)
+
+	auth, err := ClientCredentials(ctx, c, "", "")
+	require.NoError(t, err)
+
+	require.NoError(t, DeleteOAuthClient(ctx, c.Realm, c.ID))
+	grant, err := LookupAuthorization(ctx, c.Realm, c.ID)
+	require.NoError(t, err)
+	assert.True(t, grant.Revoked)
+	_, err = ValidateToken(ctx, auth.Token)
+	assert.Error(t, err)
+}
+
+func TestOAuthClientRedirectURI(t *testing.T) {
+	c := OAuthClient{RedirectURIs: []string{"https://example.com/cb"}}
+
+	uri, ok := c.RedirectURI("")
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/cb", uri)
+	_, ok = c.RedirectURI("https://example.com/cb")
+	assert.True(t, ok)
+	_, ok = c.RedirectURI("https://example.com/cb/../evil")
+	assert.False(t, ok)
+
+	c.RedirectURIs = append(c.RedirectURIs, "https://example.com/other")
+	_, ok = c.RedirectURI("")
+	assert.False(t, ok)
+}
+
+func TestOAuthClientRestrictScope(t *testing.T) {
+	c := OAuthClient{Realm: realm, Scope: "api:read,api:write"}
+
+	scope, err := c.RestrictScope("")
+	require.NoError(t, err)
+	assert.Equal(t, c.Scope, scope)
+
+	scope, err = c.RestrictScope("api:read")
+	require.NoError(t, err)
+	assert.Equal(t, "api:read", scope)
+
+	_, err = c.RestrictScope("api:admin")
+	assert.Equal(t, ErrInvalidScope, err)
+}
+
+func TestTokenEndpointGrantType(t *testing.T) {
+	form := url.Values{"grant_type": {"password"}, "username": {"me"}, "password": {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, OAuthPath+"/token", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, TokenEndpoint(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unsupported_grant_type")
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+}
+
+func TestAuthorizeEndpointMissingClient(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, OAuthPath+"/authorize?response_type=code&redirect_uri=https%3A%2F%2Fevil.example.com", nil)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, AuthorizeEndpoint(echo.New().NewContext(req, rec)))
+	// never redirect to an unverified uri
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, rec.Header().Get(echo.HeaderLocation))
+}
@@ -0,0 +1,480 @@
+package authentication
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreExternalLogins collection EXTERNAL_LOGINS
+	datastoreExternalLogins string = "EXTERNAL_LOGINS"
+
+	// SlackIssuer is the issuer of 'Sign in with Slack'
+	SlackIssuer = "https://slack.com"
+
+	// oidcDiscoveryPath is appended to the issuer to find the configuration of a provider
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	// oidcTimeout limits the requests to a provider
+	oidcTimeout = 10 * time.Second
+)
+
+type (
+	// IdentityProvider authenticates users with an external service, e.g. an OpenID Connect provider
+	IdentityProvider interface {
+		// Name identifies the provider in the login routes, e.g. 'slack'
+		Name() string
+		// AuthCodeURL returns the URL that starts the login at the provider
+		AuthCodeURL(state, nonce, challenge string) string
+		// Exchange redeems the authorization code of the callback and returns the verified identity of the user
+		Exchange(ctx context.Context, code, nonce, verifier string) (*ExternalIdentity, error)
+	}
+
+	// ExternalIdentity is a user authenticated by an IdentityProvider
+	ExternalIdentity struct {
+		Provider      string
+		Subject       string // unique per provider
+		Email         string
+		EmailVerified bool
+		Name          string
+	}
+
+	// OIDCConfig configures an OpenID Connect provider
+	OIDCConfig struct {
+		Name         string
+		Issuer       string // the provider's configuration is discovered from the issuer
+		ClientID     string
+		ClientSecret string
+		RedirectURL  string       // the callback route, e.g. https://api.example.com/login/oidc/slack/callback
+		Scopes       []string     // default openid, email and profile
+		HTTPClient   *http.Client // a client with a short timeout if nil
+	}
+
+	// OIDCProvider implements the OpenID Connect authorization code flow with PKCE, see
+	// https://openid.net/specs/openid-connect-core-1_0.html. ID tokens are verified with the keys of the provider.
+	OIDCProvider struct {
+		conf     OIDCConfig
+		metadata oidcMetadata
+
+		mu     sync.Mutex
+		keys   jwt.KeySet
+		loaded time.Time
+	}
+
+	// ExternalLogin is a login in progress at an identity provider, see StartExternalLogin
+	ExternalLogin struct {
+		Realm    string
+		Provider string
+		Nonce    string `datastore:",noindex"`
+		Verifier string `datastore:",noindex"` // the PKCE code verifier
+		Binding  string `datastore:",noindex"` // hash of the value that ties the login to the browser that started it
+		Expires  int64
+	}
+
+	oidcMetadata struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	oidcTokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+var (
+	// ErrUnknownIdentityProvider indicates a login with a provider that was not registered
+	ErrUnknownIdentityProvider = errors.New("unknown identity provider")
+	// ErrInvalidIDToken indicates an ID token that can't be verified or was not issued for this login
+	ErrInvalidIDToken = errors.New("invalid id token")
+	// ErrInvalidLoginState indicates an unknown, expired or already completed external login
+	ErrInvalidLoginState = errors.New("invalid login state")
+
+	identityProviders   = make(map[string]IdentityProvider)
+	identityProvidersMu sync.RWMutex
+)
+
+// RegisterIdentityProvider makes an identity provider available for logins. A provider with the same name is replaced.
+func RegisterIdentityProvider(p IdentityProvider) {
+	identityProvidersMu.Lock()
+	defer identityProvidersMu.Unlock()
+
+	identityProviders[p.Name()] = p
+}
+
+// LookupIdentityProvider returns the registered identity provider name
+func LookupIdentityProvider(name string) (IdentityProvider, bool) {
+	identityProvidersMu.RLock()
+	defer identityProvidersMu.RUnlock()
+
+	p, ok := identityProviders[name]
+	return p, ok
+}
+
+// UserID returns the user ID of the account of the identity, e.g. 'slack:U0123ABC'
+func (i *ExternalIdentity) UserID() string {
+	return i.Provider + ":" + i.Subject
+}
+
+// NewOIDCProvider discovers the configuration of the provider at conf.Issuer
+func NewOIDCProvider(ctx context.Context, conf OIDCConfig) (*OIDCProvider, error) {
+	if conf.Name == "" || conf.Issuer == "" || conf.ClientID == "" || conf.RedirectURL == "" {
+		return nil, errors.New("missing identity provider configuration")
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+	if conf.HTTPClient == nil {
+		conf.HTTPClient = &http.Client{Timeout: oidcTimeout}
+	}
+
+	p := OIDCProvider{conf: conf}
+	if err := p.getJSON(ctx, strings.TrimSuffix(conf.Issuer, "/")+oidcDiscoveryPath, &p.metadata); err != nil {
+		return nil, err
+	}
+	if p.metadata.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: expected '%s', got '%s'", conf.Issuer, p.metadata.Issuer)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete configuration of issuer '%s'", conf.Issuer)
+	}
+	return &p, nil
+}
+
+// NewSlackProvider creates the provider for 'Sign in with Slack', named AuthTypeSlack
+func NewSlackProvider(ctx context.Context, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	return NewOIDCProvider(ctx, OIDCConfig{
+		Name:         AuthTypeSlack,
+		Issuer:       SlackIssuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// Name returns the name of the provider
+func (p *OIDCProvider) Name() string {
+	return p.conf.Name
+}
+
+// AuthCodeURL returns the URL of the provider's authorization endpoint
+func (p *OIDCProvider) AuthCodeURL(state, nonce, challenge string) string {
+	u, _ := url.Parse(p.metadata.AuthorizationEndpoint)
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.conf.ClientID)
+	q.Set("redirect_uri", p.conf.RedirectURL)
+	q.Set("scope", strings.Join(p.conf.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	if challenge != "" {
+		q.Set("code_challenge", challenge)
+		q.Set("code_challenge_method", CodeChallengeS256)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// Exchange redeems an authorization code at the provider's token endpoint and verifies the ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, verifier string) (*ExternalIdentity, error) {
+	form := url.Values{
+		"grant_type":   {GrantAuthorizationCode},
+		"code":         {code},
+		"redirect_uri": {p.conf.RedirectURL},
+		"client_id":    {p.conf.ClientID},
+	}
+	if verifier != "" {
+		form.Set("code_verifier", verifier)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+	}
+
+	resp, err := p.conf.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tr oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("token request failed: %d %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+
+	claims, err := p.VerifyIDToken(ctx, tr.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalIdentity{
+		Provider:      p.conf.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiration and nonce of an ID token
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, token, nonce string) (*jwt.Claims, error) {
+	if token == "" {
+		return nil, ErrInvalidIDToken
+	}
+	claims, err := jwt.Parse(token, func(kid string) (*jwt.Key, bool) { return p.key(ctx, kid) })
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Issuer != p.conf.Issuer || claims.Subject == "" || claims.ExpiresAt == 0 {
+		return nil, ErrInvalidIDToken
+	}
+	if !claims.Audience.Contains(p.conf.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.conf.ClientID {
+		return nil, ErrInvalidIDToken
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+// key returns the verification key kid. The keys are reloaded if the provider rotated its keys.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*jwt.Key, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.keys.Lookup(kid); ok {
+		return k, true
+	}
+	if time.Since(p.loaded) < minKeyReload {
+		return nil, false
+	}
+
+	var jwks jwt.JWKS
+	p.loaded = time.Now()
+	if err := p.getJSON(ctx, p.metadata.JWKSURI, &jwks); err != nil {
+		return nil, false
+	}
+	p.keys = jwks.KeySet()
+
+	return p.keys.Lookup(kid)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.conf.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// StartExternalLogin starts a login to realm with an identity provider. Returns the URL of the provider
+// the user has to be sent to, and a binding that must be kept by the user's browser, e.g. in a cookie,
+// and presented when the login is completed. The login has to be completed within the authentication expiration.
+func StartExternalLogin(ctx context.Context, realm, provider string) (string, string, error) {
+	p, ok := LookupIdentityProvider(provider)
+	if !ok {
+		return "", "", ErrUnknownIdentityProvider
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString(48)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	login := ExternalLogin{
+		Realm:    realm,
+		Provider: provider,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Binding:  codeChallenge(binding),
+		Expires:  timestamp.IncT(timestamp.Now(), externalLoginExpiration()),
+	}
+	k, err := externalLoginKey(state)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := ds.DataStore().Put(ctx, k, &login); err != nil {
+		return "", "", err
+	}
+
+	return p.AuthCodeURL(state, nonce, codeChallenge(verifier)), binding, nil
+}
+
+// CompleteExternalLogin verifies the callback of an identity provider and starts a new session. The external
+// identity is mapped to an account by its user ID, see ExternalIdentity.UserID. New accounts are created as confirmed.
+// Accounts with MFA enabled get a new temporary token instead of a session, returned with status 401 and
+// ErrMFARequired. The login is completed by exchanging the token together with a code, see ExchangeToken.
+// The binding returned by StartExternalLogin makes sure that the login is completed by the browser that started it.
+func CompleteExternalLogin(ctx context.Context, provider, state, code, binding, loginFrom, userAgent string) (*Authorization, int, error) {
+	var login ExternalLogin
+
+	// a login can only be completed once, and only by the browser that started it
+	k, err := externalLoginKey(state)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	_, err = ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(k, &login); err != nil {
+			return err
+		}
+		if binding == "" || subtle.ConstantTimeCompare([]byte(codeChallenge(binding)), []byte(login.Binding)) != 1 {
+			return ErrInvalidLoginState
+		}
+		return tx.Delete(k)
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity || err == ErrInvalidLoginState {
+			return nil, http.StatusUnauthorized, ErrInvalidLoginState
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	if login.Provider != provider || login.Expires < timestamp.Now() {
+		return nil, http.StatusUnauthorized, ErrInvalidLoginState
+	}
+
+	p, ok := LookupIdentityProvider(provider)
+	if !ok {
+		return nil, http.StatusNotFound, ErrUnknownIdentityProvider
+	}
+	identity, err := p.Exchange(ctx, code, login.Nonce, login.Verifier)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+
+	acc, err := externalAccount(ctx, login.Realm, identity)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if acc.Status < account.AccountLoggedOut {
+		return nil, http.StatusForbidden, ErrNotAuthorized // account is blocked or deactivated etc ...
+	}
+
+	opts := authenticationProvider().Options()
+	req := AuthorizationRequest{
+		Realm:     acc.Realm,
+		UserID:    acc.UserID,
+		Scope:     opts.Scope,
+		Device:    provider,
+		UserAgent: userAgent,
+	}
+	auth, status, err := loginAccount(ctx, acc, &req, opts.AuthorizationExpiration, opts.AccessTokenExpiration, loginFrom)
+	if err == ErrMFARequired {
+		// the identity is verified, the second factor is checked when the temporary token is exchanged
+		if _, err := account.ResetTemporaryToken(ctx, acc, DefaultAuthenticationExpiration); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return &Authorization{Realm: acc.Realm, UserID: acc.UserID, ClientID: acc.ClientID, Token: acc.Token}, http.StatusUnauthorized, ErrMFARequired
+	}
+	return auth, status, err
+}
+
+// externalAccount returns the account of an external identity, a new account is created if needed.
+// The identity provider verified the user, unconfirmed accounts are confirmed.
+func externalAccount(ctx context.Context, realm string, identity *ExternalIdentity) (*account.Account, error) {
+	acc, err := account.FindAccountByUserID(ctx, realm, identity.UserID())
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		acc, err = account.CreateAccount(ctx, realm, identity.UserID(), DefaultAuthenticationExpiration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if acc.Status == account.AccountUnconfirmed {
+		acc.Confirmed = timestamp.Now()
+		acc.Expires = 0
+		acc.Status = account.AccountLoggedOut
+		acc.SetToken("")
+
+		if err := account.UpdateAccount(ctx, acc); err != nil {
+			return nil, err
+		}
+		account.PublishAccountEvent(ctx, account.TopicAccountConfirmed, acc)
+	}
+	return acc, nil
+}
+
+// randomString returns n random bytes, base64url encoded
+// externalLoginExpiration returns the time in minutes a login has to be completed in
+func externalLoginExpiration() int {
+	expires := authenticationProvider().Options().AuthenticationExpiration
+	if expires <= 0 {
+		return DefaultAuthenticationExpiration
+	}
+	return expires
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func externalLoginKey(state string) (*datastore.Key, error) {
+	hash, err := account.HashToken(state)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NameKey(datastoreExternalLogins, hash, nil), nil
+}
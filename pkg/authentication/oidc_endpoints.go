@@ -0,0 +1,119 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+)
+
+const (
+	// ExternalLoginPath is the prefix of the login routes of the identity providers, e.g. /login/oidc/slack
+	ExternalLoginPath = "/login/oidc"
+
+	// ExternalLoginCookie is the cookie that ties a login to the browser that started it
+	ExternalLoginCookie = "external_login"
+)
+
+// MountExternalLogin adds the login routes of the registered identity providers to e
+func MountExternalLogin(e *echo.Echo) {
+	g := e.Group(ExternalLoginPath)
+
+	g.GET("/:provider", ExternalLoginEndpoint)
+	g.GET("/:provider/callback", ExternalLoginCallbackEndpoint)
+}
+
+// ExternalLoginEndpoint redirects the user to an identity provider to log in to a realm
+//
+// GET /login/oidc/:provider?realm=...
+// status 302: redirect to the identity provider, the login is bound to the browser with a cookie
+// status 400: missing realm
+// status 404: unknown identity provider
+func ExternalLoginEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	realm := c.QueryParam("realm")
+	if realm == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+
+	uri, binding, err := StartExternalLogin(ctx, realm, c.Param("provider"))
+	if err != nil {
+		if err == ErrUnknownIdentityProvider {
+			return api.ErrorResponse(c, http.StatusNotFound, err)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	c.SetCookie(externalLoginCookie(c, binding, externalLoginExpiration()*60))
+	return c.Redirect(http.StatusFound, uri)
+}
+
+// ExternalLoginCallbackEndpoint completes the login at an identity provider and starts a new session
+//
+// GET /login/oidc/:provider/callback?state=...&code=...
+// status 200: success, the token is in the response
+// status 400: missing state or code
+// status 401: the login failed, was completed before, has expired or was started in another browser. With MFA enabled, the response contains
+// a temporary token that is exchanged together with a code, see ExchangeToken.
+// status 403: blocked or deactivated accounts can't log in
+func ExternalLoginCallbackEndpoint(c echo.Context) error {
+	ctx := platform.NewHttpContext(c.Request())
+
+	if e := c.QueryParam("error"); e != "" {
+		return api.ErrorResponse(c, http.StatusUnauthorized, errors.New(e))
+	}
+	state := c.QueryParam("state")
+	code := c.QueryParam("code")
+	if state == "" || code == "" {
+		return api.ErrorResponse(c, http.StatusBadRequest, ErrInvalidRoute)
+	}
+
+	cookie, err := c.Cookie(ExternalLoginCookie)
+	if err != nil || cookie.Value == "" {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrInvalidLoginState)
+	}
+	c.SetCookie(externalLoginCookie(c, "", -1))
+
+	ath, status, err := CompleteExternalLogin(ctx, c.Param("provider"), state, code, cookie.Value, c.Request().RemoteAddr, c.Request().UserAgent())
+	if err == ErrMFARequired && ath != nil {
+		resp := AuthorizationRequest{
+			Realm:  ath.Realm,
+			UserID: ath.UserID,
+			Token:  ath.Token,
+		}
+		return api.StandardResponse(c, status, &resp)
+	}
+	if status != http.StatusOK {
+		return api.ErrorResponse(c, status, err)
+	}
+
+	resp := AuthorizationRequest{
+		Realm:        ath.Realm,
+		UserID:       ath.UserID,
+		ClientID:     ath.ClientID,
+		Token:        ath.Token,
+		Scope:        ath.Scope,
+		RefreshToken: ath.RefreshToken,
+		Expires:      ath.Expires,
+		SessionID:    ath.SessionID,
+	}
+	return api.StandardResponse(c, status, &resp)
+}
+
+// externalLoginCookie returns the cookie that binds a login to the browser. It is sent back on the redirect
+// from the identity provider, a negative maxAge deletes it.
+func externalLoginCookie(c echo.Context, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     ExternalLoginCookie,
+		Value:    value,
+		Path:     ExternalLoginPath,
+		MaxAge:   maxAge,
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,350 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/jwt"
+	"github.com/txsvc/platform/v2/pkg/totp"
+)
+
+const (
+	oidcTestClient   = "platform"
+	oidcTestSecret   = "secret"
+	oidcTestRedirect = "https://api.example.com/login/oidc/fake/callback"
+)
+
+// fakeOIDC is a minimal OpenID Connect provider. The token endpoint returns an ID token with the claims of the code.
+type fakeOIDC struct {
+	*httptest.Server
+	key   *jwt.Key
+	codes map[string]*jwt.Claims
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	key, err := jwt.GenerateKey("idp-1", jwt.RS256)
+	require.NoError(t, err)
+
+	f := &fakeOIDC{key: key, codes: make(map[string]*jwt.Claims)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&oidcMetadata{
+			Issuer:                f.URL,
+			AuthorizationEndpoint: f.URL + "/authorize",
+			TokenEndpoint:         f.URL + "/token",
+			JWKSURI:               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwt.NewKeySet(f.key).JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		claims, ok := f.codes[r.FormValue("code")]
+		if id != oidcTestClient || secret != oidcTestSecret || !ok || r.FormValue("redirect_uri") != oidcTestRedirect {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&oidcTokenResponse{Error: "invalid_grant"})
+			return
+		}
+		token, err := jwt.Sign(claims, f.key)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(&oidcTokenResponse{AccessToken: "at", IDToken: token})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeOIDC) claims(subject, nonce string) *jwt.Claims {
+	now := time.Now().Unix()
+	return &jwt.Claims{
+		Issuer:    f.URL,
+		Subject:   subject,
+		Audience:  jwt.Audience{oidcTestClient},
+		IssuedAt:  now,
+		ExpiresAt: now + 300,
+		Nonce:     nonce,
+		Email:     subject + "@example.com",
+	}
+}
+
+func (f *fakeOIDC) provider(t *testing.T) *OIDCProvider {
+	p, err := NewOIDCProvider(context.TODO(), OIDCConfig{
+		Name:         "fake",
+		Issuer:       f.URL,
+		ClientID:     oidcTestClient,
+		ClientSecret: oidcTestSecret,
+		RedirectURL:  oidcTestRedirect,
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := newFakeOIDC(t)
+	p := f.provider(t)
+	assert.Equal(t, "fake", p.Name())
+
+	u, err := url.Parse(p.AuthCodeURL("state", "nonce", "challenge"))
+	require.NoError(t, err)
+	assert.Equal(t, f.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	q := u.Query()
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, oidcTestClient, q.Get("client_id"))
+	assert.Equal(t, oidcTestRedirect, q.Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", q.Get("scope"))
+	assert.Equal(t, "state", q.Get("state"))
+	assert.Equal(t, "nonce", q.Get("nonce"))
+	assert.Equal(t, CodeChallengeS256, q.Get("code_challenge_method"))
+
+	// the issuer must match the configuration
+	_, err = NewOIDCProvider(context.TODO(), OIDCConfig{Name: "fake", Issuer: f.URL + "/", ClientID: oidcTestClient, RedirectURL: oidcTestRedirect})
+	assert.Error(t, err)
+}
+
+func TestOIDCExchange(t *testing.T) {
+	f := newFakeOIDC(t)
+	p := f.provider(t)
+
+	f.codes["good"] = f.claims("U0123", "n-1")
+	identity, err := p.Exchange(context.TODO(), "good", "n-1", "")
+	require.NoError(t, err)
+	assert.Equal(t, "fake", identity.Provider)
+	assert.Equal(t, "U0123", identity.Subject)
+	assert.Equal(t, "fake:U0123", identity.UserID())
+	assert.Equal(t, "U0123@example.com", identity.Email)
+
+	// replayed ID token of another login
+	_, err = p.Exchange(context.TODO(), "good", "n-2", "")
+	assert.Equal(t, ErrInvalidIDToken, err)
+
+	_, err = p.Exchange(context.TODO(), "unknown", "n-1", "")
+	assert.Error(t, err)
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	f := newFakeOIDC(t)
+	p := f.provider(t)
+
+	sign := func(claims *jwt.Claims, key *jwt.Key) string {
+		token, err := jwt.Sign(claims, key)
+		require.NoError(t, err)
+		return token
+	}
+
+	claims := f.claims("U0123", "n")
+	_, err := p.VerifyIDToken(context.TODO(), sign(claims, f.key), "n")
+	assert.NoError(t, err)
+
+	c := *claims
+	c.Issuer = "https://evil.example.com"
+	_, err = p.VerifyIDToken(context.TODO(), sign(&c, f.key), "n")
+	assert.Equal(t, ErrInvalidIDToken, err)
+
+	c = *claims
+	c.Audience = jwt.Audience{"other"}
+	_, err = p.VerifyIDToken(context.TODO(), sign(&c, f.key), "n")
+	assert.Equal(t, ErrInvalidIDToken, err)
+
+	// with several audiences, the token must be issued to the client
+	c = *claims
+	c.Audience = jwt.Audience{oidcTestClient, "other"}
+	_, err = p.VerifyIDToken(context.TODO(), sign(&c, f.key), "n")
+	assert.Equal(t, ErrInvalidIDToken, err)
+	c.AuthorizedParty = oidcTestClient
+	_, err = p.VerifyIDToken(context.TODO(), sign(&c, f.key), "n")
+	assert.NoError(t, err)
+
+	c = *claims
+	c.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	_, err = p.VerifyIDToken(context.TODO(), sign(&c, f.key), "n")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken))
+
+	// not signed by the provider
+	other, err := jwt.GenerateKey("idp-1", jwt.RS256)
+	require.NoError(t, err)
+	_, err = p.VerifyIDToken(context.TODO(), sign(claims, other), "n")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken))
+
+	// the provider rotated its keys
+	rotated, err := jwt.GenerateKey("idp-2", jwt.RS256)
+	require.NoError(t, err)
+	f.key = rotated
+	p.loaded = time.Time{}
+	_, err = p.VerifyIDToken(context.TODO(), sign(claims, rotated), "n")
+	assert.NoError(t, err)
+}
+
+func TestExternalLoginEndpoint(t *testing.T) {
+	RegisterIdentityProvider(newFakeOIDC(t).provider(t))
+
+	for _, tc := range []struct {
+		provider, query string
+		status          int
+	}{
+		{"fake", "", http.StatusBadRequest},
+		{"unknown", "?realm=test", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, ExternalLoginPath+"/"+tc.provider+tc.query, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("provider")
+		c.SetParamValues(tc.provider)
+
+		require.NoError(t, ExternalLoginEndpoint(c))
+		assert.Equal(t, tc.status, rec.Code, tc.provider)
+	}
+
+	p, ok := LookupIdentityProvider("fake")
+	assert.True(t, ok)
+	assert.Equal(t, "fake", p.Name())
+
+	// the callback is rejected without the cookie set by the login endpoint
+	req := httptest.NewRequest(http.MethodGet, ExternalLoginPath+"/fake/callback?state=state&code=code", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("provider")
+	c.SetParamValues("fake")
+
+	require.NoError(t, ExternalLoginCallbackEndpoint(c))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestExternalLoginCookie(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com"+ExternalLoginPath+"/fake", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	cookie := externalLoginCookie(c, "binding", 600)
+	assert.Equal(t, ExternalLoginCookie, cookie.Name)
+	assert.Equal(t, ExternalLoginPath, cookie.Path)
+	assert.Equal(t, 600, cookie.MaxAge)
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+}
+
+func TestExternalLogin(t *testing.T) {
+	ctx := context.TODO()
+	f := newFakeOIDC(t)
+	RegisterIdentityProvider(f.provider(t))
+
+	removeAccount := func() {
+		if acc, _ := account.FindAccountByUserID(ctx, accountTestRealm, "fake:U0123"); acc != nil {
+			RevokeSessions(ctx, accountTestRealm, acc.ClientID, "")
+			DeleteAuthorization(ctx, accountTestRealm, acc.ClientID)
+			account.DeleteAccount(ctx, accountTestRealm, acc.ClientID)
+		}
+	}
+	removeAccount()
+	t.Cleanup(removeAccount)
+
+	uri, binding, err := StartExternalLogin(ctx, accountTestRealm, "fake")
+	require.NoError(t, err)
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	state := u.Query().Get("state")
+	f.codes["code"] = f.claims("U0123", u.Query().Get("nonce"))
+
+	// the state belongs to the login with the fake provider
+	_, status, _ := CompleteExternalLogin(ctx, AuthTypeSlack, state, "code", binding, "127.0.0.1", "test")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	uri, binding, err = StartExternalLogin(ctx, accountTestRealm, "fake")
+	require.NoError(t, err)
+	u, _ = url.Parse(uri)
+	state = u.Query().Get("state")
+	f.codes["code"] = f.claims("U0123", u.Query().Get("nonce"))
+
+	// the login can only be completed by the browser that started it
+	_, status, _ = CompleteExternalLogin(ctx, "fake", state, "code", "", "127.0.0.1", "test")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	_, status, _ = CompleteExternalLogin(ctx, "fake", state, "code", binding+"x", "127.0.0.1", "test")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	auth, status, err := CompleteExternalLogin(ctx, "fake", state, "code", binding, "127.0.0.1", "test")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "fake:U0123", auth.UserID)
+	assert.NotEmpty(t, auth.SessionID)
+
+	acc, err := account.FindAccountByUserID(ctx, accountTestRealm, "fake:U0123")
+	require.NoError(t, err)
+	require.NotNil(t, acc)
+	assert.Equal(t, account.AccountActive, acc.Status)
+	assert.Greater(t, acc.Confirmed, int64(0))
+
+	ath, err := ValidateToken(ctx, auth.Token)
+	require.NoError(t, err)
+	assert.Equal(t, acc.ClientID, ath.ClientID)
+
+	// a login can't be completed twice
+	_, status, _ = CompleteExternalLogin(ctx, "fake", state, "code", binding, "127.0.0.1", "test")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestExternalLoginWithMFA(t *testing.T) {
+	ctx := context.TODO()
+	f := newFakeOIDC(t)
+	RegisterIdentityProvider(f.provider(t))
+
+	removeAccount := func() {
+		if acc, _ := account.FindAccountByUserID(ctx, accountTestRealm, "fake:U0456"); acc != nil {
+			RevokeSessions(ctx, accountTestRealm, acc.ClientID, "")
+			DeleteAuthorization(ctx, accountTestRealm, acc.ClientID)
+			ds.DataStore().Delete(ctx, mfaKey(accountTestRealm, acc.ClientID))
+			account.DeleteAccount(ctx, accountTestRealm, acc.ClientID)
+		}
+	}
+	removeAccount()
+	t.Cleanup(removeAccount)
+
+	login := func() (*Authorization, int, error) {
+		uri, binding, err := StartExternalLogin(ctx, accountTestRealm, "fake")
+		require.NoError(t, err)
+		u, _ := url.Parse(uri)
+		f.codes["code"] = f.claims("U0456", u.Query().Get("nonce"))
+		return CompleteExternalLogin(ctx, "fake", u.Query().Get("state"), "code", binding, "127.0.0.1", "test")
+	}
+
+	// the first login creates the account, then MFA is enabled
+	auth, status, err := login()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	enrollment, err := EnrollMFA(ctx, accountTestRealm, auth.ClientID, auth.UserID)
+	require.NoError(t, err)
+	now := totp.Counter(time.Now())
+	code, _ := totp.Code(enrollment.Secret, now)
+	_, err = ConfirmMFA(ctx, accountTestRealm, auth.ClientID, code)
+	require.NoError(t, err)
+
+	// the identity provider does not replace the second factor
+	challenge, status, err := login()
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, ErrMFARequired, err)
+	require.NotNil(t, challenge)
+	assert.Empty(t, challenge.SessionID)
+	assert.NotEmpty(t, challenge.Token)
+
+	// the login is completed with the temporary token and a code
+	next, _ := totp.Code(enrollment.Secret, now+1)
+	req := AuthorizationRequest{Realm: accountTestRealm, UserID: challenge.UserID, Token: challenge.Token, Scope: DefaultScope, OTP: next}
+	auth, status, err = ExchangeToken(ctx, &req, 1, 0, "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, auth.SessionID)
+}
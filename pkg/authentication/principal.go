@@ -0,0 +1,111 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+)
+
+const (
+	// PrincipalContextKey is used to store the principal in the echo context
+	PrincipalContextKey = "platform.principal"
+)
+
+type (
+	// Principal is the authenticated caller of a request
+	Principal struct {
+		Realm     string   `json:"realm"`
+		ClientID  string   `json:"client_id"`
+		UserID    string   `json:"user_id"`
+		Scopes    []string `json:"scopes"`
+		TokenType string   `json:"token_type"`
+	}
+
+	principalKey struct{}
+)
+
+// NewPrincipal creates a principal from an authorization
+func NewPrincipal(auth *Authorization) *Principal {
+	scopes := make([]string, 0)
+	for _, s := range strings.Split(auth.Scope, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return &Principal{
+		Realm:     auth.Realm,
+		ClientID:  auth.ClientID,
+		UserID:    auth.UserID,
+		Scopes:    scopes,
+		TokenType: auth.TokenType,
+	}
+}
+
+// HasScope checks if the principal was granted scope, or a scope that implies it
+func (p *Principal) HasScope(scope string) bool {
+	return hasScope(p.Realm, strings.Join(p.Scopes, ","), scope)
+}
+
+// LogValues returns the principal as key/value pairs, ready to be used with a LoggingProvider
+func (p *Principal) LogValues() []string {
+	return []string{
+		"realm", p.Realm,
+		"client_id", p.ClientID,
+		"user_id", p.UserID,
+		"token_type", p.TokenType,
+	}
+}
+
+// NewPrincipalContext returns a copy of ctx that carries principal p
+func NewPrincipalContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored in ctx, if any
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// GetPrincipal returns the principal stored in the echo context, if any
+func GetPrincipal(c echo.Context) (*Principal, bool) {
+	p, ok := c.Get(PrincipalContextKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// RequireScope returns a middleware that checks the request's authorization for scope,
+// a scope expression like "api:admin|billing:write", see ParseRequirement.
+// On success the principal is stored in the echo context and in the request's context.
+//
+// status 401: missing or invalid token, or the scope was not granted
+// status 500: the authorization could not be verified
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := platform.NewHttpContext(c.Request())
+
+			auth, err := CheckAuthorization(ctx, c, scope)
+			if err != nil {
+				if err == ErrNoToken || err == ErrNotAuthorized {
+					return api.ErrorResponse(c, http.StatusUnauthorized, err)
+				}
+				return api.ErrorResponse(c, http.StatusInternalServerError, err)
+			}
+
+			p := NewPrincipal(auth)
+			c.Set(PrincipalContextKey, p)
+			c.SetRequest(c.Request().WithContext(NewPrincipalContext(ctx, p)))
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+)
+
+func TestPrincipalContext(t *testing.T) {
+	auth := Authorization{
+		Realm:     realm,
+		ClientID:  "client",
+		UserID:    userID,
+		Scope:     "api:read, api:write",
+		TokenType: DefaultTokenType,
+	}
+	p := NewPrincipal(&auth)
+	assert.Equal(t, []string{"api:read", "api:write"}, p.Scopes)
+	assert.True(t, p.HasScope("api:write"))
+	assert.False(t, p.HasScope(ScopeAPIAdmin))
+	assert.Equal(t, 8, len(p.LogValues()))
+
+	_, ok := PrincipalFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := NewPrincipalContext(context.Background(), p)
+	p2, ok := PrincipalFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, p, p2)
+}
+
+func TestRequireScopeNoToken(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	called := false
+	h := RequireScope("api:read")(func(c echo.Context) error {
+		called = true
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	assert.NoError(t, h(c))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	_, ok := GetPrincipal(c)
+	assert.False(t, ok)
+}
+
+func TestRequireScope(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+
+	createActiveUser()
+
+	acc, err := account.FindAccountByUserID(context.TODO(), accountTestRealm, accountTestUser)
+	assert.NoError(t, err)
+	auth, err := LookupAuthorization(context.TODO(), accountTestRealm, acc.ClientID)
+	assert.NoError(t, err)
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+auth.Token)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	h := RequireScope("api:read")(func(c echo.Context) error {
+		p, ok := GetPrincipal(c)
+		if assert.True(t, ok) {
+			assert.Equal(t, acc.ClientID, p.ClientID)
+			assert.Equal(t, accountTestUser, p.UserID)
+		}
+		p2, ok := PrincipalFromContext(c.Request().Context())
+		assert.True(t, ok)
+		assert.Equal(t, p, p2)
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	assert.NoError(t, h(c))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
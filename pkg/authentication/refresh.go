@@ -0,0 +1,288 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreRefreshTokens collection REFRESH_TOKENS
+	datastoreRefreshTokens string = "REFRESH_TOKENS"
+
+	// RefreshTokenPrefix is the prefix of all refresh tokens
+	RefreshTokenPrefix = "rt"
+)
+
+type (
+	// RefreshToken can be exchanged once for a new access token and a new refresh token. All refresh tokens
+	// created from one login form a family, identified by the session ID. Presenting a refresh token twice
+	// ends the session.
+	RefreshToken struct {
+		Token    string `datastore:"-"` // only the hash of the token is used as the key
+		Family   string
+		Realm    string
+		ClientID string
+		UserID   string
+		Used     int64 // 0 = not used yet
+		Revoked  bool
+		Expires  int64 // the family expires at the same time
+		Created  int64
+	}
+
+	// RefreshRequest is the request of the refresh endpoint
+	RefreshRequest struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+)
+
+var (
+	// ErrTokenReused indicates a refresh token that was used before, the token family has been revoked
+	ErrTokenReused = errors.New("refresh token reused")
+	// ErrTokenExpired indicates an expired or revoked refresh token
+	ErrTokenExpired = errors.New("refresh token expired")
+)
+
+// NewRefreshToken creates a refresh token that starts a new family
+func NewRefreshToken(auth *Authorization, expires int64) (*RefreshToken, error) {
+	family, err := id.SimpleUUID()
+	if err != nil {
+		return nil, err
+	}
+	return newRefreshToken(family, auth, expires)
+}
+
+func newRefreshToken(family string, auth *Authorization, expires int64) (*RefreshToken, error) {
+	token, err := id.RandomToken(RefreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RefreshToken{
+		Token:    token,
+		Family:   family,
+		Realm:    auth.Realm,
+		ClientID: auth.ClientID,
+		UserID:   auth.UserID,
+		Expires:  expires,
+		Created:  timestamp.Now(),
+	}, nil
+}
+
+// checkRefreshToken decides if rt can be exchanged at time now. It returns ErrTokenReused if rt was used before.
+func checkRefreshToken(rt *RefreshToken, now int64) error {
+	if rt.Revoked {
+		return ErrTokenExpired
+	}
+	if rt.Used != 0 {
+		return ErrTokenReused
+	}
+	if rt.Expires != 0 && rt.Expires < now {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// RefreshAuthorization exchanges a refresh token for a new access token of the same session, valid for accessExpires minutes,
+// and a new refresh token of the same family. A refresh token that was used before ends the session.
+func RefreshAuthorization(ctx context.Context, token string, accessExpires int) (*Authorization, int, error) {
+	if token == "" {
+		return nil, http.StatusBadRequest, ErrNoToken
+	}
+
+	// mark the token as used, in a transaction as concurrent refreshs are a reuse
+	var rt RefreshToken
+	now := timestamp.Now()
+	k, err := refreshTokenKey(token)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	_, err = ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(k, &rt); err != nil {
+			return err
+		}
+		if err := checkRefreshToken(&rt, now); err != nil {
+			return err
+		}
+		rt.Used = now
+		_, err := tx.Put(k, &rt)
+		return err
+	})
+	if err != nil {
+		switch err {
+		case datastore.ErrNoSuchEntity:
+			return nil, http.StatusUnauthorized, ErrNotAuthorized
+		case ErrTokenExpired:
+			return nil, http.StatusUnauthorized, err
+		case ErrTokenReused:
+			if rerr := revokeTokenSession(ctx, &rt); rerr != nil {
+				platform.ReportError(rerr)
+			}
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	acc, err := account.LookupAccount(ctx, rt.Realm, rt.ClientID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if acc == nil || acc.Status != account.AccountActive {
+		return nil, http.StatusUnauthorized, ErrNotAuthorized
+	}
+	grant, err := LookupAuthorization(ctx, rt.Realm, rt.ClientID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if grant == nil || grant.Revoked {
+		return nil, http.StatusUnauthorized, ErrNotAuthorized
+	}
+	session, err := LookupSession(ctx, rt.Realm, rt.Family)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if session == nil || !session.IsValid() {
+		return nil, http.StatusUnauthorized, ErrNotAuthorized
+	}
+
+	next, err := newRefreshToken(rt.Family, grant, rt.Expires)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := putRefreshToken(ctx, next); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// the new access token replaces the one of the session
+	auth := session.authorization(grant)
+	auth.Expires = accessTokenExpires(now, accessExpires, rt.Expires)
+	if err := issueToken(ctx, auth); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	authCache.Remove(session.TokenHash)
+	if err := session.attach(auth); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	session.LastUsed = now
+	if err := UpdateSession(ctx, session); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	auth.TokenHash = session.TokenHash
+	auth.RefreshToken = next.Token
+	return auth, http.StatusOK, nil
+}
+
+// RevokeRefreshTokens revokes all refresh tokens of a client
+func RevokeRefreshTokens(ctx context.Context, realm, clientID string) error {
+	var tokens []*RefreshToken
+
+	q := datastore.NewQuery(datastoreRefreshTokens).Filter("Realm =", realm).Filter("ClientID =", clientID).Filter("Revoked =", false)
+	keys, err := ds.DataStore().GetAll(ctx, q, &tokens)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	for _, rt := range tokens {
+		rt.Revoked = true
+	}
+	_, err = ds.DataStore().PutMulti(ctx, keys, tokens)
+	return err
+}
+
+// revokeTokenSession ends the session of the family of rt, including all of its refresh tokens
+func revokeTokenSession(ctx context.Context, rt *RefreshToken) error {
+	session, err := LookupSession(ctx, rt.Realm, rt.Family)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return revokeRefreshFamily(ctx, rt.Family)
+	}
+	if session.Revoked {
+		return nil
+	}
+	if err := revokeSession(ctx, session); err != nil {
+		return err
+	}
+
+	auth, err := LookupAuthorization(ctx, rt.Realm, rt.ClientID)
+	if err != nil {
+		return err
+	}
+	if auth != nil {
+		PublishAuthorizationEvent(ctx, TopicRevoked, session.authorization(auth), "")
+	}
+	return nil
+}
+
+// revokeRefreshFamily revokes all refresh tokens of a family
+func revokeRefreshFamily(ctx context.Context, family string) error {
+	var tokens []*RefreshToken
+
+	keys, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreRefreshTokens).Filter("Family =", family), &tokens)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	for _, t := range tokens {
+		t.Revoked = true
+	}
+	_, err = ds.DataStore().PutMulti(ctx, keys, tokens)
+	return err
+}
+
+// issueRefreshToken starts the refresh token family of the session of auth, the family expires at expires
+func issueRefreshToken(ctx context.Context, auth *Authorization, expires int64) (*RefreshToken, error) {
+	rt, err := newRefreshToken(auth.SessionID, auth, expires)
+	if err != nil {
+		return nil, err
+	}
+	if err := putRefreshToken(ctx, rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// accessTokenExpires returns the expiration of an access token issued at now, valid for accessExpires
+// minutes but not longer than the login
+func accessTokenExpires(now int64, accessExpires int, loginExpires int64) int64 {
+	expires := timestamp.IncT(now, accessExpires)
+	if loginExpires != 0 && expires > loginExpires {
+		return loginExpires
+	}
+	return expires
+}
+
+func putRefreshToken(ctx context.Context, rt *RefreshToken) error {
+	k, err := refreshTokenKey(rt.Token)
+	if err != nil {
+		return err
+	}
+	_, err = ds.DataStore().Put(ctx, k, rt)
+	return err
+}
+
+func refreshTokenKey(token string) (*datastore.Key, error) {
+	hash, err := account.HashToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NameKey(datastoreRefreshTokens, hash, nil), nil
+}
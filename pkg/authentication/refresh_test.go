@@ -0,0 +1,99 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+func TestCheckRefreshToken(t *testing.T) {
+	now := timestamp.Now()
+
+	rt := RefreshToken{Expires: now + 60}
+	assert.NoError(t, checkRefreshToken(&rt, now))
+
+	rt.Used = now
+	assert.Equal(t, ErrTokenReused, checkRefreshToken(&rt, now))
+
+	rt.Revoked = true
+	assert.Equal(t, ErrTokenExpired, checkRefreshToken(&rt, now))
+
+	rt = RefreshToken{Expires: now - 1}
+	assert.Equal(t, ErrTokenExpired, checkRefreshToken(&rt, now))
+}
+
+func TestAccessTokenExpires(t *testing.T) {
+	now := timestamp.Now()
+
+	assert.Equal(t, now+3600, accessTokenExpires(now, 60, now+86400))
+	assert.Equal(t, now+1800, accessTokenExpires(now, 60, now+1800)) // not longer than the login
+	assert.Equal(t, now+3600, accessTokenExpires(now, 60, 0))
+}
+
+func TestNewRefreshToken(t *testing.T) {
+	auth := Authorization{Realm: realm, ClientID: "client", UserID: userID}
+
+	rt1, err := NewRefreshToken(&auth, 100)
+	require.NoError(t, err)
+	rt2, err := NewRefreshToken(&auth, 100)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, rt1.Token, rt2.Token)
+	assert.NotEqual(t, rt1.Family, rt2.Family)
+	assert.Equal(t, "client", rt1.ClientID)
+	assert.Equal(t, int64(100), rt1.Expires)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ctx := context.TODO()
+
+	acc := createUnconfirmedUser(t, 10)
+	_, status, err := ConfirmLoginChallenge(ctx, acc.Token)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, status)
+
+	acc, err = account.LookupAccount(ctx, accountTestRealm, acc.ClientID)
+	require.NoError(t, err)
+	acc, err = account.ResetTemporaryToken(ctx, acc, 10)
+	require.NoError(t, err)
+
+	req := AuthorizationRequest{Realm: accountTestRealm, UserID: accountTestUser, Token: acc.Token, Scope: DefaultScope}
+	auth, status, err := ExchangeToken(ctx, &req, 1, 10, "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, auth.RefreshToken)
+	assert.LessOrEqual(t, auth.Expires, timestamp.IncT(timestamp.Now(), 10))
+
+	// rotate
+	auth2, status, err := RefreshAuthorization(ctx, auth.RefreshToken, 10)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, auth.Token, auth2.Token)
+	assert.NotEqual(t, auth.RefreshToken, auth2.RefreshToken)
+
+	// reuse the first refresh token, the family and the session are revoked
+	_, status, err = RefreshAuthorization(ctx, auth.RefreshToken, 10)
+	assert.Equal(t, ErrTokenReused, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	_, status, err = RefreshAuthorization(ctx, auth2.RefreshToken, 10)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	s, err := LookupSession(ctx, accountTestRealm, auth.SessionID)
+	require.NoError(t, err)
+	assert.True(t, s.Revoked)
+
+	ath, err := FindAuthorizationByToken(ctx, auth2.Token)
+	require.NoError(t, err)
+	assert.False(t, ath.IsValid())
+}
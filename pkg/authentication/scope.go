@@ -0,0 +1,209 @@
+package authentication
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// ScopeAPIRead and ScopeAPIWrite are the default scopes, see DefaultScope
+	ScopeAPIRead  = "api:read"
+	ScopeAPIWrite = "api:write"
+
+	// ScopeWildcard as the last segment of a granted scope matches all scopes with the same prefix, e.g. api:*
+	ScopeWildcard = "*"
+	// ScopeSeparator separates the segments of a scope, e.g. api:read
+	ScopeSeparator = ":"
+)
+
+type (
+	// ScopeSet is a parsed set of granted scopes. Use Has to check a scope, not a map lookup,
+	// as it also considers wildcards.
+	ScopeSet map[string]struct{}
+
+	// ScopeHierarchy maps a scope to the scopes it implies, e.g. api:admin implies api:write.
+	// Implications are transitive.
+	ScopeHierarchy map[string][]string
+
+	// Requirement is a scope expression in disjunctive normal form: it is satisfied if all scopes
+	// of at least one alternative are granted.
+	Requirement [][]string
+)
+
+var (
+	// DefaultScopeHierarchy is used for all realms without their own hierarchy
+	DefaultScopeHierarchy = ScopeHierarchy{
+		ScopeAPIAdmin: {ScopeAPIWrite},
+		ScopeAPIWrite: {ScopeAPIRead},
+	}
+
+	realmHierarchies = make(map[string]ScopeHierarchy)
+	hierarchyMutex   sync.RWMutex
+)
+
+// ParseScopes parses a comma or space separated list of scopes
+func ParseScopes(scopes string) ScopeSet {
+	s := make(ScopeSet)
+	for _, scope := range strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || r == ' ' }) {
+		s[scope] = struct{}{}
+	}
+	return s
+}
+
+// NewScopeSet creates a set from a list of scopes
+func NewScopeSet(scopes ...string) ScopeSet {
+	s := make(ScopeSet)
+	for _, scope := range scopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			s[scope] = struct{}{}
+		}
+	}
+	return s
+}
+
+// Has reports whether scope was granted, either exactly or by a wildcard like api:* or *
+func (s ScopeSet) Has(scope string) bool {
+	if scope == "" {
+		return false // empty inputs should never evalute to true
+	}
+	if _, ok := s[scope]; ok {
+		return true
+	}
+	if _, ok := s[ScopeWildcard]; ok {
+		return true
+	}
+
+	// try all prefixes of the scope, e.g. api:billing:read matches api:billing:* and api:*
+	prefix := scope
+	for {
+		i := strings.LastIndex(prefix, ScopeSeparator)
+		if i < 0 {
+			return false
+		}
+		prefix = prefix[:i]
+		if _, ok := s[prefix+ScopeSeparator+ScopeWildcard]; ok {
+			return true
+		}
+	}
+}
+
+// Satisfies reports whether the set satisfies requirement r
+func (s ScopeSet) Satisfies(r Requirement) bool {
+	for _, alternative := range r {
+		if len(alternative) == 0 {
+			continue
+		}
+		ok := true
+		for _, scope := range alternative {
+			if !s.Has(scope) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Slice returns the scopes, sorted
+func (s ScopeSet) Slice() []string {
+	scopes := make([]string, 0, len(s))
+	for scope := range s {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// String returns the scopes as a sorted, comma separated list
+func (s ScopeSet) String() string {
+	return strings.Join(s.Slice(), ",")
+}
+
+// Expand returns a copy of s that includes all scopes implied by the scopes in s
+func (h ScopeHierarchy) Expand(s ScopeSet) ScopeSet {
+	expanded := make(ScopeSet, len(s))
+	pending := make([]string, 0, len(s))
+	for scope := range s {
+		pending = append(pending, scope)
+	}
+
+	for len(pending) > 0 {
+		scope := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if _, ok := expanded[scope]; ok {
+			continue // already seen, also protects against cycles
+		}
+		expanded[scope] = struct{}{}
+		pending = append(pending, h[scope]...)
+	}
+	return expanded
+}
+
+// RegisterScopeHierarchy sets the scope hierarchy of realm. Use nil to restore the DefaultScopeHierarchy.
+func RegisterScopeHierarchy(realm string, h ScopeHierarchy) {
+	hierarchyMutex.Lock()
+	defer hierarchyMutex.Unlock()
+
+	if h == nil {
+		delete(realmHierarchies, realm)
+		return
+	}
+	realmHierarchies[realm] = h
+}
+
+// ScopeHierarchyForRealm returns the scope hierarchy of realm
+func ScopeHierarchyForRealm(realm string) ScopeHierarchy {
+	hierarchyMutex.RLock()
+	defer hierarchyMutex.RUnlock()
+
+	if h, ok := realmHierarchies[realm]; ok {
+		return h
+	}
+	return DefaultScopeHierarchy
+}
+
+// GrantedScopes parses scopes and expands them with the scope hierarchy of realm
+func GrantedScopes(realm, scopes string) ScopeSet {
+	return ScopeHierarchyForRealm(realm).Expand(ParseScopes(scopes))
+}
+
+// AllOf creates a requirement that is satisfied if all scopes are granted
+func AllOf(scopes ...string) Requirement {
+	return Requirement{scopes}
+}
+
+// AnyOf creates a requirement that is satisfied if at least one of the requirements is satisfied
+func AnyOf(reqs ...Requirement) Requirement {
+	r := make(Requirement, 0, len(reqs))
+	for _, req := range reqs {
+		r = append(r, req...)
+	}
+	return r
+}
+
+// ParseRequirement parses a scope expression. Alternatives are separated by '|', the scopes of an
+// alternative by ',' e.g. "api:admin|billing:read,billing:write" requires either api:admin,
+// or billing:read and billing:write.
+func ParseRequirement(expr string) Requirement {
+	r := make(Requirement, 0, 1)
+	for _, alternative := range strings.Split(expr, "|") {
+		if scopes := ParseScopes(alternative); len(scopes) > 0 {
+			r = append(r, scopes.Slice())
+		}
+	}
+	return r
+}
+
+// String returns the requirement as a scope expression, see ParseRequirement
+func (r Requirement) String() string {
+	alternatives := make([]string, len(r))
+	for i, alternative := range r {
+		alternatives[i] = strings.Join(alternative, ",")
+	}
+	return strings.Join(alternatives, "|")
+}
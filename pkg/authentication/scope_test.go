@@ -0,0 +1,77 @@
+package authentication
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeSetExactMatch(t *testing.T) {
+	s := ParseScopes("api:readonly, production:build")
+
+	assert.True(t, s.Has("api:readonly"))
+	assert.False(t, s.Has("api:read"))
+	assert.False(t, s.Has("production"))
+	assert.False(t, s.Has(""))
+	assert.Equal(t, "api:readonly,production:build", s.String())
+
+	a := Authorization{Realm: realm, Scope: "api:adminx"}
+	assert.False(t, a.HasAdminScope())
+	assert.False(t, hasScope(realm, "api:readonly", ScopeAPIRead))
+}
+
+func TestScopeSetWildcard(t *testing.T) {
+	s := NewScopeSet("api:*", "billing:invoices:*")
+
+	assert.True(t, s.Has(ScopeAPIAdmin))
+	assert.True(t, s.Has("api:billing:read"))
+	assert.True(t, s.Has("billing:invoices:read"))
+	assert.False(t, s.Has("billing:read"))
+	assert.False(t, s.Has("apix:read"))
+
+	assert.True(t, NewScopeSet(ScopeWildcard).Has("anything:at:all"))
+
+	a := Authorization{Realm: realm, Scope: "api:*"}
+	assert.True(t, a.HasAdminScope())
+}
+
+func TestScopeHierarchy(t *testing.T) {
+	s := DefaultScopeHierarchy.Expand(NewScopeSet(ScopeAPIAdmin))
+	assert.True(t, s.Has(ScopeAPIWrite))
+	assert.True(t, s.Has(ScopeAPIRead))
+
+	s = DefaultScopeHierarchy.Expand(NewScopeSet(ScopeAPIWrite))
+	assert.True(t, s.Has(ScopeAPIRead))
+	assert.False(t, s.Has(ScopeAPIAdmin))
+
+	// cycles are fine
+	h := ScopeHierarchy{"a:x": {"a:y"}, "a:y": {"a:x", "a:z"}}
+	assert.Equal(t, "a:x,a:y,a:z", h.Expand(NewScopeSet("a:x")).String())
+
+	// per realm hierarchy
+	RegisterScopeHierarchy("custom", ScopeHierarchy{"project:owner": {"project:edit"}, "project:edit": {"project:view"}})
+	t.Cleanup(func() { RegisterScopeHierarchy("custom", nil) })
+
+	assert.True(t, hasScope("custom", "project:owner", "project:view"))
+	assert.False(t, hasScope("custom", ScopeAPIAdmin, ScopeAPIRead))
+	assert.True(t, hasScope(realm, ScopeAPIAdmin, ScopeAPIRead))
+
+	RegisterScopeHierarchy("custom", nil)
+	assert.True(t, hasScope("custom", ScopeAPIAdmin, ScopeAPIRead))
+}
+
+func TestRequirement(t *testing.T) {
+	r := ParseRequirement("api:admin | billing:read,billing:write")
+	assert.Equal(t, "api:admin|billing:read,billing:write", r.String())
+
+	assert.True(t, NewScopeSet(ScopeAPIAdmin).Satisfies(r))
+	assert.True(t, NewScopeSet("billing:read", "billing:write").Satisfies(r))
+	assert.False(t, NewScopeSet("billing:read").Satisfies(r))
+	assert.False(t, NewScopeSet().Satisfies(r))
+	assert.False(t, NewScopeSet(ScopeAPIAdmin).Satisfies(ParseRequirement("")))
+
+	r = AnyOf(AllOf(ScopeAPIRead, "billing:read"), AllOf(ScopeAPIAdmin))
+	assert.Equal(t, "api:read,billing:read|api:admin", r.String())
+	assert.True(t, GrantedScopes(realm, "api:write,billing:read").Satisfies(r))
+	assert.False(t, GrantedScopes(realm, "api:write").Satisfies(r))
+}
@@ -0,0 +1,225 @@
+package authentication
+
+import (
+	"context"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreSessions collection SESSIONS
+	datastoreSessions string = "SESSIONS"
+
+	// DefaultMaxSessions is the number of concurrent sessions per account if not configured otherwise
+	DefaultMaxSessions = 10
+)
+
+type (
+	// Session is one login of an account, e.g. from a browser, the CLI or an OAuth client. Each session has its own
+	// access token and refresh token family, the scope is shared by all sessions of the account and kept in its
+	// Authorization. Sessions of OAuth clients can be restricted to fewer scopes.
+	Session struct {
+		ID        string `json:"id"`
+		Realm     string `json:"realm"`
+		ClientID  string `json:"client_id"`
+		UserID    string `json:"user_id"`
+		Device    string `json:"device,omitempty"`
+		UserAgent string `json:"user_agent,omitempty"`
+		IP        string `json:"ip,omitempty"`
+		Client    string `json:"oauth_client,omitempty"`          // the OAuth client that started the session, if any
+		Scope     string `json:"scope,omitempty"`                 // restricts the granted scopes, if set
+		Current   bool   `json:"current,omitempty" datastore:"-"` // the session of the request
+		Expires   int64  `json:"expires"`                         // end of the login
+		Created   int64  `json:"created"`
+		LastUsed  int64  `json:"last_used"`
+		// internal
+		TokenHash    string `json:"-"` // keyed hash of the access token
+		TokenID      string `json:"-"` // the 'jti' claim if the access token is a JWT
+		TokenExpires int64  `json:"-"`
+		Revoked      bool   `json:"-"`
+	}
+)
+
+// NewSession creates a session for auth, started by req from loginFrom
+func NewSession(auth *Authorization, req *AuthorizationRequest, loginFrom string) *Session {
+	sid, _ := id.SimpleUUID()
+	now := timestamp.Now()
+
+	return &Session{
+		ID:        sid,
+		Realm:     auth.Realm,
+		ClientID:  auth.ClientID,
+		UserID:    auth.UserID,
+		Device:    req.Device,
+		UserAgent: req.UserAgent,
+		IP:        loginFrom,
+		Expires:   auth.Expires,
+		Created:   now,
+		LastUsed:  now,
+	}
+}
+
+// IsValid verifies that the session is not revoked and not expired
+func (s *Session) IsValid() bool {
+	if s.Revoked {
+		return false
+	}
+	return s.Expires == 0 || s.Expires >= timestamp.Now()
+}
+
+// attach makes the access token of auth the token of the session
+func (s *Session) attach(auth *Authorization) error {
+	hash, err := account.HashToken(auth.Token)
+	if err != nil {
+		return err
+	}
+	s.TokenHash = hash
+	s.TokenID = auth.TokenID
+	s.TokenExpires = auth.Expires
+	return nil
+}
+
+// authorization combines the session with the authorization of the account
+func (s *Session) authorization(auth *Authorization) *Authorization {
+	a := *auth
+	a.SessionID = s.ID
+	a.OAuthClient = s.Client
+	if s.Scope != "" {
+		a.Scope = s.Scope
+	}
+	a.TokenHash = s.TokenHash
+	a.TokenID = s.TokenID
+	a.Expires = s.TokenExpires
+	a.Revoked = auth.Revoked || s.Revoked
+	return &a
+}
+
+// LookupSession retrieves a session
+func LookupSession(ctx context.Context, realm, sessionID string) (*Session, error) {
+	var s Session
+
+	if err := ds.DataStore().Get(ctx, sessionKey(realm, sessionID), &s); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSession writes the session back
+func UpdateSession(ctx context.Context, s *Session) error {
+	_, err := ds.DataStore().Put(ctx, sessionKey(s.Realm, s.ID), s)
+	return err
+}
+
+// ListSessions returns the valid sessions of a client, most recently used first
+func ListSessions(ctx context.Context, realm, clientID string) ([]*Session, error) {
+	var sessions []*Session
+
+	q := datastore.NewQuery(datastoreSessions).Filter("Realm =", realm).Filter("ClientID =", clientID).Filter("Revoked =", false)
+	if _, err := ds.DataStore().GetAll(ctx, q, &sessions); err != nil {
+		return nil, err
+	}
+
+	valid := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.IsValid() {
+			valid = append(valid, s)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].LastUsed > valid[j].LastUsed })
+
+	return valid, nil
+}
+
+// RevokeSession ends a session of a client. Its access token and refresh tokens become invalid immediately.
+func RevokeSession(ctx context.Context, realm, clientID, sessionID string) error {
+	s, err := LookupSession(ctx, realm, sessionID)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.ClientID != clientID {
+		return ErrNoSuchEntity
+	}
+	return revokeSession(ctx, s)
+}
+
+// RevokeSessions ends all sessions of a client except the session keep, if any. Returns the number of revoked sessions.
+func RevokeSessions(ctx context.Context, realm, clientID, keep string) (int, error) {
+	sessions, err := ListSessions(ctx, realm, clientID)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range sessions {
+		if s.ID == keep {
+			continue
+		}
+		if err := revokeSession(ctx, s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// startSession stores a new session and ends the least recently used sessions of the client
+// if there would be more than max sessions
+func startSession(ctx context.Context, s *Session, max int) error {
+	sessions, err := ListSessions(ctx, s.Realm, s.ClientID)
+	if err != nil {
+		return err
+	}
+	for i := len(sessions) - 1; i >= 0 && i >= max-1; i-- {
+		if err := revokeSession(ctx, sessions[i]); err != nil {
+			return err
+		}
+	}
+	return UpdateSession(ctx, s)
+}
+
+func revokeSession(ctx context.Context, s *Session) error {
+	s.Revoked = true
+	if err := UpdateSession(ctx, s); err != nil {
+		return err
+	}
+	authCache.Remove(s.TokenHash)
+
+	if err := revokeToken(ctx, &Authorization{TokenID: s.TokenID, Expires: s.TokenExpires}); err != nil {
+		return err
+	}
+	return revokeRefreshFamily(ctx, s.ID)
+}
+
+// findSessionByToken looks for the session of an access token by the hash of the token
+func findSessionByToken(ctx context.Context, hash string) (*Session, error) {
+	var sessions []*Session
+
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreSessions).Filter("TokenHash =", hash), &sessions); err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+	return sessions[0], nil
+}
+
+// maxSessions returns the configured number of concurrent sessions per account
+func maxSessions() int {
+	if n := authenticationProvider().Options().MaxSessions; n > 0 {
+		return n
+	}
+	return DefaultMaxSessions
+}
+
+func sessionKey(realm, sessionID string) *datastore.Key {
+	return datastore.NameKey(datastoreSessions, namedKey(realm, sessionID), nil)
+}
@@ -0,0 +1,92 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/account"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+func TestSessionAuthorization(t *testing.T) {
+	now := timestamp.Now()
+	grant := Authorization{Realm: realm, ClientID: "client", Scope: DefaultScope, Expires: now + 86400}
+	req := AuthorizationRequest{Device: "cli", UserAgent: "curl/7.68.0"}
+
+	s := NewSession(&grant, &req, "127.0.0.1")
+	assert.NotEmpty(t, s.ID)
+	assert.Equal(t, "cli", s.Device)
+	assert.Equal(t, "127.0.0.1", s.IP)
+	assert.True(t, s.IsValid())
+
+	auth := grant
+	auth.Token = CreateSimpleToken()
+	auth.Expires = now + 3600
+	assert.NoError(t, s.attach(&auth))
+	hash, _ := account.HashToken(auth.Token)
+	assert.Equal(t, hash, s.TokenHash)
+
+	a := s.authorization(&grant)
+	assert.Equal(t, s.ID, a.SessionID)
+	assert.Equal(t, now+3600, a.Expires)
+	assert.True(t, a.IsValid())
+
+	s.Revoked = true
+	assert.False(t, s.IsValid())
+	assert.False(t, s.authorization(&grant).IsValid())
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ctx := context.TODO()
+
+	acc := createUnconfirmedUser(t, 10)
+	_, status, err := ConfirmLoginChallenge(ctx, acc.Token)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, status)
+
+	login := func(device string) *Authorization {
+		acc, err := account.LookupAccount(ctx, accountTestRealm, acc.ClientID)
+		require.NoError(t, err)
+		acc, err = account.ResetTemporaryToken(ctx, acc, 10)
+		require.NoError(t, err)
+
+		req := AuthorizationRequest{Realm: accountTestRealm, UserID: accountTestUser, Token: acc.Token, Scope: DefaultScope, Device: device}
+		auth, status, err := ExchangeToken(ctx, &req, 1, 0, "127.0.0.1")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+		return auth
+	}
+
+	browser := login("browser")
+	cli := login("cli")
+	assert.NotEqual(t, browser.SessionID, cli.SessionID)
+
+	// logging in from the CLI does not end the browser session
+	for _, token := range []string{browser.Token, cli.Token} {
+		ath, err := FindAuthorizationByToken(ctx, token)
+		require.NoError(t, err)
+		assert.True(t, ath.IsValid())
+	}
+
+	sessions, err := ListSessions(ctx, accountTestRealm, browser.ClientID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	require.NoError(t, RevokeSession(ctx, accountTestRealm, browser.ClientID, browser.SessionID))
+	assert.Equal(t, ErrNoSuchEntity, RevokeSession(ctx, accountTestRealm, "someone-else", cli.SessionID))
+
+	ath, err := FindAuthorizationByToken(ctx, browser.Token)
+	require.NoError(t, err)
+	assert.False(t, ath.IsValid())
+
+	n, err := RevokeSessions(ctx, accountTestRealm, cli.ClientID, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
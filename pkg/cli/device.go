@@ -0,0 +1,204 @@
+// Package cli has helpers for command line clients of the platform, e.g. the login with the
+// device authorization grant and the credentials in ~/.netrc.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DeviceAuthorizationPath is the route that starts a device login
+	DeviceAuthorizationPath = "/oauth/device_authorization"
+	// TokenPath is the token endpoint of the platform
+	TokenPath = "/oauth/token"
+
+	// GrantDeviceCode is the grant type of the device authorization grant, see RFC 8628
+	GrantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// DefaultPollInterval is used if the server does not return an interval, in seconds
+	DefaultPollInterval = 5
+)
+
+type (
+	// Config configures the OAuth client of the CLI
+	Config struct {
+		Endpoint   string       // the API, e.g. https://api.example.com
+		ClientID   string       // a public OAuth client that may use the device code grant
+		Scope      string       // the scopes of the client if empty
+		HTTPClient *http.Client // http.DefaultClient if nil
+	}
+
+	// DeviceCode is the response of the device authorization endpoint, see RFC 8628, section 3.2
+	DeviceCode struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+		ExpiresIn               int64  `json:"expires_in"`
+		Interval                int64  `json:"interval"`
+	}
+
+	// Token is the response of the token endpoint
+	Token struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Scope        string `json:"scope,omitempty"`
+	}
+
+	// Error is an error response of the OAuth endpoints
+	Error struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}
+)
+
+var (
+	// ErrAccessDenied indicates that the user denied the login
+	ErrAccessDenied = errors.New("access denied")
+	// ErrExpiredToken indicates that the user did not approve the login in time
+	ErrExpiredToken = errors.New("device code expired")
+
+	// pollUnit is the unit of the poll intervals, shorter in tests
+	pollUnit = time.Second
+)
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// DeviceLogin logs in with the device authorization grant. prompt shows the user code and the verification URI to
+// the user, the login blocks until the user approved or denied the login in the browser, or the code expired.
+func DeviceLogin(ctx context.Context, conf *Config, prompt func(*DeviceCode)) (*Token, error) {
+	code, err := RequestDeviceCode(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	prompt(code)
+
+	return PollToken(ctx, conf, code)
+}
+
+// RequestDeviceCode starts a device login
+func RequestDeviceCode(ctx context.Context, conf *Config) (*DeviceCode, error) {
+	form := url.Values{"client_id": {conf.ClientID}}
+	if conf.Scope != "" {
+		form.Set("scope", conf.Scope)
+	}
+
+	var code DeviceCode
+	if err := conf.post(ctx, DeviceAuthorizationPath, form, &code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// PollToken polls the token endpoint until the user approved or denied the login, see RFC 8628, section 3.4.
+// The interval is increased whenever the server asks to slow down.
+func PollToken(ctx context.Context, conf *Config, code *DeviceCode) (*Token, error) {
+	form := url.Values{
+		"grant_type":  {GrantDeviceCode},
+		"device_code": {code.DeviceCode},
+		"client_id":   {conf.ClientID},
+	}
+	interval := code.Interval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(interval) * pollUnit):
+		}
+
+		var token Token
+		err := conf.post(ctx, TokenPath, form, &token)
+		if err == nil {
+			return &token, nil
+		}
+
+		e, ok := err.(*Error)
+		if !ok {
+			return nil, err
+		}
+		switch e.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += DefaultPollInterval
+		case "access_denied":
+			return nil, ErrAccessDenied
+		case "expired_token":
+			return nil, ErrExpiredToken
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Refresh exchanges a refresh token for new tokens
+func Refresh(ctx context.Context, conf *Config, refreshToken string) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {conf.ClientID},
+	}
+
+	var token Token
+	if err := conf.post(ctx, TokenPath, form, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Machine returns the host of the endpoint, the name of its entry in ~/.netrc
+func (conf *Config) Machine() string {
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return conf.Endpoint
+	}
+	return u.Hostname()
+}
+
+// post sends a form to an OAuth endpoint. OAuth errors are returned as *Error.
+func (conf *Config) post(ctx context.Context, path string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(conf.Endpoint, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := conf.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode != http.StatusOK {
+		var e Error
+		if err := json.NewDecoder(body).Decode(&e); err != nil || e.Code == "" {
+			return fmt.Errorf("POST %s: %s", path, resp.Status)
+		}
+		return &e
+	}
+	return json.NewDecoder(body).Decode(v)
+}
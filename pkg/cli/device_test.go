@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deviceServer answers the token requests with the given errors, then with a token
+func deviceServer(t *testing.T, responses ...string) *httptest.Server {
+	polls := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DeviceAuthorizationPath, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "cli", r.FormValue("client_id"))
+		json.NewEncoder(w).Encode(&DeviceCode{DeviceCode: "dc", UserCode: "WDJB-MJHT", VerificationURI: "https://example.com/device", ExpiresIn: 600, Interval: 1})
+	})
+	mux.HandleFunc(TokenPath, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, GrantDeviceCode, r.FormValue("grant_type"))
+		assert.Equal(t, "dc", r.FormValue("device_code"))
+
+		if polls < len(responses) {
+			polls++
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&Error{Code: responses[polls-1]})
+			return
+		}
+		json.NewEncoder(w).Encode(&Token{AccessToken: "at", TokenType: "Bearer", RefreshToken: "rt"})
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestDeviceLogin(t *testing.T) {
+	pollUnit = time.Millisecond
+
+	s := deviceServer(t, "authorization_pending", "slow_down", "authorization_pending")
+	conf := Config{Endpoint: s.URL, ClientID: "cli"}
+
+	var shown *DeviceCode
+	token, err := DeviceLogin(context.TODO(), &conf, func(code *DeviceCode) { shown = code })
+	require.NoError(t, err)
+	assert.Equal(t, "WDJB-MJHT", shown.UserCode)
+	assert.Equal(t, "at", token.AccessToken)
+	assert.Equal(t, "rt", token.RefreshToken)
+}
+
+func TestDeviceLoginErrors(t *testing.T) {
+	pollUnit = time.Millisecond
+
+	for code, expected := range map[string]error{"access_denied": ErrAccessDenied, "expired_token": ErrExpiredToken} {
+		s := deviceServer(t, "authorization_pending", code)
+		_, err := DeviceLogin(context.TODO(), &Config{Endpoint: s.URL, ClientID: "cli"}, func(*DeviceCode) {})
+		assert.Equal(t, expected, err, code)
+	}
+
+	s := deviceServer(t, "invalid_client")
+	_, err := DeviceLogin(context.TODO(), &Config{Endpoint: s.URL, ClientID: "cli"}, func(*DeviceCode) {})
+	assert.Equal(t, &Error{Code: "invalid_client"}, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, err = PollToken(ctx, &Config{Endpoint: s.URL, ClientID: "cli"}, &DeviceCode{DeviceCode: "dc"})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/txsvc/platform/v2/pkg/netrc"
+)
+
+// DefaultNetrcPath returns the path of ~/.netrc, or $NETRC if set
+func DefaultNetrcPath() (string, error) {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// SaveToken stores the tokens for machine in the netrc file at path. The access token is the password,
+// the refresh token is kept as account. Other entries of the file are not changed, the file is created if needed.
+func SaveToken(path, machine, login string, token *Token) error {
+	n, err := netrc.ParseFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		n, _ = netrc.Parse(strings.NewReader(""))
+	}
+
+	// replace the machine, existing entries might lack some of the tokens
+	n.RemoveMachine(machine)
+	n.NewMachine(machine, login, token.AccessToken, token.RefreshToken)
+
+	data, err := n.MarshalText()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadToken returns the tokens for machine from the netrc file at path, or nil if there are none
+func LoadToken(path, machine string) (*Token, error) {
+	m, err := netrc.FindMachine(path, machine)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if m == nil || m.Name != machine || m.Password == "" {
+		return nil, nil
+	}
+	return &Token{AccessToken: m.Password, TokenType: "Bearer", RefreshToken: m.Account}, nil
+}
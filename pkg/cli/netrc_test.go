@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".netrc")
+
+	token, err := LoadToken(path, "api.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("machine github.com\n\tlogin me\n\tpassword secret\n"), 0600))
+	require.NoError(t, SaveToken(path, "api.example.com", "cli", &Token{AccessToken: "at", RefreshToken: "rt"}))
+	require.NoError(t, SaveToken(path, "api.example.com", "cli", &Token{AccessToken: "at2", RefreshToken: "rt2"}))
+
+	token, err = LoadToken(path, "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "at2", token.AccessToken)
+	assert.Equal(t, "rt2", token.RefreshToken)
+
+	// other entries are kept
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "machine github.com")
+	assert.Contains(t, string(data), "password secret")
+	assert.Equal(t, 1, strings.Count(string(data), "machine api.example.com"))
+}
+
+func TestConfigMachine(t *testing.T) {
+	assert.Equal(t, "api.example.com", (&Config{Endpoint: "https://api.example.com:8443/v1"}).Machine())
+}
@@ -0,0 +1,221 @@
+package httpcontext
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2/pkg/env"
+	"github.com/txsvc/platform/v2/pkg/id"
+)
+
+const (
+	// HeaderRequestID is used to propagate the request ID
+	HeaderRequestID = "X-Request-ID"
+	// HeaderForwardedFor is set by proxies and load balancers
+	HeaderForwardedFor = "X-Forwarded-For"
+	// HeaderRealIP is set by some proxies instead of X-Forwarded-For
+	HeaderRealIP = "X-Real-IP"
+	// HeaderRequestTimeout sets a deadline, either in seconds or as a duration e.g. '500ms'
+	HeaderRequestTimeout = "X-Request-Timeout"
+
+	// maxRequestIDLength limits the size of propagated request IDs
+	maxRequestIDLength = 128
+)
+
+type (
+	contextKey int
+
+	// Config controls how a request context is built
+	Config struct {
+		// TrustedProxies are the networks whose X-Forwarded-For and X-Real-IP headers are honored
+		TrustedProxies []*net.IPNet
+		// MaxTimeout caps the deadline requested by a client, 0 = no limit
+		MaxTimeout time.Duration
+	}
+)
+
+const (
+	requestIDKey contextKey = iota
+	clientIPKey
+	userAgentKey
+)
+
+var (
+	defaultConfig *Config
+	configOnce    sync.Once
+)
+
+// New creates a context for request req with the default configuration.
+// The list of trusted proxies is read from TRUSTED_PROXIES, a comma separated list of IPs or CIDRs.
+func New(req *http.Request) context.Context {
+	configOnce.Do(func() {
+		proxies, _ := ParseTrustedProxies(env.GetString("TRUSTED_PROXIES", ""))
+		defaultConfig = &Config{
+			TrustedProxies: proxies,
+		}
+	})
+	return defaultConfig.NewContext(req)
+}
+
+// NewContext derives a new context from the request's context and attaches request ID, client IP and user agent.
+// If the client requested a timeout, the context has a matching deadline.
+func (c *Config) NewContext(req *http.Request) context.Context {
+	if req == nil {
+		return context.Background()
+	}
+
+	ctx := req.Context()
+
+	requestID := req.Header.Get(HeaderRequestID)
+	if !validRequestID(requestID) {
+		requestID, _ = id.SimpleUUID()
+	}
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	ctx = context.WithValue(ctx, clientIPKey, c.clientIP(req))
+	ctx = context.WithValue(ctx, userAgentKey, req.UserAgent())
+
+	if timeout, ok := parseTimeout(req.Header.Get(HeaderRequestTimeout)); ok {
+		if c.MaxTimeout > 0 && timeout > c.MaxTimeout {
+			timeout = c.MaxTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		// release the timer once the request is done or the deadline is reached
+		go func(ctx context.Context) {
+			<-ctx.Done()
+			cancel()
+		}(ctx)
+	}
+
+	return ctx
+}
+
+// RequestID returns the ID of the request, or "" if there is none
+func RequestID(ctx context.Context) string {
+	return stringValue(ctx, requestIDKey)
+}
+
+// ClientIP returns the IP of the client, or "" if it is unknown
+func ClientIP(ctx context.Context) string {
+	return stringValue(ctx, clientIPKey)
+}
+
+// UserAgent returns the user agent of the client, or "" if it is unknown
+func UserAgent(ctx context.Context) string {
+	return stringValue(ctx, userAgentKey)
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs and CIDRs
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p = p + "/128"
+			} else {
+				p = p + "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+// clientIP honors the forwarding headers only if the request was sent by a trusted proxy
+func (c *Config) clientIP(req *http.Request) string {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	if !c.isTrusted(remote) {
+		return remote
+	}
+
+	// walk the chain from right to left, the first untrusted address is the client
+	if xff := req.Header.Get(HeaderForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !c.isTrusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if ip := strings.TrimSpace(req.Header.Get(HeaderRealIP)); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return remote
+}
+
+func (c *Config) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeout(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+func validRequestID(rid string) bool {
+	if rid == "" || len(rid) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range rid {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func stringValue(ctx context.Context, key contextKey) string {
+	if ctx == nil {
+		return ""
+	}
+	if v, ok := ctx.Value(key).(string); ok {
+		return v
+	}
+	return ""
+}
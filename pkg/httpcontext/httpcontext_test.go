@@ -0,0 +1,107 @@
+package httpcontext
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:4711"
+	req.Header.Set("User-Agent", "podops/1.0")
+	return req
+}
+
+func TestNilRequest(t *testing.T) {
+	ctx := New(nil)
+	assert.NotNil(t, ctx)
+	assert.Empty(t, RequestID(ctx))
+	assert.Empty(t, ClientIP(ctx))
+	assert.Empty(t, UserAgent(ctx))
+}
+
+func TestNewContext(t *testing.T) {
+	ctx := New(newRequest())
+
+	assert.NotEmpty(t, RequestID(ctx))
+	assert.Equal(t, "10.0.0.1", ClientIP(ctx))
+	assert.Equal(t, "podops/1.0", UserAgent(ctx))
+
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+}
+
+func TestPropagateRequestID(t *testing.T) {
+	req := newRequest()
+	req.Header.Set(HeaderRequestID, "abc-123")
+	assert.Equal(t, "abc-123", RequestID(New(req)))
+
+	req.Header.Set(HeaderRequestID, "not valid")
+	rid := RequestID(New(req))
+	assert.NotEmpty(t, rid)
+	assert.NotEqual(t, "not valid", rid)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	require.NoError(t, err)
+	conf := Config{TrustedProxies: proxies}
+
+	// untrusted peer, headers are ignored
+	req := newRequest()
+	req.RemoteAddr = "1.2.3.4:4711"
+	req.Header.Set(HeaderForwardedFor, "5.6.7.8")
+	assert.Equal(t, "1.2.3.4", ClientIP(conf.NewContext(req)))
+
+	// trusted peer, right-most untrusted hop is the client
+	req = newRequest()
+	req.Header.Set(HeaderForwardedFor, "9.9.9.9, 5.6.7.8, 192.168.1.1")
+	assert.Equal(t, "5.6.7.8", ClientIP(conf.NewContext(req)))
+
+	// trusted peer, fall back to X-Real-IP
+	req = newRequest()
+	req.Header.Set(HeaderRealIP, "5.6.7.8")
+	assert.Equal(t, "5.6.7.8", ClientIP(conf.NewContext(req)))
+
+	_, err = ParseTrustedProxies("not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	conf := Config{MaxTimeout: time.Minute}
+
+	req := newRequest()
+	req.Header.Set(HeaderRequestTimeout, "2")
+	deadline, ok := conf.NewContext(req).Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), deadline, time.Second)
+
+	req.Header.Set(HeaderRequestTimeout, "1h")
+	deadline, ok = conf.NewContext(req).Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	req.Header.Set(HeaderRequestTimeout, "whenever")
+	_, ok = conf.NewContext(req).Deadline()
+	assert.False(t, ok)
+}
+
+func TestCancellation(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	req := newRequest().WithContext(parent)
+
+	ctx := New(req)
+	cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled")
+	}
+}
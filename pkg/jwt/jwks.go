@@ -0,0 +1,105 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+	"sort"
+)
+
+const (
+	// JWKSPath is the well-known route of the JWKS document
+	JWKSPath = "/.well-known/jwks.json"
+)
+
+type (
+	// JWK is the public part of a key as JSON Web Key, see RFC 7517
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use,omitempty"`
+		Alg string `json:"alg"`
+		// RSA
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+		// OKP
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+	}
+
+	// JWKS is a JSON Web Key Set
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+)
+
+// JWK returns the public part of the key. HS256 keys don't have a public part and return false.
+func (k *Key) JWK() (JWK, bool) {
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: RS256,
+			N:   encoding.EncodeToString(pub.N.Bytes()),
+			E:   encoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: EdDSA,
+			Crv: "Ed25519",
+			X:   encoding.EncodeToString(pub),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// Key creates a verify-only key from the JWK
+func (j *JWK) Key() (*Key, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := encoding.DecodeString(j.N)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		e, err := encoding.DecodeString(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidKey
+		}
+		return NewPublicKey(j.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())})
+	case "OKP":
+		x, err := encoding.DecodeString(j.X)
+		if err != nil || j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return NewPublicKey(j.Kid, ed25519.PublicKey(x))
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// JWKS returns the public keys of the key set, sorted by key ID
+func (ks KeySet) JWKS() *JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks))}
+	for _, k := range ks {
+		if jwk, ok := k.JWK(); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return &jwks
+}
+
+// KeySet creates a key set of verify-only keys. Keys that can't be used are skipped.
+func (j *JWKS) KeySet() KeySet {
+	ks := make(KeySet)
+	for i := range j.Keys {
+		if k, err := j.Keys[i].Key(); err == nil {
+			ks[k.ID] = k
+		}
+	}
+	return ks
+}
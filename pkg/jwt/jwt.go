@@ -0,0 +1,211 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenType is the 'typ' header
+	TokenType = "JWT"
+
+	// DefaultLeeway is the clock skew accepted when checking 'exp' and 'nbf'
+	DefaultLeeway = time.Minute
+)
+
+type (
+	// Header is the JOSE header of a token
+	Header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ,omitempty"`
+		Kid string `json:"kid,omitempty"`
+	}
+
+	// Claims are the registered claims plus the claims used by the platform
+	Claims struct {
+		Issuer    string   `json:"iss,omitempty"`
+		Subject   string   `json:"sub,omitempty"`
+		Audience  Audience `json:"aud,omitempty"`
+		ExpiresAt int64    `json:"exp,omitempty"`
+		NotBefore int64    `json:"nbf,omitempty"`
+		IssuedAt  int64    `json:"iat,omitempty"`
+		ID        string   `json:"jti,omitempty"`
+
+		Realm           string `json:"realm,omitempty"`
+		ClientID        string `json:"client_id,omitempty"`
+		Scope           string `json:"scope,omitempty"`
+		TokenType       string `json:"token_type,omitempty"`
+		SessionID       string `json:"sid,omitempty"`
+		AuthorizedParty string `json:"azp,omitempty"` // the OAuth client the token was issued to
+
+		// OpenID Connect ID tokens
+		Nonce         string `json:"nonce,omitempty"`
+		Email         string `json:"email,omitempty"`
+		EmailVerified bool   `json:"email_verified,omitempty"`
+		Name          string `json:"name,omitempty"`
+	}
+
+	// Audience is the 'aud' claim, either a single string or an array of strings, see RFC 7519, section 4.1.3
+	Audience []string
+
+	// Keyfunc returns the key that verifies a token signed with key kid
+	Keyfunc func(kid string) (*Key, bool)
+)
+
+var (
+	// ErrInvalidToken indicates a token that can't be decoded
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInvalidSignature indicates a token with a wrong signature
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrTokenExpired indicates a token after its 'exp' claim
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenNotYetValid indicates a token before its 'nbf' claim
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+
+	encoding = base64.RawURLEncoding
+)
+
+// Contains reports whether aud is one of the audiences
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes a single audience as a string
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON accepts a string or an array of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var aud []string
+	if err := json.Unmarshal(data, &aud); err != nil {
+		return err
+	}
+	*a = Audience(aud)
+	return nil
+}
+
+// Sign encodes and signs claims with key
+func Sign(claims *Claims, key *Key) (string, error) {
+	if !key.CanSign() {
+		return "", ErrVerifyOnly
+	}
+
+	header, err := json.Marshal(&Header{Alg: key.Alg, Typ: TokenType, Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + encoding.EncodeToString(sig), nil
+}
+
+// Parse verifies the signature of token with the key returned by keys and checks 'exp' and 'nbf'.
+// The 'alg' header must match the algorithm of the key.
+func Parse(token string, keys Keyfunc) (*Claims, error) {
+	return ParseAt(token, keys, time.Now())
+}
+
+// ParseAt is Parse, with the time used to check 'exp' and 'nbf'
+func ParseAt(token string, keys Keyfunc, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header Header
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	key, ok := keys(header.Kid)
+	if !ok || key == nil {
+		return nil, ErrUnknownKey
+	}
+	if header.Alg != key.Alg {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := key.verify([]byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	ts := now.Unix()
+	leeway := int64(DefaultLeeway / time.Second)
+	if claims.ExpiresAt != 0 && ts > claims.ExpiresAt+leeway {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && ts < claims.NotBefore-leeway {
+		return nil, ErrTokenNotYetValid
+	}
+	return &claims, nil
+}
+
+// DecodeHeader returns the header of token without verifying it
+func DecodeHeader(token string) (*Header, error) {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return nil, ErrInvalidToken
+	}
+	var header Header
+	if err := decodeSegment(token[:i], &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// IsJWT reports whether token looks like a JWT, i.e. has three segments and a JSON header.
+// The token is not verified.
+func IsJWT(token string) bool {
+	if strings.Count(token, ".") != 2 {
+		return false
+	}
+	h, err := DecodeHeader(token)
+	return err == nil && h.Alg != ""
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := encoding.DecodeString(seg)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeys(t *testing.T) []*Key {
+	hs, err := NewHS256Key("hs", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rs, err := NewRS256Key("rs", rk)
+	require.NoError(t, err)
+
+	_, ek, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed, err := NewEdDSAKey("ed", ek)
+	require.NoError(t, err)
+
+	return []*Key{hs, rs, ed}
+}
+
+func TestSignAndParse(t *testing.T) {
+	keys := testKeys(t)
+	ks := NewKeySet(keys...)
+
+	for _, k := range keys {
+		claims := Claims{
+			Subject:   "user",
+			Realm:     "realm",
+			ClientID:  "client",
+			Scope:     "api:read,api:write",
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			ID:        "jti",
+		}
+
+		token, err := Sign(&claims, k)
+		require.NoError(t, err, k.Alg)
+		assert.True(t, IsJWT(token))
+
+		h, err := DecodeHeader(token)
+		require.NoError(t, err)
+		assert.Equal(t, k.Alg, h.Alg)
+		assert.Equal(t, k.ID, h.Kid)
+
+		parsed, err := Parse(token, ks.Lookup)
+		require.NoError(t, err, k.Alg)
+		assert.Equal(t, claims, *parsed)
+
+		// tampered payload
+		parts := strings.Split(token, ".")
+		other, _ := Sign(&Claims{Subject: "admin"}, k)
+		forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+		_, err = Parse(forged, ks.Lookup)
+		assert.Equal(t, ErrInvalidSignature, err, k.Alg)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	keys := testKeys(t)
+	ks := NewKeySet(keys...)
+	hs, rs := keys[0], keys[1]
+
+	token, _ := Sign(&Claims{Subject: "user", ExpiresAt: time.Now().Add(-time.Hour).Unix()}, hs)
+	_, err := Parse(token, ks.Lookup)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	token, _ = Sign(&Claims{Subject: "user", NotBefore: time.Now().Add(time.Hour).Unix()}, hs)
+	_, err = Parse(token, ks.Lookup)
+	assert.Equal(t, ErrTokenNotYetValid, err)
+
+	token, _ = Sign(&Claims{Subject: "user"}, hs)
+	_, err = Parse(token, NewKeySet(rs).Lookup)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// a HS256 token signed with the public RSA key must not verify with the RSA key
+	pub, _ := x509.MarshalPKIXPublicKey(rs.Public())
+	confused, _ := NewHS256Key("rs", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	token, _ = Sign(&Claims{Subject: "admin"}, confused)
+	_, err = Parse(token, ks.Lookup)
+	assert.Equal(t, ErrUnsupportedAlgorithm, err)
+
+	// alg 'none'
+	_, err = Parse(encoding.EncodeToString([]byte(`{"alg":"none","kid":"hs"}`))+"."+encoding.EncodeToString([]byte(`{"sub":"admin"}`))+".", ks.Lookup)
+	assert.Equal(t, ErrUnsupportedAlgorithm, err)
+
+	_, err = Parse("not-a-token", ks.Lookup)
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.False(t, IsJWT("2f1e0f6e-8f5c-4a43-a0b8-2bb1d0e8c0a4"))
+}
+
+func TestKeys(t *testing.T) {
+	_, err := NewHS256Key("short", []byte("secret"))
+	assert.Error(t, err)
+
+	verifyOnly, err := NewPublicKey("ed", testKeys(t)[2].Public())
+	require.NoError(t, err)
+	assert.False(t, verifyOnly.CanSign())
+	_, err = Sign(&Claims{}, verifyOnly)
+	assert.Equal(t, ErrVerifyOnly, err)
+
+	_, ek, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(ek)
+	k, err := ParsePrivateKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	assert.Equal(t, EdDSA, k.Alg)
+
+	_, err = ParsePrivateKey("none", []byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestJWKS(t *testing.T) {
+	keys := testKeys(t)
+	jwks := NewKeySet(keys...).JWKS()
+
+	// HS256 keys are not published
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "ed", jwks.Keys[0].Kid)
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "rs", jwks.Keys[1].Kid)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+
+	ks := jwks.KeySet()
+	for _, k := range keys[1:] {
+		token, err := Sign(&Claims{Subject: "user"}, k)
+		require.NoError(t, err)
+		_, err = Parse(token, ks.Lookup)
+		assert.NoError(t, err, k.Alg)
+		assert.False(t, ks[k.ID].CanSign())
+	}
+}
+
+func TestMarshalPrivateKey(t *testing.T) {
+	for _, k := range testKeys(t) {
+		data, err := MarshalPrivateKey(k)
+		require.NoError(t, err)
+
+		restored, err := UnmarshalPrivateKey(k.ID, k.Alg, data)
+		require.NoError(t, err, k.Alg)
+
+		token, _ := Sign(&Claims{Subject: "user"}, restored)
+		_, err = Parse(token, NewKeySet(k).Lookup)
+		assert.NoError(t, err, k.Alg)
+	}
+}
+
+func TestAudience(t *testing.T) {
+	var claims Claims
+
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":"client"}`), &claims))
+	assert.Equal(t, Audience{"client"}, claims.Audience)
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":["client","api"]}`), &claims))
+	assert.True(t, claims.Audience.Contains("api"))
+	assert.False(t, claims.Audience.Contains("other"))
+	assert.Error(t, json.Unmarshal([]byte(`{"aud":42}`), &claims))
+
+	data, err := json.Marshal(&Claims{Audience: Audience{"client"}})
+	require.NoError(t, err)
+	assert.Equal(t, `{"aud":"client"}`, string(data))
+	data, err = json.Marshal(&Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
@@ -0,0 +1,250 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// supported algorithms
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+
+	// MinHMACKeySize is the minimum size of a HS256 secret in bytes
+	MinHMACKeySize = 32
+)
+
+type (
+	// Key signs and verifies tokens. A key without a private part can only verify tokens.
+	Key struct {
+		ID  string // the 'kid' header
+		Alg string
+
+		secret  []byte
+		private crypto.Signer
+		public  crypto.PublicKey
+	}
+
+	// KeySet maps key IDs to keys
+	KeySet map[string]*Key
+)
+
+var (
+	// ErrUnsupportedAlgorithm indicates an unknown or mismatched 'alg' header
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	// ErrInvalidKey indicates a key that can't be used
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrUnknownKey indicates a token signed with an unknown key
+	ErrUnknownKey = errors.New("unknown key")
+	// ErrVerifyOnly indicates a key without a private part
+	ErrVerifyOnly = errors.New("key can only verify tokens")
+)
+
+// NewHS256Key creates a HMAC-SHA256 key. The secret must be at least MinHMACKeySize bytes.
+func NewHS256Key(kid string, secret []byte) (*Key, error) {
+	if len(secret) < MinHMACKeySize {
+		return nil, fmt.Errorf("%w: secret must be at least %d bytes", ErrInvalidKey, MinHMACKeySize)
+	}
+	return &Key{ID: kid, Alg: HS256, secret: secret}, nil
+}
+
+// NewRS256Key creates a RSA-SHA256 signing key
+func NewRS256Key(kid string, key *rsa.PrivateKey) (*Key, error) {
+	if key == nil || key.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("%w: RSA keys must have at least 2048 bits", ErrInvalidKey)
+	}
+	return &Key{ID: kid, Alg: RS256, private: key, public: &key.PublicKey}, nil
+}
+
+// NewEdDSAKey creates an Ed25519 signing key
+func NewEdDSAKey(kid string, key ed25519.PrivateKey) (*Key, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidKey
+	}
+	return &Key{ID: kid, Alg: EdDSA, private: key, public: key.Public()}, nil
+}
+
+// NewPublicKey creates a key that verifies RS256 or EdDSA tokens
+func NewPublicKey(kid string, key crypto.PublicKey) (*Key, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Alg: RS256, public: k}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: kid, Alg: EdDSA, public: k}, nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// ParsePrivateKey creates a signing key from a PEM encoded PKCS#8 or PKCS#1 private key
+func ParsePrivateKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data", ErrInvalidKey)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return NewRS256Key(kid, key)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return NewRS256Key(kid, k)
+	case ed25519.PrivateKey:
+		return NewEdDSAKey(kid, k)
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// GenerateKey creates a new random key for alg
+func GenerateKey(kid, alg string) (*Key, error) {
+	switch alg {
+	case HS256:
+		secret := make([]byte, MinHMACKeySize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return NewHS256Key(kid, secret)
+	case RS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return NewRS256Key(kid, key)
+	case EdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewEdDSAKey(kid, key)
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// MarshalPrivateKey encodes the private part of a key, PEM encoded PKCS#8 for RS256 and EdDSA keys or
+// the raw secret for HS256 keys. Use UnmarshalPrivateKey to restore the key.
+func MarshalPrivateKey(k *Key) ([]byte, error) {
+	if k.Alg == HS256 {
+		return k.secret, nil
+	}
+	if k.private == nil {
+		return nil, ErrVerifyOnly
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// UnmarshalPrivateKey restores a key encoded with MarshalPrivateKey
+func UnmarshalPrivateKey(kid, alg string, data []byte) (*Key, error) {
+	if alg == HS256 {
+		return NewHS256Key(kid, data)
+	}
+	k, err := ParsePrivateKey(kid, data)
+	if err != nil {
+		return nil, err
+	}
+	if k.Alg != alg {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return k, nil
+}
+
+// Public returns the public part of the key, nil for HS256 keys
+func (k *Key) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Private returns the private part of the key, nil for HS256 and verify-only keys
+func (k *Key) Private() crypto.Signer {
+	return k.private
+}
+
+// CanSign reports whether the key can sign tokens
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case RS256:
+		if k.private == nil {
+			return nil, ErrVerifyOnly
+		}
+		h := sha256.Sum256(data)
+		return k.private.Sign(rand.Reader, h[:], crypto.SHA256)
+	case EdDSA:
+		if k.private == nil {
+			return nil, ErrVerifyOnly
+		}
+		return k.private.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+func (k *Key) verify(data, sig []byte) error {
+	switch k.Alg {
+	case HS256:
+		if k.secret == nil {
+			return ErrInvalidKey
+		}
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case RS256:
+		pub, ok := k.public.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidKey
+		}
+		h := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case EdDSA:
+		pub, ok := k.public.(ed25519.PublicKey)
+		if !ok {
+			return ErrInvalidKey
+		}
+		if !ed25519.Verify(pub, data, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// NewKeySet creates a key set from keys
+func NewKeySet(keys ...*Key) KeySet {
+	ks := make(KeySet)
+	for _, k := range keys {
+		ks[k.ID] = k
+	}
+	return ks
+}
+
+// Lookup returns the key with ID kid
+func (ks KeySet) Lookup(kid string) (*Key, bool) {
+	k, ok := ks[kid]
+	return k, ok
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParse(t *testing.T, spec string) *Schedule {
+	s, err := Parse(spec)
+	require.NoError(t, err, spec)
+	return s
+}
+
+func TestParse(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"*/15 0-6 1,15 * mon-fri",
+		"0 12 * jan-mar,dec sun",
+		"5/10 * * * 7",
+		"@daily",
+		"@Hourly",
+		"CRON_TZ=Europe/Berlin 0 6 * * *",
+		"TZ=America/New_York @weekly",
+	}
+	for _, spec := range valid {
+		_, err := Parse(spec)
+		assert.NoError(t, err, spec)
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"@often",
+		"CRON_TZ=Mars/Olympus 0 6 * * *",
+		"CRON_TZ=UTC",
+	}
+	for _, spec := range invalid {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	start := time.Date(2021, time.March, 31, 23, 58, 30, 0, time.UTC) // a wednesday
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2021, time.March, 31, 23, 59, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 6 * * *", time.Date(2021, time.April, 1, 6, 30, 0, 0, time.UTC)},
+		{"0 0 * * mon", time.Date(2021, time.April, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2021, time.April, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, time.April, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2021, time.May, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		// day of month OR day of week, if both are restricted
+		{"0 0 15 * fri", time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, mustParse(t, tt.spec).Next(start), tt.spec)
+	}
+
+	// impossible dates
+	assert.True(t, mustParse(t, "0 0 30 feb *").Next(start).IsZero())
+}
+
+func TestNextWithTimeZone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	s := mustParse(t, "CRON_TZ=Europe/Berlin 0 6 * * *")
+	next := s.Next(time.Date(2021, time.March, 31, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2021, time.April, 1, 6, 0, 0, 0, berlin), next)
+	assert.Equal(t, 4, next.UTC().Hour()) // CEST
+
+	// daylight saving time starts on 2021-03-28, 02:00 does not exist
+	s = mustParse(t, "CRON_TZ=Europe/Berlin 30 2 * * *")
+	next = s.Next(time.Date(2021, time.March, 27, 12, 0, 0, 0, berlin))
+	assert.Equal(t, time.Date(2021, time.March, 29, 2, 30, 0, 0, berlin), next)
+}
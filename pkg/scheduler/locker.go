@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreJobRuns collection SCHEDULER_RUNS
+	datastoreJobRuns string = "SCHEDULER_RUNS"
+)
+
+type (
+	// Locker decides which instance fires a job if several instances run the same scheduler
+	Locker interface {
+		// Acquire returns true if the caller is the first to claim the run of job at time t
+		Acquire(ctx context.Context, job string, t time.Time) (bool, error)
+		// Release gives up the claim of the run of job at time t, so that it can be acquired again
+		Release(ctx context.Context, job string, t time.Time) error
+	}
+
+	// MemoryLocker coordinates schedulers within the same process
+	MemoryLocker struct {
+		mu   sync.Mutex
+		runs map[string]time.Time
+	}
+
+	// DatastoreLocker coordinates schedulers across instances, using a transaction on the last run of a job
+	DatastoreLocker struct {
+		owner string
+	}
+
+	// jobRun is the last run of a job
+	jobRun struct {
+		Job     string `json:"job"`
+		Fired   int64  `json:"fired"` // the scheduled time of the run, unix seconds
+		Owner   string `json:"owner"` // the instance that fired the job
+		Created int64  `json:"-"`
+	}
+)
+
+var (
+	// Interface guards
+	_ Locker = (*MemoryLocker)(nil)
+	_ Locker = (*DatastoreLocker)(nil)
+)
+
+// NewMemoryLocker creates a locker for a single process
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{
+		runs: make(map[string]time.Time),
+	}
+}
+
+// Acquire implements the Locker interface
+func (l *MemoryLocker) Acquire(ctx context.Context, job string, t time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.runs[job]; ok && !t.After(last) {
+		return false, nil
+	}
+	l.runs[job] = t
+	return true, nil
+}
+
+// Release implements the Locker interface
+func (l *MemoryLocker) Release(ctx context.Context, job string, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.runs[job]; ok && last.Equal(t) {
+		l.runs[job] = t.Add(-time.Second)
+	}
+	return nil
+}
+
+// NewDatastoreLocker creates a locker that stores the last run of every job in the datastore.
+// The hostname is used to identify the instance if owner is empty.
+func NewDatastoreLocker(owner string) *DatastoreLocker {
+	if owner == "" {
+		owner, _ = os.Hostname()
+	}
+	return &DatastoreLocker{owner: owner}
+}
+
+// Acquire implements the Locker interface
+func (l *DatastoreLocker) Acquire(ctx context.Context, job string, t time.Time) (bool, error) {
+	k := datastore.NameKey(datastoreJobRuns, job, nil)
+	acquired := false
+
+	_, err := ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var run jobRun
+
+		acquired = false
+		if err := tx.Get(k, &run); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if run.Fired >= t.Unix() {
+			return nil // another instance was first
+		}
+
+		run = jobRun{
+			Job:     job,
+			Fired:   t.Unix(),
+			Owner:   l.owner,
+			Created: timestamp.Now(),
+		}
+		if _, err := tx.Put(k, &run); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// Release implements the Locker interface. Only the instance that acquired the run can release it.
+func (l *DatastoreLocker) Release(ctx context.Context, job string, t time.Time) error {
+	k := datastore.NameKey(datastoreJobRuns, job, nil)
+
+	_, err := ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var run jobRun
+
+		if err := tx.Get(k, &run); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if run.Fired != t.Unix() || run.Owner != l.owner {
+			return nil // claimed by another run or instance
+		}
+
+		run.Fired = t.Unix() - 1
+		_, err := tx.Put(k, &run)
+		return err
+	})
+	return err
+}
@@ -0,0 +1,314 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+type (
+	// Config configures a Scheduler
+	Config struct {
+		// Provider creates the tasks, the platform's task provider is used if nil
+		Provider provider.HttpTaskProvider
+		// Locker makes sure that only one instance fires a job, a MemoryLocker is used if nil
+		Locker Locker
+		// Location is the time zone of schedules without CRON_TZ, UTC if nil
+		Location *time.Location
+		// RetryDelay is the time to wait before a run whose task could not be created is fired again, DefaultRetryDelay if 0
+		RetryDelay time.Duration
+	}
+
+	// Scheduler creates a task every time the schedule of a job fires
+	Scheduler struct {
+		conf Config
+
+		mu      sync.Mutex
+		jobs    map[string]*job
+		running bool
+		wake    chan struct{}
+		quit    chan struct{}
+		done    chan struct{}
+	}
+
+	job struct {
+		name     string
+		schedule *Schedule
+		task     provider.HttpTask
+		next     time.Time
+		retry    time.Time // a failed run is not fired again before retry
+	}
+)
+
+const (
+	// DefaultRetryDelay is the time to wait before a failed run is fired again
+	DefaultRetryDelay = 10 * time.Second
+)
+
+var (
+	// ErrJobExists indicates that a job with the same name was already added
+	ErrJobExists = errors.New("job already exists")
+	// ErrInvalidJobName indicates a job name with characters other than letters, digits, '-' and '_'
+	ErrInvalidJobName = errors.New("invalid job name")
+
+	// job names are part of task names
+	jobNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,256}$`)
+)
+
+// New creates a scheduler without jobs
+func New(conf Config) *Scheduler {
+	if conf.Locker == nil {
+		conf.Locker = NewMemoryLocker()
+	}
+	if conf.Location == nil {
+		conf.Location = time.UTC
+	}
+	if conf.RetryDelay <= 0 {
+		conf.RetryDelay = DefaultRetryDelay
+	}
+
+	return &Scheduler{
+		conf: conf,
+		jobs: make(map[string]*job),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Add adds job name that creates task every time the cron expression spec fires.
+// The task name is set by the scheduler, in order to de-duplicate runs.
+func (s *Scheduler) Add(name, spec string, task provider.HttpTask) error {
+	if !jobNameRegexp.MatchString(name) {
+		return ErrInvalidJobName
+	}
+
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+	if schedule.Location == nil {
+		schedule.Location = s.conf.Location
+	}
+
+	s.mu.Lock()
+	if _, ok := s.jobs[name]; ok {
+		s.mu.Unlock()
+		return ErrJobExists
+	}
+	s.jobs[name] = &job{
+		name:     name,
+		schedule: schedule,
+		task:     task,
+		next:     schedule.Next(time.Now()),
+	}
+	s.mu.Unlock()
+
+	s.notify()
+	return nil
+}
+
+// Remove removes job name
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	delete(s.jobs, name)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// Next returns the next time job name fires
+func (s *Scheduler) Next(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return j.next, true
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.loop(s.quit, s.done)
+}
+
+// Stop stops the scheduler, jobs that are firing are completed first
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	close(s.quit)
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+}
+
+// Close stops the scheduler
+func (s *Scheduler) Close() error {
+	s.Stop()
+	return nil
+}
+
+// Run fires all jobs that were due at now. A job that missed several runs fires only once.
+// If the task of a run could not be created, the run is fired again after the retry delay.
+func (s *Scheduler) Run(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	due := make([]*job, 0)
+	for _, j := range s.jobs {
+		if !j.next.IsZero() && !j.next.After(now) && !j.retry.After(now) {
+			due = append(due, &job{name: j.name, schedule: j.schedule, task: j.task, next: j.next})
+			j.next = j.schedule.Next(now)
+			j.retry = time.Time{}
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(due, func(i, k int) bool { return due[i].next.Before(due[k].next) })
+
+	var errs []error
+	for _, j := range due {
+		if err := s.fire(ctx, j); err != nil {
+			platform.ReportError(err)
+			errs = append(errs, err)
+			s.retry(j, now)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d jobs failed: %v", len(errs), len(due), errs[0])
+	}
+	return nil
+}
+
+// fire creates the task of job j for its scheduled time, unless another instance already did.
+// The claim of the run is released if the task could not be created.
+func (s *Scheduler) fire(ctx context.Context, j *job) error {
+	p, err := s.provider()
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.conf.Locker.Acquire(ctx, j.name, j.next)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil // another instance was first
+	}
+
+	task := j.task
+	task.Name = fmt.Sprintf("%s-%d", j.name, j.next.Unix())
+
+	if err := p.CreateHttpTask(ctx, task); err != nil && err != provider.ErrTaskAlreadyExists {
+		if rerr := s.conf.Locker.Release(ctx, j.name, j.next); rerr != nil {
+			platform.ReportError(rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// retry schedules the failed run of job j again, unless the job was removed or replaced in the meantime
+func (s *Scheduler) retry(j *job, now time.Time) {
+	s.mu.Lock()
+	if current, ok := s.jobs[j.name]; ok && current.schedule == j.schedule {
+		current.next = j.next
+		current.retry = now.Add(s.conf.RetryDelay)
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+func (s *Scheduler) provider() (provider.HttpTaskProvider, error) {
+	if s.conf.Provider != nil {
+		return s.conf.Provider, nil
+	}
+
+	tp, ok := platform.Provider(provider.TypeTask)
+	if !ok {
+		return nil, fmt.Errorf(platform.MsgMissingProvider, provider.TypeTask.String())
+	}
+	p, ok := tp.(provider.HttpTaskProvider)
+	if !ok {
+		return nil, fmt.Errorf(platform.MsgMissingProvider, provider.TypeTask.String())
+	}
+	return p, nil
+}
+
+func (s *Scheduler) loop(quit, done chan struct{}) {
+	defer close(done)
+
+	timer := time.NewTimer(s.wait(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case now := <-timer.C:
+			s.Run(context.Background(), now)
+			timer.Reset(s.wait(time.Now()))
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.wait(time.Now()))
+		case <-quit:
+			return
+		}
+	}
+}
+
+// wait returns the time until the next job fires
+func (s *Scheduler) wait(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := now.Add(time.Hour) // check again later, in case there are no jobs
+	for _, j := range s.jobs {
+		if j.next.IsZero() {
+			continue
+		}
+		t := j.next
+		if j.retry.After(t) {
+			t = j.retry
+		}
+		if t.Before(next) {
+			next = t
+		}
+	}
+	if d := next.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// notify wakes up the loop to re-calculate the next fire time
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
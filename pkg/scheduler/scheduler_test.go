@@ -0,0 +1,157 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+type (
+	testTaskProvider struct {
+		mu    sync.Mutex
+		tasks []provider.HttpTask
+		names map[string]bool
+		err   error // returned by CreateHttpTask if set
+	}
+)
+
+func (p *testTaskProvider) CreateHttpTask(ctx context.Context, task provider.HttpTask) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if p.names[task.Name] {
+		return provider.ErrTaskAlreadyExists
+	}
+	p.names[task.Name] = true
+	p.tasks = append(p.tasks, task)
+	return nil
+}
+
+func (p *testTaskProvider) CreateHttpTasks(ctx context.Context, tasks []provider.HttpTask) error {
+	return provider.CreateHttpTasksConcurrently(ctx, tasks, 1, p.CreateHttpTask)
+}
+
+func newTestTaskProvider() *testTaskProvider {
+	return &testTaskProvider{tasks: make([]provider.HttpTask, 0), names: make(map[string]bool)}
+}
+
+func TestAddJob(t *testing.T) {
+	s := New(Config{Provider: newTestTaskProvider()})
+
+	assert.NoError(t, s.Add("cleanup", "@hourly", provider.HttpTask{Request: "/_tasks/cleanup"}))
+	assert.Equal(t, ErrJobExists, s.Add("cleanup", "@daily", provider.HttpTask{}))
+	assert.Equal(t, ErrInvalidJobName, s.Add("clean up", "@daily", provider.HttpTask{}))
+	assert.Error(t, s.Add("invalid", "every day", provider.HttpTask{}))
+
+	next, ok := s.Next("cleanup")
+	assert.True(t, ok)
+	assert.Equal(t, 0, next.Minute())
+	assert.True(t, next.After(time.Now()))
+
+	s.Remove("cleanup")
+	_, ok = s.Next("cleanup")
+	assert.False(t, ok)
+}
+
+func TestRunOnlyOnce(t *testing.T) {
+	tasks := newTestTaskProvider()
+	locker := NewMemoryLocker()
+
+	// two instances of the same scheduler
+	s1 := New(Config{Provider: tasks, Locker: locker})
+	s2 := New(Config{Provider: tasks, Locker: locker})
+
+	for _, s := range []*Scheduler{s1, s2} {
+		assert.NoError(t, s.Add("rollup", "*/5 * * * *", provider.HttpTask{Request: "/_tasks/rollup"}))
+	}
+
+	next, _ := s1.Next("rollup")
+	now := next.Add(time.Second)
+
+	assert.NoError(t, s1.Run(context.Background(), now))
+	assert.NoError(t, s2.Run(context.Background(), now))
+	assert.NoError(t, s1.Run(context.Background(), now)) // nothing is due anymore
+
+	if assert.Equal(t, 1, len(tasks.tasks)) {
+		assert.Equal(t, "/_tasks/rollup", tasks.tasks[0].Request)
+		assert.Contains(t, tasks.tasks[0].Name, "rollup-")
+	}
+
+	after, _ := s1.Next("rollup")
+	assert.Equal(t, next.Add(5*time.Minute), after)
+
+	// missed runs fire only once
+	later := after.Add(time.Hour)
+	assert.NoError(t, s2.Run(context.Background(), later))
+	assert.Equal(t, 2, len(tasks.tasks))
+}
+
+func TestRetryFailedRun(t *testing.T) {
+	tasks := newTestTaskProvider()
+	tasks.err = errors.New("unavailable")
+
+	s := New(Config{Provider: tasks, RetryDelay: time.Minute})
+	assert.NoError(t, s.Add("rollup", "@hourly", provider.HttpTask{Request: "/_tasks/rollup"}))
+
+	next, _ := s.Next("rollup")
+	now := next.Add(time.Second)
+
+	assert.Error(t, s.Run(context.Background(), now))
+	after, _ := s.Next("rollup")
+	assert.Equal(t, next, after) // the run is kept
+
+	tasks.err = nil
+	assert.NoError(t, s.Run(context.Background(), now.Add(time.Second)))
+	assert.Empty(t, tasks.tasks) // not before the retry delay
+
+	assert.NoError(t, s.Run(context.Background(), now.Add(time.Minute)))
+	if assert.Equal(t, 1, len(tasks.tasks)) {
+		assert.Equal(t, fmt.Sprintf("rollup-%d", next.Unix()), tasks.tasks[0].Name)
+	}
+}
+
+func TestMissingProvider(t *testing.T) {
+	s := New(Config{})
+	assert.NoError(t, s.Add("rollup", "@hourly", provider.HttpTask{}))
+
+	next, _ := s.Next("rollup")
+	assert.NotPanics(t, func() {
+		assert.Error(t, s.Run(context.Background(), next.Add(time.Second)))
+	})
+}
+
+func TestMemoryLockerRelease(t *testing.T) {
+	l := NewMemoryLocker()
+	now := time.Now().Truncate(time.Second)
+
+	ok, _ := l.Acquire(context.Background(), "rollup", now)
+	assert.True(t, ok)
+	ok, _ = l.Acquire(context.Background(), "rollup", now)
+	assert.False(t, ok)
+
+	assert.NoError(t, l.Release(context.Background(), "rollup", now))
+	ok, _ = l.Acquire(context.Background(), "rollup", now)
+	assert.True(t, ok)
+}
+
+func TestStartStop(t *testing.T) {
+	s := New(Config{Provider: newTestTaskProvider()})
+	assert.NoError(t, s.Add("cleanup", "@hourly", provider.HttpTask{}))
+
+	s.Start()
+	s.Start()
+	assert.NoError(t, s.Add("rollup", "@daily", provider.HttpTask{}))
+	s.Stop()
+	s.Stop()
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,423 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+)
+
+const (
+	// DefaultPath is the prefix of the route that receives all tasks
+	DefaultPath = "/_tasks"
+
+	// ParamTaskName is the route parameter that selects the handler
+	ParamTaskName = "name"
+)
+
+type (
+	// Config configures a Registry
+	Config struct {
+		// Endpoint is the base URL of the service that receives the tasks, e.g. https://api.example.com.
+		// Leave it empty to create tasks with relative URLs, e.g. for the local task provider.
+		Endpoint string
+		// Path is the route prefix, DefaultPath if empty
+		Path string
+		// Token is sent as bearer token with every task and is required by the task route
+		Token string
+		// Authenticate verifies task requests instead of Token, e.g. the OIDC token generated by Cloud Tasks.
+		// The task route rejects all requests if neither Token nor Authenticate are set.
+		Authenticate func(*http.Request) error
+		// Queues limits the queues the task route accepts requests from, all queues are accepted if empty
+		Queues []string
+		// Provider creates the tasks, the platform's task provider is used if nil
+		Provider provider.HttpTaskProvider
+		// DeadLetter is called when a handler failed permanently, optional
+		DeadLetter provider.DeadLetterFunc
+	}
+
+	// Registry maps task names to typed handlers.
+	//
+	// A handler is a func(context.Context, T) error, where T is the type of the payload,
+	// usually a pointer to a struct. The payload is decoded from JSON before the handler is called.
+	Registry struct {
+		conf Config
+
+		mu       sync.RWMutex
+		handlers map[string]*handler
+	}
+
+	// Info describes the task that is being processed, see InfoFromContext
+	Info struct {
+		Handler        string // name of the handler
+		TaskName       string
+		Queue          string
+		RetryCount     int
+		ExecutionCount int
+	}
+
+	handler struct {
+		fn      reflect.Value
+		payload reflect.Type
+	}
+
+	permanentError struct {
+		err error
+	}
+
+	infoKey struct{}
+)
+
+var (
+	// ErrUnknownTask indicates that there is no handler for a task
+	ErrUnknownTask = errors.New("unknown task")
+	// ErrInvalidHandler indicates that a handler does not have the signature func(context.Context, T) error
+	ErrInvalidHandler = errors.New("invalid task handler")
+	// ErrInvalidPayload indicates that the payload does not match the type expected by the handler
+	ErrInvalidPayload = errors.New("invalid task payload")
+	// ErrNoTaskProvider indicates that no task provider is available
+	ErrNoTaskProvider = errors.New("no task provider")
+	// ErrNoTaskAuthentication indicates a registry without a token or an authentication func, its task route rejects all requests
+	ErrNoTaskAuthentication = errors.New("task route requires a token or an authentication func")
+
+	defaultRegistry *Registry
+	defaultOnce     sync.Once
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// New creates an empty registry
+func New(conf Config) *Registry {
+	if conf.Path == "" {
+		conf.Path = DefaultPath
+	}
+	conf.Path = "/" + strings.Trim(conf.Path, "/")
+	conf.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+
+	return &Registry{
+		conf:     conf,
+		handlers: make(map[string]*handler),
+	}
+}
+
+// DefaultRegistry returns the registry that is configured from the environment: TASKS_ENDPOINT and TASKS_TOKEN.
+// The task route rejects all requests if TASKS_TOKEN is not set.
+func DefaultRegistry() *Registry {
+	defaultOnce.Do(func() {
+		defaultRegistry = New(Config{
+			Endpoint: env.GetString("TASKS_ENDPOINT", ""),
+			Token:    env.GetString("TASKS_TOKEN", ""),
+		})
+	})
+	return defaultRegistry
+}
+
+// Register adds handler h to the default registry
+func Register(name string, h interface{}) error {
+	return DefaultRegistry().Register(name, h)
+}
+
+// Enqueue creates a task for handler name using the default registry
+func Enqueue(ctx context.Context, name string, payload interface{}) error {
+	return DefaultRegistry().Enqueue(ctx, name, payload)
+}
+
+// Permanent marks err as permanent, the task is not retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked as permanent
+func IsPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
+
+// InfoFromContext returns the task info stored in ctx, if any
+func InfoFromContext(ctx context.Context) (*Info, bool) {
+	info, ok := ctx.Value(infoKey{}).(*Info)
+	return info, ok && info != nil
+}
+
+// Register adds handler h for tasks named name. h must be a func(context.Context, T) error.
+func (r *Registry) Register(name string, h interface{}) error {
+	if name == "" || strings.ContainsAny(name, "/?#") {
+		return fmt.Errorf("invalid task name '%s'", name)
+	}
+
+	fn := reflect.ValueOf(h)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 1 || ft.In(0) != contextType || ft.Out(0) != errorType {
+		return ErrInvalidHandler
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[name] = &handler{fn: fn, payload: ft.In(1)}
+	return nil
+}
+
+// Enqueue creates a task for handler name
+func (r *Registry) Enqueue(ctx context.Context, name string, payload interface{}) error {
+	return r.EnqueueTask(ctx, name, payload, provider.HttpTask{})
+}
+
+// EnqueueTask creates a task for handler name, using task as a template. Method, Request, Token and Payload
+// are set by the registry, all other attributes e.g. Name, ScheduleAt or RetryPolicy are kept.
+func (r *Registry) EnqueueTask(ctx context.Context, name string, payload interface{}, task provider.HttpTask) error {
+	h, ok := r.handler(name)
+	if !ok {
+		return ErrUnknownTask
+	}
+	if payload != nil && indirect(reflect.TypeOf(payload)) != indirect(h.payload) {
+		return ErrInvalidPayload
+	}
+
+	p, err := r.provider()
+	if err != nil {
+		return err
+	}
+	return p.CreateHttpTask(ctx, r.newTask(name, payload, task))
+}
+
+// Task returns a task for handler name without creating it, e.g. to add it to a scheduler
+func (r *Registry) Task(name string, payload interface{}) (provider.HttpTask, error) {
+	h, ok := r.handler(name)
+	if !ok {
+		return provider.HttpTask{}, ErrUnknownTask
+	}
+	if payload != nil && indirect(reflect.TypeOf(payload)) != indirect(h.payload) {
+		return provider.HttpTask{}, ErrInvalidPayload
+	}
+	return r.newTask(name, payload, provider.HttpTask{}), nil
+}
+
+// FanOut splits items into chunks of at most size items and creates one task per chunk for handler name.
+// The handler must accept a slice of the same type as items. It returns a *provider.BatchError if some
+// of the tasks could not be created.
+func (r *Registry) FanOut(ctx context.Context, name string, items interface{}, size int) error {
+	h, ok := r.handler(name)
+	if !ok {
+		return ErrUnknownTask
+	}
+	if items == nil || indirect(reflect.TypeOf(items)) != indirect(h.payload) {
+		return ErrInvalidPayload
+	}
+
+	p, err := r.provider()
+	if err != nil {
+		return err
+	}
+
+	tasks, err := provider.FanOut(r.newTask(name, nil, provider.HttpTask{}), items, size)
+	if err != nil {
+		return err
+	}
+	return p.CreateHttpTasks(ctx, tasks)
+}
+
+// URL returns the URL that tasks for handler name are sent to
+func (r *Registry) URL(name string) string {
+	return fmt.Sprintf("%s%s/%s", r.conf.Endpoint, r.conf.Path, name)
+}
+
+// Route returns the route of the task endpoint, e.g. /_tasks/:name
+func (r *Registry) Route() string {
+	return fmt.Sprintf("%s/:%s", r.conf.Path, ParamTaskName)
+}
+
+// Mount adds the task endpoint to e. Without a token or an authentication func, the endpoint rejects all requests.
+func (r *Registry) Mount(e *echo.Echo) {
+	if r.conf.Token == "" && r.conf.Authenticate == nil {
+		platform.ReportError(ErrNoTaskAuthentication)
+	}
+	e.POST(r.Route(), r.Endpoint)
+}
+
+// Endpoint receives a task, decodes its payload and calls the handler.
+//
+// POST /_tasks/:name
+// status 204: the task was processed
+// status 400: the payload could not be decoded
+// status 401: missing or invalid token or queue
+// status 404: unknown task
+// status 202: the handler failed permanently, the task is recorded as dead letter and must not be retried
+// status 500: the handler failed, the task should be retried
+func (r *Registry) Endpoint(c echo.Context) error {
+	req := c.Request()
+
+	if err := r.authenticate(req); err != nil {
+		return api.ErrorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	name := c.Param(ParamTaskName)
+	h, ok := r.handler(name)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusNotFound, ErrUnknownTask)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+	payload, err := h.decode(bytes.NewReader(body))
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+
+	info := &Info{
+		Handler:  name,
+		TaskName: req.Header.Get(provider.HeaderTaskName),
+		Queue:    req.Header.Get(provider.HeaderQueueName),
+	}
+	info.RetryCount, _ = strconv.Atoi(req.Header.Get(provider.HeaderTaskRetryCount))
+	info.ExecutionCount, _ = strconv.Atoi(req.Header.Get(provider.HeaderTaskExecutionCount))
+
+	ctx := context.WithValue(platform.NewHttpContext(req), infoKey{}, info)
+
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(ctx), payload})
+	if err, _ := out[0].Interface().(error); err != nil {
+		if IsPermanent(err) {
+			// any status other than 2xx is retried by Cloud Tasks
+			r.deadLetter(ctx, info, body, err)
+			return c.NoContent(http.StatusAccepted)
+		}
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deadLetter reports a task that failed permanently and passes it to the dead-letter hook
+func (r *Registry) deadLetter(ctx context.Context, info *Info, body []byte, err error) {
+	platform.ReportError(fmt.Errorf("task '%s' of handler '%s' failed permanently: %v", info.TaskName, info.Handler, err))
+
+	if r.conf.DeadLetter != nil {
+		task := r.newTask(info.Handler, json.RawMessage(body), provider.HttpTask{Name: info.TaskName})
+		task.Token = ""
+		r.conf.DeadLetter(ctx, &provider.DeadLetter{
+			ID:       info.TaskName,
+			Task:     task,
+			Error:    err.Error(),
+			Attempts: info.ExecutionCount + 1,
+			Failed:   time.Now(),
+		})
+	}
+}
+
+func (r *Registry) newTask(name string, payload interface{}, task provider.HttpTask) provider.HttpTask {
+	task.Method = provider.HttpMethodPost
+	task.Request = r.URL(name)
+	task.Token = r.conf.Token
+	task.Payload = payload
+	return task
+}
+
+func (r *Registry) provider() (provider.HttpTaskProvider, error) {
+	if r.conf.Provider != nil {
+		return r.conf.Provider, nil
+	}
+
+	tp, ok := platform.Provider(provider.TypeTask)
+	if !ok {
+		return nil, ErrNoTaskProvider
+	}
+	p, ok := tp.(provider.HttpTaskProvider)
+	if !ok {
+		return nil, ErrNoTaskProvider
+	}
+	return p, nil
+}
+
+func (r *Registry) handler(name string) (*handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h, ok := r.handlers[name]
+	return h, ok
+}
+
+// authenticate checks the queue and the bearer token or the authentication func of a task request
+func (r *Registry) authenticate(req *http.Request) error {
+	queue := req.Header.Get(provider.HeaderQueueName)
+	if queue == "" {
+		return fmt.Errorf("missing header '%s'", provider.HeaderQueueName)
+	}
+	if len(r.conf.Queues) > 0 {
+		found := false
+		for _, q := range r.conf.Queues {
+			if q == queue {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("queue '%s' is not accepted", queue)
+		}
+	}
+
+	if r.conf.Authenticate != nil {
+		return r.conf.Authenticate(req)
+	}
+	if r.conf.Token == "" {
+		return ErrNoTaskAuthentication
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(r.conf.Token)) != 1 {
+		return errors.New("invalid task token")
+	}
+	return nil
+}
+
+// decode reads the payload into a new value of the type the handler expects
+func (h *handler) decode(body io.Reader) (reflect.Value, error) {
+	v := reflect.New(indirect(h.payload))
+
+	if body != nil {
+		if err := json.NewDecoder(body).Decode(v.Interface()); err != nil && err != io.EOF {
+			return reflect.Value{}, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+	}
+
+	if h.payload.Kind() == reflect.Ptr {
+		return v, nil
+	}
+	return v.Elem(), nil
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,234 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/provider/local"
+)
+
+type (
+	emailPayload struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+	}
+)
+
+func newTestQueue() *local.LocalTaskProviderImpl {
+	return local.NewLocalTaskProvider(local.TaskQueueConfig{
+		Workers: 2,
+		Retry: provider.RetryPolicy{
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  5 * time.Millisecond,
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	r := New(Config{})
+
+	assert.NoError(t, r.Register("email", func(ctx context.Context, p *emailPayload) error { return nil }))
+	assert.NoError(t, r.Register("count", func(ctx context.Context, n int) error { return nil }))
+
+	assert.Equal(t, ErrInvalidHandler, r.Register("invalid", func(p *emailPayload) error { return nil }))
+	assert.Equal(t, ErrInvalidHandler, r.Register("invalid", func(ctx context.Context, p *emailPayload) {}))
+	assert.Equal(t, ErrInvalidHandler, r.Register("invalid", "not a func"))
+	assert.Error(t, r.Register("a/b", func(ctx context.Context, p *emailPayload) error { return nil }))
+
+	assert.Equal(t, "/_tasks/email", r.URL("email"))
+	assert.Equal(t, "/_tasks/:name", r.Route())
+
+	task, err := New(Config{Token: "secret"}).Task("email", nil)
+	assert.Equal(t, ErrUnknownTask, err)
+	r = New(Config{Token: "secret"})
+	r.Register("email", func(ctx context.Context, p *emailPayload) error { return nil })
+	task, err = r.Task("email", &emailPayload{To: "me@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/_tasks/email", task.Request)
+	assert.Equal(t, "secret", task.Token)
+	_, err = r.Task("email", 1)
+	assert.Equal(t, ErrInvalidPayload, err)
+
+	r = New(Config{Endpoint: "https://api.example.com/", Path: "jobs/"})
+	assert.Equal(t, "https://api.example.com/jobs/email", r.URL("email"))
+}
+
+func TestEnqueueAndDispatch(t *testing.T) {
+	var received int32
+
+	q := newTestQueue()
+	defer q.Close()
+
+	r := New(Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+
+	err := r.Register("email", func(ctx context.Context, p *emailPayload) error {
+		info, ok := InfoFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "email", info.Handler)
+		assert.Equal(t, local.LocalQueueName, info.Queue)
+		assert.NotEmpty(t, info.TaskName)
+
+		assert.Equal(t, "me@example.com", p.To)
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.NoError(t, r.Enqueue(context.Background(), "email", &emailPayload{To: "me@example.com", Subject: "hello"}))
+	assert.NoError(t, r.Enqueue(context.Background(), "email", emailPayload{To: "me@example.com"}))
+	assert.Equal(t, ErrInvalidPayload, r.Enqueue(context.Background(), "email", "me@example.com"))
+	assert.Equal(t, ErrUnknownTask, r.Enqueue(context.Background(), "unknown", nil))
+
+	q.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+}
+
+func TestRetryableAndPermanentErrors(t *testing.T) {
+	var flaky, broken int32
+
+	q := newTestQueue()
+	defer q.Close()
+
+	r := New(Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+
+	r.Register("flaky", func(ctx context.Context, n int) error {
+		if atomic.AddInt32(&flaky, 1) < 3 {
+			return errors.New("try again")
+		}
+		return nil
+	})
+	r.Register("broken", func(ctx context.Context, n int) error {
+		atomic.AddInt32(&broken, 1)
+		return Permanent(errors.New("don't try again"))
+	})
+
+	assert.NoError(t, r.Enqueue(context.Background(), "flaky", 1))
+	assert.NoError(t, r.Enqueue(context.Background(), "broken", 1))
+	q.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&flaky))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&broken))
+}
+
+func TestFanOut(t *testing.T) {
+	var received int32
+
+	q := newTestQueue()
+	defer q.Close()
+
+	r := New(Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+
+	r.Register("emails", func(ctx context.Context, batch []emailPayload) error {
+		assert.LessOrEqual(t, len(batch), 10)
+		atomic.AddInt32(&received, int32(len(batch)))
+		return nil
+	})
+
+	batch := make([]emailPayload, 95)
+	for i := range batch {
+		batch[i].To = "me@example.com"
+	}
+
+	assert.NoError(t, r.FanOut(context.Background(), "emails", batch, 10))
+	assert.Equal(t, ErrInvalidPayload, r.FanOut(context.Background(), "emails", []string{"me@example.com"}, 10))
+	q.Wait()
+
+	assert.Equal(t, int32(95), atomic.LoadInt32(&received))
+}
+
+func TestEndpoint(t *testing.T) {
+	letters := make([]*provider.DeadLetter, 0)
+
+	e := echo.New()
+	r := New(Config{Token: "secret", Queues: []string{"default"}, DeadLetter: func(ctx context.Context, dl *provider.DeadLetter) {
+		letters = append(letters, dl)
+	}})
+	r.Mount(e)
+
+	r.Register("email", func(ctx context.Context, p *emailPayload) error {
+		if p.To == "" {
+			return Permanent(errors.New("missing recipient"))
+		}
+		return nil
+	})
+
+	send := func(name, body string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, r.URL(name), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	valid := map[string]string{"Authorization": "Bearer secret", provider.HeaderQueueName: "default"}
+
+	assert.Equal(t, http.StatusNoContent, send("email", `{"to":"me@example.com"}`, valid))
+	assert.Equal(t, http.StatusAccepted, send("email", `{}`, valid))
+	if assert.Equal(t, 1, len(letters)) {
+		assert.Equal(t, "missing recipient", letters[0].Error)
+		assert.Equal(t, r.URL("email"), letters[0].Task.Request)
+		assert.Empty(t, letters[0].Task.Token)
+		assert.JSONEq(t, `{}`, string(letters[0].Task.Payload.(json.RawMessage)))
+	}
+	assert.Equal(t, http.StatusBadRequest, send("email", `{"to":`, valid))
+	assert.Equal(t, http.StatusNotFound, send("unknown", `{}`, valid))
+
+	assert.Equal(t, http.StatusUnauthorized, send("email", `{}`, map[string]string{"Authorization": "Bearer secret"}))
+	assert.Equal(t, http.StatusUnauthorized, send("email", `{}`, map[string]string{"Authorization": "Bearer wrong", provider.HeaderQueueName: "default"}))
+	assert.Equal(t, http.StatusUnauthorized, send("email", `{}`, map[string]string{"Authorization": "Bearer secret", provider.HeaderQueueName: "other"}))
+}
+
+func TestEndpointAuthentication(t *testing.T) {
+	send := func(r *Registry, token string) int {
+		e := echo.New()
+		r.Mount(e)
+		r.Register("email", func(ctx context.Context, p *emailPayload) error { return nil })
+
+		req := httptest.NewRequest(http.MethodPost, r.URL("email"), strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(provider.HeaderQueueName, "default")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// without a token, the queue header is not enough
+	assert.Equal(t, http.StatusUnauthorized, send(New(Config{}), ""))
+
+	verified := New(Config{Authenticate: func(req *http.Request) error {
+		if req.Header.Get("Authorization") != "Bearer id-token" {
+			return errors.New("invalid id token")
+		}
+		return nil
+	}})
+	assert.Equal(t, http.StatusNoContent, send(verified, "id-token"))
+	assert.Equal(t, http.StatusUnauthorized, send(verified, "other"))
+}
+
+func TestPermanent(t *testing.T) {
+	assert.Nil(t, Permanent(nil))
+
+	err := errors.New("fatal")
+	assert.True(t, IsPermanent(Permanent(err)))
+	assert.True(t, errors.Is(Permanent(err), err))
+	assert.False(t, IsPermanent(err))
+}
@@ -0,0 +1,77 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the SHA1 test vectors of RFC 6238, appendix B, truncated to 6 digits
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	for ts, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := Code(rfcSecret, Counter(time.Unix(ts, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, ts)
+	}
+
+	_, err := Code("not base32!", 1)
+	assert.Equal(t, ErrInvalidSecret, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, _ := Code(rfcSecret, Counter(now))
+
+	counter, ok := Validate(rfcSecret, code, now, DefaultSkew)
+	assert.True(t, ok)
+	assert.Equal(t, Counter(now), counter)
+
+	// clock drift of one period
+	counter, ok = Validate(rfcSecret, code, now.Add(Period*time.Second), DefaultSkew)
+	assert.True(t, ok)
+	assert.Equal(t, Counter(now), counter)
+	_, ok = Validate(rfcSecret, code, now.Add(-Period*time.Second), DefaultSkew)
+	assert.True(t, ok)
+
+	_, ok = Validate(rfcSecret, code, now.Add(2*Period*time.Second), DefaultSkew)
+	assert.False(t, ok)
+	_, ok = Validate(rfcSecret, code, now.Add(Period*time.Second), 0)
+	assert.False(t, ok)
+	_, ok = Validate(rfcSecret, "12345", now, DefaultSkew)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s1, err := GenerateSecret()
+	require.NoError(t, err)
+	s2, err := GenerateSecret()
+	require.NoError(t, err)
+	assert.NotEqual(t, s1, s2)
+	assert.Len(t, s1, 32)
+
+	_, err = Code(s1, 1)
+	assert.NoError(t, err)
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("example", "me@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/example:me@example.com", u.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	assert.Equal(t, "example", u.Query().Get("issuer"))
+}
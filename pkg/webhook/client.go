@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrBlockedAddress indicates that an endpoint resolves to a loopback, private, link-local or metadata address
+	ErrBlockedAddress = errors.New("endpoint address is not allowed")
+
+	// blockedNetworks are the private and shared address ranges that webhooks are never sent to.
+	// Loopback, link-local (incl. 169.254.169.254), multicast and unspecified addresses are checked separately.
+	blockedNetworks = parseCIDRs(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10", // carrier-grade NAT
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"198.18.0.0/15", // benchmarking
+		"fc00::/7",      // unique local, incl. the metadata address fd00:ec2::254
+	)
+)
+
+// newClient creates the default delivery client. It only connects to public addresses, the check is done
+// on the resolved address of every connection, so that DNS changes and redirects can't reach internal services.
+func newClient(timeout time.Duration, insecure bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if !insecure {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+				return ErrBlockedAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // the proxy would connect on our behalf, bypassing the address check
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkURL(req.URL.String(), insecure)
+		},
+	}
+}
+
+// checkURL returns ErrInvalidURL unless u is an absolute https URL. Hosts that are loopback or private
+// IP addresses, or localhost, are rejected with ErrBlockedAddress. Insecure accepts http and any host.
+func checkURL(u string, insecure bool) error {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return ErrInvalidURL
+	}
+	if insecure {
+		if parsed.Scheme != "https" && parsed.Scheme != "http" {
+			return ErrInvalidURL
+		}
+		return nil
+	}
+	if parsed.Scheme != "https" {
+		return ErrInvalidURL
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrBlockedAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedIP(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// blockedIP reports whether ip is a loopback, private, link-local, multicast or unspecified address
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
@@ -0,0 +1,197 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/api"
+	"github.com/txsvc/platform/v2/pkg/authentication"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// DefaultPath is the prefix of the webhook management routes
+	DefaultPath = "/webhooks"
+
+	// ParamEndpointID is the route parameter that selects the endpoint
+	ParamEndpointID = "id"
+
+	// DefaultDeliveryLimit is the number of deliveries returned by the deliveries endpoint
+	DefaultDeliveryLimit = 50
+)
+
+type (
+	// EndpointRequest registers a new endpoint
+	EndpointRequest struct {
+		URL    string   `json:"url" binding:"required"`
+		Topics []string `json:"topics" binding:"required"`
+	}
+)
+
+var (
+	// ErrNoPrincipal indicates that the request was not authenticated
+	ErrNoPrincipal = errors.New("missing principal")
+	// ErrNoSuchEndpoint indicates that the endpoint does not exist
+	ErrNoSuchEndpoint = errors.New("no such endpoint")
+)
+
+// Mount adds the webhook management routes to e. All routes require the admin scope.
+func (m *Manager) Mount(e *echo.Echo) {
+	g := e.Group(DefaultPath, authentication.RequireScope(authentication.ScopeAPIAdmin))
+
+	g.POST("", m.CreateEndpoint)
+	g.GET("", m.ListEndpoints)
+	g.DELETE("/:id", m.DeleteEndpoint)
+	g.POST("/:id/enable", m.EnableEndpoint)
+	g.GET("/:id/deliveries", m.ListDeliveries)
+}
+
+// CreateEndpoint registers an endpoint in the realm of the caller. The secret is only returned once.
+//
+// POST /webhooks
+// status 201: the endpoint was created
+// status 400: invalid url or topics
+// status 401: not authorized
+func (m *Manager) CreateEndpoint(c echo.Context) error {
+	var req EndpointRequest
+
+	p, ok := authentication.GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNoPrincipal)
+	}
+	if err := c.Bind(&req); err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+
+	ep, err := newEndpoint(p.Realm, req.URL, m.conf.Insecure, req.Topics...)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusBadRequest, err)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	if err := m.conf.Store.PutEndpoint(ctx, ep); err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusCreated, ep)
+}
+
+// ListEndpoints returns the endpoints of the caller's realm, without their secrets
+//
+// GET /webhooks
+// status 200: success
+// status 401: not authorized
+func (m *Manager) ListEndpoints(c echo.Context) error {
+	p, ok := authentication.GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNoPrincipal)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	endpoints, err := m.conf.Store.ListEndpoints(ctx, p.Realm)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	for _, ep := range endpoints {
+		ep.Secret = ""
+	}
+
+	return api.StandardResponse(c, http.StatusOK, endpoints)
+}
+
+// DeleteEndpoint removes an endpoint, pending deliveries are dropped
+//
+// DELETE /webhooks/:id
+// status 204: the endpoint was deleted
+// status 401: not authorized
+// status 404: unknown endpoint
+func (m *Manager) DeleteEndpoint(c echo.Context) error {
+	p, ok := authentication.GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNoPrincipal)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	ep, err := m.conf.Store.GetEndpoint(ctx, p.Realm, c.Param(ParamEndpointID))
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	if ep == nil {
+		return api.ErrorResponse(c, http.StatusNotFound, ErrNoSuchEndpoint)
+	}
+	if err := m.conf.Store.DeleteEndpoint(ctx, ep.Realm, ep.ID); err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// EnableEndpoint enables a disabled endpoint and resets its failure count
+//
+// POST /webhooks/:id/enable
+// status 200: success
+// status 401: not authorized
+// status 404: unknown endpoint
+func (m *Manager) EnableEndpoint(c echo.Context) error {
+	p, ok := authentication.GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNoPrincipal)
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	ep, err := m.conf.Store.GetEndpoint(ctx, p.Realm, c.Param(ParamEndpointID))
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	if ep == nil {
+		return api.ErrorResponse(c, http.StatusNotFound, ErrNoSuchEndpoint)
+	}
+
+	ep.Disabled = false
+	ep.Failures = 0
+	ep.Updated = timestamp.Now()
+	if err := m.conf.Store.PutEndpoint(ctx, ep); err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	ep.Secret = ""
+	return api.StandardResponse(c, http.StatusOK, ep)
+}
+
+// ListDeliveries returns the latest deliveries to an endpoint, newest first. Use ?limit=n to change the number of deliveries.
+//
+// GET /webhooks/:id/deliveries
+// status 200: success
+// status 401: not authorized
+// status 404: unknown endpoint
+func (m *Manager) ListDeliveries(c echo.Context) error {
+	p, ok := authentication.GetPrincipal(c)
+	if !ok {
+		return api.ErrorResponse(c, http.StatusUnauthorized, ErrNoPrincipal)
+	}
+
+	limit := DefaultDeliveryLimit
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	ctx := platform.NewHttpContext(c.Request())
+	ep, err := m.conf.Store.GetEndpoint(ctx, p.Realm, c.Param(ParamEndpointID))
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+	if ep == nil {
+		return api.ErrorResponse(c, http.StatusNotFound, ErrNoSuchEndpoint)
+	}
+
+	deliveries, err := m.conf.Store.ListDeliveries(ctx, ep.Realm, ep.ID, limit)
+	if err != nil {
+		return api.ErrorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return api.StandardResponse(c, http.StatusOK, deliveries)
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// headers of a webhook request
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderEventID   = "X-Webhook-ID"
+	HeaderTopic     = "X-Webhook-Topic"
+
+	// DefaultTolerance is the max age of a signature accepted by Verify
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	// ErrInvalidSignature indicates a missing, malformed or wrong signature
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignatureExpired indicates a signature that is older than the tolerance
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// Sign returns the signature header of body, e.g. t=1617181920,v1=5257a869...
+// The signature is the hex encoded HMAC-SHA256 of "<timestamp>.<body>", keyed with the secret of the endpoint.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, signature(secret, ts, body))
+}
+
+// Verify checks the signature header of a webhook request. Signatures older than tolerance are rejected,
+// use 0 for DefaultTolerance.
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+
+	var ts string
+	sigs := make([]string, 0, 1)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return ErrInvalidSignature
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+
+	expected := signature(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func signature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,265 @@
+package webhook
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+
+	ds "github.com/txsvc/platform/v2/pkg/datastore"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// datastoreEndpoints collection WEBHOOK_ENDPOINTS
+	datastoreEndpoints string = "WEBHOOK_ENDPOINTS"
+	// datastoreDeliveries collection WEBHOOK_DELIVERIES
+	datastoreDeliveries string = "WEBHOOK_DELIVERIES"
+
+	// DefaultMaxDeliveries is the number of deliveries a MemoryStore keeps, older deliveries are dropped
+	DefaultMaxDeliveries = 1000
+)
+
+type (
+	// Store persists endpoints and delivery logs
+	Store interface {
+		// GetEndpoint returns nil if the endpoint does not exist
+		GetEndpoint(ctx context.Context, realm, id string) (*Endpoint, error)
+		PutEndpoint(ctx context.Context, ep *Endpoint) error
+		DeleteEndpoint(ctx context.Context, realm, id string) error
+		ListEndpoints(ctx context.Context, realm string) ([]*Endpoint, error)
+		// RecordResult updates the failure count of an endpoint and disables it after maxFailures consecutive failures
+		RecordResult(ctx context.Context, realm, id string, success bool, maxFailures int) (*Endpoint, error)
+
+		AddDelivery(ctx context.Context, d *Delivery) error
+		// ListDeliveries returns the latest deliveries to an endpoint, newest first
+		ListDeliveries(ctx context.Context, realm, id string, limit int) ([]*Delivery, error)
+	}
+
+	// DatastoreStore keeps endpoints and delivery logs in the datastore
+	DatastoreStore struct {
+	}
+
+	// MemoryStore keeps endpoints and delivery logs in memory, e.g. for tests
+	MemoryStore struct {
+		// MaxDeliveries is the number of deliveries kept across all endpoints, DefaultMaxDeliveries if 0
+		MaxDeliveries int
+
+		mu         sync.Mutex
+		endpoints  map[string]*Endpoint
+		deliveries []*Delivery
+	}
+)
+
+var (
+	// Interface guards
+	_ Store = (*DatastoreStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// NewDatastoreStore creates a store backed by the datastore
+func NewDatastoreStore() *DatastoreStore {
+	return &DatastoreStore{}
+}
+
+func (s *DatastoreStore) GetEndpoint(ctx context.Context, realm, id string) (*Endpoint, error) {
+	var ep Endpoint
+
+	if err := ds.DataStore().Get(ctx, nativeKey(namedKey(realm, id)), &ep); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil // Not finding one is not an error!
+		}
+		return nil, err
+	}
+	return &ep, nil
+}
+
+func (s *DatastoreStore) PutEndpoint(ctx context.Context, ep *Endpoint) error {
+	_, err := ds.DataStore().Put(ctx, nativeKey(ep.Key()), ep)
+	return err
+}
+
+func (s *DatastoreStore) DeleteEndpoint(ctx context.Context, realm, id string) error {
+	return ds.DataStore().Delete(ctx, nativeKey(namedKey(realm, id)))
+}
+
+func (s *DatastoreStore) ListEndpoints(ctx context.Context, realm string) ([]*Endpoint, error) {
+	var endpoints []*Endpoint
+
+	if _, err := ds.DataStore().GetAll(ctx, datastore.NewQuery(datastoreEndpoints).Filter("Realm =", realm), &endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints == nil {
+		return []*Endpoint{}, nil
+	}
+	return endpoints, nil
+}
+
+func (s *DatastoreStore) RecordResult(ctx context.Context, realm, id string, success bool, maxFailures int) (*Endpoint, error) {
+	var ep Endpoint
+	k := nativeKey(namedKey(realm, id))
+
+	_, err := ds.DataStore().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(k, &ep); err != nil {
+			return err
+		}
+		ep.recordResult(success, maxFailures)
+		_, err := tx.Put(k, &ep)
+		return err
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ep, nil
+}
+
+func (s *DatastoreStore) AddDelivery(ctx context.Context, d *Delivery) error {
+	_, err := ds.DataStore().Put(ctx, datastore.NameKey(datastoreDeliveries, d.ID, nil), d)
+	return err
+}
+
+func (s *DatastoreStore) ListDeliveries(ctx context.Context, realm, id string, limit int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+
+	q := datastore.NewQuery(datastoreDeliveries).Filter("Realm =", realm).Filter("EndpointID =", id).Order("-Created").Limit(limit)
+	if _, err := ds.DataStore().GetAll(ctx, q, &deliveries); err != nil {
+		return nil, err
+	}
+	if deliveries == nil {
+		return []*Delivery{}, nil
+	}
+	return deliveries, nil
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		endpoints:  make(map[string]*Endpoint),
+		deliveries: make([]*Delivery, 0),
+	}
+}
+
+func (s *MemoryStore) GetEndpoint(ctx context.Context, realm, id string) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ep, ok := s.endpoints[namedKey(realm, id)]; ok {
+		cp := *ep
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) PutEndpoint(ctx context.Context, ep *Endpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := *ep
+	s.endpoints[ep.Key()] = &cp
+	return nil
+}
+
+func (s *MemoryStore) DeleteEndpoint(ctx context.Context, realm, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.endpoints, namedKey(realm, id))
+	return nil
+}
+
+func (s *MemoryStore) ListEndpoints(ctx context.Context, realm string) ([]*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := make([]*Endpoint, 0)
+	for _, ep := range s.endpoints {
+		if ep.Realm == realm {
+			cp := *ep
+			endpoints = append(endpoints, &cp)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Created < endpoints[j].Created })
+	return endpoints, nil
+}
+
+func (s *MemoryStore) RecordResult(ctx context.Context, realm, id string, success bool, maxFailures int) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ep, ok := s.endpoints[namedKey(realm, id)]
+	if !ok {
+		return nil, nil
+	}
+	ep.recordResult(success, maxFailures)
+
+	cp := *ep
+	return &cp, nil
+}
+
+func (s *MemoryStore) AddDelivery(ctx context.Context, d *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := *d
+	s.deliveries = append(s.deliveries, &cp)
+
+	max := s.MaxDeliveries
+	if max <= 0 {
+		max = DefaultMaxDeliveries
+	}
+	if n := len(s.deliveries) - max; n > 0 {
+		copy(s.deliveries, s.deliveries[n:])
+		for i := max; i < len(s.deliveries); i++ {
+			s.deliveries[i] = nil
+		}
+		s.deliveries = s.deliveries[:max]
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListDeliveries(ctx context.Context, realm, id string, limit int) ([]*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := make([]*Delivery, 0)
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := s.deliveries[i]; d.Realm == realm && d.EndpointID == id {
+			cp := *d
+			deliveries = append(deliveries, &cp)
+		}
+	}
+	return deliveries, nil
+}
+
+// recordResult resets the failure count on success and disables the endpoint after maxFailures consecutive failures
+func (ep *Endpoint) recordResult(success bool, maxFailures int) {
+	if success {
+		ep.Failures = 0
+	} else {
+		ep.Failures++
+		if maxFailures > 0 && ep.Failures >= maxFailures {
+			ep.Disabled = true
+		}
+	}
+	ep.Updated = timestamp.Now()
+}
+
+//
+// keys
+//
+
+func (ep *Endpoint) Key() string {
+	return namedKey(ep.Realm, ep.ID)
+}
+
+func nativeKey(key string) *datastore.Key {
+	return datastore.NameKey(datastoreEndpoints, key, nil)
+}
+
+func namedKey(part1, part2 string) string {
+	return part1 + "." + part2
+}
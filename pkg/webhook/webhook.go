@@ -0,0 +1,362 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/id"
+	"github.com/txsvc/platform/v2/pkg/tasks"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// DeliveryTask is the name of the task handler that delivers webhooks
+	DeliveryTask = "webhook-delivery"
+	// SubscriptionName is the name of the event bus subscriptions created by Subscribe
+	SubscriptionName = "webhooks"
+
+	// DefaultTimeout of a delivery request
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxFailures is the number of consecutive failed deliveries before an endpoint is disabled
+	DefaultMaxFailures = 10
+	// DefaultMaxAttempts is the number of attempts to deliver an event to an endpoint
+	DefaultMaxAttempts = 8
+
+	// AllTopics matches every topic
+	AllTopics = "*"
+	// AttributeRealm is the event attribute that selects the realm of the endpoints
+	AttributeRealm = "realm"
+)
+
+type (
+	// Endpoint receives the events of a realm
+	Endpoint struct {
+		ID     string `json:"id"`
+		Realm  string `json:"realm"`
+		URL    string `json:"url"`
+		Secret string `json:"secret,omitempty" datastore:",noindex"`
+		// Topics are exact topic names, prefixes like "account.*" or "*" for all topics
+		Topics   []string `json:"topics"`
+		Disabled bool     `json:"disabled"`
+		Failures int      `json:"failures"` // consecutive failed deliveries
+		Created  int64    `json:"created"`
+		Updated  int64    `json:"updated"`
+	}
+
+	// Delivery logs an attempt to deliver an event to an endpoint
+	Delivery struct {
+		ID         string `json:"id"`
+		EndpointID string `json:"endpoint_id"`
+		Realm      string `json:"realm"`
+		EventID    string `json:"event_id"`
+		Topic      string `json:"topic"`
+		Attempt    int    `json:"attempt"`
+		Status     int    `json:"status"` // HTTP status, 0 if the request failed
+		Error      string `json:"error,omitempty" datastore:",noindex"`
+		Duration   int64  `json:"duration"` // ms
+		Created    int64  `json:"created"`
+	}
+
+	// Message is the body of a webhook request
+	Message struct {
+		ID      string          `json:"id"`
+		Topic   string          `json:"topic"`
+		Realm   string          `json:"realm"`
+		Created int64           `json:"created"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	// Config configures a Manager
+	Config struct {
+		// Store persists endpoints and delivery logs, a DatastoreStore if nil
+		Store Store
+		// Tasks creates and receives the delivery tasks, tasks.DefaultRegistry() if nil
+		Tasks *tasks.Registry
+		// Client sends the webhook requests. If nil, a client with Timeout that only connects to public addresses.
+		// A custom client is responsible for blocking requests to internal services.
+		Client *http.Client
+		// Timeout of a delivery request, DefaultTimeout if 0
+		Timeout time.Duration
+		// MaxFailures is the number of consecutive failed deliveries before an endpoint is disabled, DefaultMaxFailures if 0
+		MaxFailures int
+		// Retry controls the redelivery of failed webhooks, at most DefaultMaxAttempts attempts if empty
+		Retry provider.RetryPolicy
+		// Insecure allows http endpoints and deliveries to loopback and private addresses, e.g. for tests and local development
+		Insecure bool
+	}
+
+	// Manager registers endpoints and delivers events to them
+	Manager struct {
+		conf Config
+	}
+
+	// deliveryPayload is the payload of a delivery task
+	deliveryPayload struct {
+		Realm      string          `json:"realm"`
+		EndpointID string          `json:"endpoint_id"`
+		EventID    string          `json:"event_id"`
+		Topic      string          `json:"topic"`
+		Body       json.RawMessage `json:"body"`
+	}
+)
+
+var (
+	// ErrEndpointDisabled indicates that an endpoint does not receive events
+	ErrEndpointDisabled = errors.New("endpoint is disabled")
+	// ErrInvalidURL indicates that the URL of an endpoint is not an absolute https URL
+	ErrInvalidURL = errors.New("invalid endpoint url")
+	// ErrInvalidEndpoint indicates a missing realm or topic
+	ErrInvalidEndpoint = errors.New("invalid endpoint")
+)
+
+// New creates a manager and registers the delivery task handler
+func New(conf Config) (*Manager, error) {
+	if conf.Store == nil {
+		conf.Store = NewDatastoreStore()
+	}
+	if conf.Tasks == nil {
+		conf.Tasks = tasks.DefaultRegistry()
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
+	}
+	if conf.Client == nil {
+		conf.Client = newClient(conf.Timeout, conf.Insecure)
+	}
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = DefaultMaxFailures
+	}
+	if conf.Retry.MaxAttempts == 0 && conf.Retry.MaxRetryDuration == 0 {
+		conf.Retry.MaxAttempts = DefaultMaxAttempts
+	}
+
+	m := Manager{
+		conf: conf,
+	}
+	if err := conf.Tasks.Register(DeliveryTask, m.deliver); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// NewEndpoint creates an endpoint with a new ID and secret. The endpoint is not stored.
+// The URL must use https and must not point to localhost or a private IP address.
+func NewEndpoint(realm, url string, topics ...string) (*Endpoint, error) {
+	return newEndpoint(realm, url, false, topics...)
+}
+
+// newEndpoint creates an endpoint, insecure accepts http URLs and private addresses
+func newEndpoint(realm, url string, insecure bool, topics ...string) (*Endpoint, error) {
+	if realm == "" || len(topics) == 0 {
+		return nil, ErrInvalidEndpoint
+	}
+	for _, t := range topics {
+		if t != AllTopics && !provider.ValidTopic(strings.TrimSuffix(t, ".*")) {
+			return nil, provider.ErrInvalidTopic
+		}
+	}
+	if err := checkURL(url, insecure); err != nil {
+		return nil, err
+	}
+
+	uid, err := id.ShortUUID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := id.RandomToken("whsec")
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp.Now()
+
+	return &Endpoint{
+		ID:      uid,
+		Realm:   realm,
+		URL:     url,
+		Secret:  secret,
+		Topics:  topics,
+		Created: now,
+		Updated: now,
+	}, nil
+}
+
+// Matches reports whether the endpoint receives events on topic
+func (ep *Endpoint) Matches(topic string) bool {
+	for _, t := range ep.Topics {
+		if t == AllTopics || t == topic {
+			return true
+		}
+		if strings.HasSuffix(t, ".*") && strings.HasPrefix(topic, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store returns the store of the manager
+func (m *Manager) Store() Store {
+	return m.conf.Store
+}
+
+// Subscribe dispatches the events on topics to the endpoints, using the platform's event bus
+func (m *Manager) Subscribe(topics ...string) ([]provider.Subscription, error) {
+	subs := make([]provider.Subscription, 0, len(topics))
+	for _, t := range topics {
+		s, err := platform.Subscribe(t, SubscriptionName, m.Dispatch)
+		if err != nil {
+			for _, s := range subs {
+				s.Unsubscribe()
+			}
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, nil
+}
+
+// Dispatch creates a delivery task for every enabled endpoint of the event's realm that matches its topic.
+// The realm is taken from the event attribute 'realm', events without a realm are ignored.
+func (m *Manager) Dispatch(ctx context.Context, e *provider.Event) error {
+	realm := e.Attributes[AttributeRealm]
+	if realm == "" {
+		return nil
+	}
+
+	endpoints, err := m.conf.Store.ListEndpoints(ctx, realm)
+	if err != nil {
+		return err
+	}
+
+	published := e.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+	data := json.RawMessage(e.Data)
+	if len(data) == 0 {
+		data = json.RawMessage("null")
+	}
+	body, err := json.Marshal(&Message{
+		ID:      e.ID,
+		Topic:   e.Topic,
+		Realm:   realm,
+		Created: published.Unix(),
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ep := range endpoints {
+		if ep.Disabled || !ep.Matches(e.Topic) {
+			continue
+		}
+
+		p := deliveryPayload{
+			Realm:      realm,
+			EndpointID: ep.ID,
+			EventID:    e.ID,
+			Topic:      e.Topic,
+			Body:       body,
+		}
+		retry := m.conf.Retry
+		task := provider.HttpTask{
+			Name:        fmt.Sprintf("%s-%s", e.ID, ep.ID),
+			RetryPolicy: &retry,
+		}
+		if err := m.conf.Tasks.EnqueueTask(ctx, DeliveryTask, &p, task); err != nil && err != provider.ErrTaskAlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends one webhook request and logs the result. Failures are retried until the endpoint is disabled.
+func (m *Manager) deliver(ctx context.Context, p *deliveryPayload) error {
+	ep, err := m.conf.Store.GetEndpoint(ctx, p.Realm, p.EndpointID)
+	if err != nil {
+		return err
+	}
+	if ep == nil {
+		return nil // the endpoint was deleted, nothing to do
+	}
+	if ep.Disabled {
+		return tasks.Permanent(ErrEndpointDisabled)
+	}
+
+	attempt := 1
+	if info, ok := tasks.InfoFromContext(ctx); ok {
+		attempt = info.RetryCount + 1
+	}
+
+	start := time.Now()
+	status, err := m.send(ctx, ep, p)
+
+	uid, _ := id.SimpleUUID()
+	d := Delivery{
+		ID:         uid,
+		EndpointID: ep.ID,
+		Realm:      ep.Realm,
+		EventID:    p.EventID,
+		Topic:      p.Topic,
+		Attempt:    attempt,
+		Status:     status,
+		Duration:   time.Since(start).Milliseconds(),
+		Created:    timestamp.Now(),
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if lerr := m.conf.Store.AddDelivery(ctx, &d); lerr != nil {
+		platform.ReportError(lerr)
+	}
+
+	updated, rerr := m.conf.Store.RecordResult(ctx, ep.Realm, ep.ID, err == nil, m.conf.MaxFailures)
+	if rerr != nil {
+		platform.ReportError(rerr)
+	}
+	if err == nil {
+		return nil
+	}
+	if updated != nil && updated.Disabled {
+		return tasks.Permanent(fmt.Errorf("%w: %v", ErrEndpointDisabled, err))
+	}
+	return err
+}
+
+// send posts the signed message to the endpoint and returns the HTTP status
+func (m *Manager) send(ctx context.Context, ep *Endpoint, p *deliveryPayload) (int, error) {
+	if err := checkURL(ep.URL, m.conf.Insecure); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(p.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "platform-webhooks")
+	req.Header.Set(HeaderEventID, p.EventID)
+	req.Header.Set(HeaderTopic, p.Topic)
+	req.Header.Set(HeaderSignature, Sign(ep.Secret, time.Now(), p.Body))
+
+	resp, err := m.conf.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
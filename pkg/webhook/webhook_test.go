@@ -0,0 +1,349 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/authentication"
+	"github.com/txsvc/platform/v2/pkg/tasks"
+	"github.com/txsvc/platform/v2/provider/local"
+)
+
+func newTestManager(t *testing.T, maxFailures int) (*Manager, *local.LocalTaskProviderImpl) {
+	q := local.NewLocalTaskProvider(local.TaskQueueConfig{Workers: 1})
+
+	r := tasks.New(tasks.Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+
+	m, err := New(Config{
+		Store:       NewMemoryStore(),
+		Tasks:       r,
+		MaxFailures: maxFailures,
+		Insecure:    true, // the test servers listen on http://127.0.0.1
+		Retry: provider.RetryPolicy{
+			MaxAttempts: 5,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  5 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+
+	return m, q
+}
+
+func newTestEvent(t *testing.T, topic, realm string) *provider.Event {
+	e, err := provider.NewEvent(topic, map[string]string{"user_id": "me"}, AttributeRealm, realm)
+	require.NoError(t, err)
+	e.ID = "evt1"
+	e.Published = time.Now()
+	return e
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"id":"evt1"}`)
+
+	sig := Sign("secret", time.Now(), body)
+	assert.True(t, strings.HasPrefix(sig, "t="))
+	assert.NoError(t, Verify("secret", sig, body, 0))
+
+	assert.Equal(t, ErrInvalidSignature, Verify("wrong", sig, body, 0))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", sig, []byte(`{"id":"evt2"}`), 0))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", "", body, 0))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", "t=abc,v1=0000", body, 0))
+
+	old := Sign("secret", time.Now().Add(-time.Hour), body)
+	assert.Equal(t, ErrSignatureExpired, Verify("secret", old, body, 0))
+	assert.NoError(t, Verify("secret", old, body, 2*time.Hour))
+}
+
+func TestEndpointMatches(t *testing.T) {
+	ep, err := NewEndpoint("realm", "https://example.com/hook", "account.*", "authorization.login")
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, ep.ID)
+	assert.True(t, strings.HasPrefix(ep.Secret, "whsec-"))
+
+	assert.True(t, ep.Matches("account.created"))
+	assert.True(t, ep.Matches("authorization.login"))
+	assert.False(t, ep.Matches("authorization.logout"))
+	assert.False(t, ep.Matches("accounts.created"))
+
+	ep.Topics = []string{AllTopics}
+	assert.True(t, ep.Matches("authorization.logout"))
+
+	_, err = NewEndpoint("realm", "ftp://example.com", "account.created")
+	assert.Equal(t, ErrInvalidURL, err)
+	_, err = NewEndpoint("realm", "http://example.com", "account.created")
+	assert.Equal(t, ErrInvalidURL, err)
+	_, err = NewEndpoint("realm", "https://example.com", "Account Created")
+	assert.Equal(t, provider.ErrInvalidTopic, err)
+	_, err = NewEndpoint("", "https://example.com", "account.created")
+	assert.Equal(t, ErrInvalidEndpoint, err)
+}
+
+func TestCheckURL(t *testing.T) {
+	assert.NoError(t, checkURL("https://example.com/hook", false))
+	assert.NoError(t, checkURL("https://8.8.8.8/hook", false))
+
+	assert.Equal(t, ErrInvalidURL, checkURL("http://example.com/hook", false))
+	assert.Equal(t, ErrInvalidURL, checkURL("example.com", false))
+
+	for _, u := range []string{
+		"https://localhost/hook",
+		"https://127.0.0.1:8080/hook",
+		"https://[::1]/hook",
+		"https://0.0.0.0/hook",
+		"https://10.1.2.3/hook",
+		"https://172.20.0.1/hook",
+		"https://192.168.1.1/hook",
+		"https://169.254.169.254/computeMetadata/v1/",
+		"https://[fd00:ec2::254]/hook",
+		"https://[::ffff:10.0.0.1]/hook",
+	} {
+		assert.Equal(t, ErrBlockedAddress, checkURL(u, false), u)
+		assert.NoError(t, checkURL(u, true), u)
+	}
+	assert.NoError(t, checkURL("http://127.0.0.1:8080/hook", true))
+	assert.Equal(t, ErrInvalidURL, checkURL("ftp://127.0.0.1/hook", true))
+}
+
+func TestBlockedDelivery(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	// the address is checked when connecting, independent of the URL
+	_, err := newClient(time.Second, false).Get(srv.URL)
+	assert.True(t, errors.Is(err, ErrBlockedAddress))
+	resp, err := newClient(time.Second, true).Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	atomic.StoreInt32(&calls, 0)
+
+	q := local.NewLocalTaskProvider(local.TaskQueueConfig{Workers: 1})
+	defer q.Close()
+	r := tasks.New(tasks.Config{Token: "secret", Provider: q})
+	q.RegisterHandler(provider.HttpMethodPost, r.Route(), r.Endpoint)
+
+	m, err := New(Config{Store: NewMemoryStore(), Tasks: r, Retry: provider.RetryPolicy{MaxAttempts: 1}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// an endpoint that was stored before its URL was validated
+	ep, _ := newEndpoint("realm", srv.URL, true, AllTopics)
+	require.NoError(t, m.Store().PutEndpoint(ctx, ep))
+
+	assert.NoError(t, m.Dispatch(ctx, newTestEvent(t, "account.created", "realm")))
+	q.Wait()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	deliveries, _ := m.Store().ListDeliveries(ctx, "realm", ep.ID, 10)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, ErrInvalidURL.Error(), deliveries[0].Error)
+}
+
+func TestDelivery(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	m, q := newTestManager(t, 3)
+	defer q.Close()
+	ctx := context.Background()
+
+	ep, _ := newEndpoint("realm", srv.URL, true, "account.*")
+	other, _ := newEndpoint("other", srv.URL, true, AllTopics)
+	require.NoError(t, m.Store().PutEndpoint(ctx, ep))
+	require.NoError(t, m.Store().PutEndpoint(ctx, other))
+
+	assert.NoError(t, m.Dispatch(ctx, newTestEvent(t, "account.created", "realm")))
+	assert.NoError(t, m.Dispatch(ctx, newTestEvent(t, "authorization.login", "realm")))
+	q.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 1)
+
+	r := received[0]
+	assert.Equal(t, "evt1", r.Header.Get(HeaderEventID))
+	assert.Equal(t, "account.created", r.Header.Get(HeaderTopic))
+	assert.NoError(t, Verify(ep.Secret, r.Header.Get(HeaderSignature), bodies[0], 0))
+
+	var msg Message
+	require.NoError(t, json.Unmarshal(bodies[0], &msg))
+	assert.Equal(t, "evt1", msg.ID)
+	assert.Equal(t, "realm", msg.Realm)
+	assert.JSONEq(t, `{"user_id":"me"}`, string(msg.Data))
+
+	deliveries, err := m.Store().ListDeliveries(ctx, "realm", ep.ID, 10)
+	assert.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, http.StatusOK, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempt)
+}
+
+func TestRetryAndDisable(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	m, q := newTestManager(t, 3)
+	defer q.Close()
+	ctx := context.Background()
+
+	ep, _ := newEndpoint("realm", srv.URL, true, AllTopics)
+	require.NoError(t, m.Store().PutEndpoint(ctx, ep))
+
+	// fails twice, succeeds on the third attempt
+	assert.NoError(t, m.Dispatch(ctx, newTestEvent(t, "account.created", "realm")))
+	q.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	deliveries, _ := m.Store().ListDeliveries(ctx, "realm", ep.ID, 10)
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].Status)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[2].Status)
+	assert.NotEmpty(t, deliveries[2].Error)
+
+	updated, _ := m.Store().GetEndpoint(ctx, "realm", ep.ID)
+	assert.Equal(t, 0, updated.Failures)
+	assert.False(t, updated.Disabled)
+
+	// always fails, the endpoint is disabled after 3 failures
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	atomic.StoreInt32(&calls, 0)
+
+	e := newTestEvent(t, "account.created", "realm")
+	e.ID = "evt2"
+	assert.NoError(t, m.Dispatch(ctx, e))
+	q.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	updated, _ = m.Store().GetEndpoint(ctx, "realm", ep.ID)
+	assert.True(t, updated.Disabled)
+	assert.Equal(t, 3, updated.Failures)
+
+	// disabled endpoints receive nothing
+	e.ID = "evt3"
+	assert.NoError(t, m.Dispatch(ctx, e))
+	q.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestMemoryStoreMaxDeliveries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	s.MaxDeliveries = 3
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, s.AddDelivery(ctx, &Delivery{ID: fmt.Sprintf("d%d", i), Realm: "realm", EndpointID: "ep", Attempt: i}))
+	}
+
+	deliveries, err := s.ListDeliveries(ctx, "realm", "ep", 10)
+	assert.NoError(t, err)
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, "d5", deliveries[0].ID)
+	assert.Equal(t, "d3", deliveries[2].ID)
+}
+
+func TestManagementEndpoints(t *testing.T) {
+	m, q := newTestManager(t, 3)
+	defer q.Close()
+
+	e := echo.New()
+	principal := &authentication.Principal{Realm: "realm", Scopes: []string{authentication.ScopeAPIAdmin}}
+
+	call := func(method, path, body string, h echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set(authentication.PrincipalContextKey, principal)
+		if id != "" {
+			c.SetParamNames(ParamEndpointID)
+			c.SetParamValues(id)
+		}
+		assert.NoError(t, h(c))
+		return rec
+	}
+
+	rec := call(http.MethodPost, "/webhooks", `{"url":"https://example.com/hook","topics":["account.*"]}`, m.CreateEndpoint, "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var ep Endpoint
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ep))
+	assert.Equal(t, "realm", ep.Realm)
+	assert.NotEmpty(t, ep.Secret)
+
+	rec = call(http.MethodPost, "/webhooks", `{"url":"example.com","topics":["account.*"]}`, m.CreateEndpoint, "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = call(http.MethodGet, "/webhooks", "", m.ListEndpoints, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var endpoints []*Endpoint
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &endpoints))
+	require.Len(t, endpoints, 1)
+	assert.Empty(t, endpoints[0].Secret)
+
+	// disable the endpoint, then enable it again
+	_, err := m.Store().RecordResult(context.Background(), "realm", ep.ID, false, 1)
+	require.NoError(t, err)
+	rec = call(http.MethodPost, "/webhooks/"+ep.ID+"/enable", "", m.EnableEndpoint, ep.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	updated, _ := m.Store().GetEndpoint(context.Background(), "realm", ep.ID)
+	assert.False(t, updated.Disabled)
+	assert.Equal(t, 0, updated.Failures)
+
+	rec = call(http.MethodGet, "/webhooks/"+ep.ID+"/deliveries", "", m.ListDeliveries, ep.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// other realms can't see the endpoint
+	principal.Realm = "other"
+	rec = call(http.MethodDelete, "/webhooks/"+ep.ID, "", m.DeleteEndpoint, ep.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	principal.Realm = "realm"
+	rec = call(http.MethodDelete, "/webhooks/"+ep.ID, "", m.DeleteEndpoint, ep.ID)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = call(http.MethodPost, "/webhooks/"+ep.ID+"/enable", "", m.EnableEndpoint, ep.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
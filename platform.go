@@ -18,10 +18,11 @@ type (
 		errorReportingProvider provider.ErrorReportingProvider
 		metricsProvdider       provider.MetricsProvider
 		httpContextProvider    provider.HttpContextProvider
+		eventBusProvider       provider.EventBusProvider
 
 		logger    map[string]provider.LoggingProvider
 		providers map[provider.ProviderType]provider.ProviderConfig
-		instances map[provider.ProviderType]provider.GenericProvider
+		instances map[provider.ProviderType]interface{}
 	}
 )
 
@@ -41,8 +42,9 @@ func reset() {
 	contextConfig := provider.WithProvider("platform.null.context", provider.TypeHttpContext, provider.NewDefaultProvider)
 	metricsConfig := provider.WithProvider("platform.null.metrics", provider.TypeMetrics, provider.NewDefaultProvider)
 	authenticationConfig := provider.WithProvider("platform.null.authentication", provider.TypeAuthentication, provider.NewDefaultProvider)
+	eventBusConfig := provider.WithProvider("platform.null.eventbus", provider.TypeEventBus, provider.NewDefaultProvider)
 
-	p, err := InitPlatform(context.Background(), loggingConfig, errorReportingConfig, contextConfig, metricsConfig, authenticationConfig)
+	p, err := InitPlatform(context.Background(), loggingConfig, errorReportingConfig, contextConfig, metricsConfig, authenticationConfig, eventBusConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -54,6 +56,7 @@ func InitPlatform(ctx context.Context, opts ...provider.ProviderConfig) (*Platfo
 	p := Platform{
 		logger:    make(map[string]provider.LoggingProvider),
 		providers: make(map[provider.ProviderType]provider.ProviderConfig),
+		instances: make(map[provider.ProviderType]interface{}),
 	}
 
 	if err := p.RegisterProviders(false, opts...); err != nil {
@@ -75,6 +78,7 @@ func RegisterPlatform(p *Platform) *Platform {
 
 // RegisterProviders registers one or more  providers.
 // An existing provider will be overwritten if ignoreExists is true, otherwise the function returns an error.
+// The function also returns an error if a provider could not be created, the previous provider is kept in this case.
 func (p *Platform) RegisterProviders(ignoreExists bool, opts ...provider.ProviderConfig) error {
 	for _, opt := range opts {
 
@@ -83,26 +87,61 @@ func (p *Platform) RegisterProviders(ignoreExists bool, opts ...provider.Provide
 				return fmt.Errorf("provider of type '%s' already registered", opt.Type.String())
 			}
 		}
-		p.providers[opt.Type] = opt
 
-		switch opt.Type {
-		case provider.TypeErrorReporter:
-			p.errorReportingProvider = opt.Impl().(provider.ErrorReportingProvider)
-		case provider.TypeHttpContext:
-			p.httpContextProvider = opt.Impl().(provider.HttpContextProvider)
-		case provider.TypeMetrics:
-			p.metricsProvdider = opt.Impl().(provider.MetricsProvider)
+		// loggers are created on demand, one instance per logID
+		if opt.Type == provider.TypeLogger {
+			p.providers[opt.Type] = opt
+			continue
+		}
+
+		// all other providers are created once and shared
+		instance := opt.Impl()
+		if instance == nil {
+			return fmt.Errorf("provider '%s' of type '%s' could not be created", opt.ID, opt.Type.String())
 		}
+		p.providers[opt.Type] = opt
+		p.setInstance(opt.Type, instance)
 	}
 	return nil
 }
 
+// setInstance replaces the shared instance of a provider type. The replaced instance is shut down,
+// a nil instance removes the provider.
+func (p *Platform) setInstance(providerType provider.ProviderType, instance interface{}) {
+	if old, ok := p.instances[providerType]; ok && old != instance {
+		if gp, ok := old.(provider.GenericProvider); ok {
+			if err := gp.Close(); err != nil && p.errorReportingProvider != nil {
+				p.errorReportingProvider.ReportError(err)
+			}
+		}
+	}
+
+	if instance == nil {
+		delete(p.instances, providerType)
+	} else {
+		p.instances[providerType] = instance
+	}
+
+	switch providerType {
+	case provider.TypeErrorReporter:
+		p.errorReportingProvider, _ = instance.(provider.ErrorReportingProvider)
+	case provider.TypeHttpContext:
+		p.httpContextProvider, _ = instance.(provider.HttpContextProvider)
+	case provider.TypeMetrics:
+		p.metricsProvdider, _ = instance.(provider.MetricsProvider)
+	case provider.TypeEventBus:
+		p.eventBusProvider, _ = instance.(provider.EventBusProvider)
+	}
+}
+
 // Close iterates over all registered providers and shuts them down.
 func (p *Platform) Close() error {
 	hasError := false
-	for _, provider := range p.instances {
-		if err := provider.Close(); err != nil {
-			hasError = true
+	for _, instance := range p.instances {
+		if gp, ok := instance.(provider.GenericProvider); ok {
+			if err := gp.Close(); err != nil {
+				hasError = true
+			}
 		}
 	}
 	if hasError {
@@ -128,6 +167,9 @@ func Provider(providerType provider.ProviderType) (interface{}, bool) {
 	if !ok {
 		return nil, false
 	}
+	if instance, ok := platform.instances[providerType]; ok {
+		return instance, true
+	}
 	return opt.Impl(), true
 }
 
@@ -149,15 +191,50 @@ func Logger(logID string) provider.LoggingProvider {
 
 // Meter logs args to a metrics log from where the values can be aggregated and analyzed.
 func Meter(ctx context.Context, metric string, args ...string) {
+	if platform.metricsProvdider == nil {
+		return
+	}
 	platform.metricsProvdider.Meter(ctx, metric, args...)
 }
 
 // ReportError reports error e using the current platform's error reporting provider
+// Without an error reporting provider, the error is written to the standard logger.
 func ReportError(e error) {
+	if platform.errorReportingProvider == nil {
+		log.Println(e)
+		return
+	}
 	platform.errorReportingProvider.ReportError(e)
 }
 
 // NewHttpContext creates a new Http context for request req
 func NewHttpContext(req *h.Request) context.Context {
+	if platform.httpContextProvider == nil {
+		if req == nil {
+			return context.Background()
+		}
+		return req.Context()
+	}
 	return platform.httpContextProvider.NewHttpContext(req)
 }
+
+// Publish sends an event with payload to all subscribers of topic. The attributes are key/value pairs.
+// Without an event bus provider, the event is dropped.
+func Publish(ctx context.Context, topic string, payload interface{}, attributes ...string) error {
+	if platform.eventBusProvider == nil {
+		return nil
+	}
+	e, err := provider.NewEvent(topic, payload, attributes...)
+	if err != nil {
+		return err
+	}
+	return platform.eventBusProvider.Publish(ctx, e)
+}
+
+// Subscribe creates subscription name on topic, using the current platform's event bus provider
+func Subscribe(topic, name string, h provider.EventHandler) (provider.Subscription, error) {
+	if platform.eventBusProvider == nil {
+		return nil, fmt.Errorf(MsgMissingProvider, provider.TypeEventBus.String())
+	}
+	return platform.eventBusProvider.Subscribe(topic, name, h)
+}
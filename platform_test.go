@@ -12,6 +12,7 @@ import (
 
 type (
 	TestProviderImpl struct {
+		closed bool
 	}
 )
 
@@ -19,6 +20,14 @@ func newTestProvider() interface{} {
 	return &TestProviderImpl{}
 }
 
+func (c *TestProviderImpl) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *TestProviderImpl) Meter(ctx context.Context, metric string, args ...string) {
+}
+
 func (c *TestProviderImpl) NewHttpContext(req *htp.Request) context.Context {
 	return context.Background()
 }
@@ -164,3 +173,64 @@ func TestGetProviderFailure(t *testing.T) {
 	assert.False(t, ok)
 	assert.Nil(t, p1)
 }
+
+func TestProviderInstanceIsShared(t *testing.T) {
+	reset()
+
+	p1, ok := Provider(provider.TypeMetrics)
+	assert.True(t, ok)
+	p2, ok := Provider(provider.TypeMetrics)
+	assert.True(t, ok)
+
+	assert.Same(t, p1, p2)
+	assert.NoError(t, Close())
+}
+
+func TestPublishWithDefaultProvider(t *testing.T) {
+	reset()
+
+	p, ok := Provider(provider.TypeEventBus)
+	assert.True(t, ok)
+	assert.NotNil(t, p.(provider.EventBusProvider))
+
+	assert.NoError(t, Publish(context.Background(), "account.created", nil, "realm", "test"))
+	assert.Equal(t, provider.ErrInvalidTopic, Publish(context.Background(), "Account Created", nil))
+
+	sub, err := Subscribe("account.created", "test", func(ctx context.Context, e *provider.Event) error { return nil })
+	assert.NoError(t, err)
+	assert.NoError(t, sub.Unsubscribe())
+}
+
+func TestReplaceProvider(t *testing.T) {
+	reset()
+
+	p := DefaultPlatform()
+	assert.NoError(t, p.RegisterProviders(true, provider.WithProvider("test", provider.TypeMetrics, newTestProvider)))
+
+	old, ok := Provider(provider.TypeMetrics)
+	assert.True(t, ok)
+	assert.NoError(t, p.RegisterProviders(true, provider.WithProvider("test", provider.TypeMetrics, newTestProvider)))
+	assert.True(t, old.(*TestProviderImpl).closed)
+
+	// a provider without an instance does not replace the current one
+	current, _ := Provider(provider.TypeMetrics)
+	created := 0
+	assert.Error(t, p.RegisterProviders(true, provider.WithProvider("nil", provider.TypeMetrics, func() interface{} {
+		created++
+		return nil
+	})))
+	assert.False(t, current.(*TestProviderImpl).closed)
+	assert.Same(t, current, p.metricsProvdider)
+	instance, ok := Provider(provider.TypeMetrics)
+	assert.True(t, ok)
+	assert.Same(t, current, instance)
+	assert.Equal(t, 1, created)
+	assert.NotPanics(t, func() { Meter(context.Background(), "test") })
+
+	// no provider at all
+	p.setInstance(provider.TypeMetrics, nil)
+	assert.Nil(t, p.metricsProvdider)
+	assert.NotPanics(t, func() { Meter(context.Background(), "test") })
+	p.setInstance(provider.TypeHttpContext, nil)
+	assert.NotNil(t, NewHttpContext(nil))
+}
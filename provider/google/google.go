@@ -3,15 +3,23 @@ package google
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	h "net/http"
+	"sync"
+	"time"
 
 	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	stackdriver_error "cloud.google.com/go/errorreporting"
 	stackdriver_logging "cloud.google.com/go/logging"
 	"google.golang.org/appengine"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/txsvc/platform/v2"
 	"github.com/txsvc/platform/v2/pkg/apis/provider"
@@ -31,11 +39,40 @@ type (
 		logger *stackdriver_logging.Logger
 	}
 
+	// CloudTasksConfig configures the Cloud Tasks provider
+	CloudTasksConfig struct {
+		ProjectID  string
+		LocationID string
+		// Queue is the default queue, HttpTask.Queue selects a different one
+		Queue string
+		// ServiceAccount is the email of the service account used to generate OIDC or OAuth tokens
+		ServiceAccount string
+		// TokenType selects the token that is generated for HTTP targets: TokenTypeOIDC, TokenTypeOAuth or none.
+		// A task with a static Token always uses the static token.
+		TokenType string
+		// Audience of OIDC tokens, the URL of the task is used if empty
+		Audience string
+		// Scope of OAuth tokens, DefaultOAuthScope is used if empty
+		Scope string
+	}
+
 	CloudTaskProviderImpl struct {
 		client *cloudtasks.Client
+		conf   CloudTasksConfig
+		// retryIgnored reports the first task with a retry policy, Cloud Tasks only supports them per queue
+		retryIgnored sync.Once
 	}
 )
 
+const (
+	// token types generated by Cloud Tasks
+	TokenTypeOIDC  = "oidc"
+	TokenTypeOAuth = "oauth"
+
+	// DefaultOAuthScope is the scope of OAuth tokens, it grants access to Google APIs
+	DefaultOAuthScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
 var (
 	// Google Cloud Platform
 	GoogleErrorReportingConfig provider.ProviderConfig = provider.WithProvider("platform.google.errorreporting", provider.TypeErrorReporter, NewStackdriverErrorReportingProvider)
@@ -47,10 +84,11 @@ var (
 
 	client *stackdriver_logging.Client
 
+	// ErrMissingQueue indicates that a queue was not named
+	ErrMissingQueue = errors.New("missing queue")
+
 	// UserAgentString identifies any http request podops makes
 	userAgentString string = "txsvc/platform 1.0.0"
-	// workerQueue is the main worker queue for all the background tasks
-	workerQueue string = fmt.Sprintf("projects/%s/locations/%s/queues/%s", env.GetString("PROJECT_ID", ""), env.GetString("LOCATION_ID", ""), env.GetString("DEFAULT_QUEUE", ""))
 
 	// Interface guards
 	_ provider.GenericProvider     = (*AppEngineContextImpl)(nil)
@@ -185,55 +223,205 @@ func (l *StackdriverLoggingProviderImpl) Meter(ctx context.Context, metric strin
 	l.LogWithLevel(provider.LevelInfo, metric, args...)
 }
 
+// NewCloudTasksProvider creates a Cloud Tasks provider that is configured from the environment:
+// PROJECT_ID, LOCATION_ID, DEFAULT_QUEUE, TASKS_SERVICE_ACCOUNT, TASKS_TOKEN_TYPE and TASKS_AUDIENCE.
 func NewCloudTasksProvider() interface{} {
-	client, err := cloudtasks.NewClient(context.Background())
+	conf := CloudTasksConfig{
+		ProjectID:      env.GetString("PROJECT_ID", ""),
+		LocationID:     env.GetString("LOCATION_ID", ""),
+		Queue:          env.GetString("DEFAULT_QUEUE", ""),
+		ServiceAccount: env.GetString("TASKS_SERVICE_ACCOUNT", ""),
+		TokenType:      env.GetString("TASKS_TOKEN_TYPE", ""),
+		Audience:       env.GetString("TASKS_AUDIENCE", ""),
+	}
+
+	t, err := NewCloudTasks(context.Background(), conf)
 	if err != nil {
+		log.Printf("could not create the Cloud Tasks client: %v", err)
 		return nil
 	}
+	return t
+}
+
+// NewCloudTasks creates a Cloud Tasks provider
+func NewCloudTasks(ctx context.Context, conf CloudTasksConfig) (*CloudTaskProviderImpl, error) {
+	if conf.TokenType != "" && conf.TokenType != TokenTypeOIDC && conf.TokenType != TokenTypeOAuth {
+		return nil, fmt.Errorf("unsupported token type '%s'", conf.TokenType)
+	}
+	if conf.TokenType != "" && conf.ServiceAccount == "" {
+		return nil, fmt.Errorf("token type '%s' requires a service account", conf.TokenType)
+	}
+
+	client, err := cloudtasks.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	return &CloudTaskProviderImpl{
 		client: client,
+		conf:   conf,
+	}, nil
+}
+
+// QueuePath returns the full path of queue name, or of the default queue if name is empty
+func (conf *CloudTasksConfig) QueuePath(name string) string {
+	if name == "" {
+		name = conf.Queue
 	}
+	return fmt.Sprintf("projects/%s/locations/%s/queues/%s", conf.ProjectID, conf.LocationID, name)
 }
 
 func (c *CloudTaskProviderImpl) Close() error {
-	return nil
+	return c.client.Close()
 }
 
 func (t *CloudTaskProviderImpl) CreateHttpTask(ctx context.Context, task provider.HttpTask) error {
+	req, err := newCreateTaskRequest(&t.conf, task)
+	if err != nil {
+		return err
+	}
+	if task.RetryPolicy != nil {
+		t.retryIgnored.Do(func() {
+			platform.ReportError(fmt.Errorf("retry policies of tasks are not supported, the retry config of queue '%s' is used", req.Parent))
+		})
+	}
+
+	_, err = t.client.CreateTask(ctx, req)
+	if status.Code(err) == codes.AlreadyExists {
+		return provider.ErrTaskAlreadyExists
+	}
+	return err
+}
+
+// CreateHttpTasks creates a batch of tasks. Cloud Tasks has no batch API, the tasks are created in parallel.
+func (t *CloudTaskProviderImpl) CreateHttpTasks(ctx context.Context, tasks []provider.HttpTask) error {
+	return provider.CreateHttpTasksConcurrently(ctx, tasks, provider.DefaultBatchConcurrency, t.CreateHttpTask)
+}
+
+// SetQueueRetryPolicy updates the retry configuration of a queue. Cloud Tasks only supports retry policies
+// per queue, the RetryPolicy of a HttpTask is ignored. The queue must be named explicitly, the change
+// applies to all tasks of the queue.
+func (t *CloudTaskProviderImpl) SetQueueRetryPolicy(ctx context.Context, queue string, policy provider.RetryPolicy) error {
+	if queue == "" {
+		return ErrMissingQueue
+	}
+
+	conf := &taskspb.RetryConfig{
+		MaxAttempts:  int32(policy.MaxAttempts),
+		MaxDoublings: int32(policy.MaxDoublings),
+	}
+	if policy.MaxAttempts < 0 {
+		conf.MaxAttempts = -1 // unlimited
+	}
+	if policy.MinBackoff > 0 {
+		conf.MinBackoff = durationpb.New(policy.MinBackoff)
+	}
+	if policy.MaxBackoff > 0 {
+		conf.MaxBackoff = durationpb.New(policy.MaxBackoff)
+	}
+	if policy.MaxRetryDuration > 0 {
+		conf.MaxRetryDuration = durationpb.New(policy.MaxRetryDuration)
+	}
+
+	req := &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:        t.conf.QueuePath(queue),
+			RetryConfig: conf,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"retry_config"}},
+	}
+
+	_, err := t.client.UpdateQueue(ctx, req)
+	return err
+}
+
+// newCreateTaskRequest translates task into a Cloud Tasks request, either for an HTTP or an App Engine target
+func newCreateTaskRequest(conf *CloudTasksConfig, task provider.HttpTask) (*taskspb.CreateTaskRequest, error) {
+	queue := conf.QueuePath(task.Queue)
 
 	headers := map[string]string{
 		"Content-Type": "application/json",
-		"User-Agent":   userAgentString,
 	}
+	for k, v := range task.Headers {
+		headers[k] = v
+	}
+	headers["User-Agent"] = userAgentString
 	if task.Token != "" {
 		headers["Authorization"] = fmt.Sprintf("Bearer %s", task.Token)
 	}
 
-	req := &taskspb.CreateTaskRequest{
-		Parent: workerQueue,
-		Task: &taskspb.Task{
-			MessageType: &taskspb.Task_HttpRequest{
-				HttpRequest: &taskspb.HttpRequest{
-					HttpMethod: toHttpMethod(task.Method),
-					Url:        task.Request,
-					Headers:    headers,
-				},
-			},
-		},
-	}
-
+	var body []byte
 	if task.Payload != nil {
 		// marshal the payload
 		b, err := json.Marshal(task.Payload)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		req.Task.GetHttpRequest().Body = b
+		body = b
 	}
 
-	_, err := t.client.CreateTask(ctx, req)
-	return err
+	req := &taskspb.CreateTaskRequest{
+		Parent: queue,
+		Task:   &taskspb.Task{},
+	}
+
+	if task.AppEngine != nil {
+		req.Task.MessageType = &taskspb.Task_AppEngineHttpRequest{
+			AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+				HttpMethod: toHttpMethod(task.Method),
+				AppEngineRouting: &taskspb.AppEngineRouting{
+					Service:  task.AppEngine.Service,
+					Version:  task.AppEngine.Version,
+					Instance: task.AppEngine.Instance,
+				},
+				RelativeUri: task.Request,
+				Headers:     headers,
+				Body:        body,
+			},
+		}
+	} else {
+		r := &taskspb.HttpRequest{
+			HttpMethod: toHttpMethod(task.Method),
+			Url:        task.Request,
+			Headers:    headers,
+			Body:       body,
+		}
+
+		// a static token takes precedence over generated tokens
+		if task.Token == "" {
+			switch conf.TokenType {
+			case TokenTypeOIDC:
+				audience := conf.Audience
+				if audience == "" {
+					audience = task.Request
+				}
+				r.AuthorizationHeader = &taskspb.HttpRequest_OidcToken{
+					OidcToken: &taskspb.OidcToken{ServiceAccountEmail: conf.ServiceAccount, Audience: audience},
+				}
+			case TokenTypeOAuth:
+				scope := conf.Scope
+				if scope == "" {
+					scope = DefaultOAuthScope
+				}
+				r.AuthorizationHeader = &taskspb.HttpRequest_OauthToken{
+					OauthToken: &taskspb.OAuthToken{ServiceAccountEmail: conf.ServiceAccount, Scope: scope},
+				}
+			}
+		}
+		req.Task.MessageType = &taskspb.Task_HttpRequest{HttpRequest: r}
+	}
+
+	if task.Name != "" {
+		req.Task.Name = fmt.Sprintf("%s/tasks/%s", queue, task.Name)
+	}
+	if eta := task.ScheduleTime(time.Now()); !eta.IsZero() {
+		req.Task.ScheduleTime = timestamppb.New(eta)
+	}
+	if task.DispatchDeadline > 0 {
+		req.Task.DispatchDeadline = durationpb.New(task.DispatchDeadline)
+	}
+
+	return req, nil
 }
 
 func toHttpMethod(m provider.HttpMethod) taskspb.HttpMethod {
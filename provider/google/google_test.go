@@ -61,6 +61,57 @@ func TTestCloudTasks(t *testing.T) {
 	}
 }
 
+func TestCreateTaskRequest(t *testing.T) {
+	conf := CloudTasksConfig{
+		ProjectID:      "podops",
+		LocationID:     "europe-west3",
+		Queue:          "default",
+		ServiceAccount: "tasks@podops.iam.gserviceaccount.com",
+		TokenType:      TokenTypeOIDC,
+	}
+
+	// HTTP target with a generated OIDC token
+	req, err := newCreateTaskRequest(&conf, provider.HttpTask{Request: "https://podops.dev/_tasks/sync", Name: "sync-42"})
+	require.NoError(t, err)
+	assert.Equal(t, "projects/podops/locations/europe-west3/queues/default", req.Parent)
+	assert.Equal(t, "projects/podops/locations/europe-west3/queues/default/tasks/sync-42", req.Task.Name)
+
+	oidc := req.Task.GetHttpRequest().GetOidcToken()
+	if assert.NotNil(t, oidc) {
+		assert.Equal(t, conf.ServiceAccount, oidc.ServiceAccountEmail)
+		assert.Equal(t, "https://podops.dev/_tasks/sync", oidc.Audience)
+	}
+
+	// a static token takes precedence
+	req, err = newCreateTaskRequest(&conf, provider.HttpTask{Request: "https://podops.dev/_tasks/sync", Token: "abc123"})
+	require.NoError(t, err)
+	assert.Nil(t, req.Task.GetHttpRequest().GetOidcToken())
+	assert.Equal(t, "Bearer abc123", req.Task.GetHttpRequest().Headers["Authorization"])
+
+	// App Engine target on a different queue
+	req, err = newCreateTaskRequest(&conf, provider.HttpTask{
+		Method:    provider.HttpMethodPost,
+		Request:   "/_tasks/sync",
+		Queue:     "background",
+		AppEngine: &provider.AppEngineTarget{Service: "worker"},
+		Payload:   map[string]string{"id": "42"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "projects/podops/locations/europe-west3/queues/background", req.Parent)
+
+	ae := req.Task.GetAppEngineHttpRequest()
+	if assert.NotNil(t, ae) {
+		assert.Equal(t, "/_tasks/sync", ae.RelativeUri)
+		assert.Equal(t, "worker", ae.AppEngineRouting.Service)
+		assert.JSONEq(t, `{"id":"42"}`, string(ae.Body))
+	}
+}
+
+func TestSetQueueRetryPolicy(t *testing.T) {
+	tp := CloudTaskProviderImpl{conf: CloudTasksConfig{ProjectID: "podops", LocationID: "europe-west3", Queue: "default"}}
+	assert.Equal(t, ErrMissingQueue, tp.SetQueueRetryPolicy(context.Background(), "", provider.RetryPolicy{MaxAttempts: 3}))
+}
+
 func TestCloudLogging(t *testing.T) {
 	require.True(t, env.Assert("PROJECT_ID"))
 	require.True(t, env.Assert("GOOGLE_APPLICATION_CREDENTIALS"))
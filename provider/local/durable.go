@@ -0,0 +1,422 @@
+package local
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+)
+
+const (
+	// DefaultTaskVisibilityTimeout is the time a dispatched task stays invisible before it is delivered again
+	DefaultTaskVisibilityTimeout = 60 * time.Second
+
+	// write-ahead log operations
+	walEnqueue = "enqueue"
+	walRetry   = "retry"
+	walAck     = "ack"
+	walDrop    = "drop"
+	walName    = "name"
+)
+
+type (
+	// DurableTaskProviderImpl is a task queue that survives process restarts.
+	// Every task is written to a write-ahead log before it is queued and is acknowledged
+	// once it was delivered. On startup, all unacknowledged tasks are dispatched again.
+	DurableTaskProviderImpl struct {
+		*LocalTaskProviderImpl
+		wal *taskLog
+	}
+
+	// taskLog implements the taskJournal interface
+	taskLog struct {
+		visibility time.Duration
+		queue      *LocalTaskProviderImpl
+
+		mu     sync.Mutex
+		file   *os.File
+		leases map[string]*taskLease
+
+		quit chan struct{}
+		done chan struct{}
+	}
+
+	taskLease struct {
+		lt    *localTask
+		until time.Time
+	}
+
+	walRecord struct {
+		Op       string             `json:"op"`
+		ID       string             `json:"id"`
+		Task     *provider.HttpTask `json:"task,omitempty"`
+		Body     []byte             `json:"body,omitempty"`
+		Attempts int                `json:"attempts,omitempty"`
+		First    int64              `json:"first,omitempty"`  // time of the first attempt, unix nanoseconds
+		Failed   int64              `json:"failed,omitempty"` // time of the final failure, unix nanoseconds
+		Error    string             `json:"error,omitempty"`
+		Expires  int64              `json:"expires,omitempty"` // end of the reservation of a task name, unix nanoseconds
+	}
+)
+
+var (
+	DurableTaskConfig provider.ProviderConfig = provider.WithProvider("platform.default.task.durable", provider.TypeTask, LocalDurableTaskProvider)
+
+	// Interface guards
+	_ provider.GenericProvider  = (*DurableTaskProviderImpl)(nil)
+	_ provider.HttpTaskProvider = (*DurableTaskProviderImpl)(nil)
+	_ provider.DeadLetterQueue  = (*DurableTaskProviderImpl)(nil)
+	_ taskJournal               = (*taskLog)(nil)
+)
+
+// LocalDurableTaskProvider creates a disk-backed task queue that is configured from the environment:
+// TASK_QUEUE_LOG, TASK_VISIBILITY_TIMEOUT (seconds), TASK_WORKERS, TASK_MAX_ATTEMPTS and TASK_MAX_RETRY_DURATION (seconds).
+func LocalDurableTaskProvider() interface{} {
+	path := env.GetString("TASK_QUEUE_LOG", "tasks.wal")
+	visibility := time.Duration(env.GetInt("TASK_VISIBILITY_TIMEOUT", int64(DefaultTaskVisibilityTimeout/time.Second))) * time.Second
+
+	t, err := NewDurableTaskProvider(path, visibility, taskQueueConfigFromEnv())
+	if err != nil {
+		platform.ReportError(fmt.Errorf("could not open the task queue '%s': %v", path, err))
+		return nil
+	}
+	return t
+}
+
+// NewDurableTaskProvider opens the write-ahead log at path, compacts it and dispatches all tasks that were not acknowledged before.
+// Dead-lettered tasks are kept in the log until they are requeued, task names stay reserved across restarts.
+func NewDurableTaskProvider(path string, visibility time.Duration, conf TaskQueueConfig) (*DurableTaskProviderImpl, error) {
+	if visibility <= 0 {
+		visibility = DefaultTaskVisibilityTimeout
+	}
+
+	pending, dead, names, err := recoverTasks(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := compactTaskLog(path, pending, dead, names); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := taskLog{
+		visibility: visibility,
+		file:       f,
+		leases:     make(map[string]*taskLease),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	wal.queue = newLocalTaskProvider(conf, &wal)
+	go wal.reaper()
+
+	for _, dt := range dead {
+		wal.queue.dead[dt.lt.name] = dt
+	}
+	for name, exp := range names {
+		wal.queue.names[name] = exp
+	}
+	wal.queue.trimDeadLetters()
+
+	// replay
+	for _, lt := range pending {
+		wal.queue.requeue(lt)
+	}
+
+	return &DurableTaskProviderImpl{
+		LocalTaskProviderImpl: wal.queue,
+		wal:                   &wal,
+	}, nil
+}
+
+// Close stops all workers and closes the write-ahead log. Pending tasks are dispatched on the next start.
+func (t *DurableTaskProviderImpl) Close() error {
+	if err := t.LocalTaskProviderImpl.Close(); err != nil {
+		return err
+	}
+	return t.wal.close()
+}
+
+// Enqueued persists a new task
+func (w *taskLog) Enqueued(lt *localTask) error {
+	task := lt.task
+	task.Payload = nil // the payload is already marshalled into body
+
+	rec := walRecord{Op: walEnqueue, ID: lt.name, Task: &task, Body: lt.body}
+	if task.Name != "" {
+		rec.Expires = time.Now().Add(DefaultTaskNameRetention).UnixNano()
+	}
+	return w.write(&rec, true)
+}
+
+// Leased hides the task for the duration of the visibility timeout
+func (w *taskLog) Leased(lt *localTask) {
+	w.mu.Lock()
+	w.leases[lt.name] = &taskLease{lt: lt, until: time.Now().Add(w.visibility)}
+	w.mu.Unlock()
+}
+
+// Acked removes the task from the log
+func (w *taskLog) Acked(lt *localTask) {
+	w.release(lt)
+	w.report(w.write(&walRecord{Op: walAck, ID: lt.name}, false))
+}
+
+// Retry records the number of attempts so far
+func (w *taskLog) Retry(lt *localTask) {
+	w.release(lt)
+	w.report(w.write(&walRecord{Op: walRetry, ID: lt.name, Attempts: lt.attempts, First: lt.first.UnixNano()}, false))
+}
+
+// Dropped marks a task that failed permanently as dead-lettered
+func (w *taskLog) Dropped(lt *localTask, err error) {
+	w.release(lt)
+	w.report(w.write(&walRecord{Op: walDrop, ID: lt.name, Attempts: lt.attempts, Failed: time.Now().UnixNano(), Error: err.Error()}, true))
+}
+
+func (w *taskLog) release(lt *localTask) {
+	w.mu.Lock()
+	delete(w.leases, lt.name)
+	w.mu.Unlock()
+}
+
+func (w *taskLog) write(rec *walRecord, sync bool) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return ErrTaskQueueClosed
+	}
+	if _, err := w.file.Write(b); err != nil {
+		return err
+	}
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+func (w *taskLog) report(err error) {
+	if err != nil {
+		platform.ReportError(err)
+	}
+}
+
+// reaper dispatches tasks again whose visibility timeout expired before they were acknowledged
+func (w *taskLog) reaper() {
+	interval := w.visibility / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(w.done)
+	}()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			expired := make([]*localTask, 0)
+
+			w.mu.Lock()
+			for name, l := range w.leases {
+				if now.After(l.until) {
+					delete(w.leases, name)
+					lt := *l.lt
+					expired = append(expired, &lt)
+				}
+			}
+			w.mu.Unlock()
+
+			for _, lt := range expired {
+				w.queue.requeue(lt)
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *taskLog) close() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.quit)
+	w.mu.Unlock()
+
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// recoverTasks replays the log and returns all tasks that were not acknowledged, in the order they were created,
+// all tasks that were dead-lettered, in the order they failed, and the task names that are still reserved
+func recoverTasks(path string) ([]*localTask, []*deadTask, map[string]time.Time, error) {
+	names := make(map[string]time.Time)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*localTask{}, []*deadTask{}, names, nil
+		}
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	tasks := make(map[string]*localTask)
+	order := make([]string, 0)
+	dead := make(map[string]*deadTask)
+	deadOrder := make([]string, 0)
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, nil, err
+		}
+
+		if len(line) > 0 {
+			var rec walRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil {
+				// a partially written record at the end of the log is ignored
+				if err == io.EOF {
+					break
+				}
+				return nil, nil, nil, jerr
+			}
+
+			if rec.Expires > 0 {
+				names[rec.ID] = time.Unix(0, rec.Expires)
+			}
+
+			switch rec.Op {
+			case walEnqueue:
+				if rec.Task != nil {
+					lt := &localTask{name: rec.ID, task: *rec.Task, body: rec.Body, attempts: rec.Attempts}
+					if rec.First > 0 {
+						lt.first = time.Unix(0, rec.First)
+					}
+					tasks[rec.ID] = lt
+					order = append(order, rec.ID)
+					delete(dead, rec.ID) // a dead-lettered task was requeued
+				}
+			case walRetry:
+				if lt, ok := tasks[rec.ID]; ok {
+					lt.attempts = rec.Attempts
+					lt.first = time.Unix(0, rec.First)
+				}
+			case walAck:
+				delete(tasks, rec.ID)
+				delete(dead, rec.ID) // a dead-lettered task was discarded
+			case walDrop:
+				if lt, ok := tasks[rec.ID]; ok {
+					lt.attempts = rec.Attempts
+					dead[rec.ID] = &deadTask{lt: lt, err: rec.Error, failed: time.Unix(0, rec.Failed)}
+					deadOrder = append(deadOrder, rec.ID)
+				}
+				delete(tasks, rec.ID)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	pending := make([]*localTask, 0, len(tasks))
+	for _, name := range order {
+		if lt, ok := tasks[name]; ok {
+			pending = append(pending, lt)
+			delete(tasks, name) // in case of duplicate enqueue records
+		}
+	}
+	letters := make([]*deadTask, 0, len(dead))
+	for _, name := range deadOrder {
+		if dt, ok := dead[name]; ok {
+			letters = append(letters, dt)
+			delete(dead, name)
+		}
+	}
+
+	now := time.Now()
+	for name, exp := range names {
+		if !exp.After(now) {
+			delete(names, name)
+		}
+	}
+	return pending, letters, names, nil
+}
+
+// compactTaskLog rewrites the log so that it only contains the pending and the dead-lettered tasks,
+// and the reservations of task names
+func compactTaskLog(path string, pending []*localTask, dead []*deadTask, names map[string]time.Time) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, lt := range pending {
+		task := lt.task
+		rec := walRecord{Op: walEnqueue, ID: lt.name, Task: &task, Body: lt.body, Attempts: lt.attempts}
+		if !lt.first.IsZero() {
+			rec.First = lt.first.UnixNano()
+		}
+		if err := enc.Encode(&rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, dt := range dead {
+		task := dt.lt.task
+		if err := enc.Encode(&walRecord{Op: walEnqueue, ID: dt.lt.name, Task: &task, Body: dt.lt.body}); err != nil {
+			f.Close()
+			return err
+		}
+		if err := enc.Encode(&walRecord{Op: walDrop, ID: dt.lt.name, Attempts: dt.lt.attempts, Failed: dt.failed.UnixNano(), Error: dt.err}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for name, exp := range names {
+		if err := enc.Encode(&walRecord{Op: walName, ID: name, Expires: exp.UnixNano()}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
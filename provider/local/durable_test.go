@@ -0,0 +1,222 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+func TestDurableQueueReplay(t *testing.T) {
+	var healthy int32
+	var delivered int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&delivered, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+	conf := TaskQueueConfig{
+		Workers: 2,
+		Retry: provider.RetryPolicy{
+			MaxAttempts: 100,
+			MinBackoff:  time.Hour, // never retried before the restart
+			MaxBackoff:  time.Hour,
+		},
+	}
+
+	q, err := NewDurableTaskProvider(path, time.Minute, conf)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		err := q.CreateHttpTask(context.Background(), provider.HttpTask{
+			Method:  provider.HttpMethodPost,
+			Request: srv.URL,
+			Payload: &testPayload{Message: "hello"},
+		})
+		assert.NoError(t, err)
+	}
+
+	// all tasks failed once
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, q.Close())
+
+	pending, _, _, err := recoverTasks(path)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(pending))
+	assert.Equal(t, 1, pending[0].attempts)
+	assert.NotEmpty(t, pending[0].body)
+
+	// restart, all tasks are delivered this time
+	atomic.StoreInt32(&healthy, 1)
+
+	q, err = NewDurableTaskProvider(path, time.Minute, conf)
+	require.NoError(t, err)
+
+	q.Wait()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&delivered))
+	assert.NoError(t, q.Close())
+
+	pending, _, _, err = recoverTasks(path)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestDurableQueueVisibilityTimeout(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release // the first delivery hangs
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+	q, err := NewDurableTaskProvider(path, 50*time.Millisecond, TaskQueueConfig{Workers: 2})
+	require.NoError(t, err)
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: srv.URL}))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	q.Wait()
+	assert.NoError(t, q.Close())
+
+	pending, _, _, err := recoverTasks(path)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestDurableQueueScheduledReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+
+	q, err := NewDurableTaskProvider(path, time.Minute, TaskQueueConfig{})
+	require.NoError(t, err)
+
+	eta := time.Now().Add(time.Hour)
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/later", Name: "later", Delay: time.Hour}))
+	assert.NoError(t, q.Close())
+
+	pending, _, _, err := recoverTasks(path)
+	require.NoError(t, err)
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "later", pending[0].name)
+		assert.WithinDuration(t, eta, pending[0].task.ScheduleAt, time.Second)
+	}
+
+	// the name is still taken after the restart
+	q, err = NewDurableTaskProvider(path, time.Minute, TaskQueueConfig{})
+	require.NoError(t, err)
+	defer q.Close()
+
+	assert.Equal(t, provider.ErrTaskAlreadyExists, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/later", Name: "later"}))
+}
+
+func TestDurableQueueDeadLetters(t *testing.T) {
+	var healthy int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+	conf := TaskQueueConfig{Retry: provider.RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond}}
+
+	q, err := NewDurableTaskProvider(path, time.Minute, conf)
+	require.NoError(t, err)
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: srv.URL, Name: "broken", Payload: &testPayload{Message: "hello"}}))
+	q.Wait()
+	assert.NoError(t, q.Close())
+
+	pending, dead, _, err := recoverTasks(path)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	require.Equal(t, 1, len(dead))
+	assert.Equal(t, "broken", dead[0].lt.name)
+	assert.Equal(t, 2, dead[0].lt.attempts)
+	assert.Contains(t, dead[0].err, "500")
+
+	// the dead letter survives a restart and can be requeued
+	atomic.StoreInt32(&healthy, 1)
+
+	q, err = NewDurableTaskProvider(path, time.Minute, conf)
+	require.NoError(t, err)
+
+	letters, err := q.DeadLetters(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(letters))
+	assert.Equal(t, "broken", letters[0].ID)
+
+	assert.NoError(t, q.Requeue(context.Background(), "broken"))
+	q.Wait()
+	assert.NoError(t, q.Close())
+
+	pending, dead, _, err = recoverTasks(path)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Empty(t, dead)
+}
+
+func TestDurableQueueNamesSurviveRestart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+
+	q, err := NewDurableTaskProvider(path, time.Minute, TaskQueueConfig{})
+	require.NoError(t, err)
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: srv.URL, Name: "once"}))
+	q.Wait()
+	assert.NoError(t, q.Close())
+
+	// the task was delivered, its name is still taken after two restarts
+	for i := 0; i < 2; i++ {
+		q, err = NewDurableTaskProvider(path, time.Minute, TaskQueueConfig{})
+		require.NoError(t, err)
+		assert.Equal(t, provider.ErrTaskAlreadyExists, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: srv.URL, Name: "once"}))
+		assert.NoError(t, q.Close())
+	}
+
+	_, _, names, err := recoverTasks(path)
+	require.NoError(t, err)
+	assert.Contains(t, names, "once")
+}
+
+func TestDurableTaskProviderError(t *testing.T) {
+	os.Setenv("TASK_QUEUE_LOG", filepath.Join(t.TempDir(), "missing", "tasks.wal"))
+	defer os.Unsetenv("TASK_QUEUE_LOG")
+
+	assert.Nil(t, LocalDurableTaskProvider())
+	_, err := platform.InitPlatform(context.Background(), DurableTaskConfig)
+	assert.Error(t, err)
+}
@@ -0,0 +1,288 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+	"github.com/txsvc/platform/v2/pkg/id"
+)
+
+type (
+	// EventBusConfig configures the in-memory event bus
+	EventBusConfig struct {
+		// Retry controls the redelivery of events that were not acknowledged
+		Retry provider.RetryPolicy
+	}
+
+	// LocalEventBusProviderImpl delivers events in-process. Every subscription has its own queue and worker,
+	// events are delivered in order and redelivered with backoff until the handler succeeds or the retry
+	// policy is exhausted. Events are not persisted.
+	LocalEventBusProviderImpl struct {
+		conf EventBusConfig
+
+		mu      sync.Mutex
+		idle    *sync.Cond
+		pending int
+		closed  bool
+		subs    map[string]map[string]*localSubscription // topic -> name -> subscription
+	}
+
+	localSubscription struct {
+		bus     *LocalEventBusProviderImpl
+		topic   string
+		name    string
+		handler provider.EventHandler
+
+		mu     sync.Mutex
+		cond   *sync.Cond
+		queue  []*provider.Event
+		closed bool
+		done   chan struct{}
+	}
+)
+
+var (
+	eventBusConfig provider.ProviderConfig = provider.WithProvider("platform.default.eventbus", provider.TypeEventBus, LocalEventBusProvider)
+
+	// ErrEventBusClosed indicates that the event bus does not accept new events
+	ErrEventBusClosed = errors.New("event bus is closed")
+
+	// Interface guards
+	_ provider.GenericProvider  = (*LocalEventBusProviderImpl)(nil)
+	_ provider.EventBusProvider = (*LocalEventBusProviderImpl)(nil)
+	_ provider.Subscription     = (*localSubscription)(nil)
+)
+
+// LocalEventBusProvider creates an in-memory event bus that is configured from the environment: EVENT_MAX_ATTEMPTS
+func LocalEventBusProvider() interface{} {
+	return NewLocalEventBusProvider(EventBusConfig{
+		Retry: provider.RetryPolicy{
+			MaxAttempts: int(env.GetInt("EVENT_MAX_ATTEMPTS", DefaultTaskMaxAttempts)),
+		},
+	})
+}
+
+// NewLocalEventBusProvider creates an in-memory event bus. Missing retry settings are replaced with the task queue defaults.
+func NewLocalEventBusProvider(conf EventBusConfig) *LocalEventBusProviderImpl {
+	conf.Retry = conf.Retry.WithDefaults(provider.RetryPolicy{
+		MaxAttempts:  DefaultTaskMaxAttempts,
+		MinBackoff:   DefaultTaskMinBackoff,
+		MaxBackoff:   DefaultTaskMaxBackoff,
+		MaxDoublings: provider.DefaultMaxDoublings,
+	})
+
+	b := LocalEventBusProviderImpl{
+		conf: conf,
+		subs: make(map[string]map[string]*localSubscription),
+	}
+	b.idle = sync.NewCond(&b.mu)
+
+	return &b
+}
+
+// Publish delivers a copy of e to every subscription of its topic
+func (b *LocalEventBusProviderImpl) Publish(ctx context.Context, e *provider.Event) error {
+	if !provider.ValidTopic(e.Topic) {
+		return provider.ErrInvalidTopic
+	}
+
+	uid, err := id.SimpleUUID()
+	if err != nil {
+		return err
+	}
+	e.ID = uid
+	e.Published = time.Now()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrEventBusClosed
+	}
+	subs := make([]*localSubscription, 0, len(b.subs[e.Topic]))
+	for _, s := range b.subs[e.Topic] {
+		subs = append(subs, s)
+	}
+	b.pending += len(subs)
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		evt := *e
+		evt.Attempt = 0
+		s.push(&evt)
+	}
+	return nil
+}
+
+// Subscribe creates subscription name on topic and starts delivering events to h
+func (b *LocalEventBusProviderImpl) Subscribe(topic, name string, h provider.EventHandler) (provider.Subscription, error) {
+	if !provider.ValidTopic(topic) {
+		return nil, provider.ErrInvalidTopic
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrEventBusClosed
+	}
+	if _, ok := b.subs[topic][name]; ok {
+		return nil, provider.ErrSubscriptionExists
+	}
+
+	s := localSubscription{
+		bus:     b,
+		topic:   topic,
+		name:    name,
+		handler: h,
+		queue:   make([]*provider.Event, 0),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if _, ok := b.subs[topic]; !ok {
+		b.subs[topic] = make(map[string]*localSubscription)
+	}
+	b.subs[topic][name] = &s
+
+	go s.worker()
+
+	return &s, nil
+}
+
+// Wait blocks until all published events have been acknowledged or dropped
+func (b *LocalEventBusProviderImpl) Wait() {
+	b.mu.Lock()
+	for b.pending > 0 {
+		b.idle.Wait()
+	}
+	b.mu.Unlock()
+}
+
+// Close stops all subscriptions and waits for deliveries that are in progress, events that were not delivered yet are dropped.
+// Close must not be called from an event handler.
+func (b *LocalEventBusProviderImpl) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := make([]*localSubscription, 0)
+	for _, topic := range b.subs {
+		for _, s := range topic {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.Unsubscribe()
+	}
+	for _, s := range subs {
+		<-s.done
+	}
+	return nil
+}
+
+func (b *LocalEventBusProviderImpl) done(n int) {
+	b.mu.Lock()
+	b.pending -= n
+	if b.pending <= 0 {
+		b.pending = 0
+		b.idle.Broadcast()
+	}
+	b.mu.Unlock()
+}
+
+// Unsubscribe stops the delivery of events, events that were not delivered yet are dropped.
+// It does not wait for a delivery that is in progress, so a handler can unsubscribe itself.
+func (s *localSubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	if s.bus.subs[s.topic][s.name] == s {
+		delete(s.bus.subs[s.topic], s.name)
+	}
+	s.bus.mu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	dropped := len(s.queue)
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.bus.done(dropped)
+	return nil
+}
+
+// push adds an event to the queue of the subscription
+func (s *localSubscription) push(e *provider.Event) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.bus.done(1)
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.cond.Signal()
+	s.mu.Unlock()
+}
+
+func (s *localSubscription) worker() {
+	defer close(s.done)
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.deliver(e)
+	}
+}
+
+// deliver calls the handler and schedules a redelivery if the event was not acknowledged
+func (s *localSubscription) deliver(e *provider.Event) {
+	e.Attempt++
+
+	err := s.handle(e)
+	if err == nil {
+		s.bus.done(1)
+		return
+	}
+
+	policy := s.bus.conf.Retry
+	if policy.Exhausted(e.Attempt, e.Published, time.Now()) {
+		platform.ReportError(fmt.Errorf("dropping event '%s' on '%s/%s' after %d attempts: %v", e.ID, s.topic, s.name, e.Attempt, err))
+		s.bus.done(1)
+		return
+	}
+
+	time.AfterFunc(policy.Backoff(e.Attempt), func() { s.push(e) })
+}
+
+// handle calls the handler, a panic counts as a nack
+func (s *localSubscription) handle(e *provider.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return s.handler(context.Background(), e)
+}
@@ -0,0 +1,177 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+func testEventBusConfig() EventBusConfig {
+	return EventBusConfig{
+		Retry: provider.RetryPolicy{
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  5 * time.Millisecond,
+		},
+	}
+}
+
+func TestEventBusProvider(t *testing.T) {
+	InitLocalProviders()
+
+	p, ok := platform.Provider(provider.TypeEventBus)
+	assert.True(t, ok)
+	assert.NotNil(t, p.(provider.EventBusProvider))
+
+	received := make(chan *provider.Event, 1)
+	sub, err := platform.Subscribe("account.created", "test", func(ctx context.Context, e *provider.Event) error {
+		received <- e
+		return nil
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	assert.NoError(t, platform.Publish(context.Background(), "account.created", &testPayload{Message: "hello"}, "realm", "podops"))
+
+	select {
+	case e := <-received:
+		var payload testPayload
+		assert.NoError(t, e.Decode(&payload))
+		assert.Equal(t, "hello", payload.Message)
+		assert.Equal(t, "podops", e.Attributes["realm"])
+		assert.NotEmpty(t, e.ID)
+		assert.Equal(t, 1, e.Attempt)
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	var a, b int32
+
+	bus := NewLocalEventBusProvider(testEventBusConfig())
+	defer bus.Close()
+
+	_, err := bus.Subscribe("account.blocked", "a", func(ctx context.Context, e *provider.Event) error {
+		atomic.AddInt32(&a, 1)
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = bus.Subscribe("account.blocked", "b", func(ctx context.Context, e *provider.Event) error {
+		atomic.AddInt32(&b, 1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = bus.Subscribe("account.blocked", "a", func(ctx context.Context, e *provider.Event) error { return nil })
+	assert.Equal(t, provider.ErrSubscriptionExists, err)
+	_, err = bus.Subscribe("Account Blocked", "c", func(ctx context.Context, e *provider.Event) error { return nil })
+	assert.Equal(t, provider.ErrInvalidTopic, err)
+
+	for i := 0; i < 10; i++ {
+		e, err := provider.NewEvent("account.blocked", nil)
+		require.NoError(t, err)
+		assert.NoError(t, bus.Publish(context.Background(), e))
+	}
+	// nobody listens
+	e, _ := provider.NewEvent("account.created", nil)
+	assert.NoError(t, bus.Publish(context.Background(), e))
+
+	bus.Wait()
+	assert.Equal(t, int32(10), atomic.LoadInt32(&a))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&b))
+}
+
+func TestRedelivery(t *testing.T) {
+	var flaky, broken int32
+
+	bus := NewLocalEventBusProvider(testEventBusConfig())
+	defer bus.Close()
+
+	bus.Subscribe("authorization.login", "flaky", func(ctx context.Context, e *provider.Event) error {
+		if atomic.AddInt32(&flaky, 1) < 3 {
+			return errors.New("nack")
+		}
+		return nil
+	})
+	bus.Subscribe("authorization.login", "broken", func(ctx context.Context, e *provider.Event) error {
+		atomic.AddInt32(&broken, 1)
+		panic("broken handler")
+	})
+
+	e, _ := provider.NewEvent("authorization.login", nil)
+	assert.NoError(t, bus.Publish(context.Background(), e))
+	bus.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&flaky))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&broken)) // dropped after MaxAttempts
+}
+
+func TestUnsubscribe(t *testing.T) {
+	var received int32
+	release := make(chan struct{})
+
+	bus := NewLocalEventBusProvider(testEventBusConfig())
+
+	sub, err := bus.Subscribe("account.created", "slow", func(ctx context.Context, e *provider.Event) error {
+		<-release
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		e, _ := provider.NewEvent("account.created", nil)
+		assert.NoError(t, bus.Publish(context.Background(), e))
+	}
+
+	close(release)
+	assert.NoError(t, sub.Unsubscribe())
+	bus.Wait() // undelivered events are dropped
+
+	assert.NoError(t, bus.Close())
+	e, _ := provider.NewEvent("account.created", nil)
+	assert.Equal(t, ErrEventBusClosed, bus.Publish(context.Background(), e))
+}
+
+func TestUnsubscribeFromHandler(t *testing.T) {
+	var received int32
+
+	bus := NewLocalEventBusProvider(testEventBusConfig())
+	defer bus.Close()
+
+	var sub provider.Subscription
+	subscribed := make(chan struct{})
+	unsubscribed := make(chan struct{})
+
+	sub, err := bus.Subscribe("account.created", "once", func(ctx context.Context, e *provider.Event) error {
+		<-subscribed
+		atomic.AddInt32(&received, 1)
+		assert.NoError(t, sub.Unsubscribe())
+		close(unsubscribed)
+		return nil
+	})
+	require.NoError(t, err)
+	close(subscribed)
+
+	for i := 0; i < 3; i++ {
+		e, _ := provider.NewEvent("account.created", nil)
+		assert.NoError(t, bus.Publish(context.Background(), e))
+	}
+
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe from the handler did not return")
+	}
+	bus.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/txsvc/platform/v2"
 
 	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/httpcontext"
 )
 
 type (
@@ -61,7 +62,7 @@ func init() {
 }
 
 func InitLocalProviders() {
-	p, err := platform.InitPlatform(context.Background(), loggingConfig, errorReportingConfig, contextConfig, metricsConfig)
+	p, err := platform.InitPlatform(context.Background(), loggingConfig, errorReportingConfig, contextConfig, metricsConfig, taskConfig, eventBusConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,16 +73,17 @@ func LocalHttpContextProvider() interface{} {
 	return &LocalProviderImpl{}
 }
 
-func LocalMetricsProvider() interface{} {
-	return &LocalProviderImpl{}
-}
-
 func (c *LocalProviderImpl) Close() error {
 	return nil
 }
 
+// NewHttpContext derives a context from the request that carries the request ID, client IP and user agent
 func (c *LocalProviderImpl) NewHttpContext(req *h.Request) context.Context {
-	return context.Background()
+	return httpcontext.New(req)
+}
+
+// Meter drops all metrics, see LocalMetricsProvider
+func (c *LocalProviderImpl) Meter(ctx context.Context, metric string, args ...string) {
 }
 
 func LocalLoggingProvider() interface{} {
@@ -151,7 +153,3 @@ func LocalErrorReportingProvider() interface{} {
 func (er *LocalErrorReportingProviderImpl) ReportError(e error) {
 	er.log.Error(e)
 }
-
-func (m *LocalProviderImpl) Meter(ctx context.Context, metric string, args ...string) {
-	// actually does nothing right now
-}
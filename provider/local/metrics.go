@@ -0,0 +1,397 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+	"github.com/txsvc/platform/v2/pkg/timestamp"
+)
+
+const (
+	// MetricsFormatJSON writes one JSON object per line
+	MetricsFormatJSON = "json"
+	// MetricsFormatCSV writes comma separated values, with a header line
+	MetricsFormatCSV = "csv"
+
+	// DefaultMetricsFlushInterval in seconds
+	DefaultMetricsFlushInterval = 10
+)
+
+type (
+	// MetricSample is an aggregated data point of a metric series
+	MetricSample struct {
+		Timestamp int64             `json:"ts"`
+		Metric    string            `json:"metric"`
+		Labels    map[string]string `json:"labels,omitempty"`
+		Count     int64             `json:"count"`
+	}
+
+	// LocalMetricsProviderImpl counts metrics in memory and periodically appends snapshots to a file
+	LocalMetricsProviderImpl struct {
+		path   string
+		format string
+
+		mu     sync.Mutex
+		series map[string]*MetricSample
+
+		quit chan struct{}
+		done chan struct{}
+	}
+)
+
+var (
+	// Interface guards
+	_ provider.GenericProvider = (*LocalMetricsProviderImpl)(nil)
+	_ provider.MetricsProvider = (*LocalMetricsProviderImpl)(nil)
+
+	csvHeader = []string{"ts", "metric", "count", "labels"}
+)
+
+// LocalMetricsProvider creates a metrics provider that is configured from the environment:
+// METRICS_LOG_FILE, METRICS_LOG_FORMAT (json|csv) and METRICS_FLUSH_INTERVAL (seconds).
+// Writing metrics to a file is opt-in, without METRICS_LOG_FILE all metrics are dropped.
+func LocalMetricsProvider() interface{} {
+	path := env.GetString("METRICS_LOG_FILE", "")
+	if path == "" {
+		return &LocalProviderImpl{}
+	}
+	format := env.GetString("METRICS_LOG_FORMAT", MetricsFormatJSON)
+	interval := env.GetInt("METRICS_FLUSH_INTERVAL", DefaultMetricsFlushInterval)
+
+	return NewLocalMetricsProvider(path, format, time.Duration(interval)*time.Second)
+}
+
+// NewLocalMetricsProvider returns a metrics provider that writes to path. Snapshots are written
+// every interval, interval <= 0 disables the periodic flush.
+func NewLocalMetricsProvider(path, format string, interval time.Duration) *LocalMetricsProviderImpl {
+	if format != MetricsFormatCSV {
+		format = MetricsFormatJSON
+	}
+
+	m := LocalMetricsProviderImpl{
+		path:   path,
+		format: format,
+		series: make(map[string]*MetricSample),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go m.flushLoop(interval)
+	} else {
+		close(m.done)
+	}
+
+	return &m
+}
+
+// Close stops the periodic flush and writes all pending samples
+func (m *LocalMetricsProviderImpl) Close() error {
+	m.mu.Lock()
+	select {
+	case <-m.quit:
+		// already closed
+	default:
+		close(m.quit)
+	}
+	m.mu.Unlock()
+
+	<-m.done
+	return m.Flush()
+}
+
+// Meter increments the counter of the series identified by metric and its labels.
+// args is a list of key/value pairs, a trailing key without a value gets an empty label.
+func (m *LocalMetricsProviderImpl) Meter(ctx context.Context, metric string, args ...string) {
+	labels := toLabels(args...)
+	key := seriesKey(metric, labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.series[key]; ok {
+		s.Count++
+		return
+	}
+	m.series[key] = &MetricSample{
+		Metric: metric,
+		Labels: labels,
+		Count:  1,
+	}
+}
+
+// Flush appends a snapshot of all series to the metrics file and resets the counters
+func (m *LocalMetricsProviderImpl) Flush() error {
+	m.mu.Lock()
+	if len(m.series) == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	snapshot := m.series
+	m.series = make(map[string]*MetricSample)
+	m.mu.Unlock()
+
+	keys := make([]string, 0, len(snapshot))
+	for k := range snapshot {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := timestamp.Now()
+	samples := make([]*MetricSample, len(keys))
+	for i, k := range keys {
+		samples[i] = snapshot[k]
+		samples[i].Timestamp = now
+	}
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if m.format == MetricsFormatCSV {
+		return writeCSV(f, samples)
+	}
+	return writeJSON(f, samples)
+}
+
+func (m *LocalMetricsProviderImpl) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(m.done)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Flush(); err != nil {
+				platform.ReportError(err)
+			}
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// ReadMetrics reads all samples from a metrics file. The format is detected from the content.
+func ReadMetrics(path string) ([]*MetricSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, err := r.Peek(1)
+	if err == io.EOF {
+		return []*MetricSample{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if head[0] == '{' {
+		return readJSON(r)
+	}
+	return readCSV(r)
+}
+
+// QuerySeries returns the samples of metric whose labels match all of the given key/value pairs
+func QuerySeries(path, metric string, args ...string) ([]*MetricSample, error) {
+	samples, err := ReadMetrics(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := toLabels(args...)
+	series := make([]*MetricSample, 0)
+
+	for _, s := range samples {
+		if s.Metric != metric {
+			continue
+		}
+		match := true
+		for k, v := range filter {
+			if lv, ok := s.Labels[k]; !ok || lv != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+// Sum returns the total count of all samples
+func Sum(samples []*MetricSample) int64 {
+	var n int64
+	for _, s := range samples {
+		n = n + s.Count
+	}
+	return n
+}
+
+func writeJSON(w io.Writer, samples []*MetricSample) error {
+	enc := json.NewEncoder(w)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSON(r io.Reader) ([]*MetricSample, error) {
+	samples := make([]*MetricSample, 0)
+
+	dec := json.NewDecoder(r)
+	for {
+		var s MetricSample
+		if err := dec.Decode(&s); err != nil {
+			if err == io.EOF {
+				return samples, nil
+			}
+			return nil, err
+		}
+		samples = append(samples, &s)
+	}
+}
+
+func writeCSV(f *os.File, samples []*MetricSample) error {
+	w := csv.NewWriter(f)
+
+	// new file, write the header first
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		if err := w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range samples {
+		record := []string{
+			strconv.FormatInt(s.Timestamp, 10),
+			s.Metric,
+			strconv.FormatInt(s.Count, 10),
+			encodeLabels(s.Labels),
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func readCSV(r io.Reader) ([]*MetricSample, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]*MetricSample, 0, len(records))
+	for _, rec := range records {
+		if len(rec) != len(csvHeader) {
+			return nil, fmt.Errorf("invalid metrics record '%s'", strings.Join(rec, ","))
+		}
+		if rec[0] == csvHeader[0] {
+			continue // header
+		}
+
+		ts, err := strconv.ParseInt(rec[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseInt(rec[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, &MetricSample{
+			Timestamp: ts,
+			Metric:    rec[1],
+			Count:     count,
+			Labels:    decodeLabels(rec[3]),
+		})
+	}
+	return samples, nil
+}
+
+func toLabels(keyValuePairs ...string) map[string]string {
+	n := len(keyValuePairs)
+	if n == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for i := 0; i < n/2; i++ {
+		labels[keyValuePairs[i*2]] = keyValuePairs[(i*2)+1]
+	}
+	if n%2 == 1 {
+		labels[keyValuePairs[n-1]] = ""
+	}
+	return labels
+}
+
+// encodeLabels returns the labels as a sorted list of 'key=value' separated by ';'
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(labels[k])
+	}
+	return buf.String()
+}
+
+func decodeLabels(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels
+}
+
+func seriesKey(metric string, labels map[string]string) string {
+	return metric + "|" + encodeLabels(labels)
+}
@@ -0,0 +1,108 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeterAndFlushJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	m := NewLocalMetricsProvider(path, MetricsFormatJSON, 0)
+
+	ctx := context.Background()
+	m.Meter(ctx, "api.request", "route", "/login", "status", "201")
+	m.Meter(ctx, "api.request", "route", "/login", "status", "201")
+	m.Meter(ctx, "api.request", "route", "/auth", "status", "200")
+	m.Meter(ctx, "account.created")
+
+	assert.NoError(t, m.Flush())
+
+	samples, err := ReadMetrics(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, len(samples))
+	}
+
+	series, err := QuerySeries(path, "api.request", "route", "/login")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(series))
+		assert.Equal(t, int64(2), series[0].Count)
+		assert.Equal(t, "201", series[0].Labels["status"])
+		assert.Greater(t, series[0].Timestamp, int64(0))
+	}
+
+	// a second snapshot only contains the new data points
+	m.Meter(ctx, "api.request", "route", "/login", "status", "201")
+	assert.NoError(t, m.Close())
+
+	series, err = QuerySeries(path, "api.request", "route", "/login")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, len(series))
+		assert.Equal(t, int64(3), Sum(series))
+	}
+
+	series, err = QuerySeries(path, "account.created")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), Sum(series))
+		assert.Empty(t, series[0].Labels)
+	}
+}
+
+func TestMeterAndFlushCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.csv")
+	m := NewLocalMetricsProvider(path, MetricsFormatCSV, 0)
+
+	ctx := context.Background()
+	m.Meter(ctx, "api.request", "route", "/login", "orphan")
+	assert.NoError(t, m.Flush())
+	m.Meter(ctx, "api.request", "route", "/login", "orphan")
+	assert.NoError(t, m.Flush())
+
+	series, err := QuerySeries(path, "api.request", "orphan", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, len(series))
+		assert.Equal(t, int64(2), Sum(series))
+		assert.Equal(t, "/login", series[0].Labels["route"])
+	}
+}
+
+func TestPeriodicFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	m := NewLocalMetricsProvider(path, MetricsFormatJSON, 10*time.Millisecond)
+	defer m.Close()
+
+	m.Meter(context.Background(), "some.thing")
+
+	assert.Eventually(t, func() bool {
+		series, err := QuerySeries(path, "some.thing")
+		return err == nil && Sum(series) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFlushEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	m := NewLocalMetricsProvider(path, MetricsFormatJSON, 0)
+
+	assert.NoError(t, m.Close())
+
+	_, err := ReadMetrics(path)
+	assert.Error(t, err) // nothing was written
+}
+
+func TestLocalMetricsProviderOptIn(t *testing.T) {
+	os.Unsetenv("METRICS_LOG_FILE")
+	_, ok := LocalMetricsProvider().(*LocalMetricsProviderImpl)
+	assert.False(t, ok)
+
+	os.Setenv("METRICS_LOG_FILE", filepath.Join(t.TempDir(), "metrics.log"))
+	defer os.Unsetenv("METRICS_LOG_FILE")
+
+	m, ok := LocalMetricsProvider().(*LocalMetricsProviderImpl)
+	if assert.True(t, ok) {
+		assert.NoError(t, m.Close())
+	}
+}
@@ -0,0 +1,588 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+	"github.com/txsvc/platform/v2/pkg/id"
+)
+
+const (
+	// LocalQueueName is reported in the queue name header of task requests that don't select a queue
+	LocalQueueName = "local"
+
+	DefaultTaskWorkers     = 4
+	DefaultTaskQueueSize   = 1000
+	DefaultTaskMaxAttempts = 5
+	DefaultTaskMinBackoff  = 100 * time.Millisecond
+	DefaultTaskMaxBackoff  = 10 * time.Second
+	DefaultTaskTimeout     = 30 * time.Second
+	// DefaultTaskNameRetention is the time a task name can't be reused
+	DefaultTaskNameRetention = time.Hour
+	// DefaultMaxDeadLetters is the number of dead-lettered tasks that are kept, the oldest are discarded first
+	DefaultMaxDeadLetters = 1000
+
+	userAgentString = "txsvc/platform 1.0.0"
+)
+
+type (
+	// TaskQueueConfig configures the in-process task queue
+	TaskQueueConfig struct {
+		Workers   int
+		QueueSize int
+		Timeout   time.Duration // timeout of a single HTTP request
+		// Retry is the default retry policy of the queue, tasks can override it
+		Retry provider.RetryPolicy
+		// DeadLetter is called after the final attempt of a task failed, optional
+		DeadLetter provider.DeadLetterFunc
+		// MaxDeadLetters limits the number of dead-lettered tasks that are kept
+		MaxDeadLetters int
+	}
+
+	// LocalTaskProviderImpl queues tasks in memory and dispatches them with a pool of workers.
+	// Tasks with a relative URL are dispatched to the handlers registered with RegisterHandler,
+	// all other tasks are sent to their target URL. Like Cloud Tasks, every status other than 2xx is retried.
+	LocalTaskProviderImpl struct {
+		conf    TaskQueueConfig
+		client  *http.Client
+		mux     *echo.Echo
+		queue   chan *localTask
+		journal taskJournal
+
+		mu      sync.Mutex
+		idle    *sync.Cond
+		pending int
+		closed  bool
+		names   map[string]time.Time // name -> expiration of the reservation
+		dead    map[string]*deadTask
+		pruned  time.Time
+		quit    chan struct{}
+		workers sync.WaitGroup
+	}
+
+	localTask struct {
+		name     string
+		task     provider.HttpTask
+		body     []byte
+		attempts int
+		first    time.Time // time of the first attempt
+	}
+
+	// deadTask is a task that failed permanently
+	deadTask struct {
+		lt     *localTask
+		err    string
+		failed time.Time
+	}
+
+	// taskJournal is notified about the lifecycle of every task, e.g. to persist the queue
+	taskJournal interface {
+		Enqueued(*localTask) error
+		Leased(*localTask)
+		Acked(*localTask)
+		Retry(*localTask)
+		Dropped(*localTask, error)
+	}
+)
+
+var (
+	taskConfig provider.ProviderConfig = provider.WithProvider("platform.default.task", provider.TypeTask, LocalTaskProvider)
+
+	// ErrTaskQueueClosed indicates that the queue does not accept new tasks
+	ErrTaskQueueClosed = errors.New("task queue is closed")
+
+	// Interface guards
+	_ provider.GenericProvider  = (*LocalTaskProviderImpl)(nil)
+	_ provider.HttpTaskProvider = (*LocalTaskProviderImpl)(nil)
+	_ provider.DeadLetterQueue  = (*LocalTaskProviderImpl)(nil)
+)
+
+// LocalTaskProvider creates an in-process task queue that is configured from the environment:
+// TASK_WORKERS, TASK_MAX_ATTEMPTS and TASK_MAX_RETRY_DURATION (seconds).
+func LocalTaskProvider() interface{} {
+	return NewLocalTaskProvider(taskQueueConfigFromEnv())
+}
+
+func taskQueueConfigFromEnv() TaskQueueConfig {
+	return TaskQueueConfig{
+		Workers: int(env.GetInt("TASK_WORKERS", DefaultTaskWorkers)),
+		Retry: provider.RetryPolicy{
+			MaxAttempts:      int(env.GetInt("TASK_MAX_ATTEMPTS", DefaultTaskMaxAttempts)),
+			MaxRetryDuration: time.Duration(env.GetInt("TASK_MAX_RETRY_DURATION", 0)) * time.Second,
+		},
+	}
+}
+
+// NewLocalTaskProvider creates an in-process task queue and starts its workers.
+// Missing config values are replaced with the defaults.
+func NewLocalTaskProvider(conf TaskQueueConfig) *LocalTaskProviderImpl {
+	return newLocalTaskProvider(conf, nil)
+}
+
+func newLocalTaskProvider(conf TaskQueueConfig, journal taskJournal) *LocalTaskProviderImpl {
+	if conf.Workers <= 0 {
+		conf.Workers = DefaultTaskWorkers
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = DefaultTaskQueueSize
+	}
+	conf.Retry = conf.Retry.WithDefaults(provider.RetryPolicy{
+		MaxAttempts:  DefaultTaskMaxAttempts,
+		MinBackoff:   DefaultTaskMinBackoff,
+		MaxBackoff:   DefaultTaskMaxBackoff,
+		MaxDoublings: provider.DefaultMaxDoublings,
+	})
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTaskTimeout
+	}
+	if conf.MaxDeadLetters <= 0 {
+		conf.MaxDeadLetters = DefaultMaxDeadLetters
+	}
+
+	mux := echo.New()
+	mux.HideBanner = true
+
+	t := LocalTaskProviderImpl{
+		conf:    conf,
+		client:  &http.Client{Timeout: conf.Timeout},
+		mux:     mux,
+		queue:   make(chan *localTask, conf.QueueSize),
+		journal: journal,
+		names:   make(map[string]time.Time),
+		dead:    make(map[string]*deadTask),
+		quit:    make(chan struct{}),
+	}
+	t.idle = sync.NewCond(&t.mu)
+
+	for i := 0; i < conf.Workers; i++ {
+		t.workers.Add(1)
+		go t.worker()
+	}
+
+	return &t
+}
+
+// RegisterHandler routes tasks with a relative URL matching path directly to handler h, without a network roundtrip
+func (t *LocalTaskProviderImpl) RegisterHandler(method provider.HttpMethod, path string, h echo.HandlerFunc) {
+	t.mux.Add(method.String(), path, h)
+}
+
+// Close stops all workers. Tasks that were not dispatched yet are dropped.
+func (t *LocalTaskProviderImpl) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.quit)
+	t.mu.Unlock()
+
+	t.workers.Wait()
+
+	t.mu.Lock()
+	t.pending = 0
+	t.idle.Broadcast()
+	t.mu.Unlock()
+
+	return nil
+}
+
+// CreateHttpTask adds a task to the queue. Tasks with a schedule time are queued once it is reached.
+func (t *LocalTaskProviderImpl) CreateHttpTask(ctx context.Context, task provider.HttpTask) error {
+	lt, err := newLocalTask(task)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTaskQueueClosed
+	}
+	if task.Name != "" && !t.reserveName(task.Name) {
+		t.mu.Unlock()
+		return provider.ErrTaskAlreadyExists
+	}
+	t.pending++
+	t.mu.Unlock()
+
+	if t.journal != nil {
+		if err := t.journal.Enqueued(lt); err != nil {
+			t.done()
+			return err
+		}
+	}
+
+	if eta := lt.task.ScheduleAt; !eta.IsZero() && eta.After(time.Now()) {
+		t.enqueueAfter(lt, time.Until(eta))
+		return nil
+	}
+
+	select {
+	case t.queue <- lt:
+		return nil
+	case <-ctx.Done():
+		t.done()
+		return ctx.Err()
+	case <-t.quit:
+		t.done()
+		return ErrTaskQueueClosed
+	}
+}
+
+// CreateHttpTasks adds a batch of tasks to the queue
+func (t *LocalTaskProviderImpl) CreateHttpTasks(ctx context.Context, tasks []provider.HttpTask) error {
+	return provider.CreateHttpTasksConcurrently(ctx, tasks, provider.DefaultBatchConcurrency, t.CreateHttpTask)
+}
+
+// DeadLetters returns all tasks that failed permanently, oldest first
+func (t *LocalTaskProviderImpl) DeadLetters(ctx context.Context) ([]*provider.DeadLetter, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	letters := make([]*provider.DeadLetter, 0, len(t.dead))
+	for _, dt := range t.dead {
+		letters = append(letters, dt.letter())
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Failed.Before(letters[j].Failed) })
+
+	return letters, nil
+}
+
+// Requeue removes a dead-lettered task and dispatches it again, with a fresh retry budget
+func (t *LocalTaskProviderImpl) Requeue(ctx context.Context, id string) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTaskQueueClosed
+	}
+	dt, ok := t.dead[id]
+	if !ok {
+		t.mu.Unlock()
+		return provider.ErrNoSuchTask
+	}
+	delete(t.dead, id)
+	t.pending++
+	t.mu.Unlock()
+
+	lt := &localTask{
+		name: dt.lt.name,
+		task: dt.lt.task,
+		body: dt.lt.body,
+	}
+	lt.task.ScheduleAt = time.Time{}
+
+	if t.journal != nil {
+		if err := t.journal.Enqueued(lt); err != nil {
+			t.mu.Lock()
+			t.dead[id] = dt
+			t.mu.Unlock()
+			t.done()
+			return err
+		}
+	}
+
+	t.enqueueAfter(lt, 0)
+	return nil
+}
+
+// Wait blocks until all tasks, including their retries, have been processed or the queue was closed
+func (t *LocalTaskProviderImpl) Wait() {
+	t.mu.Lock()
+	for t.pending > 0 {
+		t.idle.Wait()
+	}
+	t.mu.Unlock()
+}
+
+func (t *LocalTaskProviderImpl) worker() {
+	defer t.workers.Done()
+
+	for {
+		select {
+		case lt := <-t.queue:
+			t.process(lt)
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// requeue adds a task that was already accepted to the queue again, honoring its schedule time
+func (t *LocalTaskProviderImpl) requeue(lt *localTask) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	if lt.task.Name != "" {
+		t.reserveName(lt.task.Name)
+	}
+	t.pending++
+	t.mu.Unlock()
+
+	var d time.Duration
+	if eta := lt.task.ScheduleAt; !eta.IsZero() {
+		d = time.Until(eta)
+	}
+	t.enqueueAfter(lt, d)
+}
+
+// enqueueAfter adds a pending task to the queue after d
+func (t *LocalTaskProviderImpl) enqueueAfter(lt *localTask, d time.Duration) {
+	enqueue := func() {
+		select {
+		case t.queue <- lt:
+		case <-t.quit:
+			t.done()
+		}
+	}
+
+	if d <= 0 {
+		go enqueue()
+		return
+	}
+	time.AfterFunc(d, enqueue)
+}
+
+// reserveName expects the caller to hold the lock. It returns false if the name is already taken.
+func (t *LocalTaskProviderImpl) reserveName(name string) bool {
+	now := time.Now()
+
+	if exp, ok := t.names[name]; ok && exp.After(now) {
+		return false
+	}
+	t.names[name] = now.Add(DefaultTaskNameRetention)
+
+	// remove expired reservations every now and then
+	if now.Sub(t.pruned) > time.Minute {
+		for n, exp := range t.names {
+			if !exp.After(now) {
+				delete(t.names, n)
+			}
+		}
+		t.pruned = now
+	}
+	return true
+}
+
+func (t *LocalTaskProviderImpl) process(lt *localTask) {
+	lt.attempts++
+	if lt.first.IsZero() {
+		lt.first = time.Now()
+	}
+	if t.journal != nil {
+		t.journal.Leased(lt)
+	}
+
+	status, err := t.dispatch(lt)
+	if err == nil && status >= 200 && status < 300 {
+		if t.journal != nil {
+			t.journal.Acked(lt)
+		}
+		t.done()
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("task '%s' to '%s' failed with status %d", lt.name, lt.task.Request, status)
+	}
+
+	policy := t.retryPolicy(lt)
+	if policy.Exhausted(lt.attempts, lt.first, time.Now()) {
+		t.deadLetter(lt, err)
+		t.done()
+		return
+	}
+	if t.journal != nil {
+		t.journal.Retry(lt)
+	}
+
+	// try again later
+	t.enqueueAfter(lt, policy.Backoff(lt.attempts))
+}
+
+// deadLetter keeps a task that failed permanently and notifies the dead-letter hook
+func (t *LocalTaskProviderImpl) deadLetter(lt *localTask, err error) {
+	dt := &deadTask{lt: lt, err: err.Error(), failed: time.Now()}
+
+	if t.journal != nil {
+		t.journal.Dropped(lt, err)
+	}
+
+	t.mu.Lock()
+	t.dead[lt.name] = dt
+	t.mu.Unlock()
+	t.trimDeadLetters()
+	platform.ReportError(fmt.Errorf("giving up after %d attempts: %v", lt.attempts, err))
+
+	if t.conf.DeadLetter != nil {
+		t.conf.DeadLetter(context.Background(), dt.letter())
+	}
+}
+
+// trimDeadLetters discards the oldest dead-lettered tasks if there are more than MaxDeadLetters
+func (t *LocalTaskProviderImpl) trimDeadLetters() {
+	t.mu.Lock()
+	discarded := make([]*localTask, 0)
+	for len(t.dead) > t.conf.MaxDeadLetters {
+		var oldest *deadTask
+		for _, dt := range t.dead {
+			if oldest == nil || dt.failed.Before(oldest.failed) {
+				oldest = dt
+			}
+		}
+		delete(t.dead, oldest.lt.name)
+		discarded = append(discarded, oldest.lt)
+	}
+	t.mu.Unlock()
+
+	if t.journal != nil {
+		for _, lt := range discarded {
+			t.journal.Acked(lt) // removes the task from the journal
+		}
+	}
+}
+
+// retryPolicy returns the policy of the task, completed with the policy of the queue
+func (t *LocalTaskProviderImpl) retryPolicy(lt *localTask) provider.RetryPolicy {
+	if lt.task.RetryPolicy == nil {
+		return t.conf.Retry
+	}
+	return lt.task.RetryPolicy.WithDefaults(t.conf.Retry)
+}
+
+// dispatch sends the task and returns the HTTP status of the response
+func (t *LocalTaskProviderImpl) dispatch(lt *localTask) (int, error) {
+	var body io.Reader
+	if lt.body != nil {
+		body = bytes.NewReader(lt.body)
+	}
+
+	deadline := t.conf.Timeout
+	if lt.task.DispatchDeadline > 0 {
+		deadline = lt.task.DispatchDeadline
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, lt.task.Method.String(), lt.task.Request, body)
+	if err != nil {
+		return 0, err
+	}
+	if req.Body == nil {
+		req.Body = http.NoBody // handlers expect a body, as with every request a server receives
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range lt.task.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", userAgentString)
+	if lt.task.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", lt.task.Token))
+	}
+	queue := LocalQueueName
+	if lt.task.Queue != "" {
+		queue = lt.task.Queue
+	}
+	req.Header.Set(provider.HeaderQueueName, queue)
+	req.Header.Set(provider.HeaderTaskName, lt.name)
+	req.Header.Set(provider.HeaderTaskRetryCount, strconv.Itoa(lt.attempts-1))
+	req.Header.Set(provider.HeaderTaskExecutionCount, strconv.Itoa(lt.attempts-1))
+	if !lt.task.ScheduleAt.IsZero() {
+		req.Header.Set(provider.HeaderTaskETA, strconv.FormatInt(lt.task.ScheduleAt.Unix(), 10))
+	}
+
+	// relative URLs are served in-process
+	if strings.HasPrefix(lt.task.Request, "/") {
+		rec := httptest.NewRecorder()
+		t.mux.ServeHTTP(rec, req)
+		if ctx.Err() != nil {
+			return 0, ctx.Err() // the handler did not respond in time
+		}
+		return rec.Code, nil
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func (t *LocalTaskProviderImpl) done() {
+	t.mu.Lock()
+	if t.pending > 0 {
+		t.pending--
+	}
+	if t.pending == 0 {
+		t.idle.Broadcast()
+	}
+	t.mu.Unlock()
+}
+
+func (dt *deadTask) letter() *provider.DeadLetter {
+	task := dt.lt.task
+	task.Payload = nil
+	if dt.lt.body != nil {
+		task.Payload = json.RawMessage(dt.lt.body)
+	}
+
+	return &provider.DeadLetter{
+		ID:       dt.lt.name,
+		Task:     task,
+		Error:    dt.err,
+		Attempts: dt.lt.attempts,
+		Failed:   dt.failed,
+	}
+}
+
+func newLocalTask(task provider.HttpTask) (*localTask, error) {
+	name := task.Name
+	if name == "" {
+		uid, err := id.SimpleUUID()
+		if err != nil {
+			return nil, err
+		}
+		name = uid
+	}
+
+	// resolve the delay into an absolute time, in case the task has to be replayed
+	task.ScheduleAt = task.ScheduleTime(time.Now())
+	task.Delay = 0
+
+	lt := localTask{
+		name: name,
+		task: task,
+	}
+
+	if task.Payload != nil {
+		b, err := json.Marshal(task.Payload)
+		if err != nil {
+			return nil, err
+		}
+		lt.body = b
+	}
+	return &lt, nil
+}
@@ -0,0 +1,453 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+type (
+	testPayload struct {
+		Message string `json:"message"`
+	}
+)
+
+func testTaskConfig() TaskQueueConfig {
+	return TaskQueueConfig{
+		Workers: 2,
+		Retry: provider.RetryPolicy{
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  5 * time.Millisecond,
+		},
+	}
+}
+
+func TestTaskProvider(t *testing.T) {
+	InitLocalProviders()
+
+	p, ok := platform.Provider(provider.TypeTask)
+	assert.True(t, ok)
+	assert.NotNil(t, p)
+
+	tasks := p.(provider.HttpTaskProvider)
+	assert.NotNil(t, tasks)
+}
+
+func TestDispatchToURL(t *testing.T) {
+	var received int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload testPayload
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer abc123", r.Header.Get("Authorization"))
+		assert.Equal(t, LocalQueueName, r.Header.Get(provider.HeaderQueueName))
+		assert.NotEmpty(t, r.Header.Get(provider.HeaderTaskName))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, "hello", payload.Message)
+
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		err := q.CreateHttpTask(context.Background(), provider.HttpTask{
+			Method:  provider.HttpMethodPost,
+			Request: srv.URL + "/tasks/hello",
+			Token:   "abc123",
+			Payload: &testPayload{Message: "hello"},
+		})
+		assert.NoError(t, err)
+	}
+
+	q.Wait()
+	assert.Equal(t, int32(10), atomic.LoadInt32(&received))
+}
+
+func TestDispatchToHandler(t *testing.T) {
+	var received int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodPost, "/tasks/:name", func(c echo.Context) error {
+		assert.Equal(t, "hello", c.Param("name"))
+		assert.NotNil(t, c.Request().Body)
+		atomic.AddInt32(&received, 1)
+		return c.NoContent(http.StatusOK)
+	})
+
+	err := q.CreateHttpTask(context.Background(), provider.HttpTask{
+		Method:  provider.HttpMethodPost,
+		Request: "/tasks/hello",
+	})
+	assert.NoError(t, err)
+
+	q.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var attempts int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/flaky", func(c echo.Context) error {
+		n := atomic.AddInt32(&attempts, 1)
+		retries, _ := strconv.Atoi(c.Request().Header.Get(provider.HeaderTaskRetryCount))
+		assert.Equal(t, n-1, int32(retries))
+		if n < 3 {
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/broken", func(c echo.Context) error {
+		return c.NoContent(http.StatusInternalServerError)
+	})
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/flaky"}))
+	q.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/broken"}))
+	q.Wait() // gives up after MaxAttempts
+}
+
+func TestClosedQueue(t *testing.T) {
+	q := NewLocalTaskProvider(testTaskConfig())
+	assert.NoError(t, q.Close())
+	assert.NoError(t, q.Close())
+
+	err := q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/hello"})
+	assert.Equal(t, ErrTaskQueueClosed, err)
+}
+
+func TestBackoff(t *testing.T) {
+	q := NewLocalTaskProvider(TaskQueueConfig{Retry: provider.RetryPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}})
+	defer q.Close()
+
+	policy := q.conf.Retry
+	assert.Equal(t, DefaultTaskMaxAttempts, policy.MaxAttempts)
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 5*time.Second, policy.Backoff(4))
+
+	// doubles 3 times, then increases linearly
+	policy = provider.RetryPolicy{MinBackoff: 10 * time.Second, MaxBackoff: 300 * time.Second, MaxDoublings: 3}
+	expected := []int{10, 20, 40, 80, 160, 240, 300, 300}
+	for i, sec := range expected {
+		assert.Equal(t, time.Duration(sec)*time.Second, policy.Backoff(i+1))
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	now := time.Now()
+	first := now.Add(-time.Minute)
+
+	policy := provider.RetryPolicy{MaxAttempts: 3}
+	assert.False(t, policy.Exhausted(2, first, now))
+	assert.True(t, policy.Exhausted(3, first, now))
+
+	policy = provider.RetryPolicy{MaxRetryDuration: time.Hour}
+	assert.False(t, policy.Exhausted(100, first, now))
+	assert.True(t, policy.Exhausted(1, first, now.Add(time.Hour)))
+
+	// both limits must be reached
+	policy = provider.RetryPolicy{MaxAttempts: 3, MaxRetryDuration: time.Hour}
+	assert.False(t, policy.Exhausted(5, first, now))
+	assert.False(t, policy.Exhausted(1, first, now.Add(time.Hour)))
+	assert.True(t, policy.Exhausted(3, first, now.Add(time.Hour)))
+
+	policy = provider.RetryPolicy{MaxAttempts: -1}
+	assert.False(t, policy.Exhausted(1000, first, now))
+}
+
+func TestTaskRetryPolicy(t *testing.T) {
+	var attempts int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/broken", func(c echo.Context) error {
+		atomic.AddInt32(&attempts, 1)
+		return c.NoContent(http.StatusInternalServerError)
+	})
+
+	task := provider.HttpTask{Request: "/tasks/broken", RetryPolicy: &provider.RetryPolicy{MaxAttempts: 5}}
+	assert.NoError(t, q.CreateHttpTask(context.Background(), task))
+	q.Wait()
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&attempts))
+}
+
+func TestDeadLetters(t *testing.T) {
+	var healthy int32
+	letters := make(chan *provider.DeadLetter, 1)
+
+	conf := testTaskConfig()
+	conf.DeadLetter = func(ctx context.Context, dl *provider.DeadLetter) {
+		letters <- dl
+	}
+	q := NewLocalTaskProvider(conf)
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodPost, "/tasks/flaky", func(c echo.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		var payload testPayload
+		assert.NoError(t, c.Bind(&payload))
+		assert.Equal(t, "hello", payload.Message)
+		return c.NoContent(http.StatusOK)
+	})
+
+	task := provider.HttpTask{Method: provider.HttpMethodPost, Request: "/tasks/flaky", Name: "flaky", Payload: &testPayload{Message: "hello"}}
+	assert.NoError(t, q.CreateHttpTask(context.Background(), task))
+	q.Wait()
+
+	dl := <-letters
+	assert.Equal(t, "flaky", dl.ID)
+	assert.Equal(t, 3, dl.Attempts)
+	assert.Contains(t, dl.Error, "500")
+	assert.False(t, dl.Failed.IsZero())
+
+	dead, err := q.DeadLetters(context.Background())
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(dead)) {
+		assert.Equal(t, "flaky", dead[0].ID)
+		assert.JSONEq(t, `{"message":"hello"}`, string(dead[0].Task.Payload.(json.RawMessage)))
+	}
+
+	assert.Equal(t, provider.ErrNoSuchTask, q.Requeue(context.Background(), "unknown"))
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, q.Requeue(context.Background(), "flaky"))
+	q.Wait()
+
+	dead, err = q.DeadLetters(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func TestMaxDeadLetters(t *testing.T) {
+	conf := testTaskConfig()
+	conf.Workers = 1
+	conf.Retry.MaxAttempts = 1
+	conf.MaxDeadLetters = 2
+	q := NewLocalTaskProvider(conf)
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodPost, "/tasks/broken", func(c echo.Context) error {
+		return c.NoContent(http.StatusInternalServerError)
+	})
+
+	for _, name := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Method: provider.HttpMethodPost, Request: "/tasks/broken", Name: name}))
+		q.Wait()
+	}
+
+	dead, err := q.DeadLetters(context.Background())
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(dead)) {
+		assert.Equal(t, "second", dead[0].ID)
+		assert.Equal(t, "third", dead[1].ID)
+	}
+}
+
+func TestScheduledTask(t *testing.T) {
+	var dispatched int64
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/later", func(c echo.Context) error {
+		assert.NotEmpty(t, c.Request().Header.Get(provider.HeaderTaskETA))
+		atomic.StoreInt64(&dispatched, time.Now().UnixNano())
+		return c.NoContent(http.StatusOK)
+	})
+
+	start := time.Now()
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/later", Delay: 50 * time.Millisecond}))
+	q.Wait()
+
+	assert.GreaterOrEqual(t, atomic.LoadInt64(&dispatched), start.Add(50*time.Millisecond).UnixNano())
+}
+
+func TestNamedTaskDedupe(t *testing.T) {
+	var received int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/once", func(c echo.Context) error {
+		assert.Equal(t, "expire-account-42", c.Request().Header.Get(provider.HeaderTaskName))
+		atomic.AddInt32(&received, 1)
+		return c.NoContent(http.StatusOK)
+	})
+
+	task := provider.HttpTask{Request: "/tasks/once", Name: "expire-account-42"}
+	assert.NoError(t, q.CreateHttpTask(context.Background(), task))
+	assert.Equal(t, provider.ErrTaskAlreadyExists, q.CreateHttpTask(context.Background(), task))
+
+	q.Wait()
+	assert.Equal(t, provider.ErrTaskAlreadyExists, q.CreateHttpTask(context.Background(), task))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestCustomHeaders(t *testing.T) {
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/headers", func(c echo.Context) error {
+		assert.Equal(t, "bar", c.Request().Header.Get("X-Foo"))
+		assert.Equal(t, "Bearer abc123", c.Request().Header.Get("Authorization"))
+		return c.NoContent(http.StatusOK)
+	})
+
+	task := provider.HttpTask{
+		Request: "/tasks/headers",
+		Token:   "abc123",
+		Headers: map[string]string{"X-Foo": "bar", "Authorization": "Bearer something-else"},
+	}
+	assert.NoError(t, q.CreateHttpTask(context.Background(), task))
+	q.Wait()
+}
+
+func TestDispatchDeadline(t *testing.T) {
+	var attempts int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			time.Sleep(200 * time.Millisecond) // too slow the first time
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: srv.URL, DispatchDeadline: 50 * time.Millisecond}))
+	q.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestClientErrorsAreRetried(t *testing.T) {
+	var attempts int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/invalid", func(c echo.Context) error {
+		atomic.AddInt32(&attempts, 1)
+		return c.NoContent(http.StatusUnprocessableEntity)
+	})
+
+	assert.NoError(t, q.CreateHttpTask(context.Background(), provider.HttpTask{Request: "/tasks/invalid"}))
+	q.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	dead, err := q.DeadLetters(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dead))
+}
+
+func TestCreateHttpTasks(t *testing.T) {
+	var received int32
+
+	q := NewLocalTaskProvider(testTaskConfig())
+	defer q.Close()
+
+	q.RegisterHandler(provider.HttpMethodGet, "/tasks/batch", func(c echo.Context) error {
+		atomic.AddInt32(&received, 1)
+		return c.NoContent(http.StatusOK)
+	})
+
+	batch := make([]provider.HttpTask, 100)
+	for i := range batch {
+		batch[i] = provider.HttpTask{Request: "/tasks/batch", Name: "batch-" + strconv.Itoa(i%90)}
+	}
+
+	err := q.CreateHttpTasks(context.Background(), batch)
+	if assert.Error(t, err) {
+		berr, ok := err.(*provider.BatchError)
+		assert.True(t, ok)
+		assert.Equal(t, 100, len(berr.Errors))
+		assert.Equal(t, 10, len(berr.Failed()))
+		for _, i := range berr.Failed() {
+			assert.Equal(t, provider.ErrTaskAlreadyExists, berr.Errors[i])
+		}
+	}
+
+	q.Wait()
+	assert.Equal(t, int32(90), atomic.LoadInt32(&received))
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	var inflight, max int32
+
+	create := func(ctx context.Context, task provider.HttpTask) error {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		return nil
+	}
+
+	assert.NoError(t, provider.CreateHttpTasksConcurrently(context.Background(), make([]provider.HttpTask, 50), 3, create))
+	assert.LessOrEqual(t, atomic.LoadInt32(&max), int32(3))
+
+	// nothing is created once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := provider.CreateHttpTasksConcurrently(ctx, make([]provider.HttpTask, 5), 1, create)
+	assert.Error(t, err)
+}
+
+func TestFanOut(t *testing.T) {
+	items := make([]string, 25)
+
+	tasks, err := provider.FanOut(provider.HttpTask{Request: "/tasks/chunk", Name: "import"}, items, 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(tasks)) {
+		assert.Equal(t, 10, len(tasks[0].Payload.([]string)))
+		assert.Equal(t, 5, len(tasks[2].Payload.([]string)))
+		assert.Equal(t, "import-2", tasks[2].Name)
+		assert.Equal(t, "/tasks/chunk", tasks[2].Request)
+	}
+
+	_, err = provider.FanOut(provider.HttpTask{}, "not a slice", 10)
+	assert.Equal(t, provider.ErrNotASlice, err)
+
+	// an empty slice, with and without a chunk size
+	for _, size := range []int{0, 10} {
+		tasks, err = provider.FanOut(provider.HttpTask{}, []string{}, size)
+		assert.NoError(t, err)
+		assert.Empty(t, tasks)
+	}
+}
@@ -0,0 +1,301 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+	"github.com/txsvc/platform/v2/pkg/env"
+)
+
+const (
+	// FlavorStatsd is the plain StatsD line protocol, tags are dropped
+	FlavorStatsd = "statsd"
+	// FlavorDogStatsd adds tags in the '|#key:value' format
+	FlavorDogStatsd = "dogstatsd"
+
+	// DefaultAddress of the StatsD agent
+	DefaultAddress = "127.0.0.1:8125"
+	// DefaultMaxPacketSize keeps datagrams below the typical ethernet MTU
+	DefaultMaxPacketSize = 1432
+	// DefaultFlushInterval is the max time a metric is buffered before it is sent
+	DefaultFlushInterval = 100 * time.Millisecond
+)
+
+type (
+	// Config holds the StatsD client settings
+	Config struct {
+		Address       string
+		Prefix        string
+		Flavor        string
+		SampleRate    float64 // 0 < rate <= 1, applies to counters, timings and histograms
+		MaxPacketSize int
+		FlushInterval time.Duration
+	}
+
+	// StatsdMetricsProviderImpl sends metrics to a StatsD or DogStatsD agent over UDP
+	StatsdMetricsProviderImpl struct {
+		conf Config
+		conn net.Conn
+
+		mu  sync.Mutex
+		buf bytes.Buffer
+		rnd *rand.Rand
+
+		quit    chan struct{}
+		done    chan struct{}
+		dropped bool // metrics were sent after Close
+	}
+)
+
+var (
+	// ErrClosed indicates that metrics were sent after the client was closed, they are dropped
+	ErrClosed = errors.New("statsd client closed")
+
+	StatsdMetricsConfig provider.ProviderConfig = provider.WithProvider("platform.statsd.metrics", provider.TypeMetrics, NewStatsdMetricsProvider)
+
+	// Interface guards
+	_ provider.GenericProvider = (*StatsdMetricsProviderImpl)(nil)
+	_ provider.MetricsProvider = (*StatsdMetricsProviderImpl)(nil)
+)
+
+// NewStatsdMetricsProvider creates a provider that is configured from the environment:
+// STATSD_ADDRESS, STATSD_PREFIX, STATSD_FLAVOR (statsd|dogstatsd) and STATSD_SAMPLE_RATE.
+func NewStatsdMetricsProvider() interface{} {
+	rate, err := strconv.ParseFloat(env.GetString("STATSD_SAMPLE_RATE", "1"), 64)
+	if err != nil {
+		rate = 1
+	}
+
+	conf := Config{
+		Address:    env.GetString("STATSD_ADDRESS", DefaultAddress),
+		Prefix:     env.GetString("STATSD_PREFIX", ""),
+		Flavor:     env.GetString("STATSD_FLAVOR", FlavorStatsd),
+		SampleRate: rate,
+	}
+
+	s, err := New(conf)
+	if err != nil {
+		platform.ReportError(err)
+		return nil
+	}
+	return s
+}
+
+// New creates a StatsD client, missing config values are replaced with the defaults
+func New(conf Config) (*StatsdMetricsProviderImpl, error) {
+	if conf.Address == "" {
+		conf.Address = DefaultAddress
+	}
+	if conf.Flavor != FlavorDogStatsd {
+		conf.Flavor = FlavorStatsd
+	}
+	if conf.SampleRate <= 0 || conf.SampleRate > 1 {
+		conf.SampleRate = 1
+	}
+	if conf.MaxPacketSize <= 0 {
+		conf.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = DefaultFlushInterval
+	}
+	if conf.Prefix != "" && !strings.HasSuffix(conf.Prefix, ".") {
+		conf.Prefix = conf.Prefix + "."
+	}
+
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := StatsdMetricsProviderImpl{
+		conf: conf,
+		conn: conn,
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.flushLoop()
+
+	return &s, nil
+}
+
+// Close sends all buffered metrics and closes the connection
+func (s *StatsdMetricsProviderImpl) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		return nil // already closed
+	default:
+		close(s.quit)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	err := s.Flush()
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Meter increments the counter metric by one, args are key/value pairs used as tags
+func (s *StatsdMetricsProviderImpl) Meter(ctx context.Context, metric string, args ...string) {
+	s.Count(metric, 1, args...)
+}
+
+// Count adds value to a counter
+func (s *StatsdMetricsProviderImpl) Count(name string, value int64, tags ...string) {
+	if !s.sample() {
+		return
+	}
+	s.send(name, strconv.FormatInt(value, 10), "c", s.conf.SampleRate, tags)
+}
+
+// Gauge sets a gauge to value. Gauges are never sampled.
+func (s *StatsdMetricsProviderImpl) Gauge(name string, value float64, tags ...string) {
+	s.send(name, formatFloat(value), "g", 1, tags)
+}
+
+// Timing records a duration in milliseconds
+func (s *StatsdMetricsProviderImpl) Timing(name string, d time.Duration, tags ...string) {
+	if !s.sample() {
+		return
+	}
+	s.send(name, formatFloat(float64(d)/float64(time.Millisecond)), "ms", s.conf.SampleRate, tags)
+}
+
+// Histogram records a value in a histogram. Plain StatsD has no histogram type, a timer is used instead.
+func (s *StatsdMetricsProviderImpl) Histogram(name string, value float64, tags ...string) {
+	if !s.sample() {
+		return
+	}
+	t := "ms"
+	if s.conf.Flavor == FlavorDogStatsd {
+		t = "h"
+	}
+	s.send(name, formatFloat(value), t, s.conf.SampleRate, tags)
+}
+
+// Flush sends all buffered metrics
+func (s *StatsdMetricsProviderImpl) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+func (s *StatsdMetricsProviderImpl) send(name, value, metricType string, rate float64, tags []string) {
+	line := s.format(name, value, metricType, rate, tags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.quit:
+		// closed, report the first dropped metric only
+		if !s.dropped {
+			s.dropped = true
+			platform.ReportError(ErrClosed)
+		}
+		return
+	default:
+	}
+
+	// start a new datagram if the line does not fit into the current one
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > s.conf.MaxPacketSize {
+		if err := s.flush(); err != nil {
+			platform.ReportError(err)
+		}
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// flush expects the caller to hold the lock
+func (s *StatsdMetricsProviderImpl) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
+
+func (s *StatsdMetricsProviderImpl) flushLoop() {
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer func() {
+		ticker.Stop()
+		close(s.done)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				platform.ReportError(err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *StatsdMetricsProviderImpl) sample() bool {
+	if s.conf.SampleRate >= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rnd.Float64() < s.conf.SampleRate
+}
+
+// format creates a line like 'prefix.name:value|type|@rate|#key:value,key:value'
+func (s *StatsdMetricsProviderImpl) format(name, value, metricType string, rate float64, tags []string) string {
+	var b strings.Builder
+
+	b.WriteString(s.conf.Prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(metricType)
+
+	if rate < 1 {
+		b.WriteString("|@")
+		b.WriteString(formatFloat(rate))
+	}
+
+	if s.conf.Flavor == FlavorDogStatsd && len(tags) > 0 {
+		b.WriteString("|#")
+		n := len(tags)
+		for i := 0; i < n; i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(tags[i])
+			if i+1 < n {
+				b.WriteByte(':')
+				b.WriteString(tags[i+1])
+			}
+		}
+	}
+
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
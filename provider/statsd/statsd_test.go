@@ -0,0 +1,160 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/txsvc/platform/v2"
+	"github.com/txsvc/platform/v2/pkg/apis/provider"
+)
+
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn net.PacketConn) []string {
+	buf := make([]byte, 65536)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestStatsdFormat(t *testing.T) {
+	conn := listen(t)
+
+	s, err := New(Config{Address: conn.LocalAddr().String(), Prefix: "podops", Flavor: FlavorStatsd})
+	require.NoError(t, err)
+
+	s.Meter(context.Background(), "api.request", "route", "/login")
+	s.Count("api.bytes", 42)
+	s.Gauge("queue.size", 3.5)
+	s.Timing("api.latency", 1500*time.Microsecond)
+	s.Histogram("payload.size", 512)
+	assert.NoError(t, s.Close())
+
+	lines := receive(t, conn)
+	assert.Equal(t, []string{
+		"podops.api.request:1|c",
+		"podops.api.bytes:42|c",
+		"podops.queue.size:3.5|g",
+		"podops.api.latency:1.5|ms",
+		"podops.payload.size:512|ms",
+	}, lines)
+}
+
+func TestDogStatsdTags(t *testing.T) {
+	conn := listen(t)
+
+	s, err := New(Config{Address: conn.LocalAddr().String(), Flavor: FlavorDogStatsd})
+	require.NoError(t, err)
+
+	s.Meter(context.Background(), "api.request", "route", "/login", "status", "201")
+	s.Histogram("payload.size", 512, "orphan")
+	assert.NoError(t, s.Flush())
+
+	lines := receive(t, conn)
+	assert.Equal(t, []string{
+		"api.request:1|c|#route:/login,status:201",
+		"payload.size:512|h|#orphan",
+	}, lines)
+
+	assert.NoError(t, s.Close())
+}
+
+func TestBatching(t *testing.T) {
+	conn := listen(t)
+
+	s, err := New(Config{Address: conn.LocalAddr().String(), MaxPacketSize: 64, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		s.Count("some.counter", 1) // 16 bytes each
+	}
+	assert.NoError(t, s.Close())
+
+	total := 0
+	for total < 10 {
+		lines := receive(t, conn)
+		size := len(strings.Join(lines, "\n"))
+		assert.LessOrEqual(t, size, 64)
+		total = total + len(lines)
+	}
+	assert.Equal(t, 10, total)
+}
+
+func TestSampleRate(t *testing.T) {
+	conn := listen(t)
+
+	s, err := New(Config{Address: conn.LocalAddr().String(), SampleRate: 0.5, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		s.Count("sampled", 1)
+	}
+	s.Gauge("never.sampled", 1)
+	assert.NoError(t, s.Close())
+
+	sampled := 0
+	gauges := 0
+	for sampled+gauges < 1000 {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 65536)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		for _, l := range strings.Split(string(buf[:n]), "\n") {
+			if strings.HasPrefix(l, "sampled") {
+				assert.Equal(t, "sampled:1|c|@0.5", l)
+				sampled++
+			} else {
+				assert.Equal(t, "never.sampled:1|g", l)
+				gauges++
+			}
+		}
+	}
+
+	assert.Equal(t, 1, gauges)
+	assert.Greater(t, sampled, 300)
+	assert.Less(t, sampled, 700)
+}
+
+func TestStatsdProvider(t *testing.T) {
+	p, err := platform.InitPlatform(context.Background(), StatsdMetricsConfig)
+	require.NoError(t, err)
+
+	platform.RegisterPlatform(p)
+
+	m, ok := platform.Provider(provider.TypeMetrics)
+	assert.True(t, ok)
+	assert.NotNil(t, m)
+
+	platform.Meter(context.Background(), "some.thing", "foo", "bar")
+	assert.NoError(t, platform.Close())
+}
+
+func TestSendAfterClose(t *testing.T) {
+	conn := listen(t)
+
+	s, err := New(Config{Address: conn.LocalAddr().String()})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s.Count("api.request", 1)
+	s.Gauge("queue.size", 1)
+	assert.True(t, s.dropped)
+	assert.Equal(t, 0, s.buf.Len())
+	assert.NoError(t, s.Close())
+}